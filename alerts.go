@@ -0,0 +1,476 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/antonmedv/expr"
+	"github.com/antonmedv/expr/vm"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Findings of the security monitors that alerts can be raised for.
+const (
+	FindingRootToken           = "root_token"
+	FindingOperationalEvent    = "operational_event"
+	FindingWatchlist           = "watchlist"
+	FindingCredentialWatchlist = "credential_watchlist"
+	FindingBruteForce          = "brute_force"
+	FindingConfigChange        = "config_change"
+	FindingSourceDown          = "source_down"
+	FindingOutOfSchedule       = "out_of_schedule"
+	FindingReplication         = "replication"
+
+	// findingExpression is the finding of alerts raised by expressions.
+	findingExpression = "expression"
+)
+
+var findings = []string{FindingRootToken, FindingOperationalEvent, FindingWatchlist, FindingCredentialWatchlist,
+	FindingBruteForce, FindingConfigChange, FindingSourceDown, FindingOutOfSchedule, FindingReplication}
+
+// Notifier types.
+const (
+	NotifierSlack     = "slack"
+	NotifierPagerDuty = "pagerduty"
+	NotifierWebhook   = "webhook"
+)
+
+// Alert severities, which are those of PagerDuty.
+var alertSeverities = []string{"critical", "error", "warning", "info"}
+
+const (
+	defaultAlertSeverity = "warning"
+	defaultAlertThrottle = 5 * time.Minute
+	// alertMaxThrottled bounds the number of alert and dedup key pairs whose throttling is tracked, after which alerts
+	// with new keys are not throttled.
+	alertMaxThrottled = 10000
+	// alertCleanupInterval is the interval at which throttling that has lapsed is forgotten.
+	alertCleanupInterval = time.Minute
+	// pagerDutyEventsURL is the PagerDuty Events API v2 endpoint.
+	pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+)
+
+// Finding is something noteworthy a security monitor found, such as a request made with a root token. Findings with
+// the same Kind and Key are duplicates of each other for throttling, and a Resolved finding ends an earlier one with
+// the same Key, such as an audit device recovering after it went down.
+type Finding struct {
+	Kind     string
+	Key      string
+	Summary  string
+	Resolved bool
+	Time     time.Time
+	// Details are the fields of the finding, such as those posted to the webhook of the monitor.
+	Details interface{}
+}
+
+// Alert is a notification raised by an alert rule for a finding or an audit event matching its expression.
+type Alert struct {
+	Alert    string `json:"alert"`
+	Finding  string `json:"finding"`
+	Severity string `json:"severity"`
+	Summary  string `json:"summary"`
+	DedupKey string `json:"dedup_key"`
+	Resolved bool   `json:"resolved,omitempty"`
+	// Suppressed is the number of duplicates throttled since the previous notification of the alert.
+	Suppressed int         `json:"suppressed,omitempty"`
+	Time       time.Time   `json:"time"`
+	Details    interface{} `json:"details,omitempty"`
+}
+
+// Notifier delivers alerts to a backend without blocking.
+type Notifier interface {
+	Notify(alert *Alert)
+}
+
+// Alerter raises alerts for findings of the security monitors and for audit events matching expressions, and delivers
+// them to notifiers, so that critical findings don't have to wait for a Prometheus alerting pipeline. Duplicate alerts,
+// those of the same rule and dedup key, are throttled to one notification per throttle window. A nil Alerter ignores
+// findings.
+type Alerter struct {
+	byFinding  map[string][]*alertRule
+	expression []*alertRule
+	errors     func()
+
+	mu        sync.Mutex
+	throttled map[alertThrottleKey]*alertThrottle
+
+	counterNotifications *prometheus.CounterVec
+	counterThrottled     *prometheus.CounterVec
+	counterNotifyErrors  *prometheus.CounterVec
+}
+
+type alertRule struct {
+	name      string
+	severity  string
+	throttle  time.Duration
+	program   *vm.Program
+	source    string
+	notifiers []Notifier
+}
+
+type alertThrottleKey struct {
+	rule, key string
+}
+
+// alertThrottle holds when an alert was last notified and how many duplicates were throttled since.
+type alertThrottle struct {
+	last       time.Time
+	throttle   time.Duration
+	suppressed int
+}
+
+// requestDetails are the details of findings about a single request.
+type requestDetails struct {
+	RequestID     string    `json:"request_id"`
+	Operation     string    `json:"operation"`
+	Path          string    `json:"path"`
+	EntityID      string    `json:"entity_id,omitempty"`
+	EntityName    string    `json:"entity_name,omitempty"`
+	EntityGroups  []string  `json:"entity_groups,omitempty"`
+	RemoteAddress string    `json:"remote_address,omitempty"`
+	Time          time.Time `json:"time"`
+}
+
+// newRequestDetails returns the details of the request of an audit event.
+func newRequestDetails(auditEvent *AuditEvent) requestDetails {
+	request := auditEvent.entry.Request
+	details := requestDetails{
+		RequestID:     request.ID,
+		Operation:     request.Operation,
+		Path:          request.Path,
+		RemoteAddress: request.RemoteAddr,
+		EntityName:    auditEvent.identity.entityName(),
+		EntityGroups:  auditEvent.identity.entityGroups(),
+		Time:          auditEvent.time,
+	}
+	if auth := auditEvent.entry.Auth; auth != nil {
+		details.EntityID = auth.EntityID
+	}
+	return details
+}
+
+// fromAddress describes the remote address of a request in finding summaries, if it is known.
+func fromAddress(remoteAddr string) string {
+	if remoteAddr == "" {
+		return ""
+	}
+	return " from " + remoteAddr
+}
+
+// NewAlerter constructs an Alerter for the alert rules, delivering to the configured notifiers. The errors callback is
+// invoked whenever an expression fails to evaluate.
+func NewAlerter(notifierConfigs []NotifierConfig, alertConfigs []AlertConfig, errors func()) (*Alerter, error) {
+	a := &Alerter{
+		byFinding: make(map[string][]*alertRule),
+		errors:    errors,
+		throttled: make(map[alertThrottleKey]*alertThrottle),
+		counterNotifications: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "alerts",
+			Name:      "notifications_total",
+			Help:      "Number of alerts sent to notifiers. Partitioned by alert.",
+		},
+			[]string{"alert"}),
+		counterThrottled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "alerts",
+			Name:      "throttled_total",
+			Help:      "Number of duplicate alerts not sent because of throttling. Partitioned by alert.",
+		},
+			[]string{"alert"}),
+		counterNotifyErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "alerts",
+			Name:      "notifier_errors_total",
+			Help:      "Number of alerts that could not be delivered. Partitioned by notifier.",
+		},
+			[]string{"notifier"}),
+	}
+
+	notifiers := make(map[string]Notifier)
+	for _, cfg := range notifierConfigs {
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("notifier name is required")
+		}
+		if _, found := notifiers[cfg.Name]; found {
+			return nil, fmt.Errorf("notifier %s is configured more than once", cfg.Name)
+		}
+		notifier, err := a.newNotifier(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("notifier %s: %v", cfg.Name, err)
+		}
+		notifiers[cfg.Name] = notifier
+	}
+
+	names := make(map[string]bool)
+	for _, cfg := range alertConfigs {
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("alert name is required")
+		}
+		if names[cfg.Name] {
+			return nil, fmt.Errorf("alert %s is configured more than once", cfg.Name)
+		}
+		names[cfg.Name] = true
+		rule := &alertRule{name: cfg.Name, severity: cfg.Severity, throttle: cfg.Throttle, source: cfg.Expr}
+		if rule.severity == "" {
+			rule.severity = defaultAlertSeverity
+		}
+		if !containsString(alertSeverities, rule.severity) {
+			return nil, fmt.Errorf("alert %s: severity must be one of %s", cfg.Name, strings.Join(alertSeverities, ", "))
+		}
+		if rule.throttle == 0 {
+			rule.throttle = defaultAlertThrottle
+		}
+		if rule.throttle < 0 {
+			return nil, fmt.Errorf("alert %s: throttle must not be negative", cfg.Name)
+		}
+		if len(cfg.Findings) == 0 && cfg.Expr == "" {
+			return nil, fmt.Errorf("alert %s: findings or an expression are required", cfg.Name)
+		}
+		if len(cfg.Notifiers) == 0 {
+			return nil, fmt.Errorf("alert %s: notifiers are required", cfg.Name)
+		}
+		for _, name := range cfg.Notifiers {
+			notifier, found := notifiers[name]
+			if !found {
+				return nil, fmt.Errorf("alert %s: unknown notifier %s", cfg.Name, name)
+			}
+			rule.notifiers = append(rule.notifiers, notifier)
+		}
+		for _, finding := range cfg.Findings {
+			if !containsString(findings, finding) {
+				return nil, fmt.Errorf("alert %s: unknown finding %s, must be one of %s", cfg.Name, finding,
+					strings.Join(findings, ", "))
+			}
+			a.byFinding[finding] = append(a.byFinding[finding], rule)
+		}
+		if cfg.Expr != "" {
+			program, err := expr.Compile(cfg.Expr, expr.AllowUndefinedVariables(), expr.AsBool())
+			if err != nil {
+				return nil, fmt.Errorf("alert %s: %v", cfg.Name, err)
+			}
+			rule.program = program
+			a.expression = append(a.expression, rule)
+		}
+		a.counterNotifications.WithLabelValues(rule.name)
+	}
+	return a, nil
+}
+
+func (a *Alerter) collectors() []prometheus.Collector {
+	return []prometheus.Collector{a.counterNotifications, a.counterThrottled, a.counterNotifyErrors}
+}
+
+// containsString returns whether a slice contains a string.
+func containsString(slice []string, s string) bool {
+	for _, e := range slice {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// newNotifier constructs the notifier of a configuration, counting delivery failures as errors of the notifier.
+func (a *Alerter) newNotifier(cfg NotifierConfig) (Notifier, error) {
+	failed := a.counterNotifyErrors.WithLabelValues(cfg.Name).Inc
+	switch cfg.Type {
+	case NotifierSlack:
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("url is required")
+		}
+		return &slackNotifier{webhook: NewWebhook("notifier "+cfg.Name, cfg.URL, failed)}, nil
+	case NotifierPagerDuty:
+		if cfg.RoutingKey == "" {
+			return nil, fmt.Errorf("routing_key is required")
+		}
+		url := cfg.URL
+		if url == "" {
+			url = pagerDutyEventsURL
+		}
+		return &pagerDutyNotifier{
+			webhook:    NewWebhook("notifier "+cfg.Name, url, failed),
+			routingKey: cfg.RoutingKey,
+		}, nil
+	case NotifierWebhook:
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("url is required")
+		}
+		return &webhookNotifier{webhook: NewWebhook("notifier "+cfg.Name, cfg.URL, failed)}, nil
+	}
+	return nil, fmt.Errorf("unknown type %q, must be slack, pagerduty, or webhook", cfg.Type)
+}
+
+// Fire raises the alerts of the rules for a finding.
+func (a *Alerter) Fire(finding Finding) {
+	if a == nil {
+		return
+	}
+	for _, rule := range a.byFinding[finding.Kind] {
+		a.raise(rule, finding.Kind, finding)
+	}
+}
+
+// Observe raises the alerts of the rules whose expression matches an audit event. Duplicates are those of the same
+// request path.
+func (a *Alerter) Observe(auditEvent *AuditEvent) {
+	if len(a.expression) == 0 || auditEvent.entry.Request == nil {
+		return
+	}
+	env, err := auditEvent.Document()
+	if err != nil {
+		a.errors()
+		return
+	}
+	for _, rule := range a.expression {
+		output, err := expr.Run(rule.program, env)
+		if err != nil {
+			a.errors()
+			continue
+		}
+		if matched, _ := output.(bool); !matched {
+			continue
+		}
+		request := auditEvent.entry.Request
+		a.raise(rule, findingExpression, Finding{
+			Key:     request.Path,
+			Summary: fmt.Sprintf("%s %s %s matched %s", auditEvent.entry.Type, request.Operation, request.Path, rule.source),
+			Time:    auditEvent.time,
+			Details: newRequestDetails(auditEvent),
+		})
+	}
+}
+
+// raise notifies the notifiers of a rule of a finding, unless a duplicate was notified within the rule's throttle
+// window. Resolutions are never throttled.
+func (a *Alerter) raise(rule *alertRule, kind string, finding Finding) {
+	key := alertThrottleKey{rule: rule.name, key: finding.Key}
+	a.mu.Lock()
+	throttle, found := a.throttled[key]
+	if !finding.Resolved && found && finding.Time.Sub(throttle.last) < rule.throttle {
+		throttle.suppressed++
+		a.mu.Unlock()
+		a.counterThrottled.WithLabelValues(rule.name).Inc()
+		return
+	}
+	var suppressed int
+	if found {
+		suppressed = throttle.suppressed
+		delete(a.throttled, key)
+	}
+	if !finding.Resolved && len(a.throttled) < alertMaxThrottled {
+		a.throttled[key] = &alertThrottle{last: finding.Time, throttle: rule.throttle}
+	}
+	a.mu.Unlock()
+
+	alert := &Alert{
+		Alert:      rule.name,
+		Finding:    kind,
+		Severity:   rule.severity,
+		Summary:    finding.Summary,
+		DedupKey:   rule.name + "/" + finding.Key,
+		Resolved:   finding.Resolved,
+		Suppressed: suppressed,
+		Time:       finding.Time,
+		Details:    finding.Details,
+	}
+	a.counterNotifications.WithLabelValues(rule.name).Inc()
+	for _, notifier := range rule.notifiers {
+		notifier.Notify(alert)
+	}
+}
+
+// Run continuously forgets throttling that has lapsed.
+func (a *Alerter) Run() {
+	for {
+		time.Sleep(alertCleanupInterval)
+		now := time.Now()
+		a.mu.Lock()
+		for key, throttle := range a.throttled {
+			if now.Sub(throttle.last) >= throttle.throttle {
+				delete(a.throttled, key)
+			}
+		}
+		a.mu.Unlock()
+	}
+}
+
+// webhookNotifier posts alerts as they are to a URL.
+type webhookNotifier struct {
+	webhook *Webhook
+}
+
+func (n *webhookNotifier) Notify(alert *Alert) {
+	n.webhook.Notify(alert)
+}
+
+// slackNotifier posts alerts as messages to a Slack incoming webhook.
+type slackNotifier struct {
+	webhook *Webhook
+}
+
+type slackMessage struct {
+	Text string `json:"text"`
+}
+
+func (n *slackNotifier) Notify(alert *Alert) {
+	status := strings.ToUpper(alert.Severity)
+	if alert.Resolved {
+		status = "RESOLVED"
+	}
+	text := fmt.Sprintf("[%s] %s: %s", status, alert.Alert, alert.Summary)
+	if alert.Suppressed > 0 {
+		text += fmt.Sprintf(" (%d similar alerts throttled since the last one)", alert.Suppressed)
+	}
+	n.webhook.Notify(slackMessage{Text: text})
+}
+
+// pagerDutyNotifier triggers and resolves PagerDuty incidents with the Events API v2, deduplicated by the alert's dedup
+// key.
+type pagerDutyNotifier struct {
+	webhook    *Webhook
+	routingKey string
+}
+
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string      `json:"summary"`
+	Source        string      `json:"source"`
+	Severity      string      `json:"severity"`
+	Timestamp     time.Time   `json:"timestamp"`
+	Component     string      `json:"component,omitempty"`
+	CustomDetails interface{} `json:"custom_details,omitempty"`
+}
+
+func (n *pagerDutyNotifier) Notify(alert *Alert) {
+	event := pagerDutyEvent{RoutingKey: n.routingKey, EventAction: "trigger", DedupKey: truncate(alert.DedupKey, 255)}
+	if alert.Resolved {
+		event.EventAction = "resolve"
+	} else {
+		event.Payload = &pagerDutyPayload{
+			Summary:       truncate(alert.Alert+": "+alert.Summary, 1024),
+			Source:        "vault-audit-metrics",
+			Severity:      alert.Severity,
+			Timestamp:     alert.Time,
+			Component:     alert.Finding,
+			CustomDetails: alert.Details,
+		}
+	}
+	n.webhook.Notify(event)
+}
+
+// truncate shortens a string to at most n bytes.
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Defaults of the anomaly detection settings left unset.
+const (
+	defaultAnomalyInterval  = time.Minute
+	defaultAnomalyAlpha     = 0.1
+	defaultAnomalyThreshold = 3
+	defaultAnomalyWarmup    = 15
+)
+
+// Signals whose anomalies are detected.
+const (
+	anomalySignalRequests = iota
+	anomalySignalErrors
+	anomalySignals
+)
+
+// anomalySignalNames are the signal label values, indexed by signal.
+var anomalySignalNames = [anomalySignals]string{"requests", "errors"}
+
+// AnomalyDetector maintains baselines of the request and error rates of each path group as exponentially weighted
+// moving averages and variances, and scores the rate of every interval by how many standard deviations it deviates from
+// the baseline. Crossing the threshold in either direction is logged and counted as an anomaly.
+type AnomalyDetector struct {
+	interval  time.Duration
+	alpha     float64
+	threshold float64
+	warmup    int
+	groups    map[string]*anomalyGroup
+
+	gagueScore       *prometheus.GaugeVec
+	gagueBaseline    *prometheus.GaugeVec
+	counterAnomalies *prometheus.CounterVec
+}
+
+// anomalyGroup holds the event counts of the current interval and the baselines of a path group.
+type anomalyGroup struct {
+	mu      sync.Mutex
+	counts  [anomalySignals]float64
+	signals [anomalySignals]anomalySignal
+}
+
+// anomalySignal is the baseline of a signal's rate.
+type anomalySignal struct {
+	mean, variance float64
+	intervals      int
+	anomalous      bool
+}
+
+// NewAnomalyDetector constructs an AnomalyDetector for the path groups, applying defaults to unset settings.
+func NewAnomalyDetector(cfg AnomalyConfig, groups PathGroups) (*AnomalyDetector, error) {
+	d := &AnomalyDetector{
+		interval:  cfg.Interval,
+		alpha:     cfg.Alpha,
+		threshold: cfg.Threshold,
+		warmup:    cfg.Warmup,
+		groups:    make(map[string]*anomalyGroup),
+	}
+	if d.interval == 0 {
+		d.interval = defaultAnomalyInterval
+	}
+	if d.alpha == 0 {
+		d.alpha = defaultAnomalyAlpha
+	}
+	if d.threshold == 0 {
+		d.threshold = defaultAnomalyThreshold
+	}
+	if d.warmup == 0 {
+		d.warmup = defaultAnomalyWarmup
+	}
+	if d.interval < time.Second {
+		return nil, fmt.Errorf("interval must be at least 1s")
+	}
+	if d.alpha <= 0 || d.alpha >= 1 {
+		return nil, fmt.Errorf("alpha must be between 0 and 1")
+	}
+	if d.threshold < 0 || d.warmup < 0 {
+		return nil, fmt.Errorf("threshold and warmup must not be negative")
+	}
+	for _, group := range groups {
+		d.groups[group.Name] = new(anomalyGroup)
+	}
+
+	d.gagueScore = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: PromNamespace,
+		Subsystem: "anomaly",
+		Name:      "score",
+		Help:      "Number of standard deviations the rate of the last interval deviated from its baseline, negative for drops. Partitioned by path group and signal (requests or errors).",
+	},
+		[]string{"path_group", "signal"})
+	d.gagueBaseline = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: PromNamespace,
+		Subsystem: "anomaly",
+		Name:      "baseline_per_second",
+		Help:      "Exponentially weighted moving average of the rate per second. Partitioned by path group and signal (requests or errors).",
+	},
+		[]string{"path_group", "signal"})
+	d.counterAnomalies = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "anomaly",
+		Name:      "events_total",
+		Help:      "Number of times the anomaly score crossed the threshold. Partitioned by path group, signal (requests or errors), and direction (spike or drop).",
+	},
+		[]string{"path_group", "signal", "direction"})
+	return d, nil
+}
+
+func (d *AnomalyDetector) collectors() []prometheus.Collector {
+	return []prometheus.Collector{d.gagueScore, d.gagueBaseline, d.counterAnomalies}
+}
+
+// Observe counts a request, or a failed response, towards the current interval of its path group.
+func (d *AnomalyDetector) Observe(auditEvent *AuditEvent) {
+	group := d.groups[auditEvent.pathGroup]
+	if group == nil {
+		return
+	}
+	signal := anomalySignalRequests
+	switch {
+	case auditEvent.entry.Type == AuditEventTypeRequest:
+	case auditEvent.entry.Type == AuditEventTypeResponse && auditEvent.entry.Error != "":
+		signal = anomalySignalErrors
+	default:
+		return
+	}
+	group.mu.Lock()
+	group.counts[signal] += auditEvent.Weight()
+	group.mu.Unlock()
+}
+
+// update scores a rate against the baseline and then folds it into the baseline, returning the score and whether the
+// baseline had warmed up enough to score it. The standard deviation is at least that of a Poisson process with the
+// baseline's rate, so that a near-constant baseline doesn't turn every small change into an anomaly.
+func (s *anomalySignal) update(rate, alpha float64, interval time.Duration, warmup int) (score float64, scored bool) {
+	s.intervals++
+	if s.intervals == 1 {
+		s.mean = rate
+		return 0, false
+	}
+	diff := rate - s.mean
+	if s.intervals > warmup {
+		stddev := math.Sqrt(s.variance)
+		if poisson := math.Sqrt(math.Max(s.mean, 1/interval.Seconds()) / interval.Seconds()); stddev < poisson {
+			stddev = poisson
+		}
+		score, scored = diff/stddev, true
+	}
+	increment := alpha * diff
+	s.mean += increment
+	s.variance = (1 - alpha) * (s.variance + diff*increment)
+	return score, scored
+}
+
+// Run continuously scores the rates of each interval.
+func (d *AnomalyDetector) Run() {
+	for {
+		time.Sleep(d.interval)
+		for name, group := range d.groups {
+			group.mu.Lock()
+			counts := group.counts
+			group.counts = [anomalySignals]float64{}
+			group.mu.Unlock()
+			for signal := range group.signals {
+				d.score(name, signal, &group.signals[signal], counts[signal]/d.interval.Seconds())
+			}
+		}
+	}
+}
+
+// score updates the baseline of a signal of a path group with the rate of the last interval, reporting the anomaly if
+// its score crossed the threshold. Only Run accesses the baselines, so they need no lock.
+func (d *AnomalyDetector) score(group string, signal int, s *anomalySignal, rate float64) {
+	baseline := s.mean
+	score, scored := s.update(rate, d.alpha, d.interval, d.warmup)
+	d.gagueBaseline.WithLabelValues(group, anomalySignalNames[signal]).Set(s.mean)
+	if !scored {
+		return
+	}
+	d.gagueScore.WithLabelValues(group, anomalySignalNames[signal]).Set(score)
+	anomalous := math.Abs(score) >= d.threshold
+	if anomalous && !s.anomalous {
+		direction := "spike"
+		if score < 0 {
+			direction = "drop"
+		}
+		d.counterAnomalies.WithLabelValues(group, anomalySignalNames[signal], direction).Inc()
+		logWarn("anomalous rate", "path_group", group, "signal", anomalySignalNames[signal], "direction", direction,
+			"rate", rate, "baseline", baseline, "score", score)
+	}
+	s.anomalous = anomalous
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// AuditEntry is a Vault audit log entry, covering the fields used for labels and correlation. Other fields, such as
+// request and response data, are ignored when decoding, so that entries of any Vault version decode as long as these
+// fields keep their meaning.
+type AuditEntry struct {
+	Time     string         `json:"time,omitempty"`
+	Type     string         `json:"type,omitempty"`
+	Auth     *AuditAuth     `json:"auth,omitempty"`
+	Request  *AuditRequest  `json:"request,omitempty"`
+	Response *AuditResponse `json:"response,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// AuditRequest is the request of an audit log entry.
+type AuditRequest struct {
+	ID         string `json:"id,omitempty"`
+	Operation  string `json:"operation,omitempty"`
+	MountType  string `json:"mount_type,omitempty"`
+	Path       string `json:"path,omitempty"`
+	RemoteAddr string `json:"remote_address,omitempty"`
+	// Namespace is the namespace of the request, which Vault Enterprise records.
+	Namespace *AuditNamespace `json:"namespace,omitempty"`
+	// ClientToken is the HMAC of the token that made the request.
+	ClientToken string `json:"client_token,omitempty"`
+	// ClientTokenAccessor is the accessor of the token that made the request, which is HMAC'd unless the audit device is
+	// configured otherwise.
+	ClientTokenAccessor string `json:"client_token_accessor,omitempty"`
+	// WrapTTL is the TTL in seconds of the wrapping token the response was requested to be wrapped in, if any.
+	WrapTTL int64 `json:"wrap_ttl,omitempty"`
+	// Data holds the fields of the request body in use.
+	Data *AuditRequestData `json:"data,omitempty"`
+}
+
+// AuditRequestData holds the fields of the request body of an audit log entry in use.
+type AuditRequestData struct {
+	// Token is the HMAC of a token passed in the body, such as the wrapping token to unwrap.
+	Token string `json:"token,omitempty"`
+	// Accessor is the HMAC of an accessor passed in the body, such as the wrapping token accessor of a control group
+	// request to authorize.
+	Accessor string `json:"accessor,omitempty"`
+	// MFAMethodIDs are the IDs of the MFA methods an MFA validation passes credentials for, which are the keys of its
+	// mfa_payload, sorted.
+	MFAMethodIDs []string `json:"-"`
+}
+
+// UnmarshalJSON decodes the fields of a request body in use, ignoring those of unexpected types, since request bodies
+// are arbitrary.
+func (d *AuditRequestData) UnmarshalJSON(data []byte) error {
+	var fields struct {
+		Token      interface{} `json:"token"`
+		Accessor   interface{} `json:"accessor"`
+		MFAPayload interface{} `json:"mfa_payload"`
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	d.Token, _ = fields.Token.(string)
+	d.Accessor, _ = fields.Accessor.(string)
+	d.MFAMethodIDs = nil
+	if payload, ok := fields.MFAPayload.(map[string]interface{}); ok {
+		for id := range payload {
+			d.MFAMethodIDs = append(d.MFAMethodIDs, id)
+		}
+		sort.Strings(d.MFAMethodIDs)
+	}
+	return nil
+}
+
+// AuditNamespace is the namespace of the request of an audit log entry.
+type AuditNamespace struct {
+	ID string `json:"id,omitempty"`
+}
+
+// AuditResponse is the response of an audit log entry.
+type AuditResponse struct {
+	// Auth is the token issued by the response, such as for a login.
+	Auth *AuditAuth `json:"auth,omitempty"`
+	// Secret is the lease of a secret issued by the response, such as dynamic database credentials.
+	Secret *AuditSecret `json:"secret,omitempty"`
+	// LeaseDuration is the duration of the lease in seconds, where recorded.
+	LeaseDuration int64 `json:"lease_duration,omitempty"`
+	// WrapInfo is the wrapping token the response was wrapped in, if any.
+	WrapInfo *AuditWrapInfo `json:"wrap_info,omitempty"`
+	// Data holds the fields of the response body in use.
+	Data *AuditResponseData `json:"data,omitempty"`
+}
+
+// AuditResponseData holds the fields of the response body of an audit log entry in use.
+type AuditResponseData struct {
+	// Approved is whether a control group request was approved, as reported by sys/control-group/authorize and
+	// sys/control-group/request.
+	Approved bool `json:"approved,omitempty"`
+}
+
+// UnmarshalJSON decodes the fields of a response body in use, ignoring those of unexpected types, since response bodies
+// are arbitrary.
+func (d *AuditResponseData) UnmarshalJSON(data []byte) error {
+	var fields struct {
+		Approved interface{} `json:"approved"`
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	d.Approved, _ = fields.Approved.(bool)
+	return nil
+}
+
+// AuditWrapInfo is the wrapping token of a wrapped response of an audit log entry.
+type AuditWrapInfo struct {
+	// Token is the HMAC of the wrapping token.
+	Token string `json:"token,omitempty"`
+	// TTL is the TTL of the wrapping token in seconds.
+	TTL int64 `json:"ttl,omitempty"`
+	// Accessor is the accessor of the wrapping token, which is HMAC'd unless the audit device is configured otherwise.
+	Accessor string `json:"accessor,omitempty"`
+	// CreationPath is the path of the request whose response was wrapped.
+	CreationPath string `json:"creation_path,omitempty"`
+}
+
+// AuditSecret is the lease of a secret issued by the response of an audit log entry.
+type AuditSecret struct {
+	LeaseID string `json:"lease_id,omitempty"`
+}
+
+// AuditAuth is the authentication of the token that made the request of an audit log entry, or of the token issued by
+// its response.
+type AuditAuth struct {
+	Policies  []string `json:"policies,omitempty"`
+	TokenType string   `json:"token_type,omitempty"`
+	// TokenTTL is the TTL of the token in seconds, or zero if it does not expire.
+	TokenTTL int64 `json:"token_ttl,omitempty"`
+	// EntityID is the identity entity of the token, which is empty for tokens without one, such as root tokens.
+	EntityID string `json:"entity_id,omitempty"`
+	// ClientToken is the HMAC of the token.
+	ClientToken string `json:"client_token,omitempty"`
+	// Accessor is the accessor of the token, which is HMAC'd unless the audit device is configured otherwise.
+	Accessor string `json:"accessor,omitempty"`
+	// DisplayName is the display name of the token, prefixed with the path of the auth mount that issued it.
+	DisplayName string `json:"display_name,omitempty"`
+	// MFARequirement is the MFA a login must pass before it is issued a token, if any.
+	MFARequirement *AuditMFARequirement `json:"mfa_requirement,omitempty"`
+}
+
+// AuditMFARequirement is the MFA required to complete a login.
+type AuditMFARequirement struct {
+	// MFAConstraints are the named constraints that must all be satisfied, each by any of its methods.
+	MFAConstraints map[string]AuditMFAConstraint `json:"mfa_constraints,omitempty"`
+}
+
+// AuditMFAConstraint is an MFA constraint satisfied by any of its methods.
+type AuditMFAConstraint struct {
+	Any []AuditMFAMethod `json:"any,omitempty"`
+}
+
+// AuditMFAMethod is an MFA method, such as TOTP or Duo.
+type AuditMFAMethod struct {
+	ID   string `json:"id,omitempty"`
+	Type string `json:"type,omitempty"`
+}
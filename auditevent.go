@@ -1,9 +1,9 @@
 package main
 
 import (
-	"fmt"
+	"sync"
+	"time"
 
-	"github.com/hashicorp/vault/audit"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -12,16 +12,108 @@ const (
 	AuditEventTypeResponse = "response"
 )
 
+// auditEvents recycles audit events along with their entries and label maps, which would otherwise be allocated for
+// every line.
+var auditEvents = sync.Pool{New: func() interface{} {
+	return &AuditEvent{entry: new(AuditEntry)}
+}}
+
 // AuditEvent is a Vault audit log event.
 type AuditEvent struct {
-	entry *audit.AuditResponseEntry
+	entry    *AuditEntry
+	labels   prometheus.Labels
+	document map[string]interface{}
+	// line is a copy of the event's audit log line, which is only kept when it is forwarded to event sinks.
+	line []byte
+	// time is the parsed timestamp of the event.
+	time time.Time
+	// received is the time the event's line was received, and queued the time it was queued for processing.
+	received time.Time
+	queued   time.Time
+	// weight is the number of events this event stands for, which is greater than 1 for sampled events.
+	weight float64
+	// pathGroup is the path group the event belongs to, before relabeling.
+	pathGroup string
+	// class is the path class the event belongs to, if any.
+	class *PathClass
+	// identity is the resolved identity of the entity that made the request, if any.
+	identity *Identity
+	// retained is set once the event is referenced beyond its processing, which keeps it from being released.
+	retained bool
+}
+
+// newAuditEvent returns an empty audit event from the pool.
+func newAuditEvent() *AuditEvent {
+	return auditEvents.Get().(*AuditEvent)
+}
+
+// release returns the audit event to the pool, unless it is retained. The event must not be used afterwards.
+func (a *AuditEvent) release() {
+	if a.retained {
+		return
+	}
+	entry, labels := a.entry, a.labels
+	*entry = AuditEntry{}
+	for name := range labels {
+		delete(labels, name)
+	}
+	*a = AuditEvent{entry: entry, labels: labels}
+	auditEvents.Put(a)
+}
+
+// Weight returns the number of events this event stands for when incrementing counters.
+func (a *AuditEvent) Weight() float64 {
+	if a.weight == 0 {
+		return 1
+	}
+	return a.weight
 }
 
-// PromLabels generates Prometheus metric labels from an audit event.
-func (a *AuditEvent) PromLabels() prometheus.Labels {
-	return prometheus.Labels{
-		"operation": fmt.Sprint(a.entry.Request.Operation),
-		"path":      a.entry.Request.Path,
-		"error":     a.entry.Error,
+// Labels returns the full label set of the audit event. The built-in labels are computed on first use, and the returned
+// map may be modified to reshape the labels before metrics are recorded.
+func (a *AuditEvent) Labels() prometheus.Labels {
+	// label maps of pooled events are kept empty for reuse
+	if len(a.labels) == 0 {
+		if a.labels == nil {
+			a.labels = make(prometheus.Labels)
+		}
+		errorClass := ClassifyError(a.entry.Error)
+		a.labels["operation"] = string(a.entry.Request.Operation)
+		a.labels["path"] = a.entry.Request.Path
+		a.labels["error"] = a.entry.Error
+		a.labels["error_class"] = errorClass
+		a.labels["code_class"] = CodeClass(errorClass)
+		a.labels["token_type"] = a.TokenType()
+	}
+	return a.labels
+}
+
+// SetLabel attaches a derived label to the audit event, overriding any built-in label of the same name.
+func (a *AuditEvent) SetLabel(name, value string) {
+	a.Labels()[name] = value
+}
+
+// PromLabels generates Prometheus metric labels from an audit event, restricted to the given label names.
+func (a *AuditEvent) PromLabels(names []string) prometheus.Labels {
+	all := a.Labels()
+	labels := make(prometheus.Labels, len(names))
+	for _, name := range names {
+		labels[name] = all[name]
+	}
+	return labels
+}
+
+// TokenType returns the type of token that made the request. Tokens carrying the root policy are reported as "root",
+// otherwise the token type from the audit entry's auth block is used ("service" or "batch").
+func (a *AuditEvent) TokenType() string {
+	auth := a.entry.Auth
+	if auth == nil {
+		return ""
+	}
+	for _, policy := range auth.Policies {
+		if policy == "root" {
+			return "root"
+		}
 	}
+	return auth.TokenType
 }
@@ -3,13 +3,15 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net"
 	"net/http"
+	"runtime"
+	"runtime/debug"
 	"time"
 
-	"github.com/hashicorp/vault/audit"
 	"github.com/patrickmn/go-cache"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -17,28 +19,550 @@ import (
 
 const PromNamespace = "vaultaudit"
 
+// Names of the metric families whose labels can be configured.
+const (
+	MetricFamilyRequests  = "requests_total"
+	MetricFamilyResponses = "responses_total"
+	MetricFamilyLatency   = "response_duration_seconds"
+)
+
+var (
+	// counterLabelNames are the default labels attached to request and response counters.
+	counterLabelNames = []string{"operation", "path", "error", "error_class", "code_class", "token_type"}
+	// latencyLabelNames are the default labels attached to the response latency histogram.
+	latencyLabelNames = []string{"operation", "path", "error", "error_class", "code_class"}
+
+	// errMissingRequest is returned for audit log lines without a request, which every audit event is keyed by.
+	errMissingRequest = errors.New("audit entry has no request")
+)
+
 // AuditProcessor contains all of the context needed for processing Vault audit logs into Prometheus metrics.
 type AuditProcessor struct {
-	auditNetwork     string
-	auditAddr        string
-	httpAddr         string
-	timestamps       *cache.Cache
-	gagueCacheSize   *prometheus.GaugeVec
-	gagueRequests    *prometheus.GaugeVec
-	gagueResponses   *prometheus.GaugeVec
-	histogramLatency *prometheus.HistogramVec
+	auditNetwork         string
+	auditAddr            string
+	httpAddr             string
+	timestamps           TimestampStore
+	overwriteDuplicates  bool
+	cacheTTLOverrides    []cacheTTLOverride
+	snapshotPath         string
+	pending              *cache.Cache
+	receiptClock         bool
+	addresses            *AddressAggregator
+	geoIP                *GeoIP
+	identities           *IdentityResolver
+	identityLabels       bool
+	mounts               *MountTable
+	mountRefresh         time.Duration
+	filter               *EventFilter
+	sampler              *Sampler
+	expressions          *ExpressionEngine
+	paths                *PathNormalizer
+	pathGroups           *PathGrouper
+	pathClasses          *PathClassifier
+	slos                 *SLOTracker
+	anomalies            *AnomalyDetector
+	reports              *Reporter
+	metricSinks          *MetricSinks
+	eventSinks           *EventSinks
+	peers                *PeerCluster
+	connections          *ConnectionMetrics
+	interner             *stringInterner
+	sources              *SourceMonitor
+	memory               *MemoryWatchdog
+	rootTokens           *RootTokenMonitor
+	logins               *LoginMonitor
+	mfa                  *MFAMonitor
+	configChanges        *ConfigChangeMonitor
+	operationalEvents    *OperationalEventMonitor
+	privileged           *PrivilegedMonitor
+	replication          *ReplicationMonitor
+	schedules            *AccessScheduleMonitor
+	leases               *LeaseMonitor
+	tokens               *TokenIssuanceMonitor
+	watchlist            *WatchlistMonitor
+	clients              *ClientEstimator
+	topTalkers           *TopTalkers
+	credentials          *CredentialWatchlist
+	alerts               *Alerter
+	wrapping             *WrappingMonitor
+	kvLifecycle          *KVLifecycleMonitor
+	controlGroups        *ControlGroupMonitor
+	deadLetters          *DeadLetterFile
+	parseErrors          *ParseErrorMonitor
+	maxLineBytes         int
+	queue                chan *AuditEvent
+	overloadPolicy       string
+	workers              int
+	highThroughput       bool
+	inFlight             *InFlightTracker
+	correlation          *CorrelationMonitor
+	correlationCheck     time.Duration
+	inFlightCleanup      time.Duration
+	kvV2OperationLabel   bool
+	relabeler            *Relabeler
+	requestLabels        []string
+	responseLabels       []string
+	latencyLabels        []string
+	gagueCacheSize       *prometheus.GaugeVec
+	gagueRequests        *prometheus.GaugeVec
+	gagueResponses       *prometheus.GaugeVec
+	gagueInFlight        *prometheus.GaugeVec
+	histogramLatency     *prometheus.HistogramVec
+	histogramDeliveryLag *prometheus.HistogramVec
+	histogramLatencyHelp string
+	requestSeries        *seriesTracker
+	responseSeries       *seriesTracker
+	latencySeries        *seriesTracker
+	seriesTrackers       []*seriesTracker
+	seriesTTL            time.Duration
+
+	counterCardinalityLimited *prometheus.CounterVec
+	counterSeriesExpired      *prometheus.CounterVec
+	counterResponsesReordered prometheus.Counter
+	counterPendingMatched     prometheus.Counter
+	counterUnmatchedResponses prometheus.Counter
+	counterExpiredRequests    prometheus.Counter
+	counterTimestampErrors    prometheus.Counter
+	counterStoreErrors        prometheus.Counter
+	counterCacheSets          prometheus.Counter
+	counterCacheHits          prometheus.Counter
+	counterCacheMisses        prometheus.Counter
+	counterCacheOverwrites    prometheus.Counter
+	counterDuplicateRequests  prometheus.Counter
+	counterDuplicateResponses prometheus.Counter
+	counterRequestsByPolicy   *prometheus.CounterVec
+	counterLinesReceived      prometheus.Counter
+	gagueLastEvent            prometheus.Gauge
+	counterBytesReceived      prometheus.Counter
+	counterParseErrors        prometheus.Counter
+	counterOversizedLines     prometheus.Counter
+	counterUnknownTypes       prometheus.Counter
+	counterPanics             prometheus.Counter
+	counterEventsProcessed    *prometheus.CounterVec
+	histogramProcessingLag    prometheus.Histogram
+	histogramQueueWait        prometheus.Histogram
+	counterQueueBlocked       prometheus.Counter
+	counterEventsDropped      *prometheus.CounterVec
+	counterExpressionErrors   prometheus.Counter
 }
 
 // NewAuditProcessor constructs an AuditProcessor.
-func NewAuditProcessor(auditNetwork, auditAddr, httpAddr string, cacheTTL, cacheCleanup time.Duration) *AuditProcessor {
+func NewAuditProcessor(cfg *Config) (*AuditProcessor, error) {
 	p := &AuditProcessor{
-		auditNetwork: auditNetwork,
-		auditAddr:    auditAddr,
-		httpAddr:     httpAddr,
-		timestamps:   cache.New(cacheTTL, cacheCleanup),
+		auditNetwork: cfg.AuditNetwork,
+		auditAddr:    cfg.AuditAddr,
+		httpAddr:     cfg.HTTPAddr,
+		interner:     newStringInterner(maxInternedStrings),
+	}
+	timestamps, err := NewTimestampStore(cfg, func() { p.counterExpiredRequests.Inc() }, func() { p.counterStoreErrors.Inc() })
+	if err != nil {
+		return nil, fmt.Errorf("error configuring timestamp store: %v", err)
+	}
+	p.timestamps = timestamps
+	p.overwriteDuplicates = cfg.DuplicateRequestIDs == DuplicateLastWins
+	if cfg.CacheSnapshot != "" {
+		p.snapshotPath = cfg.CacheSnapshot
+		restored, err := localStore(timestamps).loadSnapshot(cfg.CacheSnapshot, cfg.CacheSnapshotMaxAge)
+		if err != nil {
+			logError("error restoring cache snapshot", "path", cfg.CacheSnapshot, "error", err)
+		} else if restored > 0 {
+			logInfo("restored request timestamps", "path", cfg.CacheSnapshot, "count", restored)
+		}
+	}
+	switch cfg.LatencyClock {
+	case LatencyClockVault:
+	case LatencyClockReceipt:
+		p.receiptClock = true
+	default:
+		return nil, fmt.Errorf("unknown latency clock: %s", cfg.LatencyClock)
+	}
+	overrides, err := compileCacheTTLOverrides(cfg.CacheTTLOverrides)
+	if err != nil {
+		return nil, fmt.Errorf("error configuring cache TTL overrides: %v", err)
+	}
+	p.cacheTTLOverrides = overrides
+	if cfg.PendingResponseTTL > 0 {
+		p.pending = newPendingResponses(cfg.PendingResponseTTL, p.unmatchedResponse)
+	}
+	p.workers = cfg.Workers
+	if p.workers <= 0 {
+		p.workers = 4 * runtime.NumCPU()
+	}
+	queueSize := cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = 10000
+	}
+	p.highThroughput = cfg.HighThroughput
+	p.queue = make(chan *AuditEvent, queueSize)
+	switch cfg.OverloadPolicy {
+	case OverloadBlock, OverloadDropNewest, OverloadDropOldest:
+		p.overloadPolicy = cfg.OverloadPolicy
+	default:
+		return nil, fmt.Errorf("unknown overload policy: %s", cfg.OverloadPolicy)
+	}
+	p.maxLineBytes = cfg.MaxLineBytes
+	if p.maxLineBytes <= 0 {
+		p.maxLineBytes = bufio.MaxScanTokenSize
+	}
+	if cfg.ParseErrorThreshold > 0 {
+		parseErrors, err := NewParseErrorMonitor(cfg.ParseErrorThreshold, cfg.ParseErrorWindow)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring parse error readiness: %v", err)
+		}
+		p.parseErrors = parseErrors
+	}
+	if cfg.DeadLetterFile != "" {
+		deadLetters, err := NewDeadLetterFile(cfg.DeadLetterFile, cfg.DeadLetterMaxBytes)
+		if err != nil {
+			return nil, fmt.Errorf("error opening dead-letter file: %v", err)
+		}
+		p.deadLetters = deadLetters
+	}
+	filter, err := NewEventFilter(&cfg.Filters)
+	if err != nil {
+		return nil, fmt.Errorf("error configuring filters: %v", err)
+	}
+	p.filter = filter
+
+	p.counterExpressionErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "events",
+		Name:      "expression_errors_total",
+		Help:      "Number of expression rule evaluations that failed.",
+	})
+	prometheus.MustRegister(p.counterExpressionErrors)
+	if len(cfg.Expressions) > 0 {
+		expressions, err := NewExpressionEngine(cfg.Expressions, p.counterExpressionErrors.Inc)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring expressions: %v", err)
+		}
+		p.expressions = expressions
+	}
+
+	sampler, err := NewSampler(cfg.Sampling)
+	if err != nil {
+		return nil, fmt.Errorf("error configuring sampling: %v", err)
+	}
+	p.sampler = sampler
+
+	paths, err := NewPathNormalizer(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("error configuring path normalization: %v", err)
+	}
+	p.paths = paths
+	p.kvV2OperationLabel = cfg.KVv2.OperationLabel
+	if len(cfg.Alerts) > 0 {
+		alerts, err := NewAlerter(cfg.Notifiers, cfg.Alerts, p.counterExpressionErrors.Inc)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring alerts: %v", err)
+		}
+		p.alerts = alerts
+	}
+	p.rootTokens = NewRootTokenMonitor(paths, cfg.RootTokenWebhook, p.alerts)
+	p.logins = NewLoginMonitor(cfg.LoginFailureSourceLabel, cfg.LoginFailureAliasLabel, cfg.BruteForceThreshold,
+		cfg.BruteForceWindow, cfg.BruteForceWebhook, p.alerts)
+	p.mfa = NewMFAMonitor()
+	p.configChanges = NewConfigChangeMonitor(p.alerts)
+	p.operationalEvents = NewOperationalEventMonitor(p.alerts)
+	p.privileged = NewPrivilegedMonitor()
+	p.replication = NewReplicationMonitor(p.alerts)
+	p.tokens = NewTokenIssuanceMonitor()
+	p.wrapping = NewWrappingMonitor()
+	p.kvLifecycle = NewKVLifecycleMonitor(paths)
+	p.controlGroups = NewControlGroupMonitor(paths)
+	watchlist, err := NewWatchlistMonitor(cfg.Watchlist, cfg.WatchlistWebhook, p.alerts)
+	if err != nil {
+		return nil, fmt.Errorf("error configuring watchlist: %v", err)
+	}
+	p.watchlist = watchlist
+	if cfg.CredentialWatchlist != nil {
+		credentials, err := NewCredentialWatchlist(*cfg.CredentialWatchlist, cfg.CredentialWatchlistWebhook,
+			p.alerts)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring credential watchlist: %v", err)
+		}
+		p.credentials = credentials
+	}
+	if cfg.ActiveClients {
+		p.clients = NewClientEstimator()
+	}
+	if cfg.TopTalkers > 0 {
+		if cfg.TopTalkers > MaxTopTalkers {
+			return nil, fmt.Errorf("error configuring top talkers: at most %d are supported", MaxTopTalkers)
+		}
+		if cfg.TopTalkersWindow < time.Minute {
+			return nil, fmt.Errorf("error configuring top talkers: window must be at least 1m")
+		}
+		p.topTalkers = NewTopTalkers(cfg.TopTalkers, cfg.TopTalkersWindow)
+	}
+
+	counterLabels := append([]string(nil), counterLabelNames...)
+	latencyLabels := append([]string(nil), latencyLabelNames...)
+
+	if cfg.DropRawError {
+		counterLabels = removeLabel(counterLabels, "error")
+		latencyLabels = removeLabel(latencyLabels, "error")
+	}
+
+	if cfg.KVv2.OperationLabel {
+		counterLabels = append(counterLabels, "kv_op")
+		latencyLabels = append(latencyLabels, "kv_op")
+	}
+
+	if p.expressions != nil && p.expressions.HasRoutes() {
+		counterLabels = append(counterLabels, "route")
+		latencyLabels = append(latencyLabels, "route")
+	}
+
+	if len(cfg.PathGroups) > 0 {
+		groups, err := NewPathGrouper(cfg.PathGroups)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring path groups: %v", err)
+		}
+		p.pathGroups = groups
+		counterLabels = append(counterLabels, "path_group")
+		latencyLabels = append(latencyLabels, "path_group")
+	}
+
+	if len(cfg.AccessSchedules) > 0 {
+		schedules, err := NewAccessScheduleMonitor(cfg.AccessSchedules, p.pathGroups, p.alerts)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring access schedules: %v", err)
+		}
+		p.schedules = schedules
+	}
+
+	if len(cfg.SLOs) > 0 {
+		if p.pathGroups == nil {
+			return nil, fmt.Errorf("error configuring slos: path_groups are required")
+		}
+		slos, err := NewSLOTracker(cfg.SLOs)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring slos: %v", err)
+		}
+		p.slos = slos
+	}
+
+	if cfg.AnomalyDetection != nil {
+		if p.pathGroups == nil {
+			return nil, fmt.Errorf("error configuring anomaly detection: path_groups are required")
+		}
+		anomalies, err := NewAnomalyDetector(*cfg.AnomalyDetection, cfg.PathGroups)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring anomaly detection: %v", err)
+		}
+		p.anomalies = anomalies
+	}
+
+	if len(cfg.Reports) > 0 {
+		reports, err := NewReporter(cfg.Reports, paths)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring reports: %v", err)
+		}
+		p.reports = reports
+	}
+
+	if len(cfg.MetricSinks) > 0 {
+		sinks, err := NewMetricSinks(cfg.MetricSinks, prometheus.DefaultGatherer)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring metric sinks: %v", err)
+		}
+		p.metricSinks = sinks
+	}
+
+	if len(cfg.EventSinks) > 0 {
+		sinks, err := NewEventSinks(cfg.EventSinks)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring event sinks: %v", err)
+		}
+		p.eventSinks = sinks
+	}
+
+	if len(cfg.Peers.Peers) > 0 {
+		peers, err := NewPeerCluster(&cfg.Peers, p.maxLineBytes, func(line []byte, received time.Time) {
+			p.enqueue(p.ingest(line, received, "", true))
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error configuring peers: %v", err)
+		}
+		p.peers = peers
+	}
+
+	if len(cfg.PathClasses) > 0 {
+		classes, err := NewPathClassifier(cfg.PathClasses)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring path classes: %v", err)
+		}
+		p.pathClasses = classes
 	}
+
+	var vault *VaultClient
+	if cfg.MountLabels || cfg.Identity.Enabled {
+		client, err := NewVaultClient(&cfg.Vault)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring vault client: %v", err)
+		}
+		vault = client
+	}
+
+	if cfg.MountLabels {
+		p.mounts = NewMountTable(vault)
+		if err := p.mounts.Refresh(); err != nil {
+			logError("error loading mount table", "error", err)
+		}
+		p.mountRefresh = cfg.MountRefresh
+		counterLabels = append(counterLabels, "mount_path", "mount_type")
+		latencyLabels = append(latencyLabels, "mount_path", "mount_type")
+	}
+	p.leases = NewLeaseMonitor(p.mounts)
+
+	if cfg.RemoteAddress.Enabled {
+		addresses, err := NewAddressAggregator(cfg.RemoteAddress.PrefixV4, cfg.RemoteAddress.PrefixV6, cfg.RemoteAddress.Networks)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring remote address label: %v", err)
+		}
+		p.addresses = addresses
+		counterLabels = append(counterLabels, "remote_address")
+	}
+
+	if cfg.GeoIP.CountryDB != "" || cfg.GeoIP.ASNDB != "" {
+		geoIP, err := NewGeoIP(cfg.GeoIP.CountryDB, cfg.GeoIP.ASNDB)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring geoip: %v", err)
+		}
+		p.geoIP = geoIP
+		if cfg.GeoIP.CountryDB != "" {
+			counterLabels = append(counterLabels, "country")
+		}
+		if cfg.GeoIP.ASNDB != "" {
+			counterLabels = append(counterLabels, "asn")
+		}
+	}
+
+	if cfg.Identity.Enabled {
+		p.identities = NewIdentityResolver(vault, cfg.Identity.CacheTTL)
+		if cfg.Identity.Labels {
+			p.identityLabels = true
+			counterLabels = append(counterLabels, "entity_name", "entity_groups")
+		}
+	}
+
+	if len(cfg.RelabelConfigs) > 0 {
+		relabeler, err := NewRelabeler(cfg.RelabelConfigs)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring relabeling: %v", err)
+		}
+		p.relabeler = relabeler
+		for _, name := range relabeler.TargetLabels() {
+			if !containsLabel(counterLabels, name) {
+				counterLabels = append(counterLabels, name)
+			}
+			if !containsLabel(latencyLabels, name) {
+				latencyLabels = append(latencyLabels, name)
+			}
+		}
+	}
+
+	for family := range cfg.Labels {
+		if !isMetricFamily(family) {
+			return nil, fmt.Errorf("unknown metric family in label configuration: %s", family)
+		}
+	}
+	for family := range cfg.MaxSeriesOverrides {
+		if !isMetricFamily(family) {
+			return nil, fmt.Errorf("unknown metric family in series limit configuration: %s", family)
+		}
+	}
+	if p.requestLabels, err = filterLabelNames(counterLabels, cfg.Labels[MetricFamilyRequests]); err != nil {
+		return nil, fmt.Errorf("error configuring %s labels: %v", MetricFamilyRequests, err)
+	}
+	if p.responseLabels, err = filterLabelNames(counterLabels, cfg.Labels[MetricFamilyResponses]); err != nil {
+		return nil, fmt.Errorf("error configuring %s labels: %v", MetricFamilyResponses, err)
+	}
+	if p.latencyLabels, err = filterLabelNames(latencyLabels, cfg.Labels[MetricFamilyLatency]); err != nil {
+		return nil, fmt.Errorf("error configuring %s labels: %v", MetricFamilyLatency, err)
+	}
+
+	if cfg.PolicyMetrics {
+		p.counterRequestsByPolicy = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "events",
+			Name:      "requests_by_policy_total",
+			Help:      "Number of Vault requests recorded in the audit log, counted once for each policy attached to the requesting token. Partitioned by policy.",
+		},
+			[]string{"policy"})
+		prometheus.MustRegister(p.counterRequestsByPolicy)
+	}
+
+	if cfg.SourceDownAfter > 0 {
+		p.sources = NewSourceMonitor(cfg.SourceDownAfter, cfg.SourceDownWebhook, p.alerts)
+	}
+
+	if cfg.MaxMemory > 0 {
+		store := localStore(p.timestamps)
+		p.memory = NewMemoryWatchdog(cfg.MaxMemory, func(fraction float64) int {
+			// the in-flight requests are shrunk along with the timestamps they await
+			p.inFlight.shrink(fraction)
+			if store == nil {
+				return 0
+			}
+			return store.shrink(fraction)
+		})
+	}
+
+	if cfg.CorrelationCheckInterval > 0 {
+		p.correlation = NewCorrelationMonitor()
+		p.correlationCheck = cfg.CorrelationCheckInterval
+	}
+
 	p.addMetrics()
-	return p
+	p.inFlight = NewInFlightTracker(cfg.CacheTTL, cfg.CacheMaxEntries, cfg.CacheMaxBytes, p.gagueInFlight)
+	p.inFlightCleanup = cfg.CacheCleanup
+
+	maxSeries := func(family string) int {
+		if n, found := cfg.MaxSeriesOverrides[family]; found {
+			return n
+		}
+		return cfg.MaxSeries
+	}
+	p.requestSeries = newSeriesTracker(p.requestLabels, maxSeries(MetricFamilyRequests), cfg.SeriesTTL, p.gagueRequests,
+		p.counterCardinalityLimited.WithLabelValues(MetricFamilyRequests), p.counterSeriesExpired.WithLabelValues(MetricFamilyRequests))
+	p.responseSeries = newSeriesTracker(p.responseLabels, maxSeries(MetricFamilyResponses), cfg.SeriesTTL, p.gagueResponses,
+		p.counterCardinalityLimited.WithLabelValues(MetricFamilyResponses), p.counterSeriesExpired.WithLabelValues(MetricFamilyResponses))
+	p.latencySeries = newSeriesTracker(p.latencyLabels, maxSeries(MetricFamilyLatency), cfg.SeriesTTL, p.histogramLatency,
+		p.counterCardinalityLimited.WithLabelValues(MetricFamilyLatency), p.counterSeriesExpired.WithLabelValues(MetricFamilyLatency))
+	p.seriesTrackers = []*seriesTracker{p.requestSeries, p.responseSeries, p.latencySeries}
+	p.seriesTTL = cfg.SeriesTTL
+
+	// path classes with custom buckets get their own histogram, distinguished by a constant path_class label
+	if p.pathClasses != nil {
+		for _, class := range p.pathClasses.classes {
+			if len(class.buckets) == 0 {
+				continue
+			}
+			class.histogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+				Namespace:   PromNamespace,
+				Subsystem:   "events",
+				Name:        MetricFamilyLatency,
+				Help:        p.histogramLatencyHelp,
+				ConstLabels: prometheus.Labels{"path_class": class.name},
+				Buckets:     class.buckets,
+			},
+				p.latencyLabels)
+			if err := prometheus.Register(class.histogram); err != nil {
+				return nil, fmt.Errorf("error registering latency histogram for path class %s: %v", class.name, err)
+			}
+			class.series = newSeriesTracker(p.latencyLabels, maxSeries(MetricFamilyLatency), cfg.SeriesTTL, class.histogram,
+				p.counterCardinalityLimited.WithLabelValues(MetricFamilyLatency), p.counterSeriesExpired.WithLabelValues(MetricFamilyLatency))
+			p.seriesTrackers = append(p.seriesTrackers, class.series)
+		}
+	}
+	return p, nil
+}
+
+// isMetricFamily reports whether name is one of the configurable metric families.
+func isMetricFamily(name string) bool {
+	return name == MetricFamilyRequests || name == MetricFamilyResponses || name == MetricFamilyLatency
 }
 
 // addMetrics defines a set of Prometheus metrics and adds them to the AuditProcessor.
@@ -52,126 +576,856 @@ func (p *AuditProcessor) addMetrics() {
 	p.gagueRequests = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: PromNamespace,
 		Subsystem: "events",
-		Name:      "requests_total",
-		Help:      "Number of Vault requests recorded in the audit log. Partitioned by operation, path, and error.",
+		Name:      MetricFamilyRequests,
+		Help:      "Number of Vault requests recorded in the audit log. Partitioned by operation, path, error, error class, code class, and token type.",
 	},
-		[]string{"operation", "path", "error"})
+		p.requestLabels)
 	p.gagueResponses = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: PromNamespace,
 		Subsystem: "events",
-		Name:      "responses_total",
-		Help:      "Number of Vault responses recorded in the audit log. Partitioned by operation, path, and error.",
+		Name:      MetricFamilyResponses,
+		Help:      "Number of Vault responses recorded in the audit log. Partitioned by operation, path, error, error class, code class, and token type.",
 	},
-		[]string{"operation", "path", "error"})
+		p.responseLabels)
+	p.histogramLatencyHelp = "Latency of a Vault response. Partitioned by operation, path, error, error class, and code class."
+	var latencyConstLabels prometheus.Labels
+	if p.pathClasses != nil && p.pathClasses.HasCustomBuckets() {
+		latencyConstLabels = prometheus.Labels{"path_class": ""}
+	}
 	p.histogramLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:   PromNamespace,
+		Subsystem:   "events",
+		Name:        MetricFamilyLatency,
+		Help:        p.histogramLatencyHelp,
+		ConstLabels: latencyConstLabels,
+	},
+		p.latencyLabels)
+	p.histogramDeliveryLag = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: PromNamespace,
 		Subsystem: "events",
-		Name:      "response_duration_seconds",
-		Help:      "Latency of a Vault response. Partitioned by operation, path, and error.",
+		Name:      "delivery_lag_seconds",
+		Help:      "Time between the timestamp Vault wrote into an audit entry and its receipt by the exporter. Partitioned by type.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
 	},
-		[]string{"operation", "path", "error"})
-	prometheus.MustRegister(p.gagueCacheSize, p.gagueRequests, p.gagueResponses, p.histogramLatency)
+		[]string{"type"})
+	p.counterCardinalityLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "events",
+		Name:      "cardinality_limited_total",
+		Help:      "Number of events whose labels were folded into the overflow series because their metric reached its series limit. Partitioned by metric.",
+	},
+		[]string{"metric"})
+	p.counterSeriesExpired = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "events",
+		Name:      "series_expired_total",
+		Help:      "Number of series deleted after not being updated within the series TTL. Partitioned by metric.",
+	},
+		[]string{"metric"})
+	p.counterResponsesReordered = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "events",
+		Name:      "responses_reordered_total",
+		Help:      "Number of responses that arrived before their request and were buffered awaiting it.",
+	})
+	p.counterPendingMatched = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "events",
+		Name:      "pending_responses_matched_total",
+		Help:      "Number of buffered responses whose request arrived before the pending response TTL elapsed.",
+	})
+	p.counterUnmatchedResponses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "events",
+		Name:      "unmatched_responses_total",
+		Help:      "Number of responses whose request was never seen, so that their latency could not be recorded.",
+	})
+	p.counterExpiredRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "events",
+		Name:      "expired_requests_total",
+		Help:      "Number of requests evicted from the timestamp cache before their response arrived.",
+	})
+	p.counterStoreErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "cache",
+		Name:      "store_errors_total",
+		Help:      "Number of failed operations on the remote timestamp store, which fall back to local-only correlation.",
+	})
+	p.counterCacheSets = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "cache",
+		Name:      "sets_total",
+		Help:      "Number of request timestamps stored in the timestamp cache.",
+	})
+	p.counterCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "cache",
+		Name:      "hits_total",
+		Help:      "Number of lookups of a response's request timestamp that found it in the timestamp cache.",
+	})
+	p.counterCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "cache",
+		Name:      "misses_total",
+		Help:      "Number of lookups of a response's request timestamp that did not find it in the timestamp cache.",
+	})
+	p.counterCacheOverwrites = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "cache",
+		Name:      "overwrites_total",
+		Help:      "Number of request timestamps replaced in the timestamp cache by a request with the same ID.",
+	})
+	p.counterDuplicateRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "events",
+		Name:      "duplicate_requests_total",
+		Help:      "Number of requests whose ID was already awaiting a response, for example due to retries or replication.",
+	})
+	p.counterDuplicateResponses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "events",
+		Name:      "duplicate_responses_total",
+		Help:      "Number of responses arriving before their request whose ID already had a response buffered, which are counted as unmatched.",
+	})
+	p.counterTimestampErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "events",
+		Name:      "timestamp_parse_errors_total",
+		Help:      "Number of audit events rejected because their timestamp could not be parsed.",
+	})
+	if p.slos != nil {
+		prometheus.MustRegister(p.slos.counterEvents, p.slos.gagueBurnRate)
+	}
+	if p.anomalies != nil {
+		prometheus.MustRegister(p.anomalies.collectors()...)
+	}
+	if p.reports != nil {
+		prometheus.MustRegister(p.reports.collectors()...)
+	}
+	if p.metricSinks != nil {
+		prometheus.MustRegister(p.metricSinks.collectors()...)
+	}
+	if p.eventSinks != nil {
+		prometheus.MustRegister(p.eventSinks.collectors()...)
+	}
+	if p.clients != nil {
+		prometheus.MustRegister(p.clients.collectors()...)
+	}
+	if p.topTalkers != nil {
+		prometheus.MustRegister(p.topTalkers.collectors()...)
+	}
+	if p.correlation != nil {
+		prometheus.MustRegister(p.correlation.gagueMode)
+	}
+	if p.sources != nil {
+		prometheus.MustRegister(p.sources.gagueDown, p.sources.counterWebhookErrors)
+	}
+	if p.memory != nil {
+		prometheus.MustRegister(p.memory.collectors()...)
+	}
+	prometheus.MustRegister(p.rootTokens.collectors()...)
+	prometheus.MustRegister(p.watchlist.collectors()...)
+	if p.credentials != nil {
+		prometheus.MustRegister(p.credentials.collectors()...)
+	}
+	if p.alerts != nil {
+		prometheus.MustRegister(p.alerts.collectors()...)
+	}
+	prometheus.MustRegister(p.logins.collectors()...)
+	prometheus.MustRegister(p.mfa.collectors()...)
+	prometheus.MustRegister(p.configChanges.collectors()...)
+	prometheus.MustRegister(p.operationalEvents.collectors()...)
+	prometheus.MustRegister(p.privileged.collectors()...)
+	prometheus.MustRegister(p.replication.collectors()...)
+	if p.schedules != nil {
+		prometheus.MustRegister(p.schedules.collectors()...)
+	}
+	prometheus.MustRegister(p.leases.collectors()...)
+	prometheus.MustRegister(p.tokens.collectors()...)
+	prometheus.MustRegister(p.wrapping.collectors()...)
+	prometheus.MustRegister(p.kvLifecycle.collectors()...)
+	prometheus.MustRegister(p.controlGroups.collectors()...)
+	if p.identities != nil {
+		prometheus.MustRegister(p.identities.collectors()...)
+	}
+	if p.parseErrors != nil {
+		prometheus.MustRegister(p.parseErrors.gagueRatio, p.parseErrors.gagueDegraded)
+	}
+	if p.peers != nil {
+		prometheus.MustRegister(p.peers.counterForwarded, p.peers.counterForwardErrors, p.peers.counterReceived)
+	}
+	p.gagueInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: PromNamespace,
+		Subsystem: "events",
+		Name:      "in_flight",
+		Help:      "Number of requests that have been seen but not yet matched to a response. Partitioned by path and operation.",
+	},
+		[]string{"path", "operation"})
+	if local := localStore(p.timestamps); local != nil {
+		prometheus.MustRegister(
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Namespace: PromNamespace,
+				Subsystem: "cache",
+				Name:      "operations_total",
+				Help:      "Number of operations on the shards of the in-memory request timestamp cache.",
+			}, local.Operations),
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Namespace: PromNamespace,
+				Subsystem: "cache",
+				Name:      "lock_wait_seconds_total",
+				Help:      "Time spent waiting on the shard locks of the in-memory request timestamp cache.",
+			}, local.LockWait),
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Namespace: PromNamespace,
+				Subsystem: "cache",
+				Name:      "evictions_total",
+				Help:      "Number of requests evicted from the in-memory request timestamp cache to stay within -cache-max-entries or -cache-max-bytes.",
+			}, local.Evictions),
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Namespace: PromNamespace,
+				Subsystem: "cache",
+				Name:      "rejections_total",
+				Help:      "Number of requests not admitted to the in-memory request timestamp cache because they alone exceed a shard's share of -cache-max-bytes.",
+			}, local.Rejections),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Namespace: PromNamespace,
+				Subsystem: "cache",
+				Name:      "bytes",
+				Help:      "Approximate memory used by the requests in the in-memory request timestamp cache.",
+			}, local.Bytes))
+	}
+	p.counterLinesReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "pipeline",
+		Name:      "lines_received_total",
+		Help:      "Number of lines received from audit devices.",
+	})
+	p.gagueLastEvent = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: PromNamespace,
+		Name:      "last_event_timestamp_seconds",
+		Help:      "Unix time at which the last line was received from any audit device.",
+	})
+	p.counterBytesReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "pipeline",
+		Name:      "bytes_received_total",
+		Help:      "Number of bytes received from audit devices.",
+	})
+	p.counterParseErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "pipeline",
+		Name:      "parse_errors_total",
+		Help:      "Number of lines that could not be decoded as JSON audit entries.",
+	})
+	p.counterOversizedLines = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "pipeline",
+		Name:      "oversized_lines_total",
+		Help:      "Number of lines skipped because they exceed -max-line-bytes.",
+	})
+	p.counterPanics = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "pipeline",
+		Name:      "processing_panics_total",
+		Help:      "Number of panics recovered while handling audit connections or processing audit events.",
+	})
+	p.counterUnknownTypes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "pipeline",
+		Name:      "unknown_event_types_total",
+		Help:      "Number of audit entries that are neither requests nor responses.",
+	})
+	p.counterEventsProcessed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "pipeline",
+		Name:      "events_processed_total",
+		Help:      "Number of audit events recorded in metrics. Partitioned by type.",
+	},
+		[]string{"type"})
+	p.histogramProcessingLag = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: PromNamespace,
+		Subsystem: "pipeline",
+		Name:      "processing_lag_seconds",
+		Help:      "Time from receiving an audit event's line to recording it in metrics, including queueing and processing.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+	})
+	p.histogramQueueWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: PromNamespace,
+		Subsystem: "pipeline",
+		Name:      "queue_wait_seconds",
+		Help:      "Time audit events waited in the processing queue for a worker.",
+		Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10),
+	})
+	p.counterQueueBlocked = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "pipeline",
+		Name:      "queue_blocked_seconds_total",
+		Help:      "Time spent waiting for room in the full processing queue, during which audit connections are not read.",
+	})
+	p.counterEventsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "pipeline",
+		Name:      "events_dropped_total",
+		Help:      "Number of audit events not recorded in metrics. Partitioned by reason (filter, sampling, expression, relabel, queue_full, or memory).",
+	},
+		[]string{"reason"})
+	p.connections = NewConnectionMetrics(p.sources)
+	prometheus.MustRegister(p.connections.collectors()...)
+	prometheus.MustRegister(p.counterLinesReceived, p.gagueLastEvent, p.counterBytesReceived, p.counterParseErrors, p.counterOversizedLines,
+		p.counterUnknownTypes, p.counterPanics,
+		p.counterEventsProcessed, p.histogramProcessingLag, p.histogramQueueWait, p.counterQueueBlocked, p.counterEventsDropped,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: PromNamespace,
+			Subsystem: "pipeline",
+			Name:      "queue_depth",
+			Help:      "Number of audit events waiting in the processing queue.",
+		}, func() float64 { return float64(len(p.queue)) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: PromNamespace,
+			Subsystem: "pipeline",
+			Name:      "queue_capacity",
+			Help:      "Number of audit events the processing queue holds, set by -queue-size.",
+		}, func() float64 { return float64(cap(p.queue)) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: PromNamespace,
+			Subsystem: "pipeline",
+			Name:      "interned_strings",
+			Help:      "Number of distinct label values, such as paths and errors, shared across decoded audit entries.",
+		}, func() float64 { return float64(p.interner.Len()) }))
+	prometheus.MustRegister(p.gagueCacheSize, p.gagueRequests, p.gagueResponses, p.histogramLatency, p.counterCardinalityLimited,
+		p.counterSeriesExpired, p.counterResponsesReordered, p.counterPendingMatched, p.counterUnmatchedResponses,
+		p.counterExpiredRequests, p.counterTimestampErrors, p.counterStoreErrors, p.counterDuplicateRequests, p.gagueInFlight,
+		p.histogramDeliveryLag, p.counterCacheSets, p.counterCacheHits, p.counterCacheMisses, p.counterCacheOverwrites,
+		p.counterDuplicateResponses)
 }
 
 // handle parses incoming connections into typed AuditEvents and dispatches them for processing.
 func (p *AuditProcessor) handle(conn net.Conn) {
+	source := connectionSource(conn)
+	lines, closed := p.connections.Open(source)
+	logDebug("accepted audit connection", "source", source)
 	defer func() {
 		if err := conn.Close(); err != nil {
-			log.Printf("error closing connection: %v\n", err)
+			logError("error closing connection", "source", source, "error", err)
+		}
+		closed()
+		logDebug("closed audit connection", "source", source)
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			p.panicked(r, "handling connection", "source", source)
 		}
 	}()
 
-	scanner := bufio.NewScanner(conn)
-	for scanner.Scan() {
-		line := scanner.Bytes()
+	reader := newLineReader(conn, p.maxLineBytes)
+	defer reader.release()
+	for {
+		line, size, err := reader.Next()
+		if err != nil {
+			// connections idle past the read deadline are closed quietly, since audit devices reconnect
+			if netErr, ok := err.(net.Error); err != io.EOF && !(ok && netErr.Timeout()) {
+				logError("error reading audit connection", "source", source, "error", err)
+			}
+			return
+		}
+		received := time.Now()
+		p.counterLinesReceived.Inc()
+		p.gagueLastEvent.Set(float64(received.UnixNano()) / 1e9)
+		lines.Received(received)
+		p.counterBytesReceived.Add(float64(size + 1))
 
 		// push connection read deadline back by 10 seconds
 		if err := conn.SetReadDeadline(time.Now().Add(10 * time.Second)); err != nil {
-			log.Printf("error setting connecton read deadline: %v\n", err)
+			logError("error setting connection read deadline", "source", source, "error", err)
 			continue
 		}
 
-		entry := new(audit.AuditResponseEntry)
-		if err := json.Unmarshal(line, entry); err != nil {
-			log.Printf("error unmarshalling audit event: %v\n", err)
+		if line == nil {
+			logWarn("skipping audit line exceeding -max-line-bytes", "source", source, "bytes", size)
+			p.counterOversizedLines.Inc()
 			continue
 		}
+		p.enqueue(p.ingest(line, received, source, false))
+	}
+}
+
+// decode decodes an audit log line into an audit event. encoding/json is only used for lines the fast decoder cannot
+// handle, so that its errors are reported. Lines without a request, such as "null", are rejected, since filters,
+// sampling, enrichment, and labels all refer to it. Since expressions can refer to any field, the whole line is also
+// decoded into the event's document when they are configured.
+func (p *AuditProcessor) decode(line []byte, auditEvent *AuditEvent) error {
+	if err := decodeAuditEntry(line, auditEvent.entry, p.interner); err != nil {
+		*auditEvent.entry = AuditEntry{}
+		if err := json.Unmarshal(line, auditEvent.entry); err != nil {
+			return err
+		}
+	}
+	if auditEvent.entry.Request == nil {
+		return errMissingRequest
+	}
+	if p.expressions != nil {
+		return json.Unmarshal(line, &auditEvent.document)
+	}
+	return nil
+}
+
+// ingest parses an audit log line received from source into a typed AuditEvent to be queued for processing. It returns
+// nil if the line could not be parsed or was forwarded to the peer owning its request ID. Lines forwarded by a peer
+// were received, and measured, by that peer.
+func (p *AuditProcessor) ingest(line []byte, received time.Time, source string, forwarded bool) *AuditEvent {
+	auditEvent := newAuditEvent()
+	entry := auditEvent.entry
+	if err := p.decode(line, auditEvent); err != nil {
+		logError("error unmarshalling audit event", "source", source, "error", err)
+		p.counterParseErrors.Inc()
+		p.recordParse(forwarded, false)
+		if p.deadLetters != nil {
+			if err := p.deadLetters.Write(received, source, line, err); err != nil {
+				logError("error writing dead letter", "error", err)
+			}
+		}
+		auditEvent.release()
+		return nil
+	}
+
+	// parse the timestamp up front so that malformed events are rejected before they reach the caches
+	timestamp, err := time.Parse(time.RFC3339Nano, entry.Time)
+	if err != nil {
+		logError("error parsing audit event timestamp", "source", source, "time", entry.Time, "error", err)
+		p.counterTimestampErrors.Inc()
+		p.recordParse(forwarded, false)
+		auditEvent.release()
+		return nil
+	}
+	p.recordParse(forwarded, true)
+
+	if !forwarded {
+		// lag from Vault writing the entry to its receipt here, where skewed clocks may yield a negative lag
+		lag := received.Sub(timestamp)
+		if lag < 0 {
+			lag = 0
+		}
+		p.histogramDeliveryLag.WithLabelValues(entry.Type).Observe(lag.Seconds())
+
+		if p.peers != nil && p.peers.Forward(entry.Request.ID, line, received) {
+			auditEvent.release()
+			return nil
+		}
+	}
+	if p.receiptClock {
+		timestamp = received
+	}
+
+	auditEvent.time, auditEvent.received, auditEvent.queued = timestamp, received, time.Now()
+	if p.eventSinks != nil {
+		// the line is read into a buffer that is reused for the next line
+		auditEvent.line = append([]byte(nil), line...)
+	}
+	return auditEvent
+}
+
+// enqueue queues an audit event for the workers, so that reading connections doesn't wait on processing, applying the
+// overload policy when the queue is full. Events are dropped while memory use is close to its limit. Nothing is queued
+// for nil events, which ingest returns for lines it didn't accept.
+func (p *AuditProcessor) enqueue(auditEvent *AuditEvent) {
+	if auditEvent == nil {
+		return
+	}
+	if p.memory != nil && p.memory.Shedding() {
+		p.drop(auditEvent, "memory")
+		return
+	}
+	select {
+	case p.queue <- auditEvent:
+		return
+	default:
+	}
+
+	switch p.overloadPolicy {
+	case OverloadDropNewest:
+		p.drop(auditEvent, "queue_full")
+	case OverloadDropOldest:
+		for {
+			select {
+			case p.queue <- auditEvent:
+				return
+			default:
+			}
+			select {
+			case dropped := <-p.queue:
+				p.drop(dropped, "queue_full")
+			default:
+			}
+		}
+	default:
+		start := time.Now()
+		p.queue <- auditEvent
+		p.counterQueueBlocked.Add(time.Since(start).Seconds())
+	}
+}
 
-		// dispatch audit event processing to another thread so the connection can close without blocking
-		go p.process(&AuditEvent{entry: entry})
+// drop discards an audit event that isn't queued for a reason.
+func (p *AuditProcessor) drop(auditEvent *AuditEvent, reason string) {
+	p.counterEventsDropped.WithLabelValues(reason).Inc()
+	auditEvent.release()
+}
+
+// work processes queued audit events. In high-throughput mode, metric updates are aggregated in a shard of the worker's
+// own and merged into the shared metrics on a ticker.
+func (p *AuditProcessor) work() {
+	var shard *metricShard
+	var flush <-chan time.Time
+	if p.highThroughput {
+		shard = newMetricShard()
+		ticker := time.NewTicker(metricShardFlushInterval)
+		defer ticker.Stop()
+		defer shard.flush()
+		flush = ticker.C
+	}
+	for {
+		select {
+		case auditEvent, ok := <-p.queue:
+			if !ok {
+				return
+			}
+			shard.observe(p.histogramQueueWait, time.Since(auditEvent.queued).Seconds())
+			p.process(auditEvent, shard)
+			auditEvent.release()
+		case <-flush:
+			shard.flush()
+		}
+	}
+}
+
+// recordParse accounts for whether a line received from an audit device parsed, for readiness. Lines forwarded by a
+// peer were already accounted for by that peer.
+func (p *AuditProcessor) recordParse(forwarded, parsed bool) {
+	if p.parseErrors != nil && !forwarded {
+		p.parseErrors.Record(!parsed)
 	}
 }
 
-// process records Prometheus metrics from Vault audit log events.
-func (p *AuditProcessor) process(auditEvent *AuditEvent) {
+// enrich attaches derived labels to an audit event.
+func (p *AuditProcessor) enrich(auditEvent *AuditEvent) {
+	auditEvent.SetLabel("path", p.paths.Normalize(auditEvent.entry.Request.Path))
+	if p.kvV2OperationLabel {
+		auditEvent.SetLabel("kv_op", p.paths.KVv2Operation(auditEvent.entry.Request.Path))
+	}
+	if p.pathGroups != nil {
+		auditEvent.pathGroup = p.pathGroups.Group(auditEvent.entry.Request.Path)
+		auditEvent.SetLabel("path_group", auditEvent.pathGroup)
+	}
+	if p.mounts != nil {
+		mountPath, mountType, found := p.mounts.Lookup(auditEvent.entry.Request.Path)
+		if !found {
+			mountType = auditEvent.entry.Request.MountType
+		}
+		auditEvent.SetLabel("mount_path", mountPath)
+		auditEvent.SetLabel("mount_type", mountType)
+	}
+	if p.addresses != nil {
+		auditEvent.SetLabel("remote_address", p.addresses.Aggregate(auditEvent.entry.Request.RemoteAddr))
+	}
+	if p.geoIP != nil {
+		country, asn := p.geoIP.Lookup(auditEvent.entry.Request.RemoteAddr)
+		auditEvent.SetLabel("country", country)
+		auditEvent.SetLabel("asn", asn)
+	}
+	if p.identityLabels {
+		var name, groups string
+		if identity := auditEvent.identity; identity != nil {
+			name, groups = identity.Name, identity.groupsLabel
+		}
+		auditEvent.SetLabel("entity_name", name)
+		auditEvent.SetLabel("entity_groups", groups)
+	}
+}
+
+// process records Prometheus metrics from Vault audit log events, through shard if not nil.
+func (p *AuditProcessor) process(auditEvent *AuditEvent, shard *metricShard) {
+	defer func() {
+		if r := recover(); r != nil {
+			p.panicked(r, "processing audit event", "event", redactEntry(auditEvent.entry))
+		}
+	}()
+
+	if p.identities != nil && auditEvent.entry.Auth != nil {
+		auditEvent.identity = p.identities.Lookup(auditEvent.entry.Auth.EntityID)
+	}
+
+	// security, replication, lease, token, wrapping, KV lifecycle, and control group metrics, reports, and alerts cover
+	// every event, regardless of filters and sampling
+	p.rootTokens.Observe(auditEvent)
+	p.watchlist.Observe(auditEvent)
+	if p.credentials != nil {
+		p.credentials.Observe(auditEvent)
+	}
+	p.logins.Observe(auditEvent)
+	p.mfa.Observe(auditEvent)
+	p.configChanges.Observe(auditEvent)
+	p.operationalEvents.Observe(auditEvent)
+	p.privileged.Observe(auditEvent)
+	p.replication.Observe(auditEvent)
+	if p.schedules != nil {
+		p.schedules.Observe(auditEvent)
+	}
+	p.leases.Observe(auditEvent)
+	p.tokens.Observe(auditEvent)
+	p.wrapping.Observe(auditEvent)
+	p.kvLifecycle.Observe(auditEvent)
+	p.controlGroups.Observe(auditEvent)
+	if p.clients != nil {
+		p.clients.Observe(auditEvent)
+	}
+	if p.topTalkers != nil {
+		p.topTalkers.Observe(auditEvent)
+	}
+	if p.reports != nil {
+		p.reports.Observe(auditEvent)
+	}
+	if p.alerts != nil {
+		p.alerts.Observe(auditEvent)
+	}
+
+	if !p.filter.Match(auditEvent.entry) {
+		p.counterEventsDropped.WithLabelValues("filter").Inc()
+		return
+	}
+	keep, weight := p.sampler.Sample(auditEvent.entry)
+	if !keep {
+		p.counterEventsDropped.WithLabelValues("sampling").Inc()
+		return
+	}
+	auditEvent.weight = weight
+	if p.expressions != nil {
+		keep, route := p.expressions.Evaluate(auditEvent)
+		if !keep {
+			p.counterEventsDropped.WithLabelValues("expression").Inc()
+			return
+		}
+		auditEvent.SetLabel("route", route)
+	}
+
+	p.enrich(auditEvent)
+	if p.relabeler != nil && !p.relabeler.Apply(auditEvent.Labels()) {
+		p.counterEventsDropped.WithLabelValues("relabel").Inc()
+		return
+	}
+	if p.pathClasses != nil {
+		auditEvent.class = p.pathClasses.Classify(auditEvent.entry.Request.Path)
+		if auditEvent.class != nil {
+			for _, name := range auditEvent.class.dropLabels {
+				auditEvent.SetLabel(name, "")
+			}
+		}
+	}
+
+	if p.anomalies != nil {
+		p.anomalies.Observe(auditEvent)
+	}
+	if p.eventSinks != nil {
+		p.eventSinks.Observe(auditEvent)
+	}
+
 	switch auditEvent.entry.Type {
 
 	case AuditEventTypeRequest:
-		p.timestamps.Set(auditEvent.entry.Request.ID, auditEvent.entry.Time, 0)
-		obs, err := p.gagueRequests.GetMetricWith(auditEvent.PromLabels())
+		if p.correlation != nil {
+			p.correlation.Request()
+		}
+		ttl := p.requestTTL(auditEvent.entry.Request.Path)
+		duplicate, err := p.timestamps.Set(auditEvent.entry.Request.ID, auditEvent.time, ttl)
 		if err != nil {
-			log.Printf("error getting gagueRequests observer: %v\n", err)
+			logError("error storing request timestamp", "request_id", auditEvent.entry.Request.ID, "error", err)
+		} else {
+			shard.add(p.counterCacheSets, 1)
+		}
+		if duplicate {
+			p.counterDuplicateRequests.Inc()
+			if p.overwriteDuplicates {
+				p.counterCacheOverwrites.Inc()
+			}
+		}
+		if !p.matchPendingResponse(auditEvent.entry.Request.ID, shard) {
+			p.inFlight.Start(auditEvent, ttl)
+		}
+		labels := auditEvent.PromLabels(p.requestLabels)
+		obs, err := p.requestSeries.gauge(labels)
+		if err != nil {
+			logError("error getting gagueRequests observer", "error", err)
 			return
 		}
-		obs.Inc()
+		shard.add(obs, auditEvent.Weight())
+		p.countPolicies(auditEvent, shard)
+		p.processed(auditEvent, shard)
 
 	case AuditEventTypeResponse:
-		p.observeLatency(auditEvent)
-		obs, err := p.gagueResponses.GetMetricWith(auditEvent.PromLabels())
+		p.inFlight.Finish(auditEvent.entry.Request.ID)
+		if p.correlation == nil || p.correlation.Response() {
+			p.observeLatency(auditEvent, shard)
+		}
+		labels := auditEvent.PromLabels(p.responseLabels)
+		obs, err := p.responseSeries.gauge(labels)
 		if err != nil {
-			log.Printf("error getting gagueResponses observer: %v\n", err)
+			logError("error getting gagueResponses observer", "error", err)
 			return
 		}
-		obs.Inc()
+		shard.add(obs, auditEvent.Weight())
+		p.processed(auditEvent, shard)
 
 	default:
-		log.Printf("unknown audit event type: %s\n", auditEvent.entry.Type)
+		logWarn("unknown audit event type", "type", auditEvent.entry.Type)
+		p.counterUnknownTypes.Inc()
+	}
+}
+
+// panicked accounts for a panic recovered while performing a task, described by fields, so that a single malformed event
+// cannot take down the exporter.
+func (p *AuditProcessor) panicked(r interface{}, task string, fields ...interface{}) {
+	fields = append(fields, "panic", r, "stack", string(debug.Stack()))
+	logError("error "+task, fields...)
+	p.counterPanics.Inc()
+}
+
+// redactEntry describes an audit entry for logs by its type, request ID, operation, and path, leaving out its data.
+func redactEntry(entry *AuditEntry) string {
+	if entry.Request == nil {
+		return fmt.Sprintf("(type=%s)", entry.Type)
+	}
+	return fmt.Sprintf("(type=%s request_id=%s operation=%s path=%s)", entry.Type, entry.Request.ID,
+		entry.Request.Operation, entry.Request.Path)
+}
+
+// processed accounts for an audit event that was recorded in metrics.
+func (p *AuditProcessor) processed(auditEvent *AuditEvent, shard *metricShard) {
+	shard.add(p.counterEventsProcessed.WithLabelValues(auditEvent.entry.Type), 1)
+	shard.observe(p.histogramProcessingLag, time.Since(auditEvent.received).Seconds())
+}
+
+// countPolicies increments the per-policy request counter once for each policy attached to the requesting token.
+func (p *AuditProcessor) countPolicies(auditEvent *AuditEvent, shard *metricShard) {
+	if p.counterRequestsByPolicy == nil || auditEvent.entry.Auth == nil {
+		return
+	}
+	for _, policy := range auditEvent.entry.Auth.Policies {
+		obs, err := p.counterRequestsByPolicy.GetMetricWithLabelValues(policy)
+		if err != nil {
+			logError("error getting counterRequestsByPolicy observer", "error", err)
+			return
+		}
+		shard.add(obs, auditEvent.Weight())
 	}
 }
 
 // observeLatency calculates and records the latency between audit log requests and responses with matching IDs.
-func (p *AuditProcessor) observeLatency(auditEvent *AuditEvent) {
-	requestTimestamp, found := p.timestamps.Get(auditEvent.entry.Request.ID)
+// Responses that arrive before their request are buffered until the request arrives, if enabled.
+func (p *AuditProcessor) observeLatency(auditEvent *AuditEvent, shard *metricShard) {
+	countersOnly := auditEvent.class != nil && auditEvent.class.countersOnly
+
+	requestTime, found, err := p.takeRequestTime(auditEvent.entry.Request.ID, shard)
+	if err != nil {
+		logError("error loading request timestamp", "request_id", auditEvent.entry.Request.ID, "error", err)
+		return
+	}
 	if !found {
-		log.Printf("prior request not found for response with request id '%s'\n", auditEvent.entry.Request.ID)
+		if countersOnly || !p.bufferResponse(auditEvent, shard) {
+			p.unmatchedResponse(auditEvent.entry.Request.ID)
+		}
 		return
 	}
 
-	requestTime, err := time.Parse(time.RFC3339Nano, fmt.Sprint(requestTimestamp))
-	if err != nil {
-		log.Printf("error parsing request timestamp '%s': %v\n", requestTimestamp, err)
+	if countersOnly {
 		return
 	}
-	responseTime, err := time.Parse(time.RFC3339Nano, auditEvent.entry.Time)
+	p.recordLatency(auditEvent, requestTime, shard)
+}
+
+// takeRequestTime removes and returns the time of a request from the timestamp cache, counting hits and misses.
+func (p *AuditProcessor) takeRequestTime(id string, shard *metricShard) (time.Time, bool, error) {
+	requestTime, found, err := p.timestamps.Take(id)
 	if err != nil {
-		log.Printf("error parsing response timestamp '%s': %v\n", auditEvent.entry.Time, err)
-		return
+		return requestTime, found, err
+	}
+	if found {
+		shard.add(p.counterCacheHits, 1)
+	} else {
+		shard.add(p.counterCacheMisses, 1)
+	}
+	return requestTime, found, nil
+}
+
+// recordLatency records the latency between a request time and a response.
+func (p *AuditProcessor) recordLatency(auditEvent *AuditEvent, requestTime time.Time, shard *metricShard) {
+	series := p.latencySeries
+	if class := auditEvent.class; class != nil && class.histogram != nil {
+		series = class.series
 	}
 
-	observer, err := p.histogramLatency.GetMetricWith(auditEvent.PromLabels())
+	observer, err := series.observer(auditEvent.PromLabels(p.latencyLabels))
 	if err != nil {
-		log.Printf("error getting histogramLatency observer: %v\n", err)
+		logError("error getting histogramLatency observer", "error", err)
 		return
 	}
-	observer.Observe(responseTime.Sub(requestTime).Seconds())
+	latency := auditEvent.time.Sub(requestTime)
+	shard.observe(observer, latency.Seconds())
+	if p.slos != nil {
+		p.slos.Observe(auditEvent, latency)
+	}
+	if p.reports != nil {
+		p.reports.ObserveLatency(latency)
+	}
 }
 
 // monitorTimestampCache continuously updates a metric reflecting the number of items in the request timestamp cache.
+// Remote timestamp stores are not monitored.
 func (p *AuditProcessor) monitorTimestampCache() {
+	sized, ok := p.timestamps.(sizedStore)
+	if !ok {
+		return
+	}
 	for {
 		time.Sleep(10 * time.Second)
 		obs, err := p.gagueCacheSize.GetMetricWith(nil)
 		if err != nil {
-			log.Printf("error getting gagueCacheSize observer: %v\n", err)
+			logError("error getting gagueCacheSize observer", "error", err)
+		}
+		obs.Set(float64(sized.Len()))
+	}
+}
+
+// expireSeries continuously deletes series that have not been updated within the series TTL.
+func (p *AuditProcessor) expireSeries() {
+	for {
+		time.Sleep(p.seriesTTL / 4)
+		for _, series := range p.seriesTrackers {
+			series.expire()
 		}
-		obs.Set(float64(p.timestamps.ItemCount()))
 	}
 }
 
 // healthz is a health endpoint.
 func (p *AuditProcessor) healthz(w http.ResponseWriter, _ *http.Request) {
-	if _, err := w.Write([]byte(fmt.Sprintf(`{"timestamp_cache_size":%d}`, p.timestamps.ItemCount()))); err != nil {
-		log.Printf("error writing healthz response: %v", err)
+	size := -1
+	if sized, ok := p.timestamps.(sizedStore); ok {
+		size = sized.Len()
+	}
+	if _, err := w.Write([]byte(fmt.Sprintf(`{"timestamp_cache_size":%d}`, size))); err != nil {
+		logError("error writing healthz response", "error", err)
+	}
+}
+
+// readyz reports whether the exporter is ready, which it is not while audit log lines persistently fail to parse.
+func (p *AuditProcessor) readyz(w http.ResponseWriter, _ *http.Request) {
+	body := `{"ready":true}`
+	if p.parseErrors != nil {
+		if ready, reason := p.parseErrors.Ready(); !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			body = fmt.Sprintf(`{"ready":false,"reason":%q}`, reason)
+		}
+	}
+	if _, err := w.Write([]byte(body)); err != nil {
+		logError("error writing readyz response", "error", err)
 	}
 }
 
@@ -181,13 +1435,115 @@ func (p *AuditProcessor) Start() error {
 	// Start the HTTP endpoint
 	http.Handle("/metrics", promhttp.Handler())
 	http.HandleFunc("/healthz", p.healthz)
+	http.HandleFunc("/readyz", p.readyz)
+	if p.topTalkers != nil {
+		http.Handle("/top-talkers", p.topTalkers)
+	}
 	go func() {
-		log.Fatalln(http.ListenAndServe(p.httpAddr, nil))
+		logFatal("error serving HTTP", "addr", p.httpAddr, "error", http.ListenAndServe(p.httpAddr, nil))
 	}()
 
+	// process audit events on a bounded number of workers
+	for i := 0; i < p.workers; i++ {
+		go p.work()
+	}
+
 	// keep timestamp cache metrics up to date
 	go p.monitorTimestampCache()
 
+	// keep the mount table in sync with Vault
+	if p.mounts != nil {
+		go p.mounts.Run(p.mountRefresh)
+	}
+
+	// resolve the entities of audit events
+	if p.identities != nil {
+		go p.identities.Run()
+	}
+
+	// forget in-flight requests whose response never arrived
+	go p.inFlight.Run(p.inFlightCleanup)
+
+	// fail readiness while audit log lines persistently fail to parse
+	if p.parseErrors != nil {
+		go p.parseErrors.Run()
+	}
+
+	// stop correlating responses while no requests are received
+	if p.correlation != nil {
+		go p.correlation.Run(p.correlationCheck)
+	}
+
+	// detect audit devices that stop sending events
+	if p.sources != nil {
+		go p.sources.Run()
+	}
+
+	// keep memory use within -max-memory
+	if p.memory != nil {
+		go p.memory.Run()
+	}
+
+	// forget sources without recent failed logins
+	if p.logins.threshold > 0 {
+		go p.logins.Run()
+	}
+
+	// keep SLO burn rates up to date
+	if p.slos != nil {
+		go p.slos.Run()
+	}
+
+	// count wrapping tokens that expire without being unwrapped
+	go p.wrapping.Run()
+
+	// count control group requests that expire without being approved
+	go p.controlGroups.Run()
+
+	// keep active client estimates up to date
+	if p.clients != nil {
+		go p.clients.Run()
+	}
+
+	// keep top talker gauges up to date
+	if p.topTalkers != nil {
+		go p.topTalkers.Run()
+	}
+
+	// score the rates of path groups against their baselines
+	if p.anomalies != nil {
+		go p.anomalies.Run()
+	}
+
+	// forget lapsed alert throttling
+	if p.alerts != nil {
+		go p.alerts.Run()
+	}
+
+	// generate reports on their schedules
+	if p.reports != nil {
+		p.reports.Run()
+	}
+
+	// push metrics to backends that don't scrape them
+	if p.metricSinks != nil {
+		p.metricSinks.Run()
+	}
+
+	// exchange events with peers, so that requests and responses meet on the instance owning their ID
+	if p.peers != nil {
+		p.peers.Run()
+		go func() {
+			err := p.peers.Serve(func(line []byte, received time.Time) { p.enqueue(p.ingest(line, received, "", true)) })
+			logFatal("error serving peers", "error", err)
+		}()
+	}
+
+	// delete idle series so scrape sizes stay bounded
+	if p.seriesTTL > 0 {
+		go p.expireSeries()
+	}
+
 	// Create audit log processing server
 	listener, err := net.Listen(p.auditNetwork, p.auditAddr)
 	if err != nil {
@@ -203,7 +1559,7 @@ func (p *AuditProcessor) Start() error {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Printf("error accepting connection: %v\n", err)
+			logError("error accepting connection", "error", err)
 			continue
 		}
 		go p.handle(conn)
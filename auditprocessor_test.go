@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	testAuditProcessorOnce sync.Once
+	testAuditProcessor     *AuditProcessor
+	testAuditProcessorErr  error
+)
+
+// newTestAuditProcessor returns an AuditProcessor with the default configuration that logs nowhere. Its metrics are
+// registered with the default registry, so it is constructed once and shared by all tests and benchmarks.
+func newTestAuditProcessor(tb testing.TB) *AuditProcessor {
+	testAuditProcessorOnce.Do(func() {
+		logger = &Logger{severity: logLevelSeverities[LogLevelInfo], out: ioutil.Discard}
+		testAuditProcessor, testAuditProcessorErr = NewAuditProcessor(&Config{
+			CacheTTL:            10 * time.Minute,
+			CacheCleanup:        time.Minute,
+			DuplicateRequestIDs: DuplicateLastWins,
+			LatencyClock:        LatencyClockVault,
+			OverloadPolicy:      OverloadBlock,
+			Workers:             1,
+		})
+	})
+	if testAuditProcessorErr != nil {
+		tb.Fatal(testAuditProcessorErr)
+	}
+	return testAuditProcessor
+}
+
+// BenchmarkIngest measures reading, decoding, and processing the lines of the test audit log like the handler of an
+// audit device connection and a worker do, without the queue between them. Each operation processes the whole log.
+func BenchmarkIngest(b *testing.B) {
+	p := newTestAuditProcessor(b)
+	log, err := ioutil.ReadFile("test/vault-audit.log")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(log)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reader := newLineReader(bytes.NewReader(log), p.maxLineBytes)
+		for {
+			line, _, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+			if auditEvent := p.ingest(line, time.Now(), "benchmark", false); auditEvent != nil {
+				p.process(auditEvent, nil)
+				auditEvent.release()
+			}
+		}
+		reader.release()
+	}
+}
+
+// TestIngestMissingRequest checks that lines without a request are counted as parse errors rather than queued.
+func TestIngestMissingRequest(t *testing.T) {
+	p := newTestAuditProcessor(t)
+	for _, line := range []string{
+		`null`,
+		`{}`,
+		`{"time":"2022-03-01T10:00:00Z","type":"request"}`,
+		`{"time":"2022-03-01T10:00:00Z","type":"response","request":null,"response":{}}`,
+	} {
+		errors := counterValue(t, p.counterParseErrors)
+		if auditEvent := p.ingest([]byte(line), time.Now(), "test", false); auditEvent != nil {
+			t.Errorf("ingesting %s: queued an event without a request", line)
+		}
+		if got := counterValue(t, p.counterParseErrors) - errors; got != 1 {
+			t.Errorf("ingesting %s: counted %v parse errors, want 1", line, got)
+		}
+	}
+}
+
+// counterValue returns the current value of a counter.
+func counterValue(t *testing.T, counter prometheus.Counter) float64 {
+	t.Helper()
+	var metric dto.Metric
+	if err := counter.Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetCounter().GetValue()
+}
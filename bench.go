@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// bench ingests audit log files as fast as possible through the pipeline configured by cfg and prints a report of its
+// performance, to make regressions visible between releases, then sends the events to the configured event sinks and
+// pushes the resulting metrics to the configured metric sinks, so that it also serves for backfills. Lines are sent
+// over a loopback connection, so that they take the same path as lines written by an audit device. It returns the
+// process exit code.
+func bench(cfg *Config, files []string) int {
+	if len(files) == 0 {
+		logError("no audit log files given to benchmark")
+		return 2
+	}
+	p, err := NewAuditProcessor(cfg)
+	if err != nil {
+		logError("error creating audit processor", "error", err)
+		return 1
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		logError("error listening for audit log connections", "error", err)
+		return 1
+	}
+	defer func() {
+		if err := listener.Close(); err != nil {
+			logError("error closing listener", "error", err)
+		}
+	}()
+
+	var workers sync.WaitGroup
+	for i := 0; i < p.workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			p.work()
+		}()
+	}
+
+	// sample the heap while ingesting, since it shrinks again once the run is over
+	var peakHeap uint64
+	sampled := make(chan struct{})
+	stop := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+		var stats runtime.MemStats
+		for {
+			runtime.ReadMemStats(&stats)
+			if stats.HeapAlloc > peakHeap {
+				peakHeap = stats.HeapAlloc
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	for _, path := range files {
+		if err := p.benchFile(listener, path); err != nil {
+			logError("error sending audit log file", "path", path, "error", err)
+			return 1
+		}
+	}
+	close(p.queue)
+	workers.Wait()
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+	close(stop)
+	<-sampled
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		logError("error gathering metrics", "error", err)
+		return 1
+	}
+	value := func(name string, labels ...string) float64 {
+		var sum float64
+		for _, family := range families {
+			if family.GetName() != name {
+				continue
+			}
+		metrics:
+			for _, metric := range family.GetMetric() {
+				for i := 0; i+1 < len(labels); i += 2 {
+					found := false
+					for _, label := range metric.GetLabel() {
+						found = found || label.GetName() == labels[i] && label.GetValue() == labels[i+1]
+					}
+					if !found {
+						continue metrics
+					}
+				}
+				sum += metric.GetCounter().GetValue() + metric.GetGauge().GetValue()
+			}
+		}
+		return sum
+	}
+	lines := value(PromNamespace + "_pipeline_lines_received_total")
+	bytes := value(PromNamespace + "_pipeline_bytes_received_total")
+	processed := value(PromNamespace + "_pipeline_events_processed_total")
+	responses := value(PromNamespace+"_pipeline_events_processed_total", "type", AuditEventTypeResponse)
+	matched := value(PromNamespace + "_cache_hits_total")
+	parseErrors := value(PromNamespace+"_pipeline_parse_errors_total") + value(PromNamespace+"_events_timestamp_parse_errors_total")
+	dropped := value(PromNamespace + "_pipeline_events_dropped_total")
+	if peakHeap < after.HeapAlloc {
+		peakHeap = after.HeapAlloc
+	}
+
+	matchRate := 0.0
+	if responses > 0 {
+		matchRate = 100 * matched / responses
+	}
+	allocs := 0.0
+	if lines > 0 {
+		allocs = float64(after.Mallocs-before.Mallocs) / lines
+	}
+	fmt.Printf("ingested %.0f lines (%.1f MiB) in %s\n", lines, bytes/(1<<20), elapsed.Round(time.Millisecond))
+	fmt.Printf("throughput:   %.0f events/s, %.1f MiB/s\n", lines/elapsed.Seconds(), bytes/(1<<20)/elapsed.Seconds())
+	fmt.Printf("allocations:  %.1f per event, %.0f bytes per event\n", allocs,
+		float64(after.TotalAlloc-before.TotalAlloc)/lines)
+	fmt.Printf("correlation:  %.1f%% of %.0f responses matched their request\n", matchRate, responses)
+	fmt.Printf("events:       %.0f processed, %.0f dropped, %.0f failed to parse\n", processed, dropped, parseErrors)
+	fmt.Printf("peak memory:  %.1f MiB heap, %.1f MiB obtained from the OS\n", float64(peakHeap)/(1<<20),
+		float64(after.Sys)/(1<<20))
+
+	// a batch run ends before the periodic pushes would, so its events are sent and its metrics are pushed once all
+	// files were ingested, failing the run if the metrics can't be, with the errors logged for each sink
+	if p.eventSinks != nil {
+		p.eventSinks.Flush()
+	}
+	if p.metricSinks != nil && p.metricSinks.Flush() != nil {
+		return 1
+	}
+	return 0
+}
+
+// benchFile sends an audit log file over a connection accepted from listener and waits until it has been read.
+func (p *AuditProcessor) benchFile(listener net.Listener, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	handled := make(chan struct{})
+	go func() {
+		defer close(handled)
+		conn, err := listener.Accept()
+		if err != nil {
+			logError("error accepting connection", "error", err)
+			return
+		}
+		p.handle(conn)
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(conn, file)
+	if closeErr := conn.Close(); err == nil {
+		err = closeErr
+	}
+	<-handled
+	return err
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// hllPrecision is the number of hash bits selecting a HyperLogLog register, giving 4096 registers and a standard
+	// error of about 1.6%.
+	hllPrecision = 12
+	hllRegisters = 1 << hllPrecision
+
+	// clientUpdateInterval is the interval at which the active client gauges are updated.
+	clientUpdateInterval = 15 * time.Second
+)
+
+// clientWindows are the windows distinct clients are estimated over. Each window is covered by a ring of sketches of
+// equal intervals, so it slides by one interval at a time.
+var clientWindows = []struct {
+	name     string
+	interval time.Duration
+	count    int
+}{
+	{"5m", time.Minute, 5},
+	{"1h", 10 * time.Minute, 6},
+	{"24h", time.Hour, 24},
+}
+
+// ClientEstimator estimates the number of distinct clients making requests, per namespace and auth method, with
+// HyperLogLog sketches. Like Vault's client count, a client is an identity entity, or the token accessor for tokens
+// without an entity. The auth method is the prefix of the token's display name, which Vault derives from the path of the
+// auth mount that issued the token, such as "userpass" for "userpass-alice", "token" for tokens created directly, and
+// "root" for root tokens.
+type ClientEstimator struct {
+	mu      sync.RWMutex
+	clients map[clientKey]*clientSketches
+
+	gagueClients *prometheus.GaugeVec
+}
+
+type clientKey struct {
+	namespace, method string
+}
+
+// clientSketches holds a ring of sketches for each client window, along with the time of the last request.
+type clientSketches struct {
+	mu       sync.Mutex
+	windows  [][]clientSketch
+	lastSeen time.Time
+}
+
+// clientSketch is the HyperLogLog sketch of the clients of one interval, identified by the interval's index since the
+// Unix epoch.
+type clientSketch struct {
+	index     int64
+	registers []uint8
+}
+
+// NewClientEstimator constructs a ClientEstimator.
+func NewClientEstimator() *ClientEstimator {
+	return &ClientEstimator{
+		clients: make(map[clientKey]*clientSketches),
+		gagueClients: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: PromNamespace,
+			Subsystem: "clients",
+			Name:      "active",
+			Help:      "Estimated number of distinct entities, and token accessors of tokens without an entity, that made requests within a window. Partitioned by namespace, auth method, and window.",
+		},
+			[]string{"namespace", "auth_method", "window"}),
+	}
+}
+
+func (e *ClientEstimator) collectors() []prometheus.Collector {
+	return []prometheus.Collector{e.gagueClients}
+}
+
+// clientAuthMethod returns the auth method of a token from its display name.
+func clientAuthMethod(displayName string) string {
+	if i := strings.IndexByte(displayName, '-'); i >= 0 {
+		return displayName[:i]
+	}
+	return displayName
+}
+
+// Observe adds the client of a request to the sketches of its namespace and auth method. Requests without a token, such
+// as logins, are ignored.
+func (e *ClientEstimator) Observe(auditEvent *AuditEvent) {
+	entry := auditEvent.entry
+	if entry.Type != AuditEventTypeRequest || entry.Request == nil || entry.Auth == nil {
+		return
+	}
+	client := entry.Auth.EntityID
+	if client == "" {
+		client = entry.Auth.Accessor
+	}
+	if client == "" {
+		return
+	}
+	key := clientKey{method: clientAuthMethod(entry.Auth.DisplayName)}
+	if entry.Request.Namespace != nil {
+		key.namespace = entry.Request.Namespace.ID
+	}
+
+	e.mu.RLock()
+	sketches := e.clients[key]
+	e.mu.RUnlock()
+	if sketches == nil {
+		e.mu.Lock()
+		if sketches = e.clients[key]; sketches == nil {
+			sketches = newClientSketches()
+			e.clients[key] = sketches
+		}
+		e.mu.Unlock()
+	}
+	sketches.add(time.Now(), hash64(client))
+}
+
+func newClientSketches() *clientSketches {
+	s := &clientSketches{windows: make([][]clientSketch, len(clientWindows))}
+	for i, window := range clientWindows {
+		s.windows[i] = make([]clientSketch, window.count)
+	}
+	return s
+}
+
+// add adds a hashed client to the sketch of the current interval of each window.
+func (s *clientSketches) add(now time.Time, hash uint64) {
+	register := hash >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(hash<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSeen = now
+	for i, window := range clientWindows {
+		index := now.UnixNano() / int64(window.interval)
+		sketch := &s.windows[i][index%int64(window.count)]
+		if sketch.index != index || sketch.registers == nil {
+			sketch.index = index
+			if sketch.registers == nil {
+				sketch.registers = make([]uint8, hllRegisters)
+			} else {
+				for r := range sketch.registers {
+					sketch.registers[r] = 0
+				}
+			}
+		}
+		if rank > sketch.registers[register] {
+			sketch.registers[register] = rank
+		}
+	}
+}
+
+// estimate returns the estimated number of distinct clients within the window with the given index in clientWindows.
+func (s *clientSketches) estimate(now time.Time, window int) float64 {
+	interval, count := clientWindows[window].interval, int64(clientWindows[window].count)
+	current := now.UnixNano() / int64(interval)
+	merged := make([]uint8, hllRegisters)
+	s.mu.Lock()
+	for _, sketch := range s.windows[window] {
+		if sketch.registers == nil || sketch.index <= current-count || sketch.index > current {
+			continue
+		}
+		for r, rank := range sketch.registers {
+			if rank > merged[r] {
+				merged[r] = rank
+			}
+		}
+	}
+	s.mu.Unlock()
+	return hllEstimate(merged)
+}
+
+// hllEstimate returns the HyperLogLog cardinality estimate of registers, using linear counting for small cardinalities.
+func hllEstimate(registers []uint8) float64 {
+	m := float64(len(registers))
+	var sum float64
+	var zeros int
+	for _, rank := range registers {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		return m * math.Log(m/float64(zeros))
+	}
+	return estimate
+}
+
+// hash64 hashes a client ID with 64-bit FNV-1a, followed by the finalizer of MurmurHash3 to spread its bits evenly, as
+// HyperLogLog requires.
+func hash64(s string) uint64 {
+	const (
+		offset64 = 14695981039346656037
+		prime64  = 1099511628211
+	)
+	hash := uint64(offset64)
+	for i := 0; i < len(s); i++ {
+		hash ^= uint64(s[i])
+		hash *= prime64
+	}
+	hash ^= hash >> 33
+	hash *= 0xff51afd7ed558ccd
+	hash ^= hash >> 33
+	hash *= 0xc4ceb9fe1a85ec53
+	hash ^= hash >> 33
+	return hash
+}
+
+// Run continuously updates the active client gauges, forgetting namespaces and auth methods without requests within the
+// longest window.
+func (e *ClientEstimator) Run() {
+	longest := clientWindows[len(clientWindows)-1]
+	for {
+		time.Sleep(clientUpdateInterval)
+		now := time.Now()
+		e.mu.Lock()
+		for key, sketches := range e.clients {
+			sketches.mu.Lock()
+			idle := now.Sub(sketches.lastSeen) > longest.interval*time.Duration(longest.count)
+			sketches.mu.Unlock()
+			if idle {
+				delete(e.clients, key)
+				for _, window := range clientWindows {
+					e.gagueClients.DeleteLabelValues(key.namespace, key.method, window.name)
+				}
+			}
+		}
+		clients := make(map[clientKey]*clientSketches, len(e.clients))
+		for key, sketches := range e.clients {
+			clients[key] = sketches
+		}
+		e.mu.Unlock()
+
+		for key, sketches := range clients {
+			for i, window := range clientWindows {
+				e.gagueClients.WithLabelValues(key.namespace, key.method, window.name).Set(sketches.estimate(now, i))
+			}
+		}
+	}
+}
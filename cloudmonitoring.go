@@ -0,0 +1,558 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	// defaultCloudMonitoringURL is the endpoint of the Cloud Monitoring API if unset.
+	defaultCloudMonitoringURL = "https://monitoring.googleapis.com"
+	// defaultCloudMonitoringPrefix is the prefix of the types of metric descriptors if unset.
+	defaultCloudMonitoringPrefix = "custom.googleapis.com/vault-audit-metrics/"
+	// cloudMonitoringMaxSeries is the largest number of time series written per request, as limited by the API.
+	cloudMonitoringMaxSeries = 200
+	// cloudMonitoringMinInterval is the shortest time between points of a time series that the API accepts.
+	cloudMonitoringMinInterval = 5 * time.Second
+	// cloudMonitoringMinPushInterval is the shortest push interval, leaving a margin over cloudMonitoringMinInterval so
+	// that periodic pushes are never too close.
+	cloudMonitoringMinPushInterval = 10 * time.Second
+	// cloudMonitoringScope is the OAuth scope required to create metric descriptors and write time series.
+	cloudMonitoringScope = "https://www.googleapis.com/auth/monitoring.write"
+	// defaultGCEMetadataHost is the host of the metadata server of Google Cloud compute environments, which
+	// GCE_METADATA_HOST overrides.
+	defaultGCEMetadataHost = "metadata.google.internal"
+)
+
+// cloudMonitoringSink writes metrics to Google Cloud Monitoring (formerly Stackdriver) as custom metrics, creating the
+// metric descriptor of every family, with its labels and help text, before writing its first time series. Counters
+// become cumulative metrics, with start times that move forward when a counter is reset, gauges become gauge metrics,
+// and histograms become cumulative distributions with their buckets as explicit bounds, while summaries are left out,
+// since their quantiles can't be aggregated. Time series are written for a generic_node monitored resource by default,
+// identifying the host, so that replicas don't write to the same series. Credentials are those of a service account
+// key file, or of the metadata server when running on Google Cloud.
+type cloudMonitoringSink struct {
+	url      string
+	project  string
+	prefix   string
+	resource cloudMonitoringResource
+	metrics  map[string]bool
+	client   *http.Client
+	tokens   *googleTokenSource
+
+	// descriptors holds the labels of the metric descriptors created so far by their type.
+	descriptors map[string]map[string]bool
+	// series holds the start times and latest values of cumulative time series, to detect resets.
+	series map[string]*cloudMonitoringCumulative
+	seen   map[string]bool
+	start  time.Time
+	// previous is the time of the previous push.
+	previous time.Time
+}
+
+// cloudMonitoringResource is the monitored resource that time series are written for.
+type cloudMonitoringResource struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels"`
+}
+
+// cloudMonitoringCumulative is the state of a cumulative time series.
+type cloudMonitoringCumulative struct {
+	start time.Time
+	value float64
+}
+
+// cloudMonitoringTimeSeries is a time series with a single point, as written by the API.
+type cloudMonitoringTimeSeries struct {
+	Metric struct {
+		Type   string            `json:"type"`
+		Labels map[string]string `json:"labels,omitempty"`
+	} `json:"metric"`
+	Resource   cloudMonitoringResource `json:"resource"`
+	MetricKind string                  `json:"metricKind"`
+	ValueType  string                  `json:"valueType"`
+	Points     []cloudMonitoringPoint  `json:"points"`
+}
+
+type cloudMonitoringPoint struct {
+	Interval struct {
+		StartTime string `json:"startTime,omitempty"`
+		EndTime   string `json:"endTime"`
+	} `json:"interval"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func newCloudMonitoringSink(cfg MetricSinkConfig) (*cloudMonitoringSink, error) {
+	s := &cloudMonitoringSink{
+		url:         strings.TrimSuffix(cfg.URL, "/"),
+		project:     cfg.Project,
+		prefix:      cfg.Prefix,
+		client:      &http.Client{Timeout: sinkTimeout},
+		descriptors: make(map[string]map[string]bool),
+		series:      make(map[string]*cloudMonitoringCumulative),
+		seen:        make(map[string]bool),
+		start:       time.Now(),
+	}
+	if s.url == "" {
+		s.url = defaultCloudMonitoringURL
+	}
+	if !strings.HasPrefix(s.url, "http://") && !strings.HasPrefix(s.url, "https://") {
+		return nil, fmt.Errorf("an http or https url is required")
+	}
+	if s.prefix == "" {
+		s.prefix = defaultCloudMonitoringPrefix
+	}
+	if cfg.Interval < cloudMonitoringMinPushInterval {
+		return nil, fmt.Errorf("interval must be at least %s", cloudMonitoringMinPushInterval)
+	}
+
+	credentials := cfg.CredentialsFile
+	if credentials == "" {
+		credentials = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	tokens, keyProject, err := newGoogleTokenSource(credentials, s.client)
+	if err != nil {
+		return nil, err
+	}
+	s.tokens = tokens
+	if s.project == "" {
+		s.project = keyProject
+	}
+
+	s.resource = cloudMonitoringResource{Type: cfg.ResourceType, Labels: make(map[string]string)}
+	if s.resource.Type == "" {
+		s.resource.Type = "generic_node"
+		s.resource.Labels["location"] = "global"
+		s.resource.Labels["namespace"] = "vault-audit-metrics"
+		if hostname, err := os.Hostname(); err == nil {
+			s.resource.Labels["node_id"] = hostname
+		}
+	}
+	for name, value := range cfg.ResourceAttributes {
+		s.resource.Labels[name] = value
+	}
+	if len(cfg.Metrics) > 0 {
+		s.metrics = make(map[string]bool)
+		for _, name := range cfg.Metrics {
+			s.metrics[name] = true
+		}
+	}
+	return s, nil
+}
+
+func (s *cloudMonitoringSink) push(families []*dto.MetricFamily, now time.Time) error {
+	// the push on shutdown may follow a periodic push too closely for the API to accept its points
+	if now.Sub(s.previous) < cloudMonitoringMinInterval {
+		return nil
+	}
+	if s.project == "" {
+		project, err := s.tokens.metadata("project/project-id")
+		if err != nil {
+			return fmt.Errorf("error looking up the project: %v", err)
+		}
+		s.project = project
+	}
+	token, err := s.tokens.token()
+	if err != nil {
+		return fmt.Errorf("error obtaining an access token: %v", err)
+	}
+	headers := map[string]string{"Authorization": "Bearer " + token}
+	end := now.UTC().Format(time.RFC3339Nano)
+
+	var series []cloudMonitoringTimeSeries
+	for _, family := range families {
+		name := family.GetName()
+		if s.metrics != nil && !s.metrics[name] {
+			continue
+		}
+		typ := metricType(family)
+		if typ == dto.MetricType_SUMMARY {
+			// quantiles can't be aggregated across time series, which is all that Cloud Monitoring does
+			continue
+		}
+		metricKind, valueType := "GAUGE", "DOUBLE"
+		switch typ {
+		case dto.MetricType_COUNTER:
+			metricKind = "CUMULATIVE"
+		case dto.MetricType_HISTOGRAM:
+			metricKind, valueType = "CUMULATIVE", "DISTRIBUTION"
+		}
+		labels := make(map[string]bool)
+		for _, m := range family.Metric {
+			for _, label := range m.Label {
+				labels[label.GetName()] = true
+			}
+		}
+		if err := s.createDescriptor(family, metricKind, valueType, labels, headers); err != nil {
+			return fmt.Errorf("error creating the metric descriptor of %s: %v", name, err)
+		}
+
+		for _, m := range family.Metric {
+			timeSeries := cloudMonitoringTimeSeries{Resource: s.resource, MetricKind: metricKind, ValueType: valueType}
+			timeSeries.Metric.Type = s.prefix + name
+			for _, label := range m.Label {
+				if label.GetValue() != "" {
+					if timeSeries.Metric.Labels == nil {
+						timeSeries.Metric.Labels = make(map[string]string, len(m.Label))
+					}
+					timeSeries.Metric.Labels[label.GetName()] = label.GetValue()
+				}
+			}
+			var point cloudMonitoringPoint
+			point.Interval.EndTime = end
+			switch typ {
+			case dto.MetricType_COUNTER:
+				value := metricValue(m)
+				if math.IsNaN(value) || math.IsInf(value, 0) {
+					continue
+				}
+				point.Interval.StartTime = s.startTime(seriesKey(name, m.Label), value, now)
+				point.Value = map[string]interface{}{"doubleValue": value}
+			case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+				value := metricValue(m)
+				if math.IsNaN(value) || math.IsInf(value, 0) {
+					continue
+				}
+				point.Value = map[string]interface{}{"doubleValue": value}
+			case dto.MetricType_HISTOGRAM:
+				histogram := m.GetHistogram()
+				count := histogram.GetSampleCount()
+				point.Interval.StartTime = s.startTime(seriesKey(name, m.Label), float64(count), now)
+				point.Value = map[string]interface{}{"distributionValue": cloudMonitoringDistribution(histogram)}
+			}
+			timeSeries.Points = []cloudMonitoringPoint{point}
+			series = append(series, timeSeries)
+		}
+	}
+	s.sweep()
+	s.previous = now
+
+	for start := 0; start < len(series); start += cloudMonitoringMaxSeries {
+		end := start + cloudMonitoringMaxSeries
+		if end > len(series) {
+			end = len(series)
+		}
+		body, err := json.Marshal(map[string]interface{}{"timeSeries": series[start:end]})
+		if err != nil {
+			return err
+		}
+		if err := postSink(s.client, s.url+"/v3/projects/"+url.PathEscape(s.project)+"/timeSeries", "application/json",
+			headers, body, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createDescriptor creates the metric descriptor of a family, unless one with all of labels was created before. Labels
+// that weren't seen yet, such as of optional features, are added by creating the descriptor again.
+func (s *cloudMonitoringSink) createDescriptor(family *dto.MetricFamily, metricKind, valueType string,
+	labels map[string]bool, headers map[string]string) error {
+	typ := s.prefix + family.GetName()
+	created := s.descriptors[typ]
+	missing := created == nil
+	for label := range labels {
+		missing = missing || !created[label]
+	}
+	if !missing {
+		return nil
+	}
+	all := make(map[string]bool, len(labels)+len(created))
+	for label := range created {
+		all[label] = true
+	}
+	for label := range labels {
+		all[label] = true
+	}
+	type labelDescriptor struct {
+		Key       string `json:"key"`
+		ValueType string `json:"valueType"`
+	}
+	descriptor := struct {
+		Type        string            `json:"type"`
+		MetricKind  string            `json:"metricKind"`
+		ValueType   string            `json:"valueType"`
+		Unit        string            `json:"unit"`
+		Description string            `json:"description"`
+		DisplayName string            `json:"displayName"`
+		Labels      []labelDescriptor `json:"labels"`
+	}{
+		Type:        typ,
+		MetricKind:  metricKind,
+		ValueType:   valueType,
+		Unit:        cloudMonitoringUnit(family.GetName()),
+		Description: family.GetHelp(),
+		DisplayName: family.GetName(),
+		Labels:      []labelDescriptor{},
+	}
+	for label := range all {
+		descriptor.Labels = append(descriptor.Labels, labelDescriptor{Key: label, ValueType: "STRING"})
+	}
+	sort.Slice(descriptor.Labels, func(i, j int) bool { return descriptor.Labels[i].Key < descriptor.Labels[j].Key })
+	body, err := json.Marshal(descriptor)
+	if err != nil {
+		return err
+	}
+	if err := postSink(s.client, s.url+"/v3/projects/"+url.PathEscape(s.project)+"/metricDescriptors",
+		"application/json", headers, body, false); err != nil {
+		return err
+	}
+	s.descriptors[typ] = all
+	return nil
+}
+
+// startTime returns the start time of the point of a cumulative time series. A series starts with the sink, and again
+// with the previous push when its value went down, which is a reset such as by deleting the series.
+func (s *cloudMonitoringSink) startTime(key string, value float64, now time.Time) string {
+	s.seen[key] = true
+	series := s.series[key]
+	switch {
+	case series == nil:
+		series = &cloudMonitoringCumulative{start: s.start}
+		s.series[key] = series
+	case value < series.value:
+		series.start = s.previous
+	}
+	series.value = value
+	// the start time of a cumulative point must be before its end time
+	if !series.start.Before(now) {
+		series.start = now.Add(-time.Millisecond)
+	}
+	return series.start.UTC().Format(time.RFC3339Nano)
+}
+
+// sweep forgets the cumulative time series that weren't seen since the previous sweep.
+func (s *cloudMonitoringSink) sweep() {
+	for key := range s.series {
+		if !s.seen[key] {
+			delete(s.series, key)
+		}
+	}
+	s.seen = make(map[string]bool, len(s.series))
+}
+
+// cloudMonitoringDistribution returns the distribution value of a histogram. Cloud Monitoring counts observations per
+// bucket rather than cumulatively, with an underflow bucket below the first bound and an overflow bucket above the
+// last.
+func cloudMonitoringDistribution(histogram *dto.Histogram) map[string]interface{} {
+	var bounds []float64
+	var counts []string
+	var previous uint64
+	for _, bucket := range histogram.Bucket {
+		if math.IsInf(bucket.GetUpperBound(), 1) {
+			continue
+		}
+		bounds = append(bounds, bucket.GetUpperBound())
+		counts = append(counts, strconv.FormatUint(bucket.GetCumulativeCount()-previous, 10))
+		previous = bucket.GetCumulativeCount()
+	}
+	counts = append(counts, strconv.FormatUint(histogram.GetSampleCount()-previous, 10))
+	var mean float64
+	if histogram.GetSampleCount() > 0 {
+		mean = histogram.GetSampleSum() / float64(histogram.GetSampleCount())
+	}
+	return map[string]interface{}{
+		"count":         strconv.FormatUint(histogram.GetSampleCount(), 10),
+		"mean":          mean,
+		"bucketOptions": map[string]interface{}{"explicitBuckets": map[string]interface{}{"bounds": bounds}},
+		"bucketCounts":  counts,
+	}
+}
+
+// cloudMonitoringUnit returns the unit of a metric by the Prometheus naming convention.
+func cloudMonitoringUnit(name string) string {
+	name = strings.TrimSuffix(name, "_total")
+	switch {
+	case strings.HasSuffix(name, "_seconds"):
+		return "s"
+	case strings.HasSuffix(name, "_bytes"):
+		return "By"
+	}
+	return "1"
+}
+
+// googleTokenSource obtains OAuth access tokens for Google APIs, by signing a JWT with the key of a service account key
+// file, or from the metadata server of Google Cloud compute environments without one. Tokens are cached until shortly
+// before they expire.
+type googleTokenSource struct {
+	client *http.Client
+	// email, key, and tokenURI are those of the service account key file, or empty to use the metadata server.
+	email    string
+	key      *rsa.PrivateKey
+	keyID    string
+	tokenURI string
+
+	cached  string
+	expires time.Time
+}
+
+// newGoogleTokenSource constructs a googleTokenSource with the service account key file at path, or the metadata server
+// if path is empty, and returns the project of the key file.
+func newGoogleTokenSource(path string, client *http.Client) (*googleTokenSource, string, error) {
+	s := &googleTokenSource{client: client}
+	if path == "" {
+		return s, "", nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	var file struct {
+		Type         string `json:"type"`
+		ProjectID    string `json:"project_id"`
+		PrivateKey   string `json:"private_key"`
+		ClientEmail  string `json:"client_email"`
+		TokenURI     string `json:"token_uri"`
+		PrivateKeyID string `json:"private_key_id"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, "", fmt.Errorf("error parsing credentials file %s: %v", path, err)
+	}
+	if file.Type != "service_account" {
+		return nil, "", fmt.Errorf("credentials file %s is not a service account key", path)
+	}
+	block, _ := pem.Decode([]byte(file.PrivateKey))
+	if block == nil {
+		return nil, "", fmt.Errorf("credentials file %s has no private key", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, "", fmt.Errorf("error parsing the private key of credentials file %s: %v", path, err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, "", fmt.Errorf("the private key of credentials file %s is not an RSA key", path)
+	}
+	s.email, s.key, s.keyID, s.tokenURI = file.ClientEmail, rsaKey, file.PrivateKeyID, file.TokenURI
+	if s.tokenURI == "" {
+		s.tokenURI = "https://oauth2.googleapis.com/token"
+	}
+	return s, file.ProjectID, nil
+}
+
+// token returns an access token, obtaining a new one if the cached one expires within a minute.
+func (s *googleTokenSource) token() (string, error) {
+	if s.cached != "" && time.Until(s.expires) > time.Minute {
+		return s.cached, nil
+	}
+	var req *http.Request
+	var err error
+	if s.key == nil {
+		req, err = http.NewRequest(http.MethodGet, s.metadataURL("instance/service-accounts/default/token?scopes="+
+			url.QueryEscape(cloudMonitoringScope)), nil)
+		if err == nil {
+			req.Header.Set("Metadata-Flavor", "Google")
+		}
+	} else {
+		var assertion string
+		assertion, err = s.assertion()
+		if err == nil {
+			form := url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {assertion}}
+			req, err = http.NewRequest(http.MethodPost, s.tokenURI, strings.NewReader(form.Encode()))
+		}
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	body, err := s.do(req)
+	if err != nil {
+		return "", err
+	}
+	var response struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "", err
+	}
+	if response.AccessToken == "" {
+		return "", fmt.Errorf("no access token in response")
+	}
+	s.cached, s.expires = response.AccessToken, time.Now().Add(time.Duration(response.ExpiresIn)*time.Second)
+	return s.cached, nil
+}
+
+// assertion returns a JWT signed with the service account's key, to exchange for an access token.
+func (s *googleTokenSource) assertion() (string, error) {
+	now := time.Now().Unix()
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": s.keyID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   s.email,
+		"scope": cloudMonitoringScope,
+		"aud":   s.tokenURI,
+		"iat":   now,
+		"exp":   now + 3600,
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// metadata returns a value from the metadata server, such as "project/project-id".
+func (s *googleTokenSource) metadata(path string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, s.metadataURL(path), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	body, err := s.do(req)
+	return strings.TrimSpace(string(body)), err
+}
+
+func (s *googleTokenSource) metadataURL(path string) string {
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = defaultGCEMetadataHost
+	}
+	return "http://" + host + "/computeMetadata/v1/" + path
+}
+
+// do sends a request and returns the body of a 2xx response.
+func (s *googleTokenSource) do(req *http.Request) ([]byte, error) {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &sinkStatusError{status: resp.StatusCode, body: string(bytes.TrimSpace(body))}
+	}
+	return body, nil
+}
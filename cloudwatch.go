@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	// defaultCloudWatchNamespace is the CloudWatch namespace of metrics if unset.
+	defaultCloudWatchNamespace = "VaultAuditMetrics"
+	// cloudWatchMaxMetrics is the largest number of metrics in one Embedded Metric Format record.
+	cloudWatchMaxMetrics = 100
+	// cloudWatchMaxDimensions is the largest number of dimensions of a CloudWatch metric.
+	cloudWatchMaxDimensions = 30
+)
+
+// cloudWatchSink emits metrics to Amazon CloudWatch as Embedded Metric Format (EMF) records, which CloudWatch extracts
+// metrics from without any API calls: over a socket to the CloudWatch agent, or to standard output, where the logging
+// drivers of ECS, EKS, and Lambda pick them up. Every unique combination of metric name and dimension values is billed
+// as a custom metric, so only the labels mapped to dimensions are kept, with the values of series differing only in
+// other labels summed, and only the configured metric families are emitted. Counters are emitted as their increments
+// since the previous push, gauges as they are, and histograms as the increments of their count and sum.
+type cloudWatchSink struct {
+	conn       *lineConn
+	out        io.Writer
+	namespace  string
+	dimensions map[string]string
+	constant   map[string]string
+	metrics    map[string]bool
+	resolution int
+	counters   *counterDeltas
+}
+
+// cloudWatchRecord is the values of the metrics sharing dimension values.
+type cloudWatchRecord struct {
+	dimensions map[string]string
+	values     map[string]float64
+	units      map[string]string
+}
+
+func newCloudWatchSink(cfg MetricSinkConfig) (*cloudWatchSink, error) {
+	s := &cloudWatchSink{
+		out:        os.Stdout,
+		namespace:  cfg.Namespace,
+		dimensions: cfg.Dimensions,
+		constant:   cfg.Tags,
+		resolution: cfg.Resolution,
+		counters:   newCounterDeltas(),
+	}
+	if cfg.Address != "" {
+		conn, err := newLineConn(cfg.Network, cfg.Address, "tcp")
+		if err != nil {
+			return nil, err
+		}
+		s.conn = conn
+	}
+	if s.namespace == "" {
+		s.namespace = defaultCloudWatchNamespace
+	}
+	switch s.resolution {
+	case 0:
+		s.resolution = 60
+	case 1, 60:
+	default:
+		return nil, fmt.Errorf("resolution must be 1 or 60 seconds")
+	}
+	if len(cfg.Dimensions)+len(cfg.Tags) > cloudWatchMaxDimensions {
+		return nil, fmt.Errorf("at most %d dimensions and tags are supported", cloudWatchMaxDimensions)
+	}
+	if len(cfg.Metrics) > 0 {
+		s.metrics = make(map[string]bool)
+		for _, name := range cfg.Metrics {
+			s.metrics[name] = true
+		}
+	}
+	return s, nil
+}
+
+func (s *cloudWatchSink) push(families []*dto.MetricFamily, now time.Time) error {
+	records := make(map[string]*cloudWatchRecord)
+	var keys []string
+	add := func(m *dto.Metric, name, unit string, value float64) {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return
+		}
+		dimensions := make(map[string]string, len(s.dimensions)+len(s.constant))
+		for key, value := range s.constant {
+			dimensions[key] = value
+		}
+		for _, label := range m.Label {
+			if dimension, found := s.dimensions[label.GetName()]; found {
+				dimensions[dimension] = label.GetValue()
+				if dimensions[dimension] == "" {
+					dimensions[dimension] = "none"
+				}
+			}
+		}
+		key := dimensionsKey(dimensions)
+		record := records[key]
+		if record == nil {
+			record = &cloudWatchRecord{dimensions: dimensions, values: make(map[string]float64), units: make(map[string]string)}
+			records[key] = record
+			keys = append(keys, key)
+		}
+		record.values[name] += value
+		record.units[name] = unit
+	}
+	for _, family := range families {
+		name := family.GetName()
+		if s.metrics != nil && !s.metrics[name] {
+			continue
+		}
+		for _, m := range family.Metric {
+			key := seriesKey(name, m.Label)
+			switch metricType(family) {
+			case dto.MetricType_COUNTER:
+				add(m, name, cloudWatchUnit(name, "Count"), s.counters.delta(key, metricValue(m)))
+			case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+				add(m, name, cloudWatchUnit(name, "None"), metricValue(m))
+			case dto.MetricType_HISTOGRAM:
+				histogram := m.GetHistogram()
+				add(m, name+"_count", "Count", s.counters.delta(key+"_count", float64(histogram.GetSampleCount())))
+				add(m, name+"_sum", cloudWatchUnit(name, "None"), s.counters.delta(key+"_sum", histogram.GetSampleSum()))
+			case dto.MetricType_SUMMARY:
+				summary := m.GetSummary()
+				add(m, name+"_count", "Count", s.counters.delta(key+"_count", float64(summary.GetSampleCount())))
+				add(m, name+"_sum", cloudWatchUnit(name, "None"), s.counters.delta(key+"_sum", summary.GetSampleSum()))
+			}
+		}
+	}
+	s.counters.sweep()
+
+	timestamp := now.UnixNano() / int64(time.Millisecond)
+	var lines []string
+	for _, key := range keys {
+		record := records[key]
+		names := make([]string, 0, len(record.values))
+		for name := range record.values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for start := 0; start < len(names); start += cloudWatchMaxMetrics {
+			end := start + cloudWatchMaxMetrics
+			if end > len(names) {
+				end = len(names)
+			}
+			line, err := s.record(record, names[start:end], timestamp)
+			if err != nil {
+				return err
+			}
+			lines = append(lines, line)
+		}
+	}
+	if s.conn != nil {
+		return s.conn.write(lines)
+	}
+	for _, line := range lines {
+		if _, err := io.WriteString(s.out, line+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// record encodes the values of metrics of a record as an Embedded Metric Format record.
+func (s *cloudWatchSink) record(record *cloudWatchRecord, names []string, timestamp int64) (string, error) {
+	type metricDefinition struct {
+		Name              string
+		Unit              string
+		StorageResolution int
+	}
+	type metricDirective struct {
+		Namespace  string
+		Dimensions [][]string
+		Metrics    []metricDefinition
+	}
+	type metadata struct {
+		Timestamp         int64
+		CloudWatchMetrics []metricDirective
+	}
+
+	dimensions := make([]string, 0, len(record.dimensions))
+	for dimension := range record.dimensions {
+		dimensions = append(dimensions, dimension)
+	}
+	sort.Strings(dimensions)
+	directive := metricDirective{Namespace: s.namespace, Dimensions: [][]string{dimensions}}
+	fields := make(map[string]interface{}, len(record.dimensions)+len(names)+1)
+	for dimension, value := range record.dimensions {
+		fields[dimension] = value
+	}
+	for _, name := range names {
+		directive.Metrics = append(directive.Metrics, metricDefinition{name, record.units[name], s.resolution})
+		fields[name] = record.values[name]
+	}
+	fields["_aws"] = metadata{Timestamp: timestamp, CloudWatchMetrics: []metricDirective{directive}}
+	line, err := json.Marshal(fields)
+	return string(line), err
+}
+
+// cloudWatchUnit returns the CloudWatch unit of a metric by the Prometheus naming convention, or fallback if it has
+// none.
+func cloudWatchUnit(name, fallback string) string {
+	name = strings.TrimSuffix(name, "_total")
+	switch {
+	case strings.HasSuffix(name, "_seconds"):
+		return "Seconds"
+	case strings.HasSuffix(name, "_bytes"):
+		return "Bytes"
+	}
+	return fallback
+}
+
+// dimensionsKey identifies a set of dimension values.
+func dimensionsKey(dimensions map[string]string) string {
+	names := make([]string, 0, len(dimensions))
+	for name := range dimensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(dimensions[name])
+		b.WriteByte(0xff)
+	}
+	return b.String()
+}
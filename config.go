@@ -0,0 +1,561 @@
+package main
+
+import (
+	"io/ioutil"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// LatencyClockVault measures latency between the timestamps Vault writes into the audit log.
+	LatencyClockVault = "vault"
+	// LatencyClockReceipt measures latency between the times the exporter receives the request and response lines.
+	LatencyClockReceipt = "receipt"
+)
+
+const (
+	// OverloadBlock stops reading audit connections while the processing queue is full, applying back-pressure to Vault.
+	OverloadBlock = "block"
+	// OverloadDropNewest drops audit events that arrive while the processing queue is full.
+	OverloadDropNewest = "drop-newest"
+	// OverloadDropOldest drops the longest queued audit events to make room for new ones.
+	OverloadDropOldest = "drop-oldest"
+)
+
+// Config contains all of the settings for an AuditProcessor. Fields tagged with `yaml:"-"` are populated from command
+// line flags, while the remaining sections are read from the optional YAML configuration file.
+type Config struct {
+	AuditNetwork string        `yaml:"-"`
+	AuditAddr    string        `yaml:"-"`
+	HTTPAddr     string        `yaml:"-"`
+	CacheTTL     time.Duration `yaml:"-"`
+	CacheCleanup time.Duration `yaml:"-"`
+	// TimestampStore selects where request timestamps are kept: TimestampStoreMemory, TimestampStoreRedis, or
+	// TimestampStoreMemcached.
+	TimestampStore string `yaml:"-"`
+	// Redis is the connection to Redis used by the Redis timestamp store.
+	Redis RedisConfig `yaml:"-"`
+	// Memcached is the connection to memcached used by the memcached timestamp store.
+	Memcached MemcachedConfig `yaml:"-"`
+	// CacheShards is the number of shards of the in-memory request timestamp cache.
+	CacheShards int `yaml:"-"`
+	// CacheMaxEntries bounds the number of requests in the in-memory cache, with zero meaning unbounded.
+	CacheMaxEntries int `yaml:"-"`
+	// CacheMaxBytes bounds the approximate memory used by the requests in the in-memory cache, with zero meaning
+	// unbounded.
+	CacheMaxBytes int64 `yaml:"-"`
+	// DuplicateRequestIDs selects how requests with an ID that is already stored are handled: DuplicateLastWins,
+	// DuplicateFirstWins, or DuplicateMultiset.
+	DuplicateRequestIDs string `yaml:"-"`
+	// CacheSnapshot is the file request timestamps held in memory are saved to on shutdown and restored from on startup.
+	CacheSnapshot string `yaml:"-"`
+	// CacheSnapshotMaxAge is the age after which a snapshot is too stale to restore.
+	CacheSnapshotMaxAge time.Duration `yaml:"-"`
+	// LatencyClock is the clock latency is measured with, either LatencyClockVault or LatencyClockReceipt.
+	LatencyClock string `yaml:"-"`
+	// Peers forward events between exporter instances so that requests and responses meet on the same instance.
+	Peers PeerConfig `yaml:"-"`
+	// CorrelationCheckInterval is the interval at which latency correlation is disabled if only responses were received
+	// (0 to always correlate).
+	CorrelationCheckInterval time.Duration `yaml:"-"`
+	// PendingResponseTTL is how long a response that arrived before its request is buffered (0 to disable).
+	PendingResponseTTL time.Duration `yaml:"-"`
+
+	// Workers is the number of audit events processed concurrently, with zero meaning four per CPU.
+	Workers int `yaml:"-"`
+	// QueueSize is the number of audit events waiting for a worker before the overload policy applies.
+	QueueSize int `yaml:"-"`
+	// OverloadPolicy decides what happens to audit events while the processing queue is full: OverloadBlock,
+	// OverloadDropNewest, or OverloadDropOldest.
+	OverloadPolicy string `yaml:"-"`
+	// HighThroughput aggregates metric updates per worker, merging them into the shared metrics on a short ticker.
+	HighThroughput bool `yaml:"-"`
+	// MaxLineBytes is the length of the longest audit log line that is processed, with longer lines being skipped.
+	MaxLineBytes int `yaml:"-"`
+	// ParseErrorThreshold is the ratio of lines failing to parse within ParseErrorWindow above which the exporter is
+	// not ready (0 to disable).
+	ParseErrorThreshold float64 `yaml:"-"`
+	// ParseErrorWindow is the rolling window the parse error ratio is measured over.
+	ParseErrorWindow time.Duration `yaml:"-"`
+	// DeadLetterFile is the file lines that cannot be decoded as audit entries are appended to, if set.
+	DeadLetterFile string `yaml:"-"`
+	// DeadLetterMaxBytes is the size at which the dead-letter file is rotated.
+	DeadLetterMaxBytes int64 `yaml:"-"`
+	// SourceDownAfter is the length of time after which an audit device that stopped sending events is considered down
+	// (0 to disable).
+	SourceDownAfter time.Duration `yaml:"-"`
+	// SourceDownWebhook is the URL audit devices going down and recovering are posted to, if set.
+	SourceDownWebhook string `yaml:"-"`
+	// RootTokenWebhook is the URL requests made with root tokens are posted to, if set.
+	RootTokenWebhook string `yaml:"-"`
+	// LoginFailureSourceLabel and LoginFailureAliasLabel add the source address and alias name as labels of the failed
+	// login metrics.
+	LoginFailureSourceLabel bool `yaml:"-"`
+	LoginFailureAliasLabel  bool `yaml:"-"`
+	// BruteForceThreshold is the number of failed logins from one source address within BruteForceWindow at which a
+	// brute force attempt is reported (0 to disable).
+	BruteForceThreshold int           `yaml:"-"`
+	BruteForceWindow    time.Duration `yaml:"-"`
+	// BruteForceWebhook is the URL brute force attempts are posted to, if set.
+	BruteForceWebhook string `yaml:"-"`
+	// WatchlistWebhook is the URL accesses of watchlist paths are posted to, if set.
+	WatchlistWebhook string `yaml:"-"`
+	// CredentialWatchlistWebhook is the URL appearances of watched credentials are posted to, if set.
+	CredentialWatchlistWebhook string `yaml:"-"`
+	// ActiveClients estimates the number of distinct clients per namespace and auth method.
+	ActiveClients bool `yaml:"-"`
+	// TopTalkers is the number of clients making the most requests that are tracked within TopTalkersWindow (0 to
+	// disable).
+	TopTalkers       int           `yaml:"-"`
+	TopTalkersWindow time.Duration `yaml:"-"`
+	// MaxMemory is the memory limit in bytes the exporter keeps within by shrinking its caches and shedding load (0 for
+	// no limit).
+	MaxMemory int64 `yaml:"-"`
+
+	// DropRawError removes the unbounded raw error label, leaving only the error class.
+	DropRawError bool `yaml:"-"`
+	// PathMaxDepth truncates the path label to its first segments, with zero meaning no truncation.
+	PathMaxDepth int `yaml:"-"`
+	// MaxSeries limits the number of series of each metric family, with zero meaning unlimited.
+	MaxSeries int `yaml:"-"`
+	// SeriesTTL is how long a series may go without updates before it is deleted, with zero meaning never.
+	SeriesTTL time.Duration `yaml:"-"`
+	// PolicyMetrics enables the per-policy request counter.
+	PolicyMetrics bool `yaml:"-"`
+	// MountLabels adds mount_path and mount_type labels resolved from the Vault mount table.
+	MountLabels bool `yaml:"-"`
+	// MountRefresh is the interval at which the mount table is reloaded.
+	MountRefresh time.Duration `yaml:"-"`
+
+	// Vault is the connection to the Vault API used for enrichment.
+	Vault VaultConfig `yaml:"-"`
+
+	RemoteAddress RemoteAddressConfig `yaml:"remote_address"`
+	// GeoIP adds country and asn labels resolved from the remote address with MaxMind databases.
+	GeoIP GeoIPConfig `yaml:"-"`
+	// Identity resolves entity IDs to entity names and groups with the Vault identity API.
+	Identity IdentityConfig `yaml:"-"`
+
+	// Filters decide which audit events are metered at all.
+	Filters FilterConfig `yaml:"filters"`
+	// Sampling counts only a fraction of the events on hot paths, scaling their counters accordingly.
+	Sampling []SamplingConfig `yaml:"sampling"`
+	// Expressions filter, sample, or route events using expressions over the decoded audit entry.
+	Expressions []ExpressionConfig `yaml:"expressions"`
+
+	KVv2 KVv2Config `yaml:"kv_v2"`
+	// CollapseDynamicSegments replaces UUIDs, lease IDs, and other opaque identifiers in paths with placeholders.
+	CollapseDynamicSegments bool `yaml:"-"`
+
+	// PathGroups assign request paths to named groups, exposed as the path_group label.
+	PathGroups PathGroups `yaml:"path_groups"`
+
+	// SLOs are latency and error objectives per path group, exposed as good and bad event counters and burn rates.
+	SLOs []SLOConfig `yaml:"slos"`
+
+	// AnomalyDetection, if set, scores the request and error rates of path groups against their baselines.
+	AnomalyDetection *AnomalyConfig `yaml:"anomaly_detection"`
+
+	// Reports periodically summarize the audit events since the previous report to disk or an HTTP endpoint.
+	Reports []ReportConfig `yaml:"reports"`
+
+	// Watchlist names groups of sensitive path patterns whose every access is counted, and optionally posted to
+	// WatchlistWebhook.
+	Watchlist PathGroups `yaml:"watchlist"`
+
+	// CredentialWatchlist, if set, counts every appearance of watched tokens and accessors, and optionally posts it to
+	// CredentialWatchlistWebhook.
+	CredentialWatchlist *CredentialWatchlistConfig `yaml:"credential_watchlist"`
+
+	// AccessSchedules count requests to path groups, or by tokens carrying policies, outside allowed windows of time.
+	AccessSchedules []AccessScheduleConfig `yaml:"access_schedules"`
+
+	// Notifiers are the Slack, PagerDuty, and webhook backends alerts are delivered to.
+	Notifiers []NotifierConfig `yaml:"notifiers"`
+	// Alerts notify notifiers of findings of the security monitors and of audit events matching expressions.
+	Alerts []AlertConfig `yaml:"alerts"`
+
+	// MetricSinks push the exporter's metrics to backends that don't scrape Prometheus exposition.
+	MetricSinks []MetricSinkConfig `yaml:"metric_sinks"`
+	// EventSinks forward the metered audit events to log backends.
+	EventSinks []EventSinkConfig `yaml:"event_sinks"`
+
+	// CacheTTLOverrides set the request timestamp cache TTL for matching paths, overriding -cache-ttl.
+	CacheTTLOverrides []CacheTTLOverride `yaml:"cache_ttl"`
+
+	// PathClasses apply different metric settings to classes of request paths.
+	PathClasses []PathClassConfig `yaml:"path_classes"`
+
+	// PathRules rewrite the path label, collapsing dynamic path segments into stable templates.
+	PathRules []PathRule `yaml:"path_rules"`
+
+	// Labels restricts the labels of individual metric families, keyed by metric family name (for example
+	// "response_duration_seconds").
+	Labels map[string]LabelFilter `yaml:"labels"`
+
+	// MaxSeriesOverrides overrides MaxSeries for individual metric families, keyed by metric family name.
+	MaxSeriesOverrides map[string]int `yaml:"max_series"`
+
+	// RelabelConfigs reshape the label set of every audit event before metrics are recorded.
+	RelabelConfigs []RelabelConfig `yaml:"relabel_configs"`
+}
+
+// RelabelConfig is a relabeling rule modeled after Prometheus relabel_config.
+type RelabelConfig struct {
+	SourceLabels []string `yaml:"source_labels"`
+	Separator    *string  `yaml:"separator"`
+	Regex        string   `yaml:"regex"`
+	TargetLabel  string   `yaml:"target_label"`
+	Replacement  *string  `yaml:"replacement"`
+	Action       string   `yaml:"action"`
+}
+
+// FilterConfig contains the audit event filters. Filters given on the command line are added to those from the file.
+type FilterConfig struct {
+	// SuppressNoise drops health check, token self-lookup, and UI traffic.
+	SuppressNoise bool `yaml:"suppress_noise"`
+	// PathInclude restricts metering to events whose path matches at least one of these regular expressions.
+	PathInclude []string `yaml:"path_include"`
+	// PathExclude drops events whose path matches any of these regular expressions.
+	PathExclude []string `yaml:"path_exclude"`
+	// OperationInclude restricts metering to events with one of these operations.
+	OperationInclude []string `yaml:"operation_include"`
+	// OperationExclude drops events with any of these operations.
+	OperationExclude []string `yaml:"operation_exclude"`
+	// Exclude drops events matching any of these combined path and operation rules.
+	Exclude []FilterRule `yaml:"exclude"`
+}
+
+// FilterRule matches events whose path matches a regular expression and whose operation is one of the listed operations
+// (or any operation, if none are listed).
+type FilterRule struct {
+	Path       string   `yaml:"path"`
+	Operations []string `yaml:"operations"`
+}
+
+// ExpressionConfig is an expression rule. Action is one of "keep", "drop", "sample" (keeping Ratio of matching events),
+// or "route" (setting the route label of matching events to Route).
+type ExpressionConfig struct {
+	Expr   string  `yaml:"expr"`
+	Action string  `yaml:"action"`
+	Ratio  float64 `yaml:"ratio"`
+	Route  string  `yaml:"route"`
+}
+
+// SamplingConfig counts one in every Every events whose path matches the regular expression Path.
+type SamplingConfig struct {
+	Path  string `yaml:"path"`
+	Every int    `yaml:"every"`
+}
+
+// KVv2Config controls built-in handling of KV v2 secret paths.
+type KVv2Config struct {
+	// Collapse rewrites paths such as "secret/data/foo/bar" into "secret/data/*".
+	Collapse bool `yaml:"-"`
+	// OperationLabel adds a kv_op label containing the KV v2 operation (such as "data" or "metadata").
+	OperationLabel bool `yaml:"-"`
+
+	// Mounts lists the KV v2 mount paths. When empty, the first segment of any path followed by a KV v2 operation
+	// segment is assumed to be a KV v2 mount.
+	Mounts []string `yaml:"mounts"`
+}
+
+// SLOConfig is a service level objective for the responses of a path group. A response is bad if it is slower than
+// Latency, or if Errors is set and it failed.
+type SLOConfig struct {
+	Name      string `yaml:"name"`
+	PathGroup string `yaml:"path_group"`
+	// Operations restricts the SLO to these operations, if set.
+	Operations []string      `yaml:"operations"`
+	Objective  float64       `yaml:"objective"`
+	Latency    time.Duration `yaml:"latency"`
+	Errors     bool          `yaml:"errors"`
+	// Windows are the windows burn rates are computed over.
+	Windows []time.Duration `yaml:"windows"`
+}
+
+// AnomalyConfig configures anomaly detection. Rates are measured over Interval and folded into their baselines with the
+// smoothing factor Alpha, with an anomaly being a score of at least Threshold standard deviations. The first Warmup
+// intervals only build the baselines.
+type AnomalyConfig struct {
+	Interval  time.Duration `yaml:"interval"`
+	Alpha     float64       `yaml:"alpha"`
+	Threshold float64       `yaml:"threshold"`
+	Warmup    int           `yaml:"warmup"`
+}
+
+// ReportConfig is a report generated on Schedule, a cron schedule such as "0 6 * * 1" or "@daily" in local time, as JSON
+// or HTML. The report is written to Directory, posted to URL, or both, and lists the Top paths and entities.
+type ReportConfig struct {
+	Name      string `yaml:"name"`
+	Schedule  string `yaml:"schedule"`
+	Format    string `yaml:"format"`
+	Directory string `yaml:"directory"`
+	URL       string `yaml:"url"`
+	Top       int    `yaml:"top"`
+}
+
+// CredentialWatchlistConfig lists the watched tokens and accessors. HMACKeyFile holds the HMAC key of the audit device,
+// which is required to watch credentials by their plaintext value.
+type CredentialWatchlistConfig struct {
+	HMACKeyFile string              `yaml:"hmac_key_file"`
+	Credentials []WatchedCredential `yaml:"credentials"`
+}
+
+// WatchedCredential is a token or accessor, given either as its HMAC as found in the audit log or as its plaintext Value.
+type WatchedCredential struct {
+	Name  string `yaml:"name"`
+	HMAC  string `yaml:"hmac"`
+	Value string `yaml:"value"`
+}
+
+// NotifierConfig is a backend alerts are delivered to. Type is slack, posting to the incoming webhook URL, pagerduty,
+// sending events with RoutingKey to the Events API v2 (or URL, if set), or webhook, posting alerts as JSON to URL.
+type NotifierConfig struct {
+	Name       string `yaml:"name"`
+	Type       string `yaml:"type"`
+	URL        string `yaml:"url"`
+	RoutingKey string `yaml:"routing_key"`
+}
+
+// AlertConfig raises an alert with Severity for the Findings of the security monitors, such as root_token, and for the
+// audit events matching Expr, notifying Notifiers at most once per Throttle for duplicates.
+type AlertConfig struct {
+	Name      string        `yaml:"name"`
+	Findings  []string      `yaml:"findings"`
+	Expr      string        `yaml:"expr"`
+	Severity  string        `yaml:"severity"`
+	Notifiers []string      `yaml:"notifiers"`
+	Throttle  time.Duration `yaml:"throttle"`
+}
+
+// MetricSinkConfig pushes the exporter's metrics every Interval to a backend of Type:
+//   - otlp posts them in the OTLP/HTTP protobuf encoding to URL, such as "http://otel-collector:4318/v1/metrics", with
+//     Headers and ResourceAttributes.
+//   - statsd emits them to Address over Network (udp or unixgram) in Flavor statsd or dogstatsd, prefixing names with
+//     Prefix and, with dogstatsd, adding Tags.
+//   - influxdb writes them in line protocol with Tags to the InfluxDB v2 HTTP API at URL, into Bucket of Org with Token,
+//     or to a Telegraf socket listener at Address over Network.
+//   - graphite writes them in the Graphite plaintext protocol to Address over Network, prefixing paths with Prefix and
+//     ordering the label values in paths by Labels, or as Graphite tags if Tagged is set.
+//   - cloudwatch emits them to Amazon CloudWatch in Namespace as Embedded Metric Format records, to the CloudWatch agent
+//     at Address over Network or to standard output, with the labels mapped by Dimensions and the constant Tags as
+//     dimensions, limited to the families named in Metrics, at a Resolution of 1 or 60 seconds.
+//   - remote_write writes them with the Prometheus remote write protocol to URL with Headers, adding Tags as external
+//     labels, and buffers up to BufferBytes of requests while URL is unavailable.
+//   - pushgateway pushes them to the Pushgateway at URL with Headers, replacing the group of Job and the Grouping
+//     labels.
+//   - newrelic sends them to the New Relic Metric API at URL, or that of the US region if unset, with Token as the
+//     license key or insert key, adding Tags as attributes.
+//   - cloudmonitoring writes them to Google Cloud Monitoring in Project as custom metrics prefixed with Prefix,
+//     limited to the families named in Metrics, for the monitored resource of ResourceType with ResourceAttributes as
+//     its labels, authenticated with the service account key of CredentialsFile or the metadata server.
+type MetricSinkConfig struct {
+	Name               string            `yaml:"name"`
+	Type               string            `yaml:"type"`
+	Interval           time.Duration     `yaml:"interval"`
+	URL                string            `yaml:"url"`
+	Headers            map[string]string `yaml:"headers"`
+	ResourceAttributes map[string]string `yaml:"resource_attributes"`
+	Network            string            `yaml:"network"`
+	Address            string            `yaml:"address"`
+	Flavor             string            `yaml:"flavor"`
+	Prefix             string            `yaml:"prefix"`
+	Tags               map[string]string `yaml:"tags"`
+	Org                string            `yaml:"org"`
+	Bucket             string            `yaml:"bucket"`
+	Token              string            `yaml:"token"`
+	Labels             []string          `yaml:"labels"`
+	Tagged             bool              `yaml:"tagged"`
+	Namespace          string            `yaml:"namespace"`
+	Dimensions         map[string]string `yaml:"dimensions"`
+	Metrics            []string          `yaml:"metrics"`
+	Resolution         int               `yaml:"resolution"`
+	BufferBytes        int               `yaml:"buffer_bytes"`
+	Job                string            `yaml:"job"`
+	Grouping           map[string]string `yaml:"grouping"`
+	Project            string            `yaml:"project"`
+	CredentialsFile    string            `yaml:"credentials_file"`
+	ResourceType       string            `yaml:"resource_type"`
+}
+
+// EventSinkConfig forwards the metered audit events passing Filters to a backend of Type, with the fields named in Redact,
+// such as "request.data", replaced, in batches of up to BatchSize events or BatchBytes of lines sent at least every
+// Interval, with up to QueueSize events waiting to be sent:
+//   - loki pushes them to the Grafana Loki push API at URL, such as "http://loki:3100/loki/api/v1/push", with Headers,
+//     in streams labeled with Tags and the event's Labels.
+//   - elasticsearch indexes them with the bulk API of the Elasticsearch or OpenSearch cluster at URL, with Headers or
+//     the basic auth of Username and Password, into the data stream or daily index Index, such as
+//     "vault-audit-{2006.01.02}", adding the event's Labels, after installing the index template IndexTemplate with
+//     the lifecycle policy ILMPolicy if set.
+//   - splunk sends them to the Splunk HTTP Event Collector at URL with the HEC token Token, into Index with Source and
+//     Sourcetype, adding Tags and the event's Labels as indexed fields, and waits for each batch to be indexed if
+//     Acknowledge is set.
+//   - s3 archives their lines as gzip-compressed objects, one per batch and hour, into Bucket in Region, or at the
+//     S3-compatible endpoint URL, under Prefix partitioned by day and hour, in StorageClass, encrypted with the KMS key
+//     KMSKeyID if set.
+type EventSinkConfig struct {
+	Name          string            `yaml:"name"`
+	Type          string            `yaml:"type"`
+	Filters       FilterConfig      `yaml:"filters"`
+	Redact        []string          `yaml:"redact"`
+	Interval      time.Duration     `yaml:"interval"`
+	BatchSize     int               `yaml:"batch_size"`
+	BatchBytes    int               `yaml:"batch_bytes"`
+	QueueSize     int               `yaml:"queue_size"`
+	URL           string            `yaml:"url"`
+	Headers       map[string]string `yaml:"headers"`
+	Tags          map[string]string `yaml:"tags"`
+	Labels        []string          `yaml:"labels"`
+	Index         string            `yaml:"index"`
+	IndexTemplate string            `yaml:"index_template"`
+	ILMPolicy     string            `yaml:"ilm_policy"`
+	Username      string            `yaml:"username"`
+	Password      string            `yaml:"password"`
+	Token         string            `yaml:"token"`
+	Acknowledge   bool              `yaml:"acknowledge"`
+	Source        string            `yaml:"source"`
+	Sourcetype    string            `yaml:"sourcetype"`
+	Bucket        string            `yaml:"bucket"`
+	Region        string            `yaml:"region"`
+	Prefix        string            `yaml:"prefix"`
+	StorageClass  string            `yaml:"storage_class"`
+	KMSKeyID      string            `yaml:"kms_key_id"`
+}
+
+// AccessScheduleConfig restricts requests to the paths of PathGroups, and requests made by tokens carrying any of
+// Policies, to Windows in the time zone TimeZone, such as "Europe/Berlin", defaulting to local time.
+type AccessScheduleConfig struct {
+	Name       string               `yaml:"name"`
+	PathGroups []string             `yaml:"path_groups"`
+	Policies   []string             `yaml:"policies"`
+	TimeZone   string               `yaml:"time_zone"`
+	Windows    []AccessWindowConfig `yaml:"windows"`
+}
+
+// AccessWindowConfig is a window of time on Days, such as "mon-fri" or "sat", or every day if empty, from Start to End
+// in the format "15:04", with "24:00" for the end of the day.
+type AccessWindowConfig struct {
+	Days  []string `yaml:"days"`
+	Start string   `yaml:"start"`
+	End   string   `yaml:"end"`
+}
+
+// CacheTTLOverride sets how long requests whose path matches Path are cached awaiting their response.
+type CacheTTLOverride struct {
+	Path string        `yaml:"path"`
+	TTL  time.Duration `yaml:"ttl"`
+}
+
+// PathClassConfig contains the metric settings for the request paths matching any of Paths.
+type PathClassConfig struct {
+	Name  string   `yaml:"name"`
+	Paths []string `yaml:"paths"`
+	// LatencyBuckets records latency into a separate histogram with these buckets, distinguished by a path_class label.
+	LatencyBuckets []float64 `yaml:"latency_buckets"`
+	// CountersOnly skips latency observations for the class.
+	CountersOnly bool `yaml:"counters_only"`
+	// DropLabels empties the values of these labels for the class.
+	DropLabels []string `yaml:"drop_labels"`
+}
+
+// PathRule replaces every match of a regular expression in the path with a template, which may reference capture groups
+// as $1 or ${name}.
+type PathRule struct {
+	Match   string `yaml:"match"`
+	Replace string `yaml:"replace"`
+}
+
+// LabelFilter is an allowlist and/or denylist of label names for a metric family.
+type LabelFilter struct {
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+}
+
+// VaultConfig contains the settings for connecting to the Vault API.
+type VaultConfig struct {
+	Addr      string
+	Token     string
+	TokenFile string
+	Namespace string
+	CACert    string
+}
+
+// RedisConfig contains the settings for connecting to Redis.
+type RedisConfig struct {
+	Addr      string
+	Password  string
+	DB        int
+	TLS       bool
+	KeyPrefix string
+	PoolSize  int
+	Timeout   time.Duration
+}
+
+// MemcachedConfig contains the settings for connecting to memcached.
+type MemcachedConfig struct {
+	Addr      string
+	KeyPrefix string
+	PoolSize  int
+	Timeout   time.Duration
+}
+
+// RemoteAddressConfig controls the optional remote_address label.
+type RemoteAddressConfig struct {
+	Enabled  bool `yaml:"-"`
+	PrefixV4 int  `yaml:"-"`
+	PrefixV6 int  `yaml:"-"`
+
+	// Networks maps network names to lists of CIDRs. Addresses within a named network are labeled with its name instead
+	// of their aggregated prefix.
+	Networks map[string][]string `yaml:"networks"`
+}
+
+// GeoIPConfig controls the optional country and asn labels. Each label is added if its database is set.
+type GeoIPConfig struct {
+	// CountryDB is the path of a MaxMind country or city database, such as GeoLite2 Country.
+	CountryDB string `yaml:"-"`
+	// ASNDB is the path of a MaxMind ASN database, such as GeoLite2 ASN.
+	ASNDB string `yaml:"-"`
+}
+
+// IdentityConfig controls the resolution of entity IDs to entity names and groups.
+type IdentityConfig struct {
+	// Enabled adds entity names and groups to webhook events and alerts.
+	Enabled bool `yaml:"-"`
+	// Labels adds entity_name and entity_groups labels to request counters, and implies Enabled.
+	Labels bool `yaml:"-"`
+	// CacheTTL is how long resolved entities and groups are cached.
+	CacheTTL time.Duration `yaml:"-"`
+}
+
+// LoadConfig reads a YAML configuration file. An empty path yields an empty configuration.
+func LoadConfig(path string) (*Config, error) {
+	cfg := new(Config)
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// PeerConfig forms a cluster of exporter instances that forward each event to the instance owning its request ID.
+type PeerConfig struct {
+	// Addr is the address of this instance in Peers, which forwarded events are received on.
+	Addr string
+	// Peers are the addresses of all instances, including this one, in the same order on every instance.
+	Peers []string
+	// QueueSize is the number of events buffered for each peer before they are processed locally instead.
+	QueueSize int
+	// Timeout bounds dialing and writing to a peer.
+	Timeout time.Duration
+	// Secret, if set, is sent by each instance when connecting to a peer, which closes connections that do not send it.
+	Secret string
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// configChangeKinds maps the path prefixes of Vault's configuration endpoints to the kind of configuration they change.
+var configChangeKinds = []struct {
+	prefix string
+	kind   string
+}{
+	{"sys/policies/", "policy"},
+	{"sys/policy/", "policy"},
+	{"sys/auth/", "auth"},
+	{"sys/mounts/", "mount"},
+	{"sys/audit/", "audit"},
+	{"identity/mfa/", "mfa"},
+	{"sys/mfa/method/", "mfa"},
+}
+
+// ConfigChangeMonitor counts changes of Vault's policies, auth methods, secrets engines, audit devices, and MFA
+// configuration, so that drift and unexpected administrative activity show up on dashboards.
+type ConfigChangeMonitor struct {
+	alerts *Alerter
+
+	counterChanges *prometheus.CounterVec
+}
+
+// NewConfigChangeMonitor constructs a ConfigChangeMonitor. Configuration changes are also findings for alerts.
+func NewConfigChangeMonitor(alerts *Alerter) *ConfigChangeMonitor {
+	return &ConfigChangeMonitor{
+		alerts: alerts,
+		counterChanges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "security",
+			Name:      "config_changes_total",
+			Help:      "Number of successful changes of policies, auth methods, secrets engines, audit devices, and MFA configuration. Partitioned by kind and operation.",
+		},
+			[]string{"kind", "operation"}),
+	}
+}
+
+func (m *ConfigChangeMonitor) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.counterChanges}
+}
+
+// configChangeKind returns the kind of configuration a request with an operation and path changes, or "" if it changes
+// none.
+func configChangeKind(operation, path string) string {
+	switch operation {
+	case "create", "update", "delete":
+	default:
+		return ""
+	}
+	for _, k := range configChangeKinds {
+		if strings.HasPrefix(path, k.prefix) {
+			return k.kind
+		}
+	}
+	return ""
+}
+
+// Observe records a configuration change from its response, unless it failed.
+func (m *ConfigChangeMonitor) Observe(auditEvent *AuditEvent) {
+	entry := auditEvent.entry
+	if entry.Type != AuditEventTypeResponse || entry.Request == nil || entry.Error != "" {
+		return
+	}
+	kind := configChangeKind(entry.Request.Operation, entry.Request.Path)
+	if kind == "" {
+		return
+	}
+	m.counterChanges.WithLabelValues(kind, entry.Request.Operation).Inc()
+	logInfo("vault configuration changed", "kind", kind, "operation", entry.Request.Operation, "path",
+		entry.Request.Path, "request_id", entry.Request.ID)
+	m.alerts.Fire(Finding{
+		Kind:    FindingConfigChange,
+		Key:     kind + " " + entry.Request.Path,
+		Summary: fmt.Sprintf("%s configuration changed with %s %s", kind, entry.Request.Operation, entry.Request.Path),
+		Time:    auditEvent.time,
+		Details: newRequestDetails(auditEvent),
+	})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ConnectionMetrics describes the connections of audit devices, partitioned by source address, so that flapping or
+// disconnected audit devices stand out.
+type ConnectionMetrics struct {
+	sources *SourceMonitor
+
+	gagueActive       *prometheus.GaugeVec
+	counterAccepted   *prometheus.CounterVec
+	counterClosed     *prometheus.CounterVec
+	counterLines      *prometheus.CounterVec
+	histogramDuration *prometheus.HistogramVec
+	gagueLastEvent    *prometheus.GaugeVec
+}
+
+// NewConnectionMetrics defines the connection metrics. If sources is not nil, connections and lines are also passed to
+// it to detect sources going down.
+func NewConnectionMetrics(sources *SourceMonitor) *ConnectionMetrics {
+	return &ConnectionMetrics{
+		sources: sources,
+		gagueActive: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: PromNamespace,
+			Subsystem: "connections",
+			Name:      "active",
+			Help:      "Number of open audit device connections. Partitioned by source address.",
+		},
+			[]string{"source"}),
+		counterAccepted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "connections",
+			Name:      "accepted_total",
+			Help:      "Number of audit device connections accepted. Partitioned by source address.",
+		},
+			[]string{"source"}),
+		counterClosed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "connections",
+			Name:      "closed_total",
+			Help:      "Number of audit device connections closed. Partitioned by source address.",
+		},
+			[]string{"source"}),
+		counterLines: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "connections",
+			Name:      "lines_received_total",
+			Help:      "Number of lines received from audit devices. Partitioned by source address.",
+		},
+			[]string{"source"}),
+		histogramDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: PromNamespace,
+			Subsystem: "connections",
+			Name:      "duration_seconds",
+			Help:      "Length of time audit device connections stayed open. Partitioned by source address.",
+			Buckets:   prometheus.ExponentialBuckets(1, 4, 10),
+		},
+			[]string{"source"}),
+		gagueLastEvent: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: PromNamespace,
+			Subsystem: "connections",
+			Name:      "last_event_timestamp_seconds",
+			Help:      "Unix time at which the last line was received from an audit device. Partitioned by source address.",
+		},
+			[]string{"source"}),
+	}
+}
+
+// collectors returns the connection metrics for registration.
+func (m *ConnectionMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.gagueActive, m.counterAccepted, m.counterClosed, m.counterLines, m.histogramDuration,
+		m.gagueLastEvent}
+}
+
+// connectionLines records the lines received on one connection.
+type connectionLines struct {
+	lines     prometheus.Counter
+	lastEvent prometheus.Gauge
+	source    *sourceState
+}
+
+// Received records a line received at a time.
+func (c *connectionLines) Received(t time.Time) {
+	c.lines.Inc()
+	c.lastEvent.Set(float64(t.UnixNano()) / 1e9)
+	if c.source != nil {
+		c.source.received(t)
+	}
+}
+
+// Open records a connection accepted from source, returning the recorder of lines received on it and a function to
+// call once it is closed.
+func (m *ConnectionMetrics) Open(source string) (*connectionLines, func()) {
+	opened := time.Now()
+	m.counterAccepted.WithLabelValues(source).Inc()
+	m.gagueActive.WithLabelValues(source).Inc()
+	lines := &connectionLines{
+		lines:     m.counterLines.WithLabelValues(source),
+		lastEvent: m.gagueLastEvent.WithLabelValues(source),
+	}
+	if m.sources != nil {
+		lines.source = m.sources.open(source)
+	}
+	return lines, func() {
+		if lines.source != nil {
+			m.sources.close(lines.source)
+		}
+		m.gagueActive.WithLabelValues(source).Dec()
+		m.counterClosed.WithLabelValues(source).Inc()
+		m.histogramDuration.WithLabelValues(source).Observe(time.Since(opened).Seconds())
+	}
+}
+
+// connectionSource returns the address a connection comes from without its port, which changes with every connection.
+// Connections over Unix sockets have no source address.
+func connectionSource(conn net.Conn) string {
+	addr := conn.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
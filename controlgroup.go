@@ -0,0 +1,204 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// controlGroupCheckInterval is the interval at which control group requests are checked for expiry.
+	controlGroupCheckInterval = 10 * time.Second
+	// controlGroupMaxPending bounds the number of control group requests awaiting approval that are tracked.
+	controlGroupMaxPending = 100000
+)
+
+// controlGroupBuckets are the histogram buckets of control group approval times, from 10 seconds to a day.
+var controlGroupBuckets = []float64{10, 30, 60, 300, 900, 1800, 3600, 7200, 14400, 28800, 86400}
+
+// pendingControlGroup is a control group request awaiting approval.
+type pendingControlGroup struct {
+	created time.Time
+	expires time.Time
+}
+
+// ControlGroupMonitor tracks the control groups of Vault Enterprise. A request to a path governed by a control group is
+// answered with a wrapped response, whose wrapping token can only be unwrapped once enough approvers authorized it
+// through sys/control-group/authorize. Such requests are matched with their authorizations by the HMAC of the wrapping
+// token accessor, which the audit device records both in the wrapped response and in the authorization request, to
+// observe how long approval takes.
+type ControlGroupMonitor struct {
+	paths *PathNormalizer
+
+	mu sync.Mutex
+	// pending holds the control group requests awaiting approval by the HMAC of their wrapping token accessor.
+	pending map[string]pendingControlGroup
+
+	counterRequests   *prometheus.CounterVec
+	counterOperations *prometheus.CounterVec
+	counterApproved   prometheus.Counter
+	counterExpired    prometheus.Counter
+	histogramApproval prometheus.Histogram
+	gaguePending      prometheus.Gauge
+}
+
+// NewControlGroupMonitor constructs a ControlGroupMonitor labeling requests with paths normalized by paths.
+func NewControlGroupMonitor(paths *PathNormalizer) *ControlGroupMonitor {
+	return &ControlGroupMonitor{
+		paths:   paths,
+		pending: make(map[string]pendingControlGroup),
+		counterRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "control_group",
+			Name:      "requests_total",
+			Help:      "Number of requests answered with a wrapped response awaiting control group approval. Partitioned by path.",
+		},
+			[]string{"path"}),
+		counterOperations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "control_group",
+			Name:      "operations_total",
+			Help:      "Number of responses to sys/control-group requests. Partitioned by operation (authorize or request) and result (success or failure).",
+		},
+			[]string{"operation", "result"}),
+		counterApproved: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "control_group",
+			Name:      "approved_total",
+			Help:      "Number of control group requests that were approved.",
+		}),
+		counterExpired: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "control_group",
+			Name:      "expired_total",
+			Help:      "Number of control group requests whose wrapping token expired before they were approved.",
+		}),
+		histogramApproval: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: PromNamespace,
+			Subsystem: "control_group",
+			Name:      "approval_duration_seconds",
+			Help:      "Time from control group requests to their approval.",
+			Buckets:   controlGroupBuckets,
+		}),
+		gaguePending: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: PromNamespace,
+			Subsystem: "control_group",
+			Name:      "requests_pending",
+			Help:      "Number of control group requests awaiting approval.",
+		}),
+	}
+}
+
+func (m *ControlGroupMonitor) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.counterRequests, m.counterOperations, m.counterApproved, m.counterExpired,
+		m.histogramApproval, m.gaguePending}
+}
+
+// controlGroupOperation returns the operation of a request path on sys/control-group, or "" if it is none.
+func controlGroupOperation(path string) string {
+	switch path {
+	case "sys/control-group/authorize":
+		return "authorize"
+	case "sys/control-group/request":
+		return "request"
+	}
+	return ""
+}
+
+// isControlGroupResponse returns whether a response was wrapped by a control group. Such responses are wrapped without
+// the client requesting it, unlike responses to requests with a wrap TTL or to sys/wrapping/wrap, and unlike the
+// tokens that replication endpoints always wrap.
+func isControlGroupResponse(entry *AuditEntry) bool {
+	if entry.Response == nil || entry.Response.WrapInfo == nil || entry.Request.WrapTTL > 0 {
+		return false
+	}
+	path := entry.Request.Path
+	return !strings.HasPrefix(path, "sys/wrapping/") && !strings.HasPrefix(path, "sys/replication/") &&
+		!strings.HasPrefix(path, "sys/control-group/")
+}
+
+// Observe records a control group request awaiting approval, or an operation on sys/control-group, from its response.
+func (m *ControlGroupMonitor) Observe(auditEvent *AuditEvent) {
+	entry := auditEvent.entry
+	if entry.Type != AuditEventTypeResponse || entry.Request == nil {
+		return
+	}
+
+	if operation := controlGroupOperation(entry.Request.Path); operation != "" {
+		result := "success"
+		if entry.Error != "" {
+			result = "failure"
+		}
+		m.counterOperations.WithLabelValues(operation, result).Inc()
+		if entry.Error == "" && entry.Request.Data != nil && entry.Response != nil && entry.Response.Data != nil &&
+			entry.Response.Data.Approved {
+			m.approve(entry.Request.Data.Accessor, auditEvent.time)
+		}
+		return
+	}
+
+	if entry.Error != "" || !isControlGroupResponse(entry) {
+		return
+	}
+	wrapInfo := entry.Response.WrapInfo
+	path := wrapInfo.CreationPath
+	if path == "" {
+		path = entry.Request.Path
+	}
+	m.counterRequests.WithLabelValues(m.paths.Normalize(path)).Inc()
+	if wrapInfo.Accessor == "" || wrapInfo.TTL <= 0 {
+		return
+	}
+	m.mu.Lock()
+	if len(m.pending) < controlGroupMaxPending {
+		m.pending[wrapInfo.Accessor] = pendingControlGroup{
+			created: auditEvent.time,
+			expires: auditEvent.time.Add(time.Duration(wrapInfo.TTL) * time.Second),
+		}
+	}
+	m.gaguePending.Set(float64(len(m.pending)))
+	m.mu.Unlock()
+}
+
+// approve records the approval of the control group request with the given wrapping token accessor, once. Approvals
+// of requests that aren't tracked, such as those made before startup, are not counted.
+func (m *ControlGroupMonitor) approve(accessor string, t time.Time) {
+	if accessor == "" {
+		return
+	}
+	m.mu.Lock()
+	request, found := m.pending[accessor]
+	delete(m.pending, accessor)
+	m.gaguePending.Set(float64(len(m.pending)))
+	m.mu.Unlock()
+	if !found {
+		return
+	}
+	m.counterApproved.Inc()
+	if elapsed := t.Sub(request.created); elapsed >= 0 {
+		m.histogramApproval.Observe(elapsed.Seconds())
+	}
+}
+
+// Run continuously counts control group requests that expired without being approved.
+func (m *ControlGroupMonitor) Run() {
+	for {
+		time.Sleep(controlGroupCheckInterval)
+		now := time.Now()
+		var expired int
+		m.mu.Lock()
+		for accessor, request := range m.pending {
+			if request.expires.Before(now) {
+				delete(m.pending, accessor)
+				expired++
+			}
+		}
+		m.gaguePending.Set(float64(len(m.pending)))
+		m.mu.Unlock()
+		if expired > 0 {
+			m.counterExpired.Add(float64(expired))
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Latency correlation modes, exposed by the correlation mode gauge.
+const (
+	// CorrelationEnabled matches responses to their requests to measure latency.
+	CorrelationEnabled = "enabled"
+	// CorrelationDisabled only counts responses, because no requests are being received.
+	CorrelationDisabled = "disabled"
+)
+
+// minUncorrelatedResponses is the number of responses without any request within a check interval after which
+// correlation is disabled, so that a quiet period is not mistaken for requests being filtered.
+const minUncorrelatedResponses = 100
+
+// CorrelationMonitor detects when audit devices only log responses, for example because requests are filtered
+// upstream, and disables latency correlation rather than reporting every response as unmatched. Correlation is
+// enabled again as soon as a request is received.
+type CorrelationMonitor struct {
+	disabled  int32
+	requests  int64
+	responses int64
+
+	gagueMode *prometheus.GaugeVec
+}
+
+// NewCorrelationMonitor constructs a CorrelationMonitor, starting with correlation enabled.
+func NewCorrelationMonitor() *CorrelationMonitor {
+	m := &CorrelationMonitor{
+		gagueMode: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: PromNamespace,
+			Subsystem: "events",
+			Name:      "correlation_mode",
+			Help:      "Whether responses are correlated with their requests to measure latency, set to 1 for the current mode. Partitioned by mode.",
+		},
+			[]string{"mode"}),
+	}
+	m.setMode(false)
+	return m
+}
+
+// Request records a request, enabling correlation if it was disabled.
+func (m *CorrelationMonitor) Request() {
+	atomic.AddInt64(&m.requests, 1)
+	if atomic.CompareAndSwapInt32(&m.disabled, 1, 0) {
+		logInfo("received a request, enabling latency correlation")
+		m.setMode(false)
+	}
+}
+
+// Response records a response, reporting whether it should be correlated with its request.
+func (m *CorrelationMonitor) Response() bool {
+	atomic.AddInt64(&m.responses, 1)
+	return atomic.LoadInt32(&m.disabled) == 0
+}
+
+// Run continuously checks whether requests are being received, disabling correlation when only responses are.
+func (m *CorrelationMonitor) Run(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		requests := atomic.SwapInt64(&m.requests, 0)
+		responses := atomic.SwapInt64(&m.responses, 0)
+		if requests == 0 && responses >= minUncorrelatedResponses && atomic.CompareAndSwapInt32(&m.disabled, 0, 1) {
+			logWarn("received responses but no requests, disabling latency correlation", "responses", responses,
+				"interval", interval)
+			m.setMode(true)
+		}
+	}
+}
+
+func (m *CorrelationMonitor) setMode(disabled bool) {
+	current, other := CorrelationEnabled, CorrelationDisabled
+	if disabled {
+		current, other = other, current
+	}
+	m.gagueMode.WithLabelValues(current).Set(1)
+	m.gagueMode.WithLabelValues(other).Set(0)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Usages of watched credentials.
+const (
+	credentialUsageRequest = "request"
+	credentialUsageIssued  = "issued"
+)
+
+// CredentialWatchlist counts every appearance of watched tokens and accessors in the audit stream, such as a token known
+// to have leaked, and optionally posts each to a webhook. Audit devices record tokens, and accessors unless configured
+// otherwise, as their HMAC, so credentials are watched either by the HMAC found in the audit log or by their plaintext
+// value, which is HMAC'd with the audit device's HMAC key.
+type CredentialWatchlist struct {
+	// credentials holds the name of each watched credential by the values it appears as in the audit log.
+	credentials map[string]string
+	webhook     *Webhook
+	alerts      *Alerter
+
+	counterHits          *prometheus.CounterVec
+	counterWebhookErrors prometheus.Counter
+}
+
+// credentialWatchlistEvent is the body posted to the credential watchlist webhook.
+type credentialWatchlistEvent struct {
+	Credential    string    `json:"credential"`
+	Usage         string    `json:"usage"`
+	RequestID     string    `json:"request_id"`
+	Operation     string    `json:"operation"`
+	Path          string    `json:"path"`
+	EntityID      string    `json:"entity_id,omitempty"`
+	EntityName    string    `json:"entity_name,omitempty"`
+	EntityGroups  []string  `json:"entity_groups,omitempty"`
+	RemoteAddress string    `json:"remote_address,omitempty"`
+	Time          time.Time `json:"time"`
+}
+
+// NewCredentialWatchlist constructs a CredentialWatchlist. If webhook is not empty, every appearance of a watched
+// credential is posted to it. Appearances are also findings for alerts.
+func NewCredentialWatchlist(cfg CredentialWatchlistConfig, webhook string, alerts *Alerter) (*CredentialWatchlist, error) {
+	var key []byte
+	if cfg.HMACKeyFile != "" {
+		buf, err := ioutil.ReadFile(cfg.HMACKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key = []byte(strings.TrimRight(string(buf), "\r\n"))
+	}
+	w := &CredentialWatchlist{credentials: make(map[string]string), alerts: alerts}
+	for _, credential := range cfg.Credentials {
+		if credential.Name == "" {
+			return nil, fmt.Errorf("credential name is required")
+		}
+		var values []string
+		switch {
+		case credential.HMAC != "" && credential.Value == "":
+			values = append(values, credential.HMAC)
+		case credential.Value != "" && credential.HMAC == "":
+			if key == nil {
+				return nil, fmt.Errorf("credential %s: hmac_key_file is required to watch plaintext values", credential.Name)
+			}
+			// accessors are recorded as is by audit devices with hmac_accessor disabled
+			values = append(values, auditHMAC(key, credential.Value), credential.Value)
+		default:
+			return nil, fmt.Errorf("credential %s: exactly one of hmac and value is required", credential.Name)
+		}
+		for _, value := range values {
+			if name, found := w.credentials[value]; found && name != credential.Name {
+				return nil, fmt.Errorf("credential %s: value is already watched as %s", credential.Name, name)
+			}
+			w.credentials[value] = credential.Name
+		}
+	}
+
+	w.counterHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "security",
+		Name:      "credential_watchlist_hits_total",
+		Help:      "Number of audit entries in which a watched token or accessor appeared. Partitioned by credential and usage (request for requests made with it, or issued for responses issuing it).",
+	},
+		[]string{"credential", "usage"})
+	w.counterWebhookErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "security",
+		Name:      "credential_watchlist_webhook_errors_total",
+		Help:      "Number of failed calls of -credential-watchlist-webhook.",
+	})
+	if webhook != "" {
+		w.webhook = NewWebhook("credential-watchlist-webhook", webhook, w.counterWebhookErrors.Inc)
+	}
+	return w, nil
+}
+
+func (w *CredentialWatchlist) collectors() []prometheus.Collector {
+	return []prometheus.Collector{w.counterHits, w.counterWebhookErrors}
+}
+
+// auditHMAC returns a value as audit devices record it, HMAC'd with SHA-256 and the audit device's key.
+func auditHMAC(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Observe records the watched credentials that made a request, or that a successful response issued. Requests are
+// counted rather than responses, so that denied attempts are counted too.
+func (w *CredentialWatchlist) Observe(auditEvent *AuditEvent) {
+	entry := auditEvent.entry
+	if entry.Request == nil {
+		return
+	}
+	switch entry.Type {
+	case AuditEventTypeRequest:
+		values := []string{entry.Request.ClientToken, entry.Request.ClientTokenAccessor}
+		if entry.Auth != nil {
+			values = append(values, entry.Auth.ClientToken, entry.Auth.Accessor)
+		}
+		w.match(auditEvent, credentialUsageRequest, values)
+	case AuditEventTypeResponse:
+		if entry.Error == "" && entry.Response != nil && entry.Response.Auth != nil {
+			auth := entry.Response.Auth
+			w.match(auditEvent, credentialUsageIssued, []string{auth.ClientToken, auth.Accessor})
+		}
+	}
+}
+
+// match records each watched credential among values once.
+func (w *CredentialWatchlist) match(auditEvent *AuditEvent, usage string, values []string) {
+	var matched []string
+	for _, value := range values {
+		name, found := w.credentials[value]
+		if value == "" || !found {
+			continue
+		}
+		if containsString(matched, name) {
+			continue
+		}
+		matched = append(matched, name)
+
+		request := auditEvent.entry.Request
+		var entity string
+		if auth := auditEvent.entry.Auth; auth != nil {
+			entity = auth.EntityID
+		}
+		w.counterHits.WithLabelValues(name, usage).Inc()
+		logWarn("watched credential appeared in audit log", "credential", name, "usage", usage, "request_id",
+			request.ID, "operation", request.Operation, "path", request.Path, "remote_address", request.RemoteAddr)
+		event := credentialWatchlistEvent{
+			Credential:    name,
+			Usage:         usage,
+			RequestID:     request.ID,
+			Operation:     request.Operation,
+			Path:          request.Path,
+			EntityID:      entity,
+			EntityName:    auditEvent.identity.entityName(),
+			EntityGroups:  auditEvent.identity.entityGroups(),
+			RemoteAddress: request.RemoteAddr,
+			Time:          auditEvent.time,
+		}
+		w.webhook.Notify(event)
+		w.alerts.Fire(Finding{
+			Kind: FindingCredentialWatchlist,
+			Key:  name + " " + usage,
+			Summary: fmt.Sprintf("watched credential %s appeared in %s %s%s", name, request.Operation,
+				request.Path, fromAddress(request.RemoteAddr)),
+			Time:    auditEvent.time,
+			Details: event,
+		})
+	}
+}
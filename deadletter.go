@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// deadLetter is a line that could not be decoded, as written to the dead-letter file.
+type deadLetter struct {
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+	Error  string    `json:"error"`
+	Line   string    `json:"line"`
+}
+
+// DeadLetterFile keeps the lines that could not be decoded as audit entries, so that schema mismatches can be
+// inspected after the fact. Once the file reaches its maximum size it is rotated to a single backup with a ".1" suffix,
+// bounding the disk space used to twice the maximum size.
+type DeadLetterFile struct {
+	path     string
+	maxBytes int64
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewDeadLetterFile opens the dead-letter file at path for appending.
+func NewDeadLetterFile(path string, maxBytes int64) (*DeadLetterFile, error) {
+	d := &DeadLetterFile{path: path, maxBytes: maxBytes}
+	if err := d.open(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *DeadLetterFile) open() error {
+	file, err := os.OpenFile(d.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	d.file, d.size = file, info.Size()
+	return nil
+}
+
+// Write appends a line received from source at a time, along with the error decoding it. If rotation fails, the line is
+// still appended to the current file, and the rotation error is returned.
+func (d *DeadLetterFile) Write(received time.Time, source string, line []byte, lineErr error) error {
+	data, err := json.Marshal(deadLetter{Time: received, Source: source, Error: lineErr.Error(), Line: string(line)})
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var rotateErr error
+	if d.maxBytes > 0 && d.size > 0 && d.size+int64(len(data)) > d.maxBytes {
+		rotateErr = d.rotate()
+	}
+	if d.file == nil {
+		// the current file could not be reopened after a failed rotation, so try again
+		if err := d.open(); err != nil {
+			return err
+		}
+	}
+	n, err := d.file.Write(data)
+	d.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return rotateErr
+}
+
+// rotate replaces the backup with the current file and starts a new one. If the current file can't be renamed, it is
+// reopened, so that lines keep being written to it. The file is left nil only if it can't be opened again.
+func (d *DeadLetterFile) rotate() error {
+	err := d.file.Close()
+	d.file = nil
+	if err != nil {
+		if openErr := d.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	if err := os.Rename(d.path, d.path+".1"); err != nil {
+		// keep writing to the current file rather than losing lines
+		if openErr := d.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	return d.open()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestDeadLetterFileRotateFailure checks that lines keep being written to the current file after renaming it to the
+// backup failed.
+func TestDeadLetterFileRotateFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead-letters.log")
+	// a non-empty directory in place of the backup makes renaming the current file fail
+	if err := os.MkdirAll(filepath.Join(path+".1", "blocked"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDeadLetterFile(path, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lineErr := errors.New("invalid character 'x' looking for beginning of value")
+	const lines = 5
+	var rotateErrors int
+	for i := 0; i < lines; i++ {
+		if err := d.Write(time.Now(), "test", []byte("xyz"), lineErr); err != nil {
+			rotateErrors++
+		}
+	}
+	if rotateErrors == 0 {
+		t.Error("no rotation failed, so the test didn't exercise a rename failure")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var written int
+	for scanner := bufio.NewScanner(file); scanner.Scan(); {
+		written++
+	}
+	if written != lines {
+		t.Errorf("wrote %d lines to the current file, want %d", written, lines)
+	}
+
+	// once the backup can be replaced, rotation works again
+	if err := os.RemoveAll(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Write(time.Now(), "test", []byte("xyz"), lineErr); err != nil {
+		t.Errorf("writing after the backup was removed: %v", err)
+	}
+	if _, err := os.Stat(path + ".1"); err != nil {
+		t.Errorf("current file wasn't rotated after the backup was removed: %v", err)
+	}
+}
@@ -0,0 +1,645 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+// errMalformedJSON is returned by the fast decoder for input it cannot decode, which is then left to encoding/json.
+var errMalformedJSON = errors.New("malformed JSON")
+
+// decodeAuditEntry decodes only the fields of an audit log line that are used for labels and correlation into entry,
+// skipping the rest, such as request and response data and headers, without decoding them. The structure of skipped
+// values is checked, but not their contents, so the decoder is more lenient than encoding/json. Otherwise, it decodes
+// the same entry as encoding/json, or fails for lines it leaves to encoding/json, such as those with escaped keys. Fields
+// that repeat across entries are interned with interner.
+func decodeAuditEntry(line []byte, entry *AuditEntry, interner *stringInterner) error {
+	d := jsonDecoder{data: line, interner: interner}
+	err := d.object(func(key []byte) error {
+		switch string(key) {
+		case "type":
+			return d.internedString(&entry.Type)
+		case "time":
+			return d.string(&entry.Time)
+		case "error":
+			return d.internedString(&entry.Error)
+		case "request":
+			if d.null() {
+				entry.Request = nil
+				return nil
+			}
+			if entry.Request == nil {
+				entry.Request = new(AuditRequest)
+			}
+			return d.request(entry.Request)
+		case "response":
+			if d.null() {
+				entry.Response = nil
+				return nil
+			}
+			if entry.Response == nil {
+				entry.Response = new(AuditResponse)
+			}
+			return d.response(entry.Response)
+		case "auth":
+			if d.null() {
+				entry.Auth = nil
+				return nil
+			}
+			if entry.Auth == nil {
+				entry.Auth = new(AuditAuth)
+			}
+			return d.auth(entry.Auth)
+		default:
+			return d.skipField(key)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	d.whitespace()
+	if d.pos != len(d.data) {
+		return errMalformedJSON
+	}
+	return nil
+}
+
+// jsonDecoder is a minimal JSON decoder reading values from data at pos.
+type jsonDecoder struct {
+	data     []byte
+	pos      int
+	interner *stringInterner
+}
+
+func (d *jsonDecoder) request(request *AuditRequest) error {
+	return d.object(func(key []byte) error {
+		switch string(key) {
+		case "id":
+			return d.string(&request.ID)
+		case "path":
+			return d.internedString(&request.Path)
+		case "operation":
+			return d.internedString(&request.Operation)
+		case "mount_type":
+			return d.internedString(&request.MountType)
+		case "remote_address":
+			return d.string(&request.RemoteAddr)
+		case "namespace":
+			if d.null() {
+				request.Namespace = nil
+				return nil
+			}
+			if request.Namespace == nil {
+				request.Namespace = new(AuditNamespace)
+			}
+			return d.object(func(key []byte) error {
+				if string(key) == "id" {
+					return d.internedString(&request.Namespace.ID)
+				}
+				return d.skipField(key)
+			})
+		case "client_token":
+			return d.string(&request.ClientToken)
+		case "client_token_accessor":
+			return d.string(&request.ClientTokenAccessor)
+		case "wrap_ttl":
+			return d.int64(&request.WrapTTL)
+		case "data":
+			if d.null() {
+				request.Data = nil
+				return nil
+			}
+			if request.Data == nil {
+				request.Data = new(AuditRequestData)
+			}
+			return d.requestData(request.Data)
+		default:
+			return d.skipField(key)
+		}
+	})
+}
+
+// requestData decodes the fields of a request body in use. Request bodies are arbitrary, so fields of unexpected types
+// are skipped, like AuditRequestData.UnmarshalJSON does.
+func (d *jsonDecoder) requestData(data *AuditRequestData) error {
+	*data = AuditRequestData{}
+	err := d.object(func(key []byte) error {
+		switch string(key) {
+		case "token":
+			data.Token = ""
+			if d.peek() != '"' {
+				return d.skip()
+			}
+			return d.string(&data.Token)
+		case "accessor":
+			data.Accessor = ""
+			if d.peek() != '"' {
+				return d.skip()
+			}
+			return d.string(&data.Accessor)
+		case "mfa_payload":
+			data.MFAMethodIDs = nil
+			if d.peek() != '{' {
+				return d.skip()
+			}
+			return d.object(func(id []byte) error {
+				if id == nil || !utf8.Valid(id) {
+					// method IDs needing escapes or replacement characters are left to encoding/json
+					return errMalformedJSON
+				}
+				data.MFAMethodIDs = append(data.MFAMethodIDs, string(id))
+				return d.skip()
+			})
+		default:
+			return d.skipDataField(key, "token", "accessor", "mfa_payload")
+		}
+	})
+	// the payload is decoded into a map by encoding/json, which keeps one of repeated method IDs
+	sort.Strings(data.MFAMethodIDs)
+	ids := data.MFAMethodIDs
+	for i := 1; i < len(ids); i++ {
+		if ids[i] == ids[i-1] {
+			ids = append(ids[:i], ids[i+1:]...)
+			i--
+		}
+	}
+	data.MFAMethodIDs = ids
+	return err
+}
+
+func (d *jsonDecoder) response(response *AuditResponse) error {
+	return d.object(func(key []byte) error {
+		switch string(key) {
+		case "auth":
+			if d.null() {
+				response.Auth = nil
+				return nil
+			}
+			if response.Auth == nil {
+				response.Auth = new(AuditAuth)
+			}
+			return d.auth(response.Auth)
+		case "secret":
+			if d.null() {
+				response.Secret = nil
+				return nil
+			}
+			if response.Secret == nil {
+				response.Secret = new(AuditSecret)
+			}
+			return d.object(func(key []byte) error {
+				if string(key) == "lease_id" {
+					return d.string(&response.Secret.LeaseID)
+				}
+				return d.skipField(key)
+			})
+		case "lease_duration":
+			return d.int64(&response.LeaseDuration)
+		case "data":
+			if d.null() {
+				response.Data = nil
+				return nil
+			}
+			if response.Data == nil {
+				response.Data = new(AuditResponseData)
+			}
+			return d.responseData(response.Data)
+		case "wrap_info":
+			if d.null() {
+				response.WrapInfo = nil
+				return nil
+			}
+			if response.WrapInfo == nil {
+				response.WrapInfo = new(AuditWrapInfo)
+			}
+			return d.object(func(key []byte) error {
+				switch string(key) {
+				case "token":
+					return d.string(&response.WrapInfo.Token)
+				case "ttl":
+					return d.int64(&response.WrapInfo.TTL)
+				case "accessor":
+					return d.string(&response.WrapInfo.Accessor)
+				case "creation_path":
+					return d.string(&response.WrapInfo.CreationPath)
+				default:
+					return d.skipField(key)
+				}
+			})
+		default:
+			return d.skipField(key)
+		}
+	})
+}
+
+// responseData decodes the fields of a response body in use. Response bodies are arbitrary, so fields of unexpected
+// types are skipped, like AuditResponseData.UnmarshalJSON does.
+func (d *jsonDecoder) responseData(data *AuditResponseData) error {
+	data.Approved = false
+	return d.object(func(key []byte) error {
+		if string(key) != "approved" {
+			return d.skipDataField(key, "approved")
+		}
+		data.Approved = false
+		if d.peek() != 't' {
+			return d.skip()
+		}
+		data.Approved = true
+		return d.literal("true")
+	})
+}
+
+func (d *jsonDecoder) auth(auth *AuditAuth) error {
+	return d.object(func(key []byte) error {
+		switch string(key) {
+		case "policies":
+			return d.strings(&auth.Policies)
+		case "token_type":
+			return d.internedString(&auth.TokenType)
+		case "token_ttl":
+			return d.int64(&auth.TokenTTL)
+		case "entity_id":
+			return d.internedString(&auth.EntityID)
+		case "client_token":
+			return d.string(&auth.ClientToken)
+		case "accessor":
+			return d.string(&auth.Accessor)
+		case "display_name":
+			return d.internedString(&auth.DisplayName)
+		case "mfa_requirement":
+			if d.null() {
+				auth.MFARequirement = nil
+				return nil
+			}
+			if auth.MFARequirement == nil {
+				auth.MFARequirement = new(AuditMFARequirement)
+			}
+			return d.mfaRequirement(auth.MFARequirement)
+		default:
+			return d.skipField(key)
+		}
+	})
+}
+
+func (d *jsonDecoder) mfaRequirement(requirement *AuditMFARequirement) error {
+	return d.object(func(key []byte) error {
+		switch string(key) {
+		case "mfa_constraints":
+			if d.null() {
+				requirement.MFAConstraints = nil
+				return nil
+			}
+			if requirement.MFAConstraints == nil {
+				requirement.MFAConstraints = make(map[string]AuditMFAConstraint)
+			}
+			return d.object(func(name []byte) error {
+				if name == nil || !utf8.Valid(name) {
+					// constraint names needing escapes or replacement characters are left to encoding/json
+					return errMalformedJSON
+				}
+				var constraint AuditMFAConstraint
+				if err := d.mfaConstraint(&constraint); err != nil {
+					return err
+				}
+				requirement.MFAConstraints[string(name)] = constraint
+				return nil
+			})
+		default:
+			return d.skipField(key)
+		}
+	})
+}
+
+func (d *jsonDecoder) mfaConstraint(constraint *AuditMFAConstraint) error {
+	return d.object(func(key []byte) error {
+		if string(key) != "any" {
+			return d.skipField(key)
+		}
+		if d.null() {
+			constraint.Any = nil
+			return nil
+		}
+		if d.peek() != '[' {
+			return errMalformedJSON
+		}
+		d.pos++
+		constraint.Any = []AuditMFAMethod{}
+		if d.peek() == ']' {
+			d.pos++
+			return nil
+		}
+		for {
+			var method AuditMFAMethod
+			err := d.object(func(key []byte) error {
+				switch string(key) {
+				case "id":
+					return d.internedString(&method.ID)
+				case "type":
+					return d.internedString(&method.Type)
+				default:
+					return d.skipField(key)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			constraint.Any = append(constraint.Any, method)
+			switch d.peek() {
+			case ',':
+				d.pos++
+			case ']':
+				d.pos++
+				return nil
+			default:
+				return errMalformedJSON
+			}
+		}
+	})
+}
+
+func (d *jsonDecoder) whitespace() {
+	for d.pos < len(d.data) {
+		switch d.data[d.pos] {
+		case ' ', '\t', '\n', '\r':
+			d.pos++
+		default:
+			return
+		}
+	}
+}
+
+// peek returns the next byte after any whitespace, or 0 at the end of the input.
+func (d *jsonDecoder) peek() byte {
+	d.whitespace()
+	if d.pos == len(d.data) {
+		return 0
+	}
+	return d.data[d.pos]
+}
+
+// null consumes a null value, reporting whether there was one.
+func (d *jsonDecoder) null() bool {
+	if d.peek() == 'n' && d.literal("null") == nil {
+		return true
+	}
+	return false
+}
+
+func (d *jsonDecoder) literal(literal string) error {
+	if len(d.data)-d.pos < len(literal) || string(d.data[d.pos:d.pos+len(literal)]) != literal {
+		return errMalformedJSON
+	}
+	d.pos += len(literal)
+	return nil
+}
+
+// object calls field with the key of each field of an object, which must consume the field's value.
+func (d *jsonDecoder) object(field func(key []byte) error) error {
+	if d.peek() != '{' {
+		return errMalformedJSON
+	}
+	d.pos++
+	if d.peek() == '}' {
+		d.pos++
+		return nil
+	}
+	for {
+		if d.peek() != '"' {
+			return errMalformedJSON
+		}
+		key, escaped, err := d.rawString()
+		if err != nil {
+			return err
+		}
+		if escaped {
+			// keys of interest never need escaping, so escaped keys are given as nil
+			key = nil
+		}
+		if d.peek() != ':' {
+			return errMalformedJSON
+		}
+		d.pos++
+		if err := field(key); err != nil {
+			return err
+		}
+		switch d.peek() {
+		case ',':
+			d.pos++
+		case '}':
+			d.pos++
+			return nil
+		default:
+			return errMalformedJSON
+		}
+	}
+}
+
+// rawString consumes a string, returning its contents without the quotes and whether it contains escape sequences.
+func (d *jsonDecoder) rawString() ([]byte, bool, error) {
+	d.pos++
+	start, escaped := d.pos, false
+	for d.pos < len(d.data) {
+		switch c := d.data[d.pos]; {
+		case c == '"':
+			d.pos++
+			return d.data[start : d.pos-1], escaped, nil
+		case c == '\\':
+			escaped = true
+			d.pos += 2
+		case c < ' ':
+			return nil, false, errMalformedJSON
+		default:
+			d.pos++
+		}
+	}
+	return nil, false, errMalformedJSON
+}
+
+// string decodes a string or null into s.
+func (d *jsonDecoder) string(s *string) error {
+	return d.decodeString(s, false)
+}
+
+// internedString decodes a string or null into s, interning strings without escape sequences.
+func (d *jsonDecoder) internedString(s *string) error {
+	return d.decodeString(s, d.interner != nil)
+}
+
+func (d *jsonDecoder) decodeString(s *string, intern bool) error {
+	switch d.peek() {
+	case '"':
+		start := d.pos
+		raw, escaped, err := d.rawString()
+		if err != nil {
+			return err
+		}
+		// encoding/json replaces invalid UTF-8, which is left to it like escape sequences
+		if !escaped && utf8.Valid(raw) {
+			if intern {
+				*s = d.interner.intern(raw)
+			} else {
+				*s = string(raw)
+			}
+			return nil
+		}
+		if err := json.Unmarshal(d.data[start:d.pos], s); err != nil {
+			return errMalformedJSON
+		}
+		return nil
+	case 'n':
+		return d.literal("null")
+	default:
+		return errMalformedJSON
+	}
+}
+
+// strings decodes an array of strings or null into s.
+func (d *jsonDecoder) strings(s *[]string) error {
+	switch d.peek() {
+	case '[':
+	case 'n':
+		*s = nil
+		return d.literal("null")
+	default:
+		return errMalformedJSON
+	}
+	d.pos++
+	values := (*s)[:0]
+	if values == nil {
+		// like encoding/json, empty arrays are decoded into empty rather than nil slices
+		values = []string{}
+	}
+	if d.peek() == ']' {
+		d.pos++
+		*s = values
+		return nil
+	}
+	for {
+		var value string
+		if err := d.internedString(&value); err != nil {
+			return err
+		}
+		values = append(values, value)
+		switch d.peek() {
+		case ',':
+			d.pos++
+		case ']':
+			d.pos++
+			*s = values
+			return nil
+		default:
+			return errMalformedJSON
+		}
+	}
+}
+
+// int64 decodes an integer or null into n.
+func (d *jsonDecoder) int64(n *int64) error {
+	if d.null() {
+		return nil
+	}
+	start := d.pos
+	if err := d.skip(); err != nil {
+		return err
+	}
+	digits := d.data[start:d.pos]
+	if digits[0] == '-' {
+		digits = digits[1:]
+	}
+	// leading zeros are invalid JSON, but accepted by strconv
+	if len(digits) > 1 && digits[0] == '0' {
+		return errMalformedJSON
+	}
+	value, err := strconv.ParseInt(string(d.data[start:d.pos]), 10, 64)
+	if err != nil {
+		return errMalformedJSON
+	}
+	*n = value
+	return nil
+}
+
+// skipField consumes the value of a field that is not decoded. encoding/json also decodes fields whose key only matches
+// in a different case, and all decoded keys are lowercase ASCII, so keys with uppercase or non-ASCII characters, or with
+// escape sequences, given as nil, are left to it.
+func (d *jsonDecoder) skipField(key []byte) error {
+	if key == nil {
+		return errMalformedJSON
+	}
+	for _, c := range key {
+		if c >= 'A' && c <= 'Z' || c >= utf8.RuneSelf {
+			return errMalformedJSON
+		}
+	}
+	return d.skip()
+}
+
+// skipDataField consumes the value of a field of a request or response body that is not decoded. Since body keys are
+// arbitrary, only keys matching one of the decoded keys in a different case, or with escape sequences, given as nil, are
+// left to encoding/json.
+func (d *jsonDecoder) skipDataField(key []byte, decoded ...string) error {
+	if key == nil {
+		return errMalformedJSON
+	}
+	for _, name := range decoded {
+		if bytes.EqualFold(key, []byte(name)) {
+			return errMalformedJSON
+		}
+	}
+	return d.skip()
+}
+
+// skip consumes a value of any type without decoding it.
+func (d *jsonDecoder) skip() error {
+	switch c := d.peek(); {
+	case c == '"':
+		_, _, err := d.rawString()
+		return err
+	case c == '{':
+		return d.object(func([]byte) error { return d.skip() })
+	case c == '[':
+		d.pos++
+		if d.peek() == ']' {
+			d.pos++
+			return nil
+		}
+		for {
+			if err := d.skip(); err != nil {
+				return err
+			}
+			switch d.peek() {
+			case ',':
+				d.pos++
+			case ']':
+				d.pos++
+				return nil
+			default:
+				return errMalformedJSON
+			}
+		}
+	case c == 't':
+		return d.literal("true")
+	case c == 'f':
+		return d.literal("false")
+	case c == 'n':
+		return d.literal("null")
+	case c == '-' || c >= '0' && c <= '9':
+		start := d.pos
+		for d.pos < len(d.data) && isNumberByte(d.data[d.pos]) {
+			d.pos++
+		}
+		if d.pos == start {
+			return errMalformedJSON
+		}
+		return nil
+	default:
+		return errMalformedJSON
+	}
+}
+
+func isNumberByte(c byte) bool {
+	return c >= '0' && c <= '9' || c == '-' || c == '+' || c == '.' || c == 'e' || c == 'E'
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// decodeTestRequest is a request line using every decoded field of requests.
+const decodeTestRequest = `{"time":"2022-03-01T10:00:00.123456Z","type":"request","auth":{"client_token":"hmac-sha256:ct",` +
+	`"accessor":"hmac-sha256:acc","display_name":"userpass-alice","policies":["default","dev"],` +
+	`"token_policies":["default"],"token_type":"service","token_ttl":3600,"entity_id":"e1","metadata":{"username":"alice"}},` +
+	`"request":{"id":"r1","client_id":"c1","operation":"update","mount_type":"kv","client_token":"hmac-sha256:ct",` +
+	`"client_token_accessor":"hmac-sha256:acc","namespace":{"id":"root","path":""},"path":"sys/wrapping/unwrap",` +
+	`"data":{"token":"hmac-sha256:wt","accessor":"hmac-sha256:wa","other":[1,2.5,-3e2,true,false,null]},` +
+	`"wrap_ttl":300,"remote_address":"10.0.0.1","headers":{"X-Forwarded-For":["10.0.0.2"]}},"error":""}`
+
+// decodeTestResponse is a response line using every decoded field of responses.
+const decodeTestResponse = `{"time":"2022-03-01T10:00:00.2Z","type":"response","auth":{"client_token":"hmac-sha256:ct",` +
+	`"policies":["default"],"token_type":"batch","mfa_requirement":{"mfa_request_id":"m1","mfa_constraints":` +
+	`{"totp":{"any":[{"id":"m-1","type":"totp","uses_passcode":true},{"id":"m-2","type":"duo"}]},"none":{"any":[]}}}},` +
+	`"request":{"id":"r1","operation":"read","path":"database/creds/app","remote_address":"10.0.0.1"},` +
+	`"response":{"auth":{"client_token":"hmac-sha256:new","accessor":"hmac-sha256:newacc","policies":["app"],` +
+	`"token_type":"service","token_ttl":-1,"entity_id":"e2","display_name":"approle"},"secret":{"lease_id":"database/creds/app/l1"},` +
+	`"lease_duration":3600,"wrap_info":{"token":"hmac-sha256:wt","ttl":300,"accessor":"hmac-sha256:wa",` +
+	`"creation_path":"database/creds/app","creation_time":"2022-03-01T10:00:00Z"},"data":{"approved":true,"username":"u"}}}`
+
+func TestDecodeAuditEntry(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		// fallback is whether the line is left to encoding/json rather than decoded by the fast decoder.
+		fallback bool
+	}{
+		{name: "request", line: decodeTestRequest},
+		{name: "response", line: decodeTestResponse},
+		{name: "empty", line: `{}`},
+		{name: "whitespace", line: " \t{ \"type\" : \"request\" , \"request\" : { \"id\" : \"r1\" } }\r\n"},
+		{name: "empty containers", line: `{"auth":{"policies":[]},"request":{"data":{}},"response":{"data":{}}}`},
+
+		{name: "escaped values", line: `{"type":"request","error":"permission denied\n","request":{"id":"a\\b\u0000",` +
+			`"path":"secret/\"quoted\"/é😀","data":{"token":"\/t"}},"auth":{"policies":["a\tb"]}}`},
+		{name: "escaped skipped values", line: `{"type":"request","request":{"id":"r1","data":{"x":"\"}\\"}}}`},
+		{name: "escaped key", line: `{"\u0074ype":"request"}`, fallback: true},
+		{name: "escaped skipped key", line: `{"type":"request","request":{"headers":{"\u0078":1}}}`},
+		{name: "escaped data key", line: `{"request":{"data":{"\u0074oken":"t"}}}`, fallback: true},
+		{name: "escaped MFA method ID", line: `{"request":{"data":{"mfa_payload":{"\u0061":["1"]}}}}`, fallback: true},
+		{name: "non-ASCII", line: `{"request":{"id":"r1","path":"secret/café"},"auth":{"display_name":"ünïcode"}}`},
+		{name: "invalid UTF-8", line: "{\"request\":{\"path\":\"secret/\xff\",\"id\":\"\xc3\"}}"},
+		{name: "invalid UTF-8 in skipped value", line: "{\"request\":{\"id\":\"r1\",\"data\":{\"x\":\"\xff\"}}}"},
+
+		{name: "key in upper case", line: `{"Type":"request"}`, fallback: true},
+		{name: "nested key in upper case", line: `{"request":{"PATH":"secret/foo"}}`, fallback: true},
+		{name: "data key in upper case", line: `{"request":{"data":{"Token":"t"}}}`, fallback: true},
+		{name: "data key with Kelvin sign", line: `{"request":{"data":{"to` + "\u212a" + `en":"t"}}}`, fallback: true},
+		{name: "other data keys in upper case", line: `{"request":{"data":{"Password":"p","token":"t"}},` +
+			`"response":{"data":{"APPROVED":"x","approved":true}}}`, fallback: true},
+		{name: "unrelated data keys in upper case", line: `{"request":{"data":{"Password":"p","token":"t"}},` +
+			`"response":{"data":{"Username":"u","approved":true}}}`},
+
+		{name: "nulls", line: `{"time":null,"type":null,"error":null,"auth":null,"request":{"id":null,"namespace":null,` +
+			`"wrap_ttl":null,"data":null},"response":{"auth":null,"secret":null,"wrap_info":null,"data":null,` +
+			`"lease_duration":null}}`},
+		{name: "null request", line: `{"type":"request","request":null}`},
+		{name: "null elements", line: `{"auth":{"policies":["a",null,"b"],"mfa_requirement":{"mfa_constraints":` +
+			`{"c":{"any":null}}}}}`},
+		{name: "null policies", line: `{"auth":{"policies":null}}`},
+		{name: "null data fields", line: `{"request":{"data":{"token":null,"accessor":null,"mfa_payload":null}},` +
+			`"response":{"data":{"approved":null}}}`},
+		{name: "null line", line: `null`, fallback: true},
+
+		{name: "unexpected data types", line: `{"request":{"data":{"token":5,"accessor":{"a":"b"},"mfa_payload":["x"]}},` +
+			`"response":{"data":{"approved":"true"}}}`},
+		{name: "false approval", line: `{"response":{"data":{"approved":false}}}`},
+		{name: "data of unexpected type", line: `{"request":{"data":"x"}}`, fallback: true},
+		{name: "string of unexpected type", line: `{"request":{"path":5}}`, fallback: true},
+		{name: "integer of unexpected type", line: `{"request":{"wrap_ttl":"300"}}`, fallback: true},
+		{name: "fractional integer", line: `{"response":{"lease_duration":1.5}}`, fallback: true},
+		{name: "integer with exponent", line: `{"response":{"lease_duration":1e3}}`, fallback: true},
+		{name: "integer with leading zero", line: `{"response":{"lease_duration":010}}`, fallback: true},
+		{name: "integer overflow", line: `{"response":{"lease_duration":9223372036854775808}}`, fallback: true},
+		{name: "negative integer", line: `{"response":{"lease_duration":-0,"auth":{"token_ttl":-9223372036854775808}}}`},
+		{name: "policies of unexpected type", line: `{"auth":{"policies":"root"}}`, fallback: true},
+		{name: "request of unexpected type", line: `{"request":[]}`, fallback: true},
+		{name: "MFA methods of unexpected type", line: `{"auth":{"mfa_requirement":{"mfa_constraints":{"c":{"any":{}}}}}}`,
+			fallback: true},
+
+		{name: "nested data", line: `{"request":{"data":{"token":"t","nested":{"token":"inner","accessor":"inner",` +
+			`"mfa_payload":{"x":[]}},"list":[{"accessor":"a"},[{"token":"b"}]]}},` +
+			`"response":{"data":{"nested":{"approved":true},"approved":false}}}`},
+		{name: "repeated data fields", line: `{"request":{"data":{"token":"a","accessor":"b","mfa_payload":{"m":[]},` +
+			`"token":5,"accessor":null,"mfa_payload":"x"}},"response":{"data":{"approved":true,"approved":1}}}`},
+		{name: "repeated data", line: `{"request":{"data":{"token":"a","accessor":"b"},"data":{"x":1}},` +
+			`"response":{"data":{"approved":true},"data":{}}}`},
+		{name: "repeated fields", line: `{"type":"request","type":"response","request":{"id":"a","path":"p"},` +
+			`"request":{"id":"b"},"auth":{"policies":["a","b"],"policies":["c"]}}`},
+
+		{name: "MFA payload", line: `{"request":{"path":"sys/mfa/validate","data":{"mfa_request_id":"m1",` +
+			`"mfa_payload":{"method-b":["123456"],"method-a":[],"method-c":{"passcode":"1"}}}}}`},
+		{name: "empty MFA payload", line: `{"request":{"data":{"mfa_payload":{}}}}`},
+		{name: "repeated MFA method IDs", line: `{"request":{"data":{"mfa_payload":{"b":[],"a":[],"b":["1"],"a":[]}}}}`},
+		{name: "non-ASCII MFA method ID", line: `{"request":{"data":{"mfa_payload":{"é":[]}}}}`},
+		{name: "invalid UTF-8 MFA method ID", line: "{\"request\":{\"data\":{\"mfa_payload\":{\"\xff\":[]}}}}",
+			fallback: true},
+
+		{name: "trailing garbage", line: `{"type":"request"} x`, fallback: true},
+		{name: "second value", line: `{"type":"request"}{"type":"response"}`, fallback: true},
+		{name: "missing comma", line: `{"type":"request" "error":""}`, fallback: true},
+		{name: "trailing comma", line: `{"type":"request",}`, fallback: true},
+		{name: "control character", line: "{\"error\":\"a\tb\"}", fallback: true},
+		{name: "empty line", line: ``, fallback: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testDecodeAuditEntry(t, []byte(test.line), test.fallback)
+		})
+	}
+}
+
+// TestDecodeAuditEntryTruncated checks that every truncation of a line is rejected by both decoders.
+func TestDecodeAuditEntryTruncated(t *testing.T) {
+	for _, line := range []string{decodeTestRequest, decodeTestResponse} {
+		for i := 0; i < len(line); i++ {
+			testDecodeAuditEntry(t, []byte(line[:i]), true)
+		}
+	}
+}
+
+// TestDecodeAuditEntryLog checks that the lines of the test audit log are decoded by the fast decoder like encoding/json
+// decodes them.
+func TestDecodeAuditEntryLog(t *testing.T) {
+	file, err := os.Open("test/vault-audit.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	lines := 0
+	for scanner.Scan() {
+		lines++
+		testDecodeAuditEntry(t, scanner.Bytes(), false)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if lines == 0 {
+		t.Fatal("no lines in test/vault-audit.log")
+	}
+}
+
+// testDecodeAuditEntry checks that decodeAuditEntry decodes line into the same entry as encoding/json, or, if fallback,
+// that it leaves line to encoding/json by failing.
+func testDecodeAuditEntry(t *testing.T, line []byte, fallback bool) {
+	t.Helper()
+	var want AuditEntry
+	wantErr := json.Unmarshal(line, &want)
+
+	var got AuditEntry
+	err := decodeAuditEntry(line, &got, newStringInterner(maxInternedStrings))
+	switch {
+	case fallback && err == nil:
+		t.Errorf("decoding %q: decoded %s, want it left to encoding/json", line, describeAuditEntry(&got))
+	case !fallback && err != nil:
+		t.Errorf("decoding %q: %v, want %s (error %v)", line, err, describeAuditEntry(&want), wantErr)
+	case err == nil && wantErr != nil:
+		t.Errorf("decoding %q: decoded %s, want encoding/json error %v", line, describeAuditEntry(&got), wantErr)
+	case err == nil && !reflect.DeepEqual(got, want):
+		t.Errorf("decoding %q: decoded %s, want %s", line, describeAuditEntry(&got), describeAuditEntry(&want))
+	}
+}
+
+// describeAuditEntry formats an entry for test failures, including the fields that are not encoded to JSON.
+func describeAuditEntry(entry *AuditEntry) string {
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		return err.Error()
+	}
+	if entry.Request != nil && entry.Request.Data != nil {
+		return fmt.Sprintf("%s with MFA method IDs %#v", encoded, entry.Request.Data.MFAMethodIDs)
+	}
+	return string(encoded)
+}
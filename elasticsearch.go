@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultElasticsearchIndex is the data stream events are written to if unset, named by the data stream naming
+	// scheme so that Elasticsearch's built-in logs template applies unless an index template is installed.
+	defaultElasticsearchIndex = "logs-vault.audit-default"
+	// elasticsearchTemplatePriority is the priority of the installed index template, above that of the built-in
+	// templates.
+	elasticsearchTemplatePriority = 200
+	// elasticsearchBulkPath is the path of the bulk API, with the response limited to what is needed to tell which
+	// events were rejected.
+	elasticsearchBulkPath = "/_bulk?filter_path=errors,items.*.status,items.*.error.type,items.*.error.reason"
+)
+
+// elasticsearchSink indexes audit events into Elasticsearch or OpenSearch with the bulk API. Each event is a document
+// of its audit log line, along with its timestamp as @timestamp and the event's labels selected for the sink under
+// labels. Events are written to a data stream, which leaves rollover and retention to index lifecycle management, or to
+// an index named after the event's day, such as "vault-audit-2006.01.02". Events rejected for throttling are retried,
+// while the rest of the batch is not sent again.
+type elasticsearchSink struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+	// indexPrefix, indexLayout, and indexSuffix make up the name of the index of an event, where indexLayout is the
+	// time layout of its day, if any.
+	indexPrefix string
+	indexLayout string
+	indexSuffix string
+	// templateName and template are the name and body of the index template installed before the first write, if any.
+	templateName string
+	template     []byte
+}
+
+func newElasticsearchSink(cfg EventSinkConfig) (*elasticsearchSink, error) {
+	base, err := url.Parse(strings.TrimSuffix(cfg.URL, "/"))
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") {
+		return nil, fmt.Errorf("an http or https url is required")
+	}
+	s := &elasticsearchSink{
+		url:          base.String(),
+		headers:      make(map[string]string, len(cfg.Headers)+1),
+		client:       &http.Client{Timeout: sinkTimeout},
+		indexPrefix:  cfg.Index,
+		templateName: cfg.IndexTemplate,
+	}
+	if s.indexPrefix == "" {
+		s.indexPrefix = defaultElasticsearchIndex
+	}
+	if start := strings.IndexByte(s.indexPrefix, '{'); start >= 0 {
+		end := strings.IndexByte(s.indexPrefix[start:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("invalid index: %q", cfg.Index)
+		}
+		s.indexLayout = s.indexPrefix[start+1 : start+end]
+		s.indexPrefix, s.indexSuffix = s.indexPrefix[:start], s.indexPrefix[start+end+1:]
+	}
+	if s.indexPrefix+s.indexSuffix != strings.ToLower(s.indexPrefix+s.indexSuffix) {
+		return nil, fmt.Errorf("index must be lowercase")
+	}
+	if cfg.Username != "" {
+		s.headers["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(cfg.Username+":"+cfg.Password))
+	}
+	for name, value := range cfg.Headers {
+		s.headers[name] = value
+	}
+	if cfg.ILMPolicy != "" && s.templateName == "" {
+		return nil, fmt.Errorf("ilm_policy is set in the index template, which requires index_template")
+	}
+	if s.templateName != "" {
+		if s.template, err = s.indexTemplate(cfg.ILMPolicy); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// indexTemplate returns the body of the index template for the sink's indices, which makes them a data stream unless
+// they are named by day, and leaves the request and response data unindexed, so that arbitrary keys in them don't
+// inflate the mapping.
+func (s *elasticsearchSink) indexTemplate(ilmPolicy string) ([]byte, error) {
+	pattern := s.indexPrefix + s.indexSuffix
+	if s.indexLayout != "" {
+		pattern = s.indexPrefix + "*" + s.indexSuffix
+	}
+	unindexed := map[string]interface{}{"type": "object", "enabled": false}
+	template := map[string]interface{}{
+		"mappings": map[string]interface{}{
+			"dynamic_templates": []interface{}{
+				map[string]interface{}{"strings": map[string]interface{}{
+					"match_mapping_type": "string",
+					"mapping":            map[string]interface{}{"type": "keyword", "ignore_above": 1024},
+				}},
+			},
+			"properties": map[string]interface{}{
+				"@timestamp": map[string]interface{}{"type": "date"},
+				"labels":     map[string]interface{}{"type": "object"},
+				"request":    map[string]interface{}{"properties": map[string]interface{}{"data": unindexed}},
+				"response":   map[string]interface{}{"properties": map[string]interface{}{"data": unindexed}},
+			},
+		},
+	}
+	if ilmPolicy != "" {
+		template["settings"] = map[string]interface{}{"index.lifecycle.name": ilmPolicy}
+	}
+	body := map[string]interface{}{
+		"index_patterns": []string{pattern},
+		"priority":       elasticsearchTemplatePriority,
+		"template":       template,
+		"_meta":          map[string]interface{}{"managed_by": "vault-audit-metrics"},
+	}
+	if s.indexLayout == "" {
+		body["data_stream"] = map[string]interface{}{}
+	}
+	return json.Marshal(body)
+}
+
+func (s *elasticsearchSink) send(events []*forwardedEvent) error {
+	if s.template != nil {
+		_, err := sendSink(s.client, http.MethodPut, s.url+"/_index_template/"+url.PathEscape(s.templateName),
+			"application/json", s.headers, s.template, false)
+		if err != nil {
+			return fmt.Errorf("error installing index template: %w", err)
+		}
+		s.template = nil
+	}
+
+	var buf bytes.Buffer
+	for _, event := range events {
+		if err := s.appendAction(&buf, event); err != nil {
+			return err
+		}
+	}
+	body, err := sendSink(s.client, http.MethodPost, s.url+elasticsearchBulkPath, "application/x-ndjson", s.headers,
+		buf.Bytes(), true)
+	if err != nil {
+		return err
+	}
+
+	var response struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int `json:"status"`
+			Error  struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return fmt.Errorf("error decoding bulk response: %v", err)
+	}
+	if !response.Errors {
+		return nil
+	}
+	if len(response.Items) != len(events) {
+		return fmt.Errorf("bulk response has %d items for %d events", len(response.Items), len(events))
+	}
+	partial := new(partialSendError)
+	for i, item := range response.Items {
+		for _, result := range item {
+			if result.Status >= 200 && result.Status <= 299 {
+				continue
+			}
+			status := &sinkStatusError{status: result.Status, body: result.Error.Type + ": " + result.Error.Reason}
+			if status.retryable() {
+				partial.retry = append(partial.retry, events[i])
+			} else {
+				partial.rejected++
+			}
+			if partial.err == nil || !status.retryable() {
+				partial.err = status
+			}
+		}
+	}
+	if partial.err == nil {
+		return nil
+	}
+	return partial
+}
+
+// appendAction appends the bulk action creating the document of an event to buf. Data streams only accept create
+// actions, which index a new document like any other action since no ID is given.
+func (s *elasticsearchSink) appendAction(buf *bytes.Buffer, event *forwardedEvent) error {
+	index := s.indexPrefix + s.indexSuffix
+	if s.indexLayout != "" {
+		index = s.indexPrefix + event.time.UTC().Format(s.indexLayout) + s.indexSuffix
+	}
+	action, err := json.Marshal(map[string]interface{}{"create": map[string]string{"_index": index}})
+	if err != nil {
+		return err
+	}
+	line := bytes.TrimSpace(event.line)
+	if len(line) < 2 || line[0] != '{' {
+		return fmt.Errorf("audit log line is not a JSON object")
+	}
+	// the fields are spliced into the line rather than decoding and encoding it again
+	fields, err := json.Marshal(struct {
+		Timestamp string            `json:"@timestamp"`
+		Labels    map[string]string `json:"labels,omitempty"`
+	}{event.time.UTC().Format(time.RFC3339Nano), event.labels})
+	if err != nil {
+		return err
+	}
+	buf.Write(action)
+	buf.WriteByte('\n')
+	buf.Write(fields[:len(fields)-1])
+	if rest := bytes.TrimSpace(line[1:]); len(rest) > 0 && rest[0] != '}' {
+		buf.WriteByte(',')
+	}
+	buf.Write(line[1:])
+	buf.WriteByte('\n')
+	return nil
+}
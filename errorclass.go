@@ -0,0 +1,83 @@
+package main
+
+import "strings"
+
+const (
+	ErrorClassNone             = ""
+	ErrorClassPermissionDenied = "permission_denied"
+	ErrorClassInvalidRequest   = "invalid_request"
+	ErrorClassUpstreamError    = "upstream_error"
+	ErrorClassSealed           = "sealed"
+	ErrorClassRateLimited      = "rate_limited"
+	ErrorClassOther            = "other"
+)
+
+const (
+	CodeClassSuccess     = "2xx"
+	CodeClassClientError = "4xx"
+	CodeClassServerError = "5xx"
+)
+
+// errorClassRules maps words and phrases of lowercased Vault error messages to error classes. Patterns only match whole
+// words, so that "sealed" doesn't match "unsealed" and "eof" doesn't match "geoff". Rules are checked in order, so more
+// specific conditions (such as a sealed Vault) come before generic ones.
+var errorClassRules = []struct {
+	class    string
+	patterns []string
+}{
+	{ErrorClassSealed, []string{"vault is sealed", "sealed"}},
+	{ErrorClassRateLimited, []string{"rate limit", "quota exceeded", "too many requests"}},
+	{ErrorClassPermissionDenied, []string{"permission denied", "invalid token", "missing client token", "unauthorized", "forbidden"}},
+	{ErrorClassUpstreamError, []string{"connection refused", "connection reset", "timeout", "timed out", "deadline exceeded", "no such host", "i/o", "internal error", "unavailable", "eof"}},
+	{ErrorClassInvalidRequest, []string{"invalid", "missing", "unsupported", "unknown", "not found", "no handler", "bad request", "required", "malformed", "already exists"}},
+}
+
+// ClassifyError maps a raw Vault error message into a small, fixed set of error classes. An empty message yields an
+// empty class.
+func ClassifyError(msg string) string {
+	if msg == "" {
+		return ErrorClassNone
+	}
+	lower := strings.ToLower(msg)
+	for _, rule := range errorClassRules {
+		for _, pattern := range rule.patterns {
+			if containsWord(lower, pattern) {
+				return rule.class
+			}
+		}
+	}
+	return ErrorClassOther
+}
+
+// containsWord reports whether pattern occurs in s neither preceded nor followed by a letter or digit.
+func containsWord(s, pattern string) bool {
+	for offset := 0; ; {
+		i := strings.Index(s[offset:], pattern)
+		if i < 0 {
+			return false
+		}
+		start, end := offset+i, offset+i+len(pattern)
+		if (start == 0 || !isWordByte(s[start-1])) && (end == len(s) || !isWordByte(s[end])) {
+			return true
+		}
+		offset = start + 1
+	}
+}
+
+// isWordByte reports whether b is an ASCII letter or digit, or part of a multi-byte UTF-8 sequence.
+func isWordByte(b byte) bool {
+	return 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' || b >= 0x80
+}
+
+// CodeClass maps an error class to an HTTP-status-style outcome class: 2xx when there is no error, 4xx for errors caused
+// by the client, and 5xx for everything else.
+func CodeClass(errorClass string) string {
+	switch errorClass {
+	case ErrorClassNone:
+		return CodeClassSuccess
+	case ErrorClassPermissionDenied, ErrorClassInvalidRequest, ErrorClassRateLimited:
+		return CodeClassClientError
+	default:
+		return CodeClassServerError
+	}
+}
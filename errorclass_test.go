@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want string
+	}{
+		{msg: "", want: ErrorClassNone},
+		{msg: "Vault is sealed", want: ErrorClassSealed},
+		{msg: "error performing token check: Vault is sealed", want: ErrorClassSealed},
+		{msg: "1 error occurred:\n\t* permission denied\n\n", want: ErrorClassPermissionDenied},
+		{msg: "missing client token", want: ErrorClassPermissionDenied},
+		{msg: "1 error occurred:\n\t* unsupported path\n\n", want: ErrorClassInvalidRequest},
+		{msg: "rate limit quota exceeded", want: ErrorClassRateLimited},
+		{msg: "dial tcp 10.0.0.1:5432: connect: connection refused", want: ErrorClassUpstreamError},
+		{msg: "read tcp 10.0.0.1:8200: i/o timeout", want: ErrorClassUpstreamError},
+		{msg: "unexpected EOF", want: ErrorClassUpstreamError},
+		{msg: "EOF", want: ErrorClassUpstreamError},
+
+		// patterns that occur inside other words
+		{msg: "cannot rekey while Vault is unsealed", want: ErrorClassOther},
+		{msg: "unsealing is in progress", want: ErrorClassOther},
+		{msg: `entity alias "geoffrey" is disabled`, want: ErrorClassOther},
+		{msg: "transit key wi/oaep is disabled", want: ErrorClassOther},
+		{msg: "role has been invalidated", want: ErrorClassOther},
+		{msg: "cannot unseal: Vault is sealed", want: ErrorClassSealed},
+		{msg: "the Vault was unsealed, then sealed again", want: ErrorClassSealed},
+		{msg: "ünsealed", want: ErrorClassOther},
+	}
+	for _, test := range tests {
+		if got := ClassifyError(test.msg); got != test.want {
+			t.Errorf("ClassifyError(%q) = %q, want %q", test.msg, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// defaultEventSinkInterval is the longest time a forwarded event waits for its batch to fill up if unset.
+	defaultEventSinkInterval = time.Second
+	// defaultEventSinkBatchSize is the number of events sent to a sink at once if unset.
+	defaultEventSinkBatchSize = 1000
+	// defaultEventSinkQueueSize is the number of events that may wait to be sent to a sink if unset, beyond which new
+	// events are dropped.
+	defaultEventSinkQueueSize = 10000
+	// defaultS3EventSinkInterval, defaultS3EventSinkBatchSize, and defaultS3EventSinkBatchBytes replace the defaults of
+	// the other sinks for s3 sinks, where every batch is an object, and objects should be few and large.
+	defaultS3EventSinkInterval   = 5 * time.Minute
+	defaultS3EventSinkBatchSize  = 1000000
+	defaultS3EventSinkBatchBytes = 64 << 20
+	// eventSinkRetries is the number of times a batch that failed with a retryable error is sent again.
+	eventSinkRetries = 5
+	// eventSinkMinBackoff and eventSinkMaxBackoff bound the exponential backoff between retries of a batch.
+	eventSinkMinBackoff = 500 * time.Millisecond
+	eventSinkMaxBackoff = 30 * time.Second
+	// redactedValue replaces the values of redacted fields.
+	redactedValue = "[redacted]"
+)
+
+// Types of event sinks.
+const (
+	EventSinkLoki          = "loki"
+	EventSinkElasticsearch = "elasticsearch"
+	EventSinkSplunk        = "splunk"
+	EventSinkS3            = "s3"
+)
+
+// forwardedEvent is an audit event as forwarded to an event sink.
+type forwardedEvent struct {
+	time time.Time
+	// line is the audit log line, with the fields redacted for the sink.
+	line []byte
+	// labels are the event's labels selected for the sink, leaving out empty ones.
+	labels map[string]string
+}
+
+// eventSink sends batches of forwarded audit events to a backend.
+type eventSink interface {
+	send(events []*forwardedEvent) error
+}
+
+// partialSendError is returned by sinks that accept some events of a batch and reject others, such as bulk APIs, so
+// that only the rejected events are sent again.
+type partialSendError struct {
+	// retry are the rejected events that may be accepted if sent again, such as those rejected by throttling.
+	retry []*forwardedEvent
+	// rejected is the number of rejected events that won't be accepted if sent again.
+	rejected int
+	// err is the error of one of the rejected events.
+	err error
+}
+
+func (e *partialSendError) Error() string {
+	return fmt.Sprintf("%d events rejected: %v", len(e.retry)+e.rejected, e.err)
+}
+
+// EventSinks forward the audit events that are metered, that is those passing the filters, sampling, expressions, and
+// relabeling, to log backends such as Grafana Loki or Elasticsearch, so that the events behind the metrics can be looked
+// at alongside them. Each sink may narrow down the events further with filters of its own, redact fields of their
+// lines, and label them with the event's labels after relabeling. Events are queued and sent in batches in the
+// background, so that a slow or failing backend doesn't hold up processing; events that don't fit the queue are dropped.
+type EventSinks struct {
+	sinks []*configuredEventSink
+
+	counterSent    *prometheus.CounterVec
+	counterDropped *prometheus.CounterVec
+	counterErrors  *prometheus.CounterVec
+}
+
+// configuredEventSink is an event sink along with its settings and queue.
+type configuredEventSink struct {
+	name      string
+	sink      eventSink
+	filter    *EventFilter
+	labels    []string
+	redact    [][]string
+	interval  time.Duration
+	batchSize int
+	// batchBytes is the size of the lines of a batch that it is sent at, or 0 if only its number of events counts.
+	batchBytes int
+	queue      chan *forwardedEvent
+	// flush receives a channel to close once the queued events were sent.
+	flush chan chan struct{}
+}
+
+// NewEventSinks constructs EventSinks for the configured sinks and starts sending events to them in the background.
+func NewEventSinks(configs []EventSinkConfig) (*EventSinks, error) {
+	s := new(EventSinks)
+	names := make(map[string]bool)
+	for _, cfg := range configs {
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("event sink name is required")
+		}
+		if names[cfg.Name] {
+			return nil, fmt.Errorf("event sink %s is configured more than once", cfg.Name)
+		}
+		names[cfg.Name] = true
+		if cfg.Interval < 0 || cfg.BatchSize < 0 || cfg.BatchBytes < 0 || cfg.QueueSize < 0 {
+			return nil, fmt.Errorf("event sink %s: interval, batch_size, batch_bytes, and queue_size must not be negative",
+				cfg.Name)
+		}
+		interval, batchSize, batchBytes := defaultEventSinkInterval, defaultEventSinkBatchSize, 0
+		if cfg.Type == EventSinkS3 {
+			interval, batchSize, batchBytes = defaultS3EventSinkInterval, defaultS3EventSinkBatchSize,
+				defaultS3EventSinkBatchBytes
+		}
+		if cfg.Interval == 0 {
+			cfg.Interval = interval
+		}
+		if cfg.BatchSize == 0 {
+			cfg.BatchSize = batchSize
+		}
+		if cfg.BatchBytes == 0 {
+			cfg.BatchBytes = batchBytes
+		}
+		if cfg.QueueSize == 0 {
+			cfg.QueueSize = defaultEventSinkQueueSize
+		}
+		filter, err := NewEventFilter(&cfg.Filters)
+		if err != nil {
+			return nil, fmt.Errorf("event sink %s: %v", cfg.Name, err)
+		}
+		var sink eventSink
+		switch cfg.Type {
+		case EventSinkLoki:
+			sink, err = newLokiSink(cfg)
+		case EventSinkElasticsearch:
+			sink, err = newElasticsearchSink(cfg)
+		case EventSinkSplunk:
+			sink, err = newSplunkSink(cfg)
+		case EventSinkS3:
+			sink, err = newS3Sink(cfg)
+		default:
+			err = fmt.Errorf("unknown type %q", cfg.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("event sink %s: %v", cfg.Name, err)
+		}
+		configured := &configuredEventSink{
+			name:       cfg.Name,
+			sink:       sink,
+			filter:     filter,
+			labels:     cfg.Labels,
+			interval:   cfg.Interval,
+			batchSize:  cfg.BatchSize,
+			batchBytes: cfg.BatchBytes,
+			queue:      make(chan *forwardedEvent, cfg.QueueSize),
+			flush:      make(chan chan struct{}),
+		}
+		for _, field := range cfg.Redact {
+			configured.redact = append(configured.redact, strings.Split(field, "."))
+		}
+		s.sinks = append(s.sinks, configured)
+	}
+
+	s.counterSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "event_sinks",
+		Name:      "events_sent_total",
+		Help:      "Number of audit events sent to an event sink. Partitioned by sink.",
+	},
+		[]string{"sink"})
+	s.counterDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "event_sinks",
+		Name:      "events_dropped_total",
+		Help:      "Number of audit events that could not be sent to an event sink. Partitioned by sink and reason (queue_full, redaction, or send).",
+	},
+		[]string{"sink", "reason"})
+	s.counterErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "event_sinks",
+		Name:      "send_errors_total",
+		Help:      "Number of failed attempts to send a batch of audit events to an event sink, including those retried. Partitioned by sink.",
+	},
+		[]string{"sink"})
+
+	for _, sink := range s.sinks {
+		go s.run(sink)
+	}
+	return s, nil
+}
+
+func (s *EventSinks) collectors() []prometheus.Collector {
+	return []prometheus.Collector{s.counterSent, s.counterDropped, s.counterErrors}
+}
+
+// Observe queues a metered audit event for the sinks whose filters it passes, without blocking.
+func (s *EventSinks) Observe(auditEvent *AuditEvent) {
+	for _, sink := range s.sinks {
+		if !sink.filter.Match(auditEvent.entry) {
+			continue
+		}
+		event := &forwardedEvent{time: auditEvent.time, line: auditEvent.line}
+		if len(sink.redact) > 0 {
+			line, err := redactLine(auditEvent.line, sink.redact)
+			if err != nil {
+				logError("error redacting audit event", "sink", sink.name, "event", redactEntry(auditEvent.entry),
+					"error", err)
+				s.counterDropped.WithLabelValues(sink.name, "redaction").Inc()
+				continue
+			}
+			event.line = line
+		}
+		if len(sink.labels) > 0 {
+			all := auditEvent.Labels()
+			event.labels = make(map[string]string, len(sink.labels))
+			for _, name := range sink.labels {
+				if all[name] != "" {
+					event.labels[name] = all[name]
+				}
+			}
+		}
+		select {
+		case sink.queue <- event:
+		default:
+			s.counterDropped.WithLabelValues(sink.name, "queue_full").Inc()
+		}
+	}
+}
+
+// Flush sends the queued events to every sink right away, so that they aren't lost on shutdown or at the end of a batch
+// run. Batches that fail aren't retried, so that shutdown isn't held up.
+func (s *EventSinks) Flush() {
+	for _, sink := range s.sinks {
+		done := make(chan struct{})
+		sink.flush <- done
+		<-done
+	}
+}
+
+// run sends the events queued for a sink once a batch is full, by number of events or size, or every interval.
+func (s *EventSinks) run(sink *configuredEventSink) {
+	ticker := time.NewTicker(sink.interval)
+	defer ticker.Stop()
+	var batch []*forwardedEvent
+	var size int
+	add := func(event *forwardedEvent) bool {
+		batch = append(batch, event)
+		size += len(event.line)
+		return len(batch) >= sink.batchSize || (sink.batchBytes > 0 && size >= sink.batchBytes)
+	}
+	for {
+		select {
+		case event := <-sink.queue:
+			if add(event) {
+				s.send(sink, batch, eventSinkRetries)
+				batch, size = nil, 0
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				s.send(sink, batch, eventSinkRetries)
+				batch, size = nil, 0
+			}
+		case done := <-sink.flush:
+			for flushed := false; !flushed; {
+				full := false
+				select {
+				case event := <-sink.queue:
+					full = add(event)
+				default:
+					flushed = true
+				}
+				if len(batch) > 0 && (flushed || full) {
+					s.send(sink, batch, 0)
+					batch, size = nil, 0
+				}
+			}
+			close(done)
+		}
+	}
+}
+
+// send sends a batch of events to a sink, retrying up to retries times with exponential backoff while it fails with
+// errors that may not recur, such as server errors and throttling. Of batches that were partially accepted, only the
+// events that may be accepted if sent again are retried.
+func (s *EventSinks) send(sink *configuredEventSink, batch []*forwardedEvent, retries int) {
+	backoff := eventSinkMinBackoff
+	for attempt := 0; ; attempt++ {
+		err := sink.sink.send(batch)
+		if err == nil {
+			s.counterSent.WithLabelValues(sink.name).Add(float64(len(batch)))
+			return
+		}
+		s.counterErrors.WithLabelValues(sink.name).Inc()
+		var partial *partialSendError
+		if errors.As(err, &partial) {
+			s.counterSent.WithLabelValues(sink.name).Add(float64(len(batch) - len(partial.retry) - partial.rejected))
+			if partial.rejected > 0 {
+				logError("audit events rejected", "sink", sink.name, "events", partial.rejected, "error", partial.err)
+				s.counterDropped.WithLabelValues(sink.name, "send").Add(float64(partial.rejected))
+			}
+			if batch = partial.retry; len(batch) == 0 {
+				return
+			}
+		}
+		if attempt >= retries || !retryableSinkError(err) {
+			logError("error sending audit events", "sink", sink.name, "events", len(batch), "error", err)
+			s.counterDropped.WithLabelValues(sink.name, "send").Add(float64(len(batch)))
+			return
+		}
+		logWarn("error sending audit events, retrying", "sink", sink.name, "events", len(batch), "error", err,
+			"backoff", backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > eventSinkMaxBackoff {
+			backoff = eventSinkMaxBackoff
+		}
+	}
+}
+
+// redactLine replaces the values of fields of an audit log line, given as paths of object keys, with redactedValue.
+// Fields that are absent are left alone.
+func redactLine(line []byte, fields [][]string) ([]byte, error) {
+	var document map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	// numbers are kept as they are written, rather than converted to floats and back
+	decoder.UseNumber()
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+	for _, path := range fields {
+		object := document
+		for i, key := range path {
+			value, found := object[key]
+			if !found {
+				break
+			}
+			if i == len(path)-1 {
+				object[key] = redactedValue
+				break
+			}
+			if object, found = value.(map[string]interface{}); !found {
+				break
+			}
+		}
+	}
+	return json.Marshal(document)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/antonmedv/expr"
+	"github.com/antonmedv/expr/vm"
+)
+
+// Expression rule actions.
+const (
+	ExpressionActionKeep   = "keep"
+	ExpressionActionDrop   = "drop"
+	ExpressionActionSample = "sample"
+	ExpressionActionRoute  = "route"
+)
+
+// ExpressionEngine evaluates user-defined expressions over decoded audit entries to filter, sample, or route events.
+// Expressions use the expr language (https://github.com/antonmedv/expr) with the audit entry's JSON fields as variables,
+// e.g. `request.path startsWith "secret/" && "admin" in auth.policies`.
+type ExpressionEngine struct {
+	rules  []expressionRule
+	errors func()
+}
+
+type expressionRule struct {
+	source  string
+	program *vm.Program
+	action  string
+	ratio   float64
+	route   string
+	// seed is the hash the request ID is hashed into for sampling, which differs between rules so that their sampling
+	// decisions are independent of each other and of the sampling rules.
+	seed uint32
+}
+
+// NewExpressionEngine compiles expression rules. The errors callback is invoked whenever an expression fails to
+// evaluate.
+func NewExpressionEngine(configs []ExpressionConfig, errors func()) (*ExpressionEngine, error) {
+	e := &ExpressionEngine{errors: errors}
+	for i, cfg := range configs {
+		program, err := expr.Compile(cfg.Expr, expr.AllowUndefinedVariables())
+		if err != nil {
+			return nil, fmt.Errorf("expression %d: %v", i, err)
+		}
+		rule := expressionRule{source: cfg.Expr, program: program, action: cfg.Action, ratio: cfg.Ratio, route: cfg.Route,
+			seed: fnv32a("expression " + strconv.Itoa(i) + "\x00")}
+		switch rule.action {
+		case ExpressionActionKeep, ExpressionActionDrop:
+		case ExpressionActionSample:
+			if rule.ratio <= 0 || rule.ratio > 1 {
+				return nil, fmt.Errorf("expression %d: sample ratio must be in (0, 1]: %v", i, rule.ratio)
+			}
+		case ExpressionActionRoute:
+			if rule.route == "" {
+				return nil, fmt.Errorf("expression %d: route action requires a route name", i)
+			}
+		default:
+			return nil, fmt.Errorf("expression %d: unknown action: %s", i, rule.action)
+		}
+		e.rules = append(e.rules, rule)
+	}
+	return e, nil
+}
+
+// HasRoutes reports whether any rule routes events, in which case metrics get a route label.
+func (e *ExpressionEngine) HasRoutes() bool {
+	for _, rule := range e.rules {
+		if rule.action == ExpressionActionRoute {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluate runs the expression rules in order against an audit event. It returns false if the event should be dropped,
+// and the name of the first matching route, if any. An event that doesn't match a keep rule is dropped, one that
+// matches a drop rule is dropped, and one that matches a sample rule is kept with the rule's ratio. Like sampling rules,
+// sample rules decide by a hash of the request ID, so that a request and its response are kept or dropped together,
+// and the weight of kept events is divided by the ratio.
+func (e *ExpressionEngine) Evaluate(auditEvent *AuditEvent) (keep bool, route string) {
+	env, err := auditEvent.Document()
+	if err != nil {
+		e.errors()
+		return true, ""
+	}
+
+	for _, rule := range e.rules {
+		matched, err := e.match(rule, env)
+		if err != nil {
+			e.errors()
+			continue
+		}
+		switch rule.action {
+		case ExpressionActionKeep:
+			if !matched {
+				return false, ""
+			}
+		case ExpressionActionDrop:
+			if matched {
+				return false, ""
+			}
+		case ExpressionActionSample:
+			if matched {
+				if float64(fnv32aAppend(rule.seed, auditEvent.entry.Request.ID)) >= rule.ratio*(1<<32) {
+					return false, ""
+				}
+				auditEvent.weight = auditEvent.Weight() / rule.ratio
+			}
+		case ExpressionActionRoute:
+			if matched && route == "" {
+				route = rule.route
+			}
+		}
+	}
+	return true, route
+}
+
+// match evaluates a single rule, which must produce a boolean.
+func (e *ExpressionEngine) match(rule expressionRule, env map[string]interface{}) (bool, error) {
+	output, err := expr.Run(rule.program, env)
+	if err != nil {
+		return false, err
+	}
+	matched, ok := output.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression %q returned %T instead of bool", rule.source, output)
+	}
+	return matched, nil
+}
+
+// Document returns the audit log line decoded into generic JSON values, as used for expression evaluation. Events not
+// decoded with their document get one holding the fields of their entry.
+func (a *AuditEvent) Document() (map[string]interface{}, error) {
+	if a.document == nil {
+		data, err := json.Marshal(a.entry)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &a.document); err != nil {
+			return nil, err
+		}
+	}
+	return a.document, nil
+}
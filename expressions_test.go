@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+// TestExpressionEngineSample checks that sample rules keep or drop a request and its response together, and that the
+// weights of kept events add up to the number of matching events.
+func TestExpressionEngineSample(t *testing.T) {
+	engine, err := NewExpressionEngine([]ExpressionConfig{
+		{Expr: `request.path startsWith "secret/"`, Action: ExpressionActionSample, Ratio: 0.5},
+		{Expr: `request.path == "secret/data/hot"`, Action: ExpressionActionSample, Ratio: 0.1},
+	}, func() { t.Error("expression failed to evaluate") })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const requests = 20000
+	for _, test := range []struct {
+		path   string
+		weight float64
+	}{
+		{path: "sys/health", weight: 1},
+		{path: "secret/data/app", weight: 2},
+		{path: "secret/data/hot", weight: 20},
+	} {
+		var kept int
+		var counted float64
+		for i := 0; i < requests; i++ {
+			id := fmt.Sprintf("%08x-0000-4000-8000-%012x", i, i)
+			var decisions [2]bool
+			for j, eventType := range []string{AuditEventTypeRequest, AuditEventTypeResponse} {
+				auditEvent := &AuditEvent{entry: &AuditEntry{Type: eventType, Request: &AuditRequest{ID: id, Path: test.path}}}
+				decisions[j], _ = engine.Evaluate(auditEvent)
+				if !decisions[j] {
+					continue
+				}
+				if auditEvent.Weight() != test.weight {
+					t.Fatalf("%s: kept %s with weight %v, want %v", test.path, eventType, auditEvent.Weight(), test.weight)
+				}
+				if eventType == AuditEventTypeRequest {
+					kept++
+					counted += auditEvent.Weight()
+				}
+			}
+			if decisions[0] != decisions[1] {
+				t.Fatalf("%s: request %s kept %v but its response kept %v", test.path, id, decisions[0], decisions[1])
+			}
+		}
+		// the weighted count of a sample of requests/weight requests is off by about sqrt(requests*weight)
+		if tolerance := 4 * math.Sqrt(requests*test.weight); math.Abs(counted-requests) > tolerance {
+			t.Errorf("%s: counted %v of %d requests from %d kept, want within %.0f", test.path, counted, requests, kept,
+				tolerance)
+		}
+	}
+}
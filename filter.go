@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// noisePathPatterns match high-volume health check, token self-lookup, and UI traffic that dominates audit volume and
+// skews latency percentiles.
+var noisePathPatterns = []string{
+	`^sys/health$`,
+	`^auth/token/lookup-self$`,
+	`^sys/internal/ui/`,
+}
+
+// EventFilter decides which audit events are metered at all. Events that don't pass the filter are dropped before they
+// consume correlation cache or metric capacity.
+type EventFilter struct {
+	pathInclude      []*regexp.Regexp
+	pathExclude      []*regexp.Regexp
+	operationInclude map[string]bool
+	operationExclude map[string]bool
+	exclude          []filterRule
+}
+
+type filterRule struct {
+	path       *regexp.Regexp
+	operations map[string]bool
+}
+
+// NewEventFilter constructs an EventFilter from the filter settings of the configuration.
+func NewEventFilter(cfg *FilterConfig) (*EventFilter, error) {
+	f := new(EventFilter)
+	var err error
+	if f.pathInclude, err = compileRegexps(cfg.PathInclude); err != nil {
+		return nil, fmt.Errorf("invalid path include filter: %v", err)
+	}
+	pathExclude := cfg.PathExclude
+	if cfg.SuppressNoise {
+		pathExclude = append(append([]string(nil), pathExclude...), noisePathPatterns...)
+	}
+	if f.pathExclude, err = compileRegexps(pathExclude); err != nil {
+		return nil, fmt.Errorf("invalid path exclude filter: %v", err)
+	}
+	f.operationInclude = operationSet(cfg.OperationInclude)
+	f.operationExclude = operationSet(cfg.OperationExclude)
+	for i, rule := range cfg.Exclude {
+		path, err := regexp.Compile(rule.Path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude rule %d: %v", i, err)
+		}
+		f.exclude = append(f.exclude, filterRule{path: path, operations: operationSet(rule.Operations)})
+	}
+	return f, nil
+}
+
+// Match reports whether an audit entry should be metered. If any include filters are set the request path and
+// operation have to match at least one of them, and they must not match any exclude filter or rule.
+func (f *EventFilter) Match(entry *AuditEntry) bool {
+	path := entry.Request.Path
+	operation := strings.ToLower(entry.Request.Operation)
+
+	if len(f.pathInclude) > 0 && !matchAny(f.pathInclude, path) {
+		return false
+	}
+	if matchAny(f.pathExclude, path) {
+		return false
+	}
+	if len(f.operationInclude) > 0 && !f.operationInclude[operation] {
+		return false
+	}
+	if f.operationExclude[operation] {
+		return false
+	}
+	for _, rule := range f.exclude {
+		if rule.path.MatchString(path) && (len(rule.operations) == 0 || rule.operations[operation]) {
+			return false
+		}
+	}
+	return true
+}
+
+// operationSet builds a case-insensitive set of operations.
+func operationSet(operations []string) map[string]bool {
+	set := make(map[string]bool, len(operations))
+	for _, operation := range operations {
+		set[strings.ToLower(operation)] = true
+	}
+	return set
+}
+
+// compileRegexps compiles a list of regular expressions.
+func compileRegexps(exprs []string) ([]*regexp.Regexp, error) {
+	regexps := make([]*regexp.Regexp, 0, len(exprs))
+	for _, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		regexps = append(regexps, re)
+	}
+	return regexps, nil
+}
+
+// matchAny reports whether s matches any of the regular expressions.
+func matchAny(regexps []*regexp.Regexp, s string) bool {
+	for _, re := range regexps {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
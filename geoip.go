@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// geoIPCacheSize is the number of addresses whose country and autonomous system are cached, after which the cache is
+// cleared.
+const geoIPCacheSize = 65536
+
+// GeoIP resolves client addresses to their country and autonomous system with MaxMind databases, such as GeoLite2
+// Country and GeoLite2 ASN, caching the results of recent addresses.
+type GeoIP struct {
+	country *mmdbReader
+	asn     *mmdbReader
+
+	mu    sync.Mutex
+	cache map[string]geoIPResult
+}
+
+type geoIPResult struct {
+	country, asn string
+}
+
+// NewGeoIP opens the country and ASN databases at the given paths. Either may be empty, leaving its label empty.
+func NewGeoIP(countryPath, asnPath string) (*GeoIP, error) {
+	g := &GeoIP{cache: make(map[string]geoIPResult)}
+	var err error
+	if countryPath != "" {
+		if g.country, err = openMMDB(countryPath); err != nil {
+			return nil, fmt.Errorf("country database %s: %v", countryPath, err)
+		}
+	}
+	if asnPath != "" {
+		if g.asn, err = openMMDB(asnPath); err != nil {
+			return nil, fmt.Errorf("asn database %s: %v", asnPath, err)
+		}
+	}
+	return g, nil
+}
+
+// Lookup returns the ISO country code and autonomous system number of a remote address, which are empty if unknown.
+func (g *GeoIP) Lookup(addr string) (country, asn string) {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	g.mu.Lock()
+	result, found := g.cache[addr]
+	g.mu.Unlock()
+	if found {
+		return result.country, result.asn
+	}
+
+	if ip := net.ParseIP(addr); ip != nil {
+		if g.country != nil {
+			record := g.lookup(g.country, ip)
+			if result.country = mmdbString(record, "country", "iso_code"); result.country == "" {
+				result.country = mmdbString(record, "registered_country", "iso_code")
+			}
+		}
+		if g.asn != nil {
+			if number, ok := mmdbValue(g.lookup(g.asn, ip), "autonomous_system_number").(uint64); ok {
+				result.asn = strconv.FormatUint(number, 10)
+			}
+		}
+	}
+
+	g.mu.Lock()
+	if len(g.cache) >= geoIPCacheSize {
+		g.cache = make(map[string]geoIPResult)
+	}
+	g.cache[addr] = result
+	g.mu.Unlock()
+	return result.country, result.asn
+}
+
+// lookup returns the record of an address in a database, or nil if it has none or the database is corrupt.
+func (g *GeoIP) lookup(db *mmdbReader, ip net.IP) interface{} {
+	record, err := db.lookup(ip)
+	if err != nil {
+		logError("error looking up address in geoip database", "address", ip, "error", err)
+	}
+	return record
+}
+
+// mmdbValue returns the value at a path of map keys in a decoded record, or nil if there is none.
+func mmdbValue(record interface{}, keys ...string) interface{} {
+	for _, key := range keys {
+		m, ok := record.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		record = m[key]
+	}
+	return record
+}
+
+// mmdbString returns the string at a path of map keys in a decoded record, or an empty string if there is none.
+func mmdbString(record interface{}, keys ...string) string {
+	s, _ := mmdbValue(record, keys...).(string)
+	return s
+}
+
+// mmdbMetadataMarker starts the metadata section at the end of a MaxMind DB file.
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+var errMMDBCorrupt = errors.New("corrupt maxmind database")
+
+// Data types of the MaxMind DB format.
+const (
+	mmdbTypeExtended = iota
+	mmdbTypePointer
+	mmdbTypeString
+	mmdbTypeDouble
+	mmdbTypeBytes
+	mmdbTypeUint16
+	mmdbTypeUint32
+	mmdbTypeMap
+	mmdbTypeInt32
+	mmdbTypeUint64
+	mmdbTypeUint128
+	mmdbTypeArray
+	mmdbTypeContainer
+	mmdbTypeEndMarker
+	mmdbTypeBool
+	mmdbTypeFloat
+)
+
+// mmdbReader looks up addresses in a MaxMind DB file, which is a binary search tree over the bits of addresses whose
+// leaves point into a data section of records. See https://maxmind.github.io/MaxMind-DB/.
+type mmdbReader struct {
+	tree       []byte
+	data       mmdbDecoder
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	// ipv4Start is the node of ::/96, where IPv4 addresses are looked up in IPv6 databases.
+	ipv4Start uint
+}
+
+// openMMDB reads a MaxMind DB file into memory.
+func openMMDB(path string) (*mmdbReader, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("not a maxmind database")
+	}
+	metadata, _, err := mmdbDecoder(buf[i+len(mmdbMetadataMarker):]).decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding metadata: %v", err)
+	}
+	r := new(mmdbReader)
+	for key, field := range map[string]*uint{"node_count": &r.nodeCount, "record_size": &r.recordSize,
+		"ip_version": &r.ipVersion} {
+		value, ok := mmdbValue(metadata, key).(uint64)
+		if !ok {
+			return nil, fmt.Errorf("metadata lacks %s", key)
+		}
+		*field = uint(value)
+	}
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported record size: %d", r.recordSize)
+	}
+	treeSize := r.nodeCount * r.recordSize / 4
+	// the search tree is followed by 16 zero bytes, and then the data section
+	if treeSize+16 > uint(i) {
+		return nil, errMMDBCorrupt
+	}
+	r.tree = buf[:treeSize]
+	r.data = mmdbDecoder(buf[treeSize+16 : i])
+	if r.ipVersion == 6 {
+		for bit := 0; bit < 96 && r.ipv4Start < r.nodeCount; bit++ {
+			r.ipv4Start = r.record(r.ipv4Start, 0)
+		}
+	}
+	return r, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a node.
+func (r *mmdbReader) record(node, bit uint) uint {
+	b := r.tree
+	switch r.recordSize {
+	case 24:
+		off := node*6 + bit*3
+		return uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+	case 28:
+		off := node * 7
+		if bit == 0 {
+			return uint(b[off+3]&0xf0)<<20 | uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+		}
+		return uint(b[off+3]&0x0f)<<24 | uint(b[off+4])<<16 | uint(b[off+5])<<8 | uint(b[off+6])
+	default:
+		off := node*8 + bit*4
+		return uint(b[off])<<24 | uint(b[off+1])<<16 | uint(b[off+2])<<8 | uint(b[off+3])
+	}
+}
+
+// lookup returns the decoded record of an address, or nil if the database has none.
+func (r *mmdbReader) lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		if r.ipVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else if r.ipVersion == 4 {
+		return nil, nil
+	}
+	for i := uint(0); i < uint(len(ip))*8 && node < r.nodeCount; i++ {
+		node = r.record(node, uint(ip[i/8]>>(7-i%8))&1)
+	}
+	switch {
+	case node == r.nodeCount:
+		return nil, nil
+	case node < r.nodeCount:
+		return nil, errMMDBCorrupt
+	}
+	record, _, err := r.data.decode(node - r.nodeCount - 16)
+	return record, err
+}
+
+// mmdbDecoder decodes values of the MaxMind DB data section, in which pointers are offsets from its start.
+type mmdbDecoder []byte
+
+// decode decodes the value at offset into a string, float64, []byte, uint64, int32, *big.Int, bool, map, or slice,
+// returning the offset following it.
+func (d mmdbDecoder) decode(offset uint) (interface{}, uint, error) {
+	if offset >= uint(len(d)) {
+		return nil, 0, errMMDBCorrupt
+	}
+	control := d[offset]
+	offset++
+	typ := uint(control >> 5)
+	if typ == mmdbTypePointer {
+		pointer, next, err := d.pointer(control, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := d.decode(pointer)
+		return value, next, err
+	}
+	if typ == mmdbTypeExtended {
+		if offset >= uint(len(d)) {
+			return nil, 0, errMMDBCorrupt
+		}
+		typ = 7 + uint(d[offset])
+		offset++
+	}
+	size := uint(control & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(d)) {
+			return nil, 0, errMMDBCorrupt
+		}
+		size = [...]uint{29, 285, 65821}[n-1] + mmdbUint(d[offset:offset+n])
+		offset += n
+	}
+
+	switch typ {
+	case mmdbTypeMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var key, value interface{}
+			var err error
+			if key, offset, err = d.decode(offset); err != nil {
+				return nil, 0, err
+			}
+			if value, offset, err = d.decode(offset); err != nil {
+				return nil, 0, err
+			}
+			s, ok := key.(string)
+			if !ok {
+				return nil, 0, errMMDBCorrupt
+			}
+			m[s] = value
+		}
+		return m, offset, nil
+	case mmdbTypeArray:
+		a := make([]interface{}, size)
+		for i := range a {
+			var err error
+			if a[i], offset, err = d.decode(offset); err != nil {
+				return nil, 0, err
+			}
+		}
+		return a, offset, nil
+	case mmdbTypeBool:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(d)) {
+		return nil, 0, errMMDBCorrupt
+	}
+	b, next := d[offset:offset+size], offset+size
+	switch typ {
+	case mmdbTypeString:
+		return string(b), next, nil
+	case mmdbTypeBytes:
+		return append([]byte(nil), b...), next, nil
+	case mmdbTypeDouble:
+		if size != 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return math.Float64frombits(uint64(mmdbUint(b))), next, nil
+	case mmdbTypeFloat:
+		if size != 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return float64(math.Float32frombits(uint32(mmdbUint(b)))), next, nil
+	case mmdbTypeUint16, mmdbTypeUint32, mmdbTypeUint64:
+		if size > 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return uint64(mmdbUint(b)), next, nil
+	case mmdbTypeInt32:
+		if size > 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return int32(uint32(mmdbUint(b))), next, nil
+	case mmdbTypeUint128:
+		return new(big.Int).SetBytes(b), next, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported maxmind data type: %d", typ)
+}
+
+// pointer decodes the target of a pointer whose control byte has been read, returning the offset following it.
+func (d mmdbDecoder) pointer(control byte, offset uint) (pointer, next uint, err error) {
+	n := uint(control>>3)&3 + 1
+	if offset+n > uint(len(d)) {
+		return 0, 0, errMMDBCorrupt
+	}
+	pointer = mmdbUint(d[offset : offset+n])
+	if n < 4 {
+		pointer |= uint(control&7) << (8 * n)
+	}
+	pointer += [...]uint{0, 2048, 526336, 0}[n-1]
+	return pointer, offset + n, nil
+}
+
+// mmdbUint decodes a big-endian unsigned integer.
+func mmdbUint(b []byte) uint {
+	var v uint
+	for _, c := range b {
+		v = v<<8 | uint(c)
+	}
+	return v
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	// graphiteNodeRegexp matches the characters that aren't safe in a node of a Graphite path, such as the dots that
+	// separate nodes and the slashes that would nest Whisper files.
+	graphiteNodeRegexp = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+	// graphiteTagReplacer replaces the characters that aren't allowed in Graphite tag values.
+	graphiteTagReplacer = strings.NewReplacer(";", "_", "~", "_", " ", "_", "\n", "_")
+)
+
+// graphiteSink writes metrics in the Graphite plaintext protocol to Carbon. Counters are written as their cumulative
+// values, to be graphed with functions such as perSecond, gauges as they are, and histograms as their count, sum, and
+// cumulative bucket counts. The values of labels become nodes of the path after the metric name, those of the
+// configured labels first in their order and the others in the order of their names, or with tagged set, Graphite tags.
+type graphiteSink struct {
+	conn   *lineConn
+	prefix string
+	labels map[string]int
+	tagged bool
+}
+
+func newGraphiteSink(cfg MetricSinkConfig) (*graphiteSink, error) {
+	conn, err := newLineConn(cfg.Network, cfg.Address, "tcp")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Tagged && len(cfg.Labels) > 0 {
+		return nil, fmt.Errorf("labels can't be ordered when tagged")
+	}
+	s := &graphiteSink{conn: conn, prefix: cfg.Prefix, labels: make(map[string]int), tagged: cfg.Tagged}
+	for i, label := range cfg.Labels {
+		s.labels[label] = i
+	}
+	return s, nil
+}
+
+func (s *graphiteSink) push(families []*dto.MetricFamily, now time.Time) error {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	var lines []string
+	add := func(name string, labels []*dto.LabelPair, suffix string, value float64) {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return
+		}
+		lines = append(lines, s.path(name, labels, suffix)+" "+strconv.FormatFloat(value, 'f', -1, 64)+" "+timestamp)
+	}
+	for _, family := range families {
+		name := family.GetName()
+		for _, m := range family.Metric {
+			switch metricType(family) {
+			case dto.MetricType_COUNTER, dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+				add(name, m.Label, "", metricValue(m))
+			case dto.MetricType_HISTOGRAM:
+				histogram := m.GetHistogram()
+				add(name, m.Label, "count", float64(histogram.GetSampleCount()))
+				add(name, m.Label, "sum", histogram.GetSampleSum())
+				for _, bucket := range histogram.Bucket {
+					if !math.IsInf(bucket.GetUpperBound(), 1) {
+						add(name, m.Label, "bucket.le_"+graphiteNode(strconv.FormatFloat(bucket.GetUpperBound(), 'g', -1, 64)),
+							float64(bucket.GetCumulativeCount()))
+					}
+				}
+				add(name, m.Label, "bucket.le_inf", float64(histogram.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				summary := m.GetSummary()
+				add(name, m.Label, "count", float64(summary.GetSampleCount()))
+				add(name, m.Label, "sum", summary.GetSampleSum())
+				for _, quantile := range summary.Quantile {
+					add(name, m.Label, "quantile_"+graphiteNode(strconv.FormatFloat(quantile.GetQuantile(), 'g', -1, 64)),
+						quantile.GetValue())
+				}
+			}
+		}
+	}
+	return s.conn.write(lines)
+}
+
+// path returns the Graphite path of a series, with suffix nodes after those of its labels.
+func (s *graphiteSink) path(name string, labels []*dto.LabelPair, suffix string) string {
+	var b strings.Builder
+	b.WriteString(s.prefix)
+	b.WriteString(name)
+	if s.tagged {
+		if suffix != "" {
+			b.WriteByte('.')
+			b.WriteString(suffix)
+		}
+		for _, label := range labels {
+			if label.GetValue() != "" {
+				b.WriteByte(';')
+				b.WriteString(label.GetName())
+				b.WriteByte('=')
+				b.WriteString(graphiteTagReplacer.Replace(label.GetValue()))
+			}
+		}
+		return b.String()
+	}
+
+	ordered := labels
+	if len(s.labels) > 0 {
+		ordered = append([]*dto.LabelPair(nil), labels...)
+		sort.SliceStable(ordered, func(i, j int) bool {
+			a, aFound := s.labels[ordered[i].GetName()]
+			b, bFound := s.labels[ordered[j].GetName()]
+			if aFound && bFound {
+				return a < b
+			}
+			return aFound && !bFound
+		})
+	}
+	for _, label := range ordered {
+		b.WriteByte('.')
+		b.WriteString(graphiteNode(label.GetValue()))
+	}
+	if suffix != "" {
+		b.WriteByte('.')
+		b.WriteString(suffix)
+	}
+	return b.String()
+}
+
+// graphiteNode returns a value as a node of a Graphite path. Empty values become "none", so that every series of a
+// metric has the same number of nodes.
+func graphiteNode(value string) string {
+	if value == "" {
+		return "none"
+	}
+	return graphiteNodeRegexp.ReplaceAllString(value, "_")
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// identityQueueSize bounds the number of entities awaiting resolution. Entities beyond it are resolved once they are
+	// seen again.
+	identityQueueSize = 1000
+	// identityMaxEntries bounds the number of entities and groups cached.
+	identityMaxEntries = 100000
+	// identityRetryInterval is how long an entity that failed to resolve is left unresolved before it is retried.
+	identityRetryInterval = time.Minute
+)
+
+// Identity is the name and group names of an identity entity. Identities are shared and must not be modified.
+type Identity struct {
+	Name   string
+	Groups []string
+	// groupsLabel holds the group names sorted and joined by commas.
+	groupsLabel string
+}
+
+// identityEntry is a cached entity or group.
+type identityEntry struct {
+	identity *Identity
+	expires  time.Time
+}
+
+// IdentityResolver resolves the entity IDs of audit entries to entity names and group memberships with the identity
+// API of Vault, so that they can be labeled and reported by name rather than by UUID. Resolutions are cached for a TTL
+// and made in the background, so that the processing of audit events never waits for Vault: an entity is unresolved
+// until its first resolution completes, and expired entries are served until they are refreshed.
+type IdentityResolver struct {
+	client *VaultClient
+	ttl    time.Duration
+	queue  chan string
+
+	mu       sync.Mutex
+	entities map[string]identityEntry
+	// groups holds the names of groups by their ID.
+	groups map[string]identityEntry
+	// queued holds the entity IDs queued for resolution.
+	queued map[string]bool
+
+	counterLookups *prometheus.CounterVec
+	gagueEntries   prometheus.GaugeFunc
+}
+
+// NewIdentityResolver constructs an IdentityResolver caching resolutions for ttl.
+func NewIdentityResolver(client *VaultClient, ttl time.Duration) *IdentityResolver {
+	r := &IdentityResolver{
+		client:   client,
+		ttl:      ttl,
+		queue:    make(chan string, identityQueueSize),
+		entities: make(map[string]identityEntry),
+		groups:   make(map[string]identityEntry),
+		queued:   make(map[string]bool),
+		counterLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "identity",
+			Name:      "lookups_total",
+			Help:      "Number of entities and groups looked up with the Vault identity API. Partitioned by kind (entity or group) and result (success, not_found, or error).",
+		},
+			[]string{"kind", "result"}),
+	}
+	r.gagueEntries = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: PromNamespace,
+		Subsystem: "identity",
+		Name:      "cache_entries",
+		Help:      "Number of entities whose name and groups are cached.",
+	}, func() float64 {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return float64(len(r.entities))
+	})
+	return r
+}
+
+func (r *IdentityResolver) collectors() []prometheus.Collector {
+	return []prometheus.Collector{r.counterLookups, r.gagueEntries}
+}
+
+// Lookup returns the identity of an entity ID, or nil if it is not resolved yet, in which case it is queued for
+// resolution. Expired identities are returned while they are refreshed.
+func (r *IdentityResolver) Lookup(entityID string) *Identity {
+	if entityID == "" {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, found := r.entities[entityID]
+	if found && time.Now().Before(entry.expires) {
+		return entry.identity
+	}
+	if !r.queued[entityID] {
+		select {
+		case r.queue <- entityID:
+			r.queued[entityID] = true
+		default:
+		}
+	}
+	return entry.identity
+}
+
+// Run resolves queued entities.
+func (r *IdentityResolver) Run() {
+	for entityID := range r.queue {
+		identity, err := r.resolve(entityID)
+		expires := time.Now().Add(r.ttl)
+		if err != nil {
+			logWarn("error resolving entity", "entity_id", entityID, "error", err)
+			expires = time.Now().Add(identityRetryInterval)
+		}
+
+		r.mu.Lock()
+		delete(r.queued, entityID)
+		if identity == nil {
+			// keep serving the previous identity, if any
+			identity = r.entities[entityID].identity
+		}
+		evictIdentities(r.entities)
+		r.entities[entityID] = identityEntry{identity: identity, expires: expires}
+		r.mu.Unlock()
+	}
+}
+
+// entityResponse is the response of the identity/entity/id endpoint.
+type entityResponse struct {
+	Data struct {
+		Name              string   `json:"name"`
+		GroupIDs          []string `json:"group_ids"`
+		DirectGroupIDs    []string `json:"direct_group_ids"`
+		InheritedGroupIDs []string `json:"inherited_group_ids"`
+	} `json:"data"`
+}
+
+// groupResponse is the response of the identity/group/id endpoint.
+type groupResponse struct {
+	Data struct {
+		Name string `json:"name"`
+	} `json:"data"`
+}
+
+// resolve reads an entity and the names of the groups it is a member of, directly or inherited. Entities that do not
+// exist, such as deleted ones, resolve to an empty identity. Groups that fail to resolve are named by their ID.
+func (r *IdentityResolver) resolve(entityID string) (*Identity, error) {
+	var entity entityResponse
+	if err := r.client.Get("identity/entity/id/"+url.PathEscape(entityID), &entity); err != nil {
+		var statusErr *vaultStatusError
+		if errors.As(err, &statusErr) && statusErr.status == http.StatusNotFound {
+			r.counterLookups.WithLabelValues("entity", "not_found").Inc()
+			return &Identity{}, nil
+		}
+		r.counterLookups.WithLabelValues("entity", "error").Inc()
+		return nil, err
+	}
+	r.counterLookups.WithLabelValues("entity", "success").Inc()
+
+	groupIDs := append(append([]string(nil), entity.Data.DirectGroupIDs...), entity.Data.InheritedGroupIDs...)
+	if len(groupIDs) == 0 {
+		groupIDs = entity.Data.GroupIDs
+	}
+	identity := &Identity{Name: entity.Data.Name}
+	for _, groupID := range groupIDs {
+		name := r.groupName(groupID)
+		if !containsString(identity.Groups, name) {
+			identity.Groups = append(identity.Groups, name)
+		}
+	}
+	sort.Strings(identity.Groups)
+	identity.groupsLabel = strings.Join(identity.Groups, ",")
+	return identity, nil
+}
+
+// groupName returns the name of a group, from the cache if it is there, or its ID if it cannot be read.
+func (r *IdentityResolver) groupName(groupID string) string {
+	r.mu.Lock()
+	entry, found := r.groups[groupID]
+	r.mu.Unlock()
+	if found && time.Now().Before(entry.expires) {
+		return entry.identity.Name
+	}
+
+	var group groupResponse
+	err := r.client.Get("identity/group/id/"+url.PathEscape(groupID), &group)
+	if err != nil {
+		r.counterLookups.WithLabelValues("group", "error").Inc()
+		logWarn("error resolving group", "group_id", groupID, "error", err)
+		if found {
+			return entry.identity.Name
+		}
+		return groupID
+	}
+	r.counterLookups.WithLabelValues("group", "success").Inc()
+	name := group.Data.Name
+	if name == "" {
+		name = groupID
+	}
+
+	r.mu.Lock()
+	evictIdentities(r.groups)
+	r.groups[groupID] = identityEntry{identity: &Identity{Name: name}, expires: time.Now().Add(r.ttl)}
+	r.mu.Unlock()
+	return name
+}
+
+// evictIdentities makes room for an entry in a full cache by deleting expired entries, or arbitrary ones if none have
+// expired.
+func evictIdentities(cache map[string]identityEntry) {
+	if len(cache) < identityMaxEntries {
+		return
+	}
+	now := time.Now()
+	for id, entry := range cache {
+		if now.After(entry.expires) {
+			delete(cache, id)
+		}
+	}
+	for id := range cache {
+		if len(cache) < identityMaxEntries {
+			break
+		}
+		delete(cache, id)
+	}
+}
+
+// entityName returns the name of the entity of an identity, or "" if it is not resolved.
+func (i *Identity) entityName() string {
+	if i == nil {
+		return ""
+	}
+	return i.Name
+}
+
+// entityGroups returns the group names of an identity, or nil if it is not resolved.
+func (i *Identity) entityGroups() []string {
+	if i == nil {
+		return nil
+	}
+	return i.Groups
+}
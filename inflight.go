@@ -0,0 +1,147 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// inFlightRequestOverhead approximates the memory used by an in-flight request besides its ID, path, and operation: the
+// request itself, its list element, and its map entry.
+const inFlightRequestOverhead = 176
+
+// InFlightTracker tracks requests that have been seen but not yet matched to a response, giving a real-time view of
+// request concurrency and stuck operations. Requests are forgotten once their cache TTL elapses, like their timestamps,
+// and the tracker is bounded like the in-memory timestamp cache: the oldest requests are forgotten to stay within
+// -cache-max-entries and -cache-max-bytes, and when memory use is close to -max-memory.
+type InFlightTracker struct {
+	ttl   time.Duration
+	gauge *prometheus.GaugeVec
+	// maxEntries and maxBytes bound the number of requests and their approximate size in memory, with zero meaning
+	// unbounded.
+	maxEntries int
+	maxBytes   int64
+
+	mu sync.Mutex
+	// requests holds the elements of order, which lists the requests from least to most recently started, and bytes is
+	// their approximate size in memory.
+	requests map[string]*list.Element
+	order    *list.List
+	bytes    int64
+	counts   map[inFlightSeries]int
+}
+
+// inFlightSeries identifies a series of the in-flight gauge.
+type inFlightSeries struct {
+	path      string
+	operation string
+}
+
+// inFlightRequest is a request awaiting its response.
+type inFlightRequest struct {
+	id      string
+	series  inFlightSeries
+	expires time.Time
+}
+
+// size approximates the memory used by an in-flight request.
+func (r *inFlightRequest) size() int64 {
+	return inFlightRequestOverhead + int64(len(r.id)+len(r.series.path)+len(r.series.operation))
+}
+
+// NewInFlightTracker constructs an InFlightTracker updating gauge, which is partitioned by path and operation, holding
+// up to maxEntries requests of up to maxBytes in total, with zero meaning unbounded.
+func NewInFlightTracker(ttl time.Duration, maxEntries int, maxBytes int64, gauge *prometheus.GaugeVec) *InFlightTracker {
+	return &InFlightTracker{ttl: ttl, gauge: gauge, maxEntries: maxEntries, maxBytes: maxBytes,
+		requests: make(map[string]*list.Element), order: list.New(), counts: make(map[inFlightSeries]int)}
+}
+
+// Start records a request as in flight for up to ttl, or the default TTL if ttl is zero.
+func (t *InFlightTracker) Start(auditEvent *AuditEvent, ttl time.Duration) {
+	if ttl == 0 {
+		ttl = t.ttl
+	}
+	labels := auditEvent.Labels()
+	request := &inFlightRequest{
+		id:      auditEvent.entry.Request.ID,
+		series:  inFlightSeries{path: labels["path"], operation: labels["operation"]},
+		expires: time.Now().Add(ttl),
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, found := t.requests[request.id]; found {
+		return
+	}
+	// a request that cannot fit even in an empty tracker is not tracked, rather than emptying the tracker for it
+	if t.maxBytes > 0 && request.size() > t.maxBytes {
+		return
+	}
+	for oldest := t.order.Front(); oldest != nil && t.full(request.size()); oldest = t.order.Front() {
+		t.finish(oldest.Value.(*inFlightRequest).id)
+	}
+	t.requests[request.id] = t.order.PushBack(request)
+	t.bytes += request.size()
+	t.counts[request.series]++
+	t.gauge.WithLabelValues(request.series.path, request.series.operation).Inc()
+}
+
+// full reports whether a new request of size bytes would exceed the tracker's bounds.
+func (t *InFlightTracker) full(size int64) bool {
+	return (t.maxEntries > 0 && len(t.requests) >= t.maxEntries) || (t.maxBytes > 0 && t.bytes+size > t.maxBytes)
+}
+
+// Finish records that the response to a request arrived.
+func (t *InFlightTracker) Finish(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.finish(id)
+}
+
+func (t *InFlightTracker) finish(id string) {
+	element, found := t.requests[id]
+	if !found {
+		return
+	}
+	request := element.Value.(*inFlightRequest)
+	delete(t.requests, id)
+	t.order.Remove(element)
+	t.bytes -= request.size()
+	series := request.series
+
+	// drop series once nothing is in flight, so paths seen once do not linger
+	t.counts[series]--
+	if t.counts[series] == 0 {
+		delete(t.counts, series)
+		t.gauge.DeleteLabelValues(series.path, series.operation)
+		return
+	}
+	t.gauge.WithLabelValues(series.path, series.operation).Dec()
+}
+
+// shrink forgets the least recently started fraction of the requests, returning the number of forgotten requests.
+func (t *InFlightTracker) shrink(fraction float64) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := int(fraction * float64(len(t.requests)))
+	for i := 0; i < n; i++ {
+		t.finish(t.order.Front().Value.(*inFlightRequest).id)
+	}
+	return n
+}
+
+// Run continuously forgets requests whose response never arrived.
+func (t *InFlightTracker) Run(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		now := time.Now()
+		t.mu.Lock()
+		for id, element := range t.requests {
+			if element.Value.(*inFlightRequest).expires.Before(now) {
+				t.finish(id)
+			}
+		}
+		t.mu.Unlock()
+	}
+}
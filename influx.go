@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// influxBatchSize is the number of lines written to InfluxDB per request, as recommended by InfluxDB.
+const influxBatchSize = 5000
+
+var (
+	// influxMeasurementEscaper escapes measurement names in line protocol.
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	// influxKeyEscaper escapes tag keys, tag values, and field keys in line protocol.
+	influxKeyEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+)
+
+// influxSink writes metrics in InfluxDB line protocol to the InfluxDB v2 HTTP API, or to a Telegraf socket listener.
+// Metric families are written the way Telegraf's Prometheus input writes them: each family is a measurement with the
+// labels as tags, and a counter field for counters, a gauge field for gauges, a value field for untyped metrics, and
+// count, sum, and one field per bucket upper bound for histograms, so that dashboards built on scraped exporters work
+// alike.
+type influxSink struct {
+	// writeURL is the URL of the write endpoint of the InfluxDB v2 HTTP API, or empty to write to conn.
+	writeURL string
+	token    string
+	client   *http.Client
+	conn     *lineConn
+	tags     string
+}
+
+func newInfluxSink(cfg MetricSinkConfig) (*influxSink, error) {
+	s := &influxSink{token: cfg.Token}
+	switch {
+	case cfg.URL != "" && cfg.Address != "":
+		return nil, fmt.Errorf("either url or address may be set")
+	case cfg.URL != "":
+		if cfg.Org == "" || cfg.Bucket == "" {
+			return nil, fmt.Errorf("org and bucket are required")
+		}
+		base, err := url.Parse(strings.TrimSuffix(cfg.URL, "/") + "/api/v2/write")
+		if err != nil || (base.Scheme != "http" && base.Scheme != "https") {
+			return nil, fmt.Errorf("an http or https url is required")
+		}
+		base.RawQuery = url.Values{"org": {cfg.Org}, "bucket": {cfg.Bucket}, "precision": {"ns"}}.Encode()
+		s.writeURL = base.String()
+		s.client = &http.Client{Timeout: sinkTimeout}
+	default:
+		conn, err := newLineConn(cfg.Network, cfg.Address, "tcp")
+		if err != nil {
+			return nil, err
+		}
+		s.conn = conn
+	}
+	names := make([]string, 0, len(cfg.Tags))
+	for name := range cfg.Tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if cfg.Tags[name] != "" {
+			s.tags += "," + influxKeyEscaper.Replace(name) + "=" + influxKeyEscaper.Replace(cfg.Tags[name])
+		}
+	}
+	return s, nil
+}
+
+func (s *influxSink) push(families []*dto.MetricFamily, now time.Time) error {
+	timestamp := strconv.FormatInt(now.UnixNano(), 10)
+	var lines []string
+	for _, family := range families {
+		measurement := influxMeasurementEscaper.Replace(family.GetName())
+		for _, m := range family.Metric {
+			var fields []string
+			switch metricType(family) {
+			case dto.MetricType_COUNTER:
+				fields = appendInfluxField(fields, "counter", metricValue(m))
+			case dto.MetricType_GAUGE:
+				fields = appendInfluxField(fields, "gauge", metricValue(m))
+			case dto.MetricType_UNTYPED:
+				fields = appendInfluxField(fields, "value", metricValue(m))
+			case dto.MetricType_HISTOGRAM:
+				histogram := m.GetHistogram()
+				fields = appendInfluxField(fields, "count", float64(histogram.GetSampleCount()))
+				fields = appendInfluxField(fields, "sum", histogram.GetSampleSum())
+				for _, bucket := range histogram.Bucket {
+					if !math.IsInf(bucket.GetUpperBound(), 1) {
+						fields = appendInfluxField(fields, strconv.FormatFloat(bucket.GetUpperBound(), 'g', -1, 64),
+							float64(bucket.GetCumulativeCount()))
+					}
+				}
+				fields = appendInfluxField(fields, "+Inf", float64(histogram.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				summary := m.GetSummary()
+				fields = appendInfluxField(fields, "count", float64(summary.GetSampleCount()))
+				fields = appendInfluxField(fields, "sum", summary.GetSampleSum())
+				for _, quantile := range summary.Quantile {
+					fields = appendInfluxField(fields, strconv.FormatFloat(quantile.GetQuantile(), 'g', -1, 64),
+						quantile.GetValue())
+				}
+			}
+			if len(fields) == 0 {
+				continue
+			}
+			var b strings.Builder
+			b.WriteString(measurement)
+			// Prometheus sorts labels by name, as line protocol prefers tags to be
+			for _, label := range m.Label {
+				if label.GetValue() != "" {
+					b.WriteByte(',')
+					b.WriteString(influxKeyEscaper.Replace(label.GetName()))
+					b.WriteByte('=')
+					b.WriteString(influxKeyEscaper.Replace(label.GetValue()))
+				}
+			}
+			b.WriteString(s.tags)
+			b.WriteByte(' ')
+			b.WriteString(strings.Join(fields, ","))
+			b.WriteByte(' ')
+			b.WriteString(timestamp)
+			lines = append(lines, b.String())
+		}
+	}
+
+	if s.writeURL == "" {
+		return s.conn.write(lines)
+	}
+	var headers map[string]string
+	if s.token != "" {
+		headers = map[string]string{"Authorization": "Token " + s.token}
+	}
+	for start := 0; start < len(lines); start += influxBatchSize {
+		end := start + influxBatchSize
+		if end > len(lines) {
+			end = len(lines)
+		}
+		body := strings.Join(lines[start:end], "\n") + "\n"
+		if err := postSink(s.client, s.writeURL, "text/plain; charset=utf-8", headers, []byte(body), true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendInfluxField appends a float field. Line protocol has no representation of NaN and infinities, so such fields
+// are left out.
+func appendInfluxField(fields []string, key string, value float64) []string {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return fields
+	}
+	return append(fields, influxKeyEscaper.Replace(key)+"="+strconv.FormatFloat(value, 'g', -1, 64))
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"sync"
+)
+
+// maxInternedStrings bounds the strings held by a stringInterner, so that unbounded values such as paths with dynamic
+// segments cannot grow it indefinitely. Once full, new values are no longer interned.
+const maxInternedStrings = 100000
+
+// stringInterner deduplicates the label values that repeat across audit entries, such as paths, operations, and
+// errors, so that decoding them returns a shared string instead of allocating one for every entry.
+type stringInterner struct {
+	max int
+
+	mu      sync.RWMutex
+	strings map[string]string
+}
+
+func newStringInterner(max int) *stringInterner {
+	return &stringInterner{max: max, strings: make(map[string]string)}
+}
+
+// intern returns the shared string equal to b, adding it if there is room.
+func (i *stringInterner) intern(b []byte) string {
+	i.mu.RLock()
+	s, found := i.strings[string(b)]
+	i.mu.RUnlock()
+	if found {
+		return s
+	}
+
+	s = string(b)
+	i.mu.Lock()
+	if len(i.strings) < i.max {
+		i.strings[s] = s
+	}
+	i.mu.Unlock()
+	return s
+}
+
+// Len returns the number of interned strings.
+func (i *stringInterner) Len() int {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return len(i.strings)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// KV v2 lifecycle operations.
+const (
+	kvLifecycleDelete         = "delete"
+	kvLifecycleDestroy        = "destroy"
+	kvLifecycleUndelete       = "undelete"
+	kvLifecycleMetadataDelete = "metadata_delete"
+)
+
+// KVLifecycleMonitor counts the operations that remove KV v2 secret versions, or bring them back, by mount: soft
+// deletions of the latest version (delete on data/) or specific versions (delete/), permanent destruction of versions
+// (destroy/), undeletions (undelete/), and deletions of all versions and metadata of secrets (delete on metadata/),
+// making accidental or malicious mass deletion of secrets visible.
+type KVLifecycleMonitor struct {
+	paths *PathNormalizer
+
+	counterOperations *prometheus.CounterVec
+}
+
+// NewKVLifecycleMonitor constructs a KVLifecycleMonitor recognizing KV v2 secret paths with paths.
+func NewKVLifecycleMonitor(paths *PathNormalizer) *KVLifecycleMonitor {
+	return &KVLifecycleMonitor{
+		paths: paths,
+		counterOperations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "kv",
+			Name:      "lifecycle_operations_total",
+			Help:      "Number of responses to KV v2 requests deleting, destroying, or undeleting secret versions, or deleting secret metadata. Partitioned by mount, operation (delete, destroy, undelete, or metadata_delete), and result (success or failure).",
+		},
+			[]string{"mount", "operation", "result"}),
+	}
+}
+
+func (m *KVLifecycleMonitor) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.counterOperations}
+}
+
+// kvLifecycleOperation returns the lifecycle operation of a request on a KV v2 path operation (such as "data"), or ""
+// if it is not one.
+func kvLifecycleOperation(requestOperation, kvOperation string) string {
+	switch requestOperation {
+	case "delete":
+		switch kvOperation {
+		case "data":
+			return kvLifecycleDelete
+		case "metadata":
+			return kvLifecycleMetadataDelete
+		}
+	case "create", "update":
+		switch kvOperation {
+		case "delete":
+			return kvLifecycleDelete
+		case "destroy":
+			return kvLifecycleDestroy
+		case "undelete":
+			return kvLifecycleUndelete
+		}
+	}
+	return ""
+}
+
+// Observe records a KV v2 lifecycle operation from its response. Failed responses are counted too, since denied
+// attempts to delete secrets are as telling as successful ones.
+func (m *KVLifecycleMonitor) Observe(auditEvent *AuditEvent) {
+	entry := auditEvent.entry
+	if entry.Type != AuditEventTypeResponse || entry.Request == nil {
+		return
+	}
+	request := entry.Request
+	// the mount type is recorded for requests that were routed to a mount
+	if request.MountType != "" && request.MountType != "kv" {
+		return
+	}
+	mount, kvOperation, key, ok := m.paths.splitKVv2(request.Path)
+	if !ok || key == "" {
+		return
+	}
+	operation := kvLifecycleOperation(request.Operation, kvOperation)
+	if operation == "" {
+		return
+	}
+	result := "success"
+	if entry.Error != "" {
+		result = "failure"
+	}
+	m.counterOperations.WithLabelValues(mount, operation, result).Inc()
+}
@@ -0,0 +1,56 @@
+package main
+
+import "fmt"
+
+// containsLabel reports whether a label name is in the list.
+func containsLabel(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// removeLabel returns the label names without the given name.
+func removeLabel(names []string, name string) []string {
+	kept := names[:0]
+	for _, n := range names {
+		if n != name {
+			kept = append(kept, n)
+		}
+	}
+	return kept
+}
+
+// filterLabelNames applies a LabelFilter to a list of available label names. When the filter has an include list only
+// those labels are kept, after which any excluded labels are removed.
+func filterLabelNames(names []string, filter LabelFilter) ([]string, error) {
+	available := make(map[string]bool, len(names))
+	for _, name := range names {
+		available[name] = true
+	}
+	for _, name := range append(append([]string(nil), filter.Include...), filter.Exclude...) {
+		if !available[name] {
+			return nil, fmt.Errorf("unknown label: %s", name)
+		}
+	}
+
+	kept := append([]string(nil), names...)
+	if len(filter.Include) > 0 {
+		include := make(map[string]bool, len(filter.Include))
+		for _, name := range filter.Include {
+			include[name] = true
+		}
+		kept = kept[:0]
+		for _, name := range names {
+			if include[name] {
+				kept = append(kept, name)
+			}
+		}
+	}
+	for _, name := range filter.Exclude {
+		kept = removeLabel(kept, name)
+	}
+	return kept, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// leaseEndpoints maps the endpoints renewing and revoking leases and tokens to what they act on and how. Lease
+// endpoints may be followed by a lease ID or prefix, which starts with the path of the mount that issued the lease.
+var leaseEndpoints = []struct {
+	prefix string
+	kind   string
+	action string
+}{
+	{"sys/leases/renew", "lease", "renew"},
+	{"sys/leases/revoke-prefix", "lease", "revoke"},
+	{"sys/leases/revoke-force", "lease", "revoke"},
+	{"sys/leases/revoke", "lease", "revoke"},
+	{"sys/renew", "lease", "renew"},
+	{"sys/revoke-prefix", "lease", "revoke"},
+	{"sys/revoke-force", "lease", "revoke"},
+	{"sys/revoke", "lease", "revoke"},
+	{"auth/token/renew", "token", "renew"},
+	{"auth/token/revoke", "token", "revoke"},
+}
+
+// LeaseMonitor counts issued leases and successful lease and token renewals and revocations by the mount that issued
+// them, making lease churn, a common cause of storage pressure in Vault, observable. It also observes the durations of
+// issued leases, highlighting dynamic secrets minted with excessive TTLs.
+type LeaseMonitor struct {
+	mounts *MountTable
+
+	counterOperations *prometheus.CounterVec
+	counterIssued     *prometheus.CounterVec
+	histogramDuration *prometheus.HistogramVec
+}
+
+// NewLeaseMonitor constructs a LeaseMonitor resolving the mounts of leases with mounts, if not nil, and by their first
+// path segment otherwise.
+func NewLeaseMonitor(mounts *MountTable) *LeaseMonitor {
+	return &LeaseMonitor{
+		mounts: mounts,
+		counterOperations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "leases",
+			Name:      "operations_total",
+			Help:      "Number of successful lease and token renewals and revocations. Partitioned by kind (lease or token), action (renew or revoke), and the mount that issued them, where known.",
+		},
+			[]string{"kind", "action", "mount"}),
+		counterIssued: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "leases",
+			Name:      "issued_total",
+			Help:      "Number of leases issued with secrets. Partitioned by the mount that issued them.",
+		},
+			[]string{"mount"}),
+		histogramDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: PromNamespace,
+			Subsystem: "leases",
+			Name:      "issued_duration_seconds",
+			Help:      "Duration of leases issued with secrets, for leases whose audit entry carries one. Partitioned by the mount that issued them.",
+			Buckets:   ttlBuckets,
+		},
+			[]string{"mount"}),
+	}
+}
+
+func (m *LeaseMonitor) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.counterOperations, m.counterIssued, m.histogramDuration}
+}
+
+// leaseOperation returns what a request path renews or revokes and how, and the lease ID or prefix following the
+// endpoint, if any. ok is false for other paths.
+func leaseOperation(path string) (kind, action, lease string, ok bool) {
+	for _, endpoint := range leaseEndpoints {
+		if !strings.HasPrefix(path, endpoint.prefix) {
+			continue
+		}
+		rest := path[len(endpoint.prefix):]
+		if endpoint.kind == "token" {
+			// auth/token/renew-self, revoke-accessor, revoke-orphan, and the like
+			if rest != "" && rest[0] != '-' && rest[0] != '/' {
+				continue
+			}
+			return endpoint.kind, endpoint.action, "", true
+		}
+		switch {
+		case rest == "":
+			return endpoint.kind, endpoint.action, "", true
+		case rest[0] == '/':
+			return endpoint.kind, endpoint.action, rest[1:], true
+		}
+	}
+	return "", "", "", false
+}
+
+// mount returns the path of the mount that issued a lease, or "" if it is not known.
+func (m *LeaseMonitor) mount(lease string) string {
+	if lease == "" {
+		return ""
+	}
+	if m.mounts != nil {
+		if mountPath, _, found := m.mounts.Lookup(lease); found {
+			return mountPath
+		}
+	}
+	if i := strings.IndexByte(lease, '/'); i >= 0 {
+		return lease[:i+1]
+	}
+	return ""
+}
+
+// Observe records an issued lease or a lease or token renewal or revocation from its response, unless it failed.
+func (m *LeaseMonitor) Observe(auditEvent *AuditEvent) {
+	entry := auditEvent.entry
+	if entry.Type != AuditEventTypeResponse || entry.Request == nil || entry.Error != "" {
+		return
+	}
+	if response := entry.Response; response != nil && response.Secret != nil && response.Secret.LeaseID != "" {
+		mount := m.mount(response.Secret.LeaseID)
+		m.counterIssued.WithLabelValues(mount).Inc()
+		if response.LeaseDuration > 0 {
+			m.histogramDuration.WithLabelValues(mount).Observe(float64(response.LeaseDuration))
+		}
+		return
+	}
+	kind, action, lease, ok := leaseOperation(entry.Request.Path)
+	if !ok {
+		return
+	}
+	mount := m.mount(lease)
+	if kind == "token" {
+		mount = "auth/token/"
+	}
+	m.counterOperations.WithLabelValues(kind, action, mount).Inc()
+}
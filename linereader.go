@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+)
+
+// lineReaderBufferSize is the initial buffer size of a lineReader, which grows as needed for longer lines.
+const lineReaderBufferSize = 64 * 1024
+
+// lineReaders recycles line readers and their buffers across connections.
+var lineReaders = sync.Pool{New: func() interface{} {
+	return &lineReader{reader: bufio.NewReaderSize(nil, lineReaderBufferSize)}
+}}
+
+// lineReader reads newline-delimited lines of up to a maximum length. Unlike bufio.Scanner, it skips longer lines
+// instead of failing, so that a single oversized audit entry doesn't end the connection.
+type lineReader struct {
+	reader *bufio.Reader
+	max    int
+	line   []byte
+}
+
+// newLineReader returns a lineReader from the pool reading lines of up to max bytes from r. It should be released once
+// r is exhausted.
+func newLineReader(r io.Reader, max int) *lineReader {
+	reader := lineReaders.Get().(*lineReader)
+	reader.reader.Reset(r)
+	reader.max = max
+	return reader
+}
+
+// release returns the lineReader to the pool. Line buffers grown by long lines are dropped rather than kept alive.
+func (r *lineReader) release() {
+	r.reader.Reset(nil)
+	if cap(r.line) > lineReaderBufferSize {
+		r.line = nil
+	}
+	lineReaders.Put(r)
+}
+
+// Next returns the next line without its line ending. The line is only valid until the next call. If the line is
+// longer than the maximum, it is skipped: the returned line is nil and size holds the line's length.
+func (r *lineReader) Next() (line []byte, size int, err error) {
+	r.line = r.line[:0]
+	size = 0
+	for {
+		chunk, err := r.reader.ReadSlice('\n')
+		size += len(chunk)
+		// keep room for the line ending, which is trimmed below
+		if size <= r.max+2 {
+			r.line = append(r.line, chunk...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && (err != io.EOF || size == 0) {
+			return nil, 0, err
+		}
+		break
+	}
+
+	r.line = bytes.TrimSuffix(r.line, []byte("\n"))
+	r.line = bytes.TrimSuffix(r.line, []byte("\r"))
+	if size > len(r.line)+2 || len(r.line) > r.max {
+		return nil, size, nil
+	}
+	return r.line, len(r.line), nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// defaultPathMix resembles the traffic of a cluster serving applications, dominated by secret reads and token lookups.
+const defaultPathMix = "read:secret/data/app/config=40,read:auth/token/lookup-self=20,read:sys/health=10," +
+	"update:auth/approle/login=10,read:database/creds/app=8,update:transit/encrypt/app=6," +
+	"create:secret/data/app/{uuid}=4,delete:sys/leases/revoke/{uuid}=2"
+
+// loadgenErrors are the errors of failed responses, covering each error class.
+var loadgenErrors = []string{
+	"1 error occurred:\n\t* permission denied\n\n",
+	"permission denied",
+	"invalid request",
+	"rate limit quota exceeded",
+	"internal error",
+	"context deadline exceeded",
+}
+
+// loadgenPath is an entry of the path mix.
+type loadgenPath struct {
+	operation string
+	path      string
+	weight    int
+}
+
+// loadgenConfig describes the audit event stream to generate.
+type loadgenConfig struct {
+	paths       []loadgenPath
+	totalWeight int
+	errorRatio  float64
+	idReuse     float64
+	latency     time.Duration
+}
+
+// loadgen synthesizes Vault audit request and response entries and writes them to an exporter, for capacity planning
+// and regression testing without a Vault cluster. It returns the process exit code.
+func loadgen(args []string) int {
+	flags := flag.NewFlagSet("loadgen", flag.ExitOnError)
+	target := flags.String("target", "127.0.0.1:9090", "Address of the exporter's audit listener to send events to")
+	network := flags.String("network", "tcp", "Network of the target address")
+	rate := flags.Float64("rate", 1000, "Requests per second, each followed by its response (0 for as fast as possible)")
+	duration := flags.Duration("duration", time.Minute, "Length of time to generate events for (0 to run until interrupted)")
+	connections := flags.Int("connections", 1, "Number of connections to spread requests over, like several Vault nodes")
+	pathMix := flags.String("path-mix", defaultPathMix, "Comma-separated operation:path=weight entries requests are drawn from, where {uuid} in a path is replaced with a random UUID")
+	errorRatio := flags.Float64("error-ratio", 0.02, "Fraction of responses carrying an error")
+	idReuse := flags.Float64("id-reuse", 0, "Fraction of requests reusing the ID of the previous request, as with retries")
+	latency := flags.Duration("latency", 20*time.Millisecond, "Mean time between a request and its response, exponentially distributed")
+	seed := flags.Int64("seed", 0, "Seed of the random generator, to repeat a stream (0 for a random seed)")
+	_ = flags.Parse(args)
+
+	cfg := loadgenConfig{errorRatio: *errorRatio, idReuse: *idReuse, latency: *latency}
+	paths, err := parsePathMix(*pathMix)
+	if err != nil {
+		logError("error parsing -path-mix", "error", err)
+		return 2
+	}
+	cfg.paths = paths
+	for _, path := range paths {
+		cfg.totalWeight += path.weight
+	}
+	if *connections < 1 {
+		logError("-connections must be at least 1")
+		return 2
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		if *duration > 0 {
+			select {
+			case <-signals:
+			case <-time.After(*duration):
+			}
+		} else {
+			<-signals
+		}
+		close(stop)
+	}()
+
+	var sent int64
+	var failed int32
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < *connections; i++ {
+		conn, err := net.Dial(*network, *target)
+		if err != nil {
+			logError("error connecting to target", "target", *target, "error", err)
+			return 1
+		}
+		wg.Add(1)
+		go func(i int, conn net.Conn) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(*seed + int64(i)))
+			if err := cfg.generate(conn, random, *rate/float64(*connections), stop, &sent); err != nil {
+				logError("error writing to target", "target", *target, "error", err)
+				atomic.StoreInt32(&failed, 1)
+			}
+			if err := conn.Close(); err != nil {
+				logError("error closing connection", "error", err)
+			}
+		}(i, conn)
+	}
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	requests := atomic.LoadInt64(&sent)
+	fmt.Printf("sent %d requests and their responses in %s (%.0f events/s)\n", requests, elapsed.Round(time.Millisecond),
+		float64(2*requests)/elapsed.Seconds())
+	if atomic.LoadInt32(&failed) != 0 {
+		return 1
+	}
+	return 0
+}
+
+// parsePathMix parses comma-separated operation:path=weight entries.
+func parsePathMix(mix string) ([]loadgenPath, error) {
+	var paths []loadgenPath
+	for _, entry := range strings.Split(mix, ",") {
+		i := strings.LastIndexByte(entry, '=')
+		j := strings.IndexByte(entry, ':')
+		if i < 0 || j < 0 || j > i {
+			return nil, fmt.Errorf("expected operation:path=weight, got %q", entry)
+		}
+		weight, err := strconv.Atoi(entry[i+1:])
+		if err != nil || weight <= 0 {
+			return nil, fmt.Errorf("invalid weight in %q", entry)
+		}
+		paths = append(paths, loadgenPath{operation: entry[:j], path: entry[j+1 : i], weight: weight})
+	}
+	return paths, nil
+}
+
+// generate writes requests and their responses to w at rate requests per second until stop is closed, counting the
+// requests in sent.
+func (cfg *loadgenConfig) generate(w net.Conn, random *rand.Rand, rate float64, stop <-chan struct{}, sent *int64) error {
+	writer := bufio.NewWriter(w)
+	encoder := json.NewEncoder(writer)
+	start := time.Now()
+	var count int64
+	var id string
+	for {
+		select {
+		case <-stop:
+			return writer.Flush()
+		default:
+		}
+
+		// catch up with the rate, then wait a little for more requests to become due
+		due := count + 1000
+		if rate > 0 {
+			due = int64(time.Since(start).Seconds() * rate)
+		}
+		for ; count < due; count++ {
+			if id == "" || random.Float64() >= cfg.idReuse {
+				id = randomUUID(random)
+			}
+			request, response := cfg.entries(random, id)
+			if err := encoder.Encode(request); err != nil {
+				return err
+			}
+			if err := encoder.Encode(response); err != nil {
+				return err
+			}
+			atomic.AddInt64(sent, 1)
+		}
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+		if rate > 0 {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
+
+// entries returns a request drawn from the path mix and its response.
+func (cfg *loadgenConfig) entries(random *rand.Rand, id string) (*AuditEntry, *AuditEntry) {
+	n := random.Intn(cfg.totalWeight)
+	path := cfg.paths[0]
+	for _, p := range cfg.paths {
+		if n < p.weight {
+			path = p
+			break
+		}
+		n -= p.weight
+	}
+
+	now := time.Now().UTC()
+	auth := &AuditAuth{Policies: []string{"default", "app-" + strconv.Itoa(random.Intn(10))}, TokenType: "service"}
+	if random.Intn(100) == 0 {
+		auth.Policies = []string{"root"}
+	}
+	request := &AuditEntry{
+		Time: now.Format(time.RFC3339Nano),
+		Type: AuditEventTypeRequest,
+		Auth: auth,
+		Request: &AuditRequest{
+			ID:         id,
+			Operation:  path.operation,
+			Path:       strings.Replace(path.path, "{uuid}", randomUUID(random), -1),
+			RemoteAddr: "10.0." + strconv.Itoa(random.Intn(4)) + "." + strconv.Itoa(1+random.Intn(50)),
+		},
+	}
+	response := *request
+	response.Type = AuditEventTypeResponse
+	latency := time.Duration(random.ExpFloat64() * float64(cfg.latency))
+	response.Time = now.Add(latency).Format(time.RFC3339Nano)
+	if random.Float64() < cfg.errorRatio {
+		response.Error = loadgenErrors[random.Intn(len(loadgenErrors))]
+	}
+	return request, &response
+}
+
+// randomUUID returns a random identifier formatted like a UUID.
+func randomUUID(random *rand.Rand) string {
+	return fmt.Sprintf("%08x-%04x-%04x-%04x-%012x", random.Uint32(), random.Intn(1<<16), random.Intn(1<<16),
+		random.Intn(1<<16), random.Int63n(1<<48))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// LogFile is a log file that is rotated once it reaches a maximum size or age. Rotated files are kept with numbered
+// suffixes, ".1" being the most recent, up to a maximum number of backups, bounding the disk space used by logs.
+type LogFile struct {
+	path     string
+	maxBytes int64
+	maxAge   time.Duration
+	backups  int
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// NewLogFile opens the log file at path for appending. A maxBytes or maxAge of 0 disables rotation by size or age.
+func NewLogFile(path string, maxBytes int64, maxAge time.Duration, backups int) (*LogFile, error) {
+	if backups < 1 {
+		return nil, fmt.Errorf("at least one backup must be kept")
+	}
+	f := &LogFile{path: path, maxBytes: maxBytes, maxAge: maxAge, backups: backups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *LogFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	f.file, f.size, f.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+// Write appends p to the log file, rotating it first if p would exceed the maximum size or the file has reached the
+// maximum age. If rotation fails, p is still written to the current file.
+func (f *LogFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.size > 0 && (f.maxBytes > 0 && f.size+int64(len(p)) > f.maxBytes ||
+		f.maxAge > 0 && time.Since(f.opened) >= f.maxAge) {
+		if err := f.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "error rotating log file: %v\n", err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the backups by one, dropping the oldest, moves the current file to the first backup, and starts a new
+// one.
+func (f *LogFile) rotate() error {
+	for i := f.backups - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		// keep writing to the current file rather than losing logs
+		if openErr := f.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	return f.open()
+}
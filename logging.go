@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log levels, in increasing order of severity.
+const (
+	LogLevelDebug = "debug"
+	LogLevelInfo  = "info"
+	LogLevelWarn  = "warn"
+	LogLevelError = "error"
+)
+
+// Log formats.
+const (
+	// LogFormatConsole writes human-readable lines of space-separated key=value fields.
+	LogFormatConsole = "console"
+	// LogFormatJSON writes one JSON object per line.
+	LogFormatJSON = "json"
+)
+
+var logLevelSeverities = map[string]int{
+	LogLevelDebug: 0,
+	LogLevelInfo:  1,
+	LogLevelWarn:  2,
+	LogLevelError: 3,
+}
+
+// logSampleInterval is the interval over which log entries with the same message are sampled.
+const logSampleInterval = 10 * time.Second
+
+// Logger writes leveled log entries with structured fields, passed as alternating keys and values.
+type Logger struct {
+	severity int
+	json     bool
+	sampler  *logSampler
+
+	mu  sync.Mutex
+	out io.Writer
+	buf bytes.Buffer
+}
+
+// logger is the process-wide logger, replaced in main once the log flags are parsed.
+var logger = &Logger{severity: logLevelSeverities[LogLevelInfo], out: os.Stderr}
+
+// NewLogger constructs a Logger writing entries of at least level to out in format.
+func NewLogger(out io.Writer, level string, format string) (*Logger, error) {
+	severity, ok := logLevelSeverities[level]
+	if !ok {
+		return nil, fmt.Errorf("unknown log level: %s", level)
+	}
+	if format != LogFormatConsole && format != LogFormatJSON {
+		return nil, fmt.Errorf("unknown log format: %s", format)
+	}
+	return &Logger{severity: severity, json: format == LogFormatJSON, out: out}, nil
+}
+
+// Sample limits entries with the same level and message to the first entries within each sampling interval, and then
+// every thereafter-th one. At the end of each interval, the number of entries that were suppressed is logged, so that a
+// storm of errors such as unmatched responses doesn't itself overwhelm the host.
+func (l *Logger) Sample(first, thereafter int) {
+	l.sampler = &logSampler{first: first, thereafter: thereafter, counts: make(map[logSampleKey]*logSample)}
+	go l.sampler.run(l)
+}
+
+// Enabled reports whether entries of level are written.
+func (l *Logger) Enabled(level string) bool {
+	return logLevelSeverities[level] >= l.severity
+}
+
+// Log writes an entry of level with msg and fields, which alternate between keys and values.
+func (l *Logger) Log(level string, msg string, fields ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	if l.sampler != nil && !l.sampler.allow(level, msg) {
+		return
+	}
+	l.write(level, msg, fields)
+}
+
+func (l *Logger) write(level string, msg string, fields []interface{}) {
+	now := time.Now().UTC()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buf.Reset()
+	if l.json {
+		l.buf.WriteString(`{"time":"`)
+		l.buf.WriteString(now.Format(time.RFC3339Nano))
+		l.buf.WriteString(`","level":"`)
+		l.buf.WriteString(level)
+		l.buf.WriteString(`","msg":`)
+		writeJSONValue(&l.buf, msg)
+		for i := 0; i < len(fields); i += 2 {
+			l.buf.WriteByte(',')
+			writeJSONValue(&l.buf, fieldKey(fields[i]))
+			l.buf.WriteByte(':')
+			writeJSONValue(&l.buf, fieldValue(fields, i))
+		}
+		l.buf.WriteString("}\n")
+	} else {
+		l.buf.WriteString(now.Format("2006-01-02T15:04:05.000Z07:00"))
+		l.buf.WriteByte(' ')
+		l.buf.WriteString(strings.ToUpper(level))
+		l.buf.WriteByte(' ')
+		l.buf.WriteString(msg)
+		for i := 0; i < len(fields); i += 2 {
+			l.buf.WriteByte(' ')
+			l.buf.WriteString(fieldKey(fields[i]))
+			l.buf.WriteByte('=')
+			writeConsoleValue(&l.buf, fieldValue(fields, i))
+		}
+		l.buf.WriteByte('\n')
+	}
+	_, _ = l.out.Write(l.buf.Bytes())
+}
+
+// Write implements io.Writer, so that the standard library logger, which is used by dependencies, writes through the
+// Logger. Each write is logged as a single entry, at error level when it starts with "error".
+func (l *Logger) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	level := LogLevelInfo
+	if strings.HasPrefix(msg, "error") {
+		level = LogLevelError
+	}
+	l.Log(level, msg)
+	return len(p), nil
+}
+
+// logSampler counts the entries logged with each level and message within the current sampling interval.
+type logSampler struct {
+	first      int
+	thereafter int
+
+	mu     sync.Mutex
+	counts map[logSampleKey]*logSample
+}
+
+type logSampleKey struct {
+	level, msg string
+}
+
+type logSample struct {
+	logged, suppressed int
+}
+
+// allow counts an entry, reporting whether it should be logged.
+func (s *logSampler) allow(level string, msg string) bool {
+	key := logSampleKey{level: level, msg: msg}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sample, ok := s.counts[key]
+	if !ok {
+		sample = new(logSample)
+		s.counts[key] = sample
+	}
+	if sample.logged < s.first || s.thereafter > 0 && (sample.logged+sample.suppressed-s.first)%s.thereafter == 0 {
+		sample.logged++
+		return true
+	}
+	sample.suppressed++
+	return false
+}
+
+// run starts a new sampling interval every logSampleInterval, logging the number of entries suppressed in the last one.
+func (s *logSampler) run(l *Logger) {
+	for {
+		time.Sleep(logSampleInterval)
+		s.mu.Lock()
+		counts := s.counts
+		s.counts = make(map[logSampleKey]*logSample, len(counts))
+		s.mu.Unlock()
+		for key, sample := range counts {
+			if sample.suppressed > 0 {
+				l.write(key.level, "suppressed repeated log entries", []interface{}{"msg", key.msg,
+					"suppressed", sample.suppressed, "interval", logSampleInterval})
+			}
+		}
+	}
+}
+
+func fieldKey(key interface{}) string {
+	if s, ok := key.(string); ok {
+		return s
+	}
+	return fmt.Sprint(key)
+}
+
+// fieldValue returns the value following the key at index i, converting errors and other types without a natural
+// representation to strings.
+func fieldValue(fields []interface{}, i int) interface{} {
+	if i+1 >= len(fields) {
+		return nil
+	}
+	switch v := fields[i+1].(type) {
+	case nil, string, bool, int, int32, int64, uint32, uint64, float64:
+		return v
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func writeJSONValue(buf *bytes.Buffer, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(data)
+}
+
+// writeConsoleValue writes v, quoting strings that are empty or contain spaces, quotes or control characters.
+func writeConsoleValue(buf *bytes.Buffer, v interface{}) {
+	s, ok := v.(string)
+	if !ok {
+		fmt.Fprint(buf, v)
+		return
+	}
+	if s == "" || strings.IndexFunc(s, func(r rune) bool { return r <= ' ' || r == '"' || r == '=' }) >= 0 {
+		s = strconv.Quote(s)
+	}
+	buf.WriteString(s)
+}
+
+// logDebug logs msg and fields at debug level.
+func logDebug(msg string, fields ...interface{}) {
+	logger.Log(LogLevelDebug, msg, fields...)
+}
+
+// logInfo logs msg and fields at info level.
+func logInfo(msg string, fields ...interface{}) {
+	logger.Log(LogLevelInfo, msg, fields...)
+}
+
+// logWarn logs msg and fields at warn level.
+func logWarn(msg string, fields ...interface{}) {
+	logger.Log(LogLevelWarn, msg, fields...)
+}
+
+// logError logs msg and fields at error level.
+func logError(msg string, fields ...interface{}) {
+	logger.Log(LogLevelError, msg, fields...)
+}
+
+// logFatal logs msg and fields at error level and exits.
+func logFatal(msg string, fields ...interface{}) {
+	logger.Log(LogLevelError, msg, fields...)
+	os.Exit(1)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// loginCleanupInterval is the interval at which sources without recent login failures are forgotten.
+const loginCleanupInterval = time.Minute
+
+// LoginMonitor tracks failed logins per auth method and mount, turning the audit stream into basic credential stuffing
+// detection. Logins are requests to paths of the form auth/<mount>/login, with the alias name of auth methods such as
+// userpass and ldap following as another segment. Once failures from one source address exceed a threshold within a
+// window, a brute force attempt is logged, counted, and optionally posted to a webhook.
+type LoginMonitor struct {
+	sourceLabel bool
+	aliasLabel  bool
+	threshold   int
+	window      time.Duration
+	webhook     *Webhook
+	alerts      *Alerter
+
+	mu sync.Mutex
+	// failures holds the times of the recent failed logins of each source address, oldest first, and alerted the
+	// sources whose brute force attempt was already reported within the window.
+	failures map[string][]time.Time
+	alerted  map[string]time.Time
+
+	counterFailures      *prometheus.CounterVec
+	gagueStreak          *prometheus.GaugeVec
+	counterBruteForce    *prometheus.CounterVec
+	counterWebhookErrors prometheus.Counter
+}
+
+// bruteForceEvent is the body posted to the brute force webhook.
+type bruteForceEvent struct {
+	Source   string    `json:"source"`
+	Mount    string    `json:"mount"`
+	Failures int       `json:"failures"`
+	Window   string    `json:"window"`
+	Time     time.Time `json:"time"`
+}
+
+// NewLoginMonitor constructs a LoginMonitor. sourceLabel and aliasLabel add the source address and alias name as labels
+// of the failure metrics, at the cost of a series for each. A brute force attempt is reported once a source fails
+// threshold logins within window, with a threshold of zero disabling detection. If webhook is not empty, brute force
+// attempts are posted to it. Brute force attempts are also findings for alerts.
+func NewLoginMonitor(sourceLabel, aliasLabel bool, threshold int, window time.Duration, webhook string,
+	alerts *Alerter) *LoginMonitor {
+	labels := []string{"mount", "method"}
+	if sourceLabel {
+		labels = append(labels, "source")
+	}
+	if aliasLabel {
+		labels = append(labels, "alias")
+	}
+	m := &LoginMonitor{
+		sourceLabel: sourceLabel,
+		aliasLabel:  aliasLabel,
+		alerts:      alerts,
+		threshold:   threshold,
+		window:      window,
+		failures:    make(map[string][]time.Time),
+		alerted:     make(map[string]time.Time),
+		counterFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "security",
+			Name:      "login_failures_total",
+			Help:      "Number of failed logins. Partitioned by auth mount and method, and optionally source address and alias name.",
+		},
+			labels),
+		gagueStreak: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: PromNamespace,
+			Subsystem: "security",
+			Name:      "login_failure_streak",
+			Help:      "Number of consecutive failed logins since the last successful one. Partitioned like login_failures_total.",
+		},
+			labels),
+		counterBruteForce: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "security",
+			Name:      "brute_force_detections_total",
+			Help:      "Number of source addresses that failed -brute-force-threshold logins within -brute-force-window. Partitioned by the auth mount of the last failure.",
+		},
+			[]string{"mount"}),
+		counterWebhookErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "security",
+			Name:      "brute_force_webhook_errors_total",
+			Help:      "Number of failed calls of -brute-force-webhook.",
+		}),
+	}
+	if webhook != "" {
+		m.webhook = NewWebhook("brute-force-webhook", webhook, m.counterWebhookErrors.Inc)
+	}
+	return m
+}
+
+func (m *LoginMonitor) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.counterFailures, m.gagueStreak, m.counterBruteForce, m.counterWebhookErrors}
+}
+
+// parseLoginPath splits the path of a login request into its auth mount and alias name, reporting whether it is one.
+func parseLoginPath(path string) (mount, alias string, ok bool) {
+	if !strings.HasPrefix(path, "auth/") {
+		return "", "", false
+	}
+	rest := path[len("auth/"):]
+	i := strings.Index(rest, "/login")
+	if i <= 0 {
+		return "", "", false
+	}
+	mount, rest = rest[:i], rest[i+len("/login"):]
+	switch {
+	case rest == "":
+	case rest[0] == '/':
+		alias = rest[1:]
+	default:
+		return "", "", false
+	}
+	return mount, alias, true
+}
+
+// Observe records the outcome of a login from its response.
+func (m *LoginMonitor) Observe(auditEvent *AuditEvent) {
+	entry := auditEvent.entry
+	if entry.Type != AuditEventTypeResponse || entry.Request == nil {
+		return
+	}
+	mount, alias, ok := parseLoginPath(entry.Request.Path)
+	if !ok {
+		return
+	}
+	labels := prometheus.Labels{"mount": mount, "method": entry.Request.MountType}
+	if m.sourceLabel {
+		labels["source"] = entry.Request.RemoteAddr
+	}
+	if m.aliasLabel {
+		labels["alias"] = alias
+	}
+	if entry.Error == "" {
+		m.gagueStreak.With(labels).Set(0)
+		return
+	}
+	m.counterFailures.With(labels).Inc()
+	m.gagueStreak.With(labels).Inc()
+	if m.threshold > 0 {
+		m.detect(entry.Request.RemoteAddr, mount, auditEvent.time)
+	}
+}
+
+// detect records a failed login of a source, reporting a brute force attempt once the source reaches the threshold
+// within the window. A source is reported at most once per window.
+func (m *LoginMonitor) detect(source, mount string, t time.Time) {
+	m.mu.Lock()
+	failures := append(m.failures[source], t)
+	cutoff := t.Add(-m.window)
+	for len(failures) > 0 && failures[0].Before(cutoff) {
+		failures = failures[1:]
+	}
+	// only the most recent failures can make up the threshold
+	if len(failures) > m.threshold {
+		failures = failures[len(failures)-m.threshold:]
+	}
+	m.failures[source] = failures
+	n := len(failures)
+	alerted, found := m.alerted[source]
+	report := n >= m.threshold && !(found && alerted.After(cutoff))
+	if report {
+		m.alerted[source] = t
+	}
+	m.mu.Unlock()
+	if !report {
+		return
+	}
+
+	logWarn("possible brute force login attempt", "source", source, "mount", mount, "failures", n, "window", m.window)
+	m.counterBruteForce.WithLabelValues(mount).Inc()
+	event := bruteForceEvent{Source: source, Mount: mount, Failures: n, Window: m.window.String(), Time: t}
+	m.webhook.Notify(event)
+	m.alerts.Fire(Finding{
+		Kind:    FindingBruteForce,
+		Key:     source,
+		Summary: fmt.Sprintf("possible brute force login attempt from %s: %d failed logins on %s within %s", source, n, mount, m.window),
+		Time:    t,
+		Details: event,
+	})
+}
+
+// Run continuously forgets sources without failed logins within the window.
+func (m *LoginMonitor) Run() {
+	for {
+		time.Sleep(loginCleanupInterval)
+		cutoff := time.Now().Add(-m.window)
+		m.mu.Lock()
+		for source, failures := range m.failures {
+			if len(failures) == 0 || failures[len(failures)-1].Before(cutoff) {
+				delete(m.failures, source)
+			}
+		}
+		for source, alerted := range m.alerted {
+			if alerted.Before(cutoff) {
+				delete(m.alerted, source)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// lokiSink pushes audit events to Grafana Loki with the push API, as gzip-compressed JSON. Each event is a log line of
+// the stream identified by the constant tags, by default a job label, and the event's labels selected for the sink,
+// which should be few and of low cardinality, such as operation and path_group, since Loki indexes every stream.
+type lokiSink struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+	tags    map[string]string
+}
+
+func newLokiSink(cfg EventSinkConfig) (*lokiSink, error) {
+	if !strings.HasPrefix(cfg.URL, "http://") && !strings.HasPrefix(cfg.URL, "https://") {
+		return nil, fmt.Errorf("an http or https url is required")
+	}
+	s := &lokiSink{
+		url:     cfg.URL,
+		headers: cfg.Headers,
+		client:  &http.Client{Timeout: sinkTimeout},
+		tags:    map[string]string{"job": "vault-audit-metrics"},
+	}
+	for name, value := range cfg.Tags {
+		s.tags[name] = value
+	}
+	for _, name := range cfg.Labels {
+		if !labelNameRegexp.MatchString(name) {
+			return nil, fmt.Errorf("invalid label: %q", name)
+		}
+	}
+	return s, nil
+}
+
+func (s *lokiSink) send(events []*forwardedEvent) error {
+	type stream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	// Loki rejects entries older than the latest of their stream unless out-of-order writes are enabled, while events
+	// are processed roughly, but not exactly, in order
+	sorted := append([]*forwardedEvent(nil), events...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].time.Before(sorted[j].time) })
+	streams := make(map[string]*stream)
+	var keys []string
+	for _, event := range sorted {
+		labels := make(map[string]string, len(s.tags)+len(event.labels))
+		for name, value := range s.tags {
+			labels[name] = value
+		}
+		for name, value := range event.labels {
+			labels[name] = value
+		}
+		key := dimensionsKey(labels)
+		if streams[key] == nil {
+			streams[key] = &stream{Stream: labels}
+			keys = append(keys, key)
+		}
+		streams[key].Values = append(streams[key].Values,
+			[2]string{strconv.FormatInt(event.time.UnixNano(), 10), string(event.line)})
+	}
+	sort.Strings(keys)
+	push := struct {
+		Streams []*stream `json:"streams"`
+	}{}
+	for _, key := range keys {
+		push.Streams = append(push.Streams, streams[key])
+	}
+	body, err := json.Marshal(push)
+	if err != nil {
+		return err
+	}
+	return postSink(s.client, s.url, "application/json", s.headers, body, true)
+}
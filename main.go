@@ -3,8 +3,12 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -17,22 +21,272 @@ var (
 	flagHTTPAddr     = flag.String("http-addr", ":8080", "Address to bind the HTTP server (including /metrics) to")
 	flagCacheTTL     = flag.Duration("cache-ttl", 5*time.Minute, "Length of time to cache request timestamps for calculating latency")
 	flagCacheCleanup = flag.Duration("cache-cleanup", 1*time.Minute, "Interval at which expired entries in the request timestamp cache are evicted")
+	flagStore        = flag.String("timestamp-store", TimestampStoreMemory, "Where to keep request timestamps: \"memory\", or \"redis\" or \"memcached\" to correlate across replicas")
+	flagCacheShards  = flag.Int("cache-shards", 16, "Number of independently locked shards of the request timestamp cache")
+	flagCacheMax     = flag.Int("cache-max-entries", 0, "Maximum number of requests in the timestamp cache, after which the least recently stored are evicted (0 for unbounded)")
+	flagCacheBytes   = flag.Int64("cache-max-bytes", 0, "Approximate maximum memory used by requests in the timestamp cache, after which the least recently stored are evicted (0 for unbounded)")
+	flagDuplicates   = flag.String("duplicate-request-ids", DuplicateLastWins, "How to handle requests whose ID is already awaiting a response: \"last-wins\", \"first-wins\", or \"multiset\" to match responses to each of them in order")
+	flagSnapshot     = flag.String("cache-snapshot", "", "File to save request timestamps to on shutdown and restore them from on startup")
+	flagSnapshotAge  = flag.Duration("cache-snapshot-max-age", 5*time.Minute, "Age after which a cache snapshot is too stale to restore")
+	flagLatencyClock = flag.String("latency-clock", LatencyClockVault, "Clock to measure latency with: \"vault\" for audit log timestamps, or \"receipt\" for the exporter's own clock when lines are received")
+	flagPendingTTL   = flag.Duration("pending-response-ttl", 10*time.Second, "Length of time to buffer responses that arrive before their request (0 to disable)")
+	flagCorrelation  = flag.Duration("correlation-check-interval", 1*time.Minute, "Interval at which latency correlation is disabled if only responses were received, such as when requests are filtered upstream (0 to always correlate)")
+	flagWorkers      = flag.Int("workers", 0, "Number of audit events processed concurrently (0 for four per CPU)")
+	flagQueueSize    = flag.Int("queue-size", 10000, "Number of audit events waiting for a worker before the overload policy applies")
+	flagOverload     = flag.String("overload-policy", OverloadBlock, "What to do with audit events while the processing queue is full: \"block\" reading audit connections, \"drop-newest\", or \"drop-oldest\"")
+	flagHighTput     = flag.Bool("high-throughput", false, "Aggregate metric updates per worker and merge them every 500ms, avoiding contention on shared series at very high event rates at the cost of metrics lagging slightly")
+	flagMaxLineBytes = flag.Int("max-line-bytes", 1024*1024, "Length of the longest audit log line that is processed, with longer lines being skipped and counted")
+	flagParseErrors  = flag.Float64("parse-error-threshold", 0.1, "Ratio of audit log lines failing to parse within -parse-error-window above which /readyz fails (0 to disable)")
+	flagParseWindow  = flag.Duration("parse-error-window", 5*time.Minute, "Rolling window the parse error ratio is measured over")
+	flagDeadLetter   = flag.String("dead-letter-file", "", "File to append lines that cannot be decoded as audit entries to, with their receipt time and source")
+	flagDeadLetterSz = flag.Int64("dead-letter-max-bytes", 10*1024*1024, "Size at which the dead-letter file is rotated, keeping one previous file")
+	flagLogLevel     = flag.String("log-level", LogLevelInfo, "Minimum level of log entries: \"debug\", \"info\", \"warn\", or \"error\"")
+	flagLogFormat    = flag.String("log-format", LogFormatConsole, "Format of log entries: \"console\", or \"json\" for one JSON object per line")
+	flagLogSampleN   = flag.Int("log-sample-first", 10, "Number of log entries with the same message logged every 10 seconds before sampling them (0 to log every entry)")
+	flagLogSampleM   = flag.Int("log-sample-thereafter", 100, "Once sampling, log only one in this many entries with the same message (0 to log none)")
+	flagLogFile      = flag.String("log-file", "", "File to write logs to instead of standard error, rotated by size and age")
+	flagLogMaxBytes  = flag.Int64("log-max-bytes", 100*1024*1024, "Size at which the log file is rotated (0 to not rotate by size)")
+	flagLogMaxAge    = flag.Duration("log-max-age", 0, "Age at which the log file is rotated (0 to not rotate by age)")
+	flagLogBackups   = flag.Int("log-max-backups", 5, "Number of rotated log files to keep")
+	flagSourceDown   = flag.Duration("source-down-after", 5*time.Minute, "Length of time after which an audit device that stopped sending events is considered down (0 to disable)")
+	flagSourceHook   = flag.String("source-down-webhook", "", "URL to post a JSON event to when an audit device goes down or recovers")
+	flagRootHook     = flag.String("root-token-webhook", "", "URL to post a JSON event to for every request made with a root token")
+	flagLoginSource  = flag.Bool("login-failure-source-label", false, "Add a source label with the remote address to failed login metrics")
+	flagLoginAlias   = flag.Bool("login-failure-alias-label", false, "Add an alias label with the alias name of auth methods such as userpass and ldap to failed login metrics")
+	flagBruteForceN  = flag.Int("brute-force-threshold", 0, "Number of failed logins from one remote address within -brute-force-window at which a brute force attempt is reported (0 to disable)")
+	flagBruteWindow  = flag.Duration("brute-force-window", 5*time.Minute, "Window failed logins are counted over for brute force detection")
+	flagBruteHook    = flag.String("brute-force-webhook", "", "URL to post a JSON event to for every brute force attempt")
+	flagWatchHook    = flag.String("watchlist-webhook", "", "URL to post a JSON event to for every access of a watchlist path")
+	flagCredHook     = flag.String("credential-watchlist-webhook", "", "URL to post a JSON event to for every appearance of a watched credential")
+	flagClients      = flag.Bool("active-clients", false, "Estimate the number of distinct active clients per namespace and auth method over 5m, 1h, and 24h")
+	flagTopTalkers   = flag.Int("top-talkers", 0, "Number of clients making the most requests to track within -top-talkers-window, up to 100 (0 to disable)")
+	flagTopWindow    = flag.Duration("top-talkers-window", 15*time.Minute, "Sliding window top talkers are tracked over")
+	flagMaxMemory    = flag.Int64("max-memory", 0, "Memory limit in bytes, set as GOMEMLIMIT, approaching which the request timestamp cache is shrunk and audit events are dropped (0 for no limit)")
+	flagConfig       = flag.String("config", "", "Path to an optional YAML configuration file")
+	flagDropRawError = flag.Bool("drop-raw-error", false, "Drop the raw error label from metrics, keeping only the error_class label")
+	flagNoise        = flag.Bool("suppress-noise", false, "Do not meter sys/health, auth/token/lookup-self, and sys/internal/ui/* events")
+	flagPathInclude  = stringsFlag("path-include", "Only meter events whose path matches this regex (repeatable)")
+	flagPathExclude  = stringsFlag("path-exclude", "Do not meter events whose path matches this regex (repeatable)")
+	flagOpInclude    = stringsFlag("operation-include", "Only meter events with this operation (repeatable)")
+	flagOpExclude    = stringsFlag("operation-exclude", "Do not meter events with this operation (repeatable)")
+	flagPathMaxDepth = flag.Int("path-max-depth", 0, "Truncate the path label to its first N segments (0 to keep full paths)")
+	flagKVv2Collapse = flag.Bool("kv-v2-collapse", false, "Collapse KV v2 secret paths such as secret/data/foo/bar into secret/data/*")
+	flagKVv2OpLabel  = flag.Bool("kv-v2-op-label", false, "Add a kv_op label containing the KV v2 operation (data, metadata, delete, undelete, destroy, or subkeys)")
+	flagCollapseIDs  = flag.Bool("collapse-dynamic-segments", false, "Replace UUIDs, lease IDs, hex digests, and Vault tokens in paths with :uuid, :lease, and :id")
+	flagMaxSeries    = flag.Int("max-series", 0, "Maximum number of series per metric, after which new label combinations are folded into a single series with every label set to \"__other__\" (0 for unlimited)")
+	flagSeriesTTL    = flag.Duration("series-ttl", 0, "Length of time a series may go without updates before it is deleted (0 to never delete)")
+	flagPolicyMetric = flag.Bool("policy-metrics", false, "Count requests once per policy attached to the requesting token")
+
+	flagMountLabels  = flag.Bool("mount-labels", false, "Add mount_path and mount_type labels resolved from the Vault mount table (requires Vault API access)")
+	flagMountRefresh = flag.Duration("mount-refresh", 5*time.Minute, "Interval at which the Vault mount table is reloaded")
+
+	flagRedisAddr      = flag.String("redis-addr", "", "Address of the Redis server used by the redis timestamp store")
+	flagRedisDB        = flag.Int("redis-db", 0, "Redis database number used by the redis timestamp store")
+	flagRedisTLS       = flag.Bool("redis-tls", false, "Connect to Redis with TLS")
+	flagRedisKeyPrefix = flag.String("redis-key-prefix", "vault-audit-metrics:", "Prefix of the Redis keys request timestamps are stored under")
+	flagRedisPoolSize  = flag.Int("redis-pool-size", 8, "Maximum number of open Redis connections")
+	flagRedisTimeout   = flag.Duration("redis-timeout", 1*time.Second, "Timeout of Redis connections and commands")
+
+	flagMemcachedAddr      = flag.String("memcached-addr", "", "Address of the memcached server used by the memcached timestamp store")
+	flagMemcachedKeyPrefix = flag.String("memcached-key-prefix", "vault-audit-metrics:", "Prefix of the memcached keys request timestamps are stored under")
+	flagMemcachedPoolSize  = flag.Int("memcached-pool-size", 8, "Maximum number of open memcached connections")
+	flagMemcachedTimeout   = flag.Duration("memcached-timeout", 1*time.Second, "Timeout of memcached connections and commands")
+
+	flagPeerAddr      = flag.String("peer-addr", "", "Address of this instance in -peers, on which events forwarded by peers are received")
+	flagPeers         = flag.String("peers", "", "Comma-separated addresses of all instances, in the same order on each, to forward events to the instance owning their request ID")
+	flagPeerQueueSize = flag.Int("peer-queue-size", 10000, "Number of events buffered for each peer before they are processed locally instead")
+	flagPeerTimeout   = flag.Duration("peer-timeout", 1*time.Second, "Timeout of dialing and writing to peers")
+
+	flagVaultAddr      = flag.String("vault-addr", os.Getenv("VAULT_ADDR"), "Address of the Vault API, used for enrichment")
+	flagVaultTokenFile = flag.String("vault-token-file", "", "File to read the Vault token from on every request, such as a Vault Agent sink (defaults to VAULT_TOKEN)")
+	flagVaultCACert    = flag.String("vault-ca-cert", os.Getenv("VAULT_CACERT"), "CA certificate to verify the Vault API with")
+
+	flagIdentity         = flag.Bool("identity-enrichment", false, "Resolve entity IDs to entity names and groups with the Vault identity API for webhook events and alerts (requires Vault API access)")
+	flagIdentityLabels   = flag.Bool("identity-labels", false, "Add entity_name and entity_groups labels, resolved with the Vault identity API, to request counters (implies -identity-enrichment)")
+	flagIdentityCacheTTL = flag.Duration("identity-cache-ttl", 10*time.Minute, "Length of time resolved entity names and groups are cached")
+
+	flagRemoteAddressLabel    = flag.Bool("remote-address-label", false, "Add a remote_address label, aggregated to named networks or prefixes, to request counters")
+	flagRemoteAddressPrefixV4 = flag.Int("remote-address-prefix-v4", 24, "Prefix length that IPv4 remote addresses are aggregated to")
+	flagRemoteAddressPrefixV6 = flag.Int("remote-address-prefix-v6", 64, "Prefix length that IPv6 remote addresses are aggregated to")
+
+	flagGeoIPCountryDB = flag.String("geoip-country-db", "", "MaxMind country or city database to add a country label, resolved from the remote address, to request counters")
+	flagGeoIPASNDB     = flag.String("geoip-asn-db", "", "MaxMind ASN database to add an asn label, resolved from the remote address, to request counters")
 )
 
 func main() {
-	flag.Parse()
+	// loadgen has flags of its own, while bench and rules generate take the exporter's flags so that they measure, or
+	// generate rules for, the same configuration
+	args, benchmark, generateRules := os.Args[1:], false, false
+	if len(args) > 0 {
+		switch args[0] {
+		case "loadgen":
+			os.Exit(loadgen(args[1:]))
+		case "bench":
+			args, benchmark = args[1:], true
+		case "rules":
+			if len(args) < 2 || args[1] != "generate" {
+				fmt.Fprintln(os.Stderr, "usage: vault-audit-metrics rules generate [flags]")
+				os.Exit(2)
+			}
+			args, generateRules = args[2:], true
+		}
+	}
+	_ = flag.CommandLine.Parse(args)
 
 	if *flagVersion {
 		fmt.Println(version)
 		os.Exit(0)
 	}
 
-	processor := NewAuditProcessor(
-		*flagAuditNetwork,
-		*flagAuditAddr,
-		*flagHTTPAddr,
-		*flagCacheTTL,
-		*flagCacheCleanup,
-	)
-	log.Fatalln(processor.Start())
+	var logOutput io.Writer = os.Stderr
+	if *flagLogFile != "" {
+		file, err := NewLogFile(*flagLogFile, *flagLogMaxBytes, *flagLogMaxAge, *flagLogBackups)
+		if err != nil {
+			logFatal("error opening log file", "path", *flagLogFile, "error", err)
+		}
+		logOutput = file
+	}
+	configured, err := NewLogger(logOutput, *flagLogLevel, *flagLogFormat)
+	if err != nil {
+		logFatal("error configuring logging", "error", err)
+	}
+	if *flagLogSampleN > 0 {
+		configured.Sample(*flagLogSampleN, *flagLogSampleM)
+	}
+	logger = configured
+	// route logs of dependencies using the standard library logger through the structured logger
+	log.SetFlags(0)
+	log.SetOutput(logger)
+
+	cfg, err := LoadConfig(*flagConfig)
+	if err != nil {
+		logFatal("error loading config", "error", err)
+	}
+	cfg.AuditNetwork = *flagAuditNetwork
+	cfg.AuditAddr = *flagAuditAddr
+	cfg.HTTPAddr = *flagHTTPAddr
+	cfg.CacheTTL = *flagCacheTTL
+	cfg.CacheCleanup = *flagCacheCleanup
+	cfg.TimestampStore = *flagStore
+	cfg.Redis.Addr = *flagRedisAddr
+	cfg.Redis.Password = os.Getenv("REDIS_PASSWORD")
+	cfg.Redis.DB = *flagRedisDB
+	cfg.Redis.TLS = *flagRedisTLS
+	cfg.Redis.KeyPrefix = *flagRedisKeyPrefix
+	cfg.Redis.PoolSize = *flagRedisPoolSize
+	cfg.Redis.Timeout = *flagRedisTimeout
+	cfg.Memcached.Addr = *flagMemcachedAddr
+	cfg.Memcached.KeyPrefix = *flagMemcachedKeyPrefix
+	cfg.Memcached.PoolSize = *flagMemcachedPoolSize
+	cfg.Memcached.Timeout = *flagMemcachedTimeout
+	cfg.Peers.Addr = *flagPeerAddr
+	if *flagPeers != "" {
+		cfg.Peers.Peers = strings.Split(*flagPeers, ",")
+	}
+	cfg.Peers.QueueSize = *flagPeerQueueSize
+	cfg.Peers.Timeout = *flagPeerTimeout
+	cfg.Peers.Secret = os.Getenv("PEER_SECRET")
+	cfg.CacheShards = *flagCacheShards
+	cfg.CacheMaxEntries = *flagCacheMax
+	cfg.CacheMaxBytes = *flagCacheBytes
+	cfg.DuplicateRequestIDs = *flagDuplicates
+	cfg.CacheSnapshot = *flagSnapshot
+	cfg.CacheSnapshotMaxAge = *flagSnapshotAge
+	cfg.LatencyClock = *flagLatencyClock
+	cfg.PendingResponseTTL = *flagPendingTTL
+	cfg.CorrelationCheckInterval = *flagCorrelation
+	cfg.Workers = *flagWorkers
+	cfg.QueueSize = *flagQueueSize
+	cfg.OverloadPolicy = *flagOverload
+	cfg.HighThroughput = *flagHighTput
+	cfg.MaxLineBytes = *flagMaxLineBytes
+	cfg.ParseErrorThreshold = *flagParseErrors
+	cfg.ParseErrorWindow = *flagParseWindow
+	cfg.DeadLetterFile = *flagDeadLetter
+	cfg.DeadLetterMaxBytes = *flagDeadLetterSz
+	cfg.SourceDownAfter = *flagSourceDown
+	cfg.SourceDownWebhook = *flagSourceHook
+	cfg.RootTokenWebhook = *flagRootHook
+	cfg.LoginFailureSourceLabel = *flagLoginSource
+	cfg.LoginFailureAliasLabel = *flagLoginAlias
+	cfg.BruteForceThreshold = *flagBruteForceN
+	cfg.BruteForceWindow = *flagBruteWindow
+	cfg.BruteForceWebhook = *flagBruteHook
+	cfg.WatchlistWebhook = *flagWatchHook
+	cfg.CredentialWatchlistWebhook = *flagCredHook
+	cfg.ActiveClients = *flagClients
+	cfg.TopTalkers = *flagTopTalkers
+	cfg.TopTalkersWindow = *flagTopWindow
+	cfg.MaxMemory = *flagMaxMemory
+	cfg.DropRawError = *flagDropRawError
+	cfg.Filters.SuppressNoise = cfg.Filters.SuppressNoise || *flagNoise
+	cfg.Filters.PathInclude = append(cfg.Filters.PathInclude, *flagPathInclude...)
+	cfg.Filters.PathExclude = append(cfg.Filters.PathExclude, *flagPathExclude...)
+	cfg.Filters.OperationInclude = append(cfg.Filters.OperationInclude, *flagOpInclude...)
+	cfg.Filters.OperationExclude = append(cfg.Filters.OperationExclude, *flagOpExclude...)
+	cfg.PathMaxDepth = *flagPathMaxDepth
+	cfg.KVv2.Collapse = *flagKVv2Collapse
+	cfg.KVv2.OperationLabel = *flagKVv2OpLabel
+	cfg.CollapseDynamicSegments = *flagCollapseIDs
+	cfg.MaxSeries = *flagMaxSeries
+	cfg.SeriesTTL = *flagSeriesTTL
+	cfg.PolicyMetrics = *flagPolicyMetric
+	cfg.MountLabels = *flagMountLabels
+	cfg.MountRefresh = *flagMountRefresh
+	cfg.Vault.Addr = *flagVaultAddr
+	cfg.Vault.Token = os.Getenv("VAULT_TOKEN")
+	cfg.Vault.TokenFile = *flagVaultTokenFile
+	cfg.Vault.Namespace = os.Getenv("VAULT_NAMESPACE")
+	cfg.Vault.CACert = *flagVaultCACert
+	cfg.Identity.Enabled = *flagIdentity || *flagIdentityLabels
+	cfg.Identity.Labels = *flagIdentityLabels
+	cfg.Identity.CacheTTL = *flagIdentityCacheTTL
+	cfg.RemoteAddress.Enabled = *flagRemoteAddressLabel
+	cfg.RemoteAddress.PrefixV4 = *flagRemoteAddressPrefixV4
+	cfg.RemoteAddress.PrefixV6 = *flagRemoteAddressPrefixV6
+	cfg.GeoIP.CountryDB = *flagGeoIPCountryDB
+	cfg.GeoIP.ASNDB = *flagGeoIPASNDB
+
+	if benchmark {
+		os.Exit(bench(cfg, flag.Args()))
+	}
+	if generateRules {
+		os.Exit(rulesGenerate(cfg))
+	}
+
+	processor, err := NewAuditProcessor(cfg)
+	if err != nil {
+		logFatal("error creating audit processor", "error", err)
+	}
+
+	// shut down gracefully, so that state such as the cache snapshot is persisted
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logInfo("shutting down", "signal", sig)
+		processor.Shutdown()
+		os.Exit(0)
+	}()
+
+	logFatal("error serving audit log connections", "error", processor.Start())
+}
+
+// stringsValue is a flag.Value that collects the values of a repeatable flag.
+type stringsValue []string
+
+func (s *stringsValue) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsValue) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// stringsFlag defines a repeatable string flag.
+func stringsFlag(name, usage string) *stringsValue {
+	value := new(stringsValue)
+	flag.Var(value, name, usage)
+	return value
 }
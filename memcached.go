@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MemcachedStore is a TimestampStore backed by memcached, which lets replicas behind a load balancer correlate
+// requests and responses received by one another. Entries expire through memcached item expiration, so expired requests
+// are not counted.
+type MemcachedStore struct {
+	pool       *connPool
+	prefix     string
+	duplicates string
+	ttl        time.Duration
+}
+
+// NewMemcachedStore constructs a MemcachedStore, verifying that memcached is reachable. DuplicateMultiset is not
+// supported.
+func NewMemcachedStore(cfg *MemcachedConfig, duplicates string, ttl time.Duration) (*MemcachedStore, error) {
+	if cfg.Addr == "" {
+		return nil, errors.New("memcached address is required")
+	}
+	if duplicates == DuplicateMultiset {
+		return nil, fmt.Errorf("the memcached store does not support %s duplicate request IDs", duplicates)
+	}
+	s := &MemcachedStore{
+		pool:       newConnPool("memcached", cfg.Addr, false, cfg.PoolSize, cfg.Timeout, nil),
+		prefix:     cfg.KeyPrefix,
+		duplicates: duplicates,
+		ttl:        ttl,
+	}
+	if _, err := s.command("version\r\n"); err != nil {
+		return nil, fmt.Errorf("error connecting to memcached: %v", err)
+	}
+	return s, nil
+}
+
+func (s *MemcachedStore) Set(id string, t time.Time, ttl time.Duration) (bool, error) {
+	if ttl == 0 {
+		ttl = s.ttl
+	}
+	// expiration times are whole seconds, and values over 30 days would be read as absolute Unix times
+	seconds := int64((ttl + time.Second - 1) / time.Second)
+	if seconds > 30*24*60*60 {
+		seconds = 30 * 24 * 60 * 60
+	}
+	value := strconv.FormatInt(t.UnixNano(), 10)
+
+	// add only stores keys that don't exist yet, which detects duplicates; in last-wins mode they are then overwritten
+	reply, err := s.command(fmt.Sprintf("add %s 0 %d %d\r\n%s\r\n", s.prefix+id, seconds, len(value), value))
+	if err != nil {
+		return false, err
+	}
+	switch reply {
+	case "STORED":
+		return false, nil
+	case "NOT_STORED":
+	default:
+		return false, fmt.Errorf("unexpected memcached reply to add: %s", reply)
+	}
+	if s.duplicates == DuplicateFirstWins {
+		return true, nil
+	}
+	reply, err = s.command(fmt.Sprintf("set %s 0 %d %d\r\n%s\r\n", s.prefix+id, seconds, len(value), value))
+	if err != nil {
+		return true, err
+	}
+	if reply != "STORED" {
+		return true, fmt.Errorf("unexpected memcached reply to set: %s", reply)
+	}
+	return true, nil
+}
+
+func (s *MemcachedStore) Take(id string) (time.Time, bool, error) {
+	value, found, err := s.get(s.prefix + id)
+	if err != nil || !found {
+		return time.Time{}, false, err
+	}
+
+	// memcached has no atomic get-and-delete, so only the caller whose delete succeeds takes the request
+	reply, err := s.command(fmt.Sprintf("delete %s\r\n", s.prefix+id))
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	switch reply {
+	case "DELETED":
+	case "NOT_FOUND":
+		return time.Time{}, false, nil
+	default:
+		return time.Time{}, false, fmt.Errorf("unexpected memcached reply to delete: %s", reply)
+	}
+
+	nanos, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("error parsing stored timestamp '%s': %v", value, err)
+	}
+	return time.Unix(0, nanos), true, nil
+}
+
+// command sends a storage or deletion command and returns its single-line reply.
+func (s *MemcachedStore) command(cmd string) (string, error) {
+	conn, err := s.pool.get()
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.WriteString(conn, cmd); err != nil {
+		s.pool.discard(conn)
+		return "", err
+	}
+	reply, err := conn.reader.ReadString('\n')
+	if err != nil {
+		s.pool.discard(conn)
+		return "", err
+	}
+	s.pool.put(conn)
+	reply = strings.TrimSuffix(reply, "\r\n")
+	if reply == "ERROR" || strings.HasPrefix(reply, "CLIENT_ERROR") || strings.HasPrefix(reply, "SERVER_ERROR") {
+		return "", errors.New(reply)
+	}
+	return reply, nil
+}
+
+// get retrieves the value of a key.
+func (s *MemcachedStore) get(key string) (string, bool, error) {
+	conn, err := s.pool.get()
+	if err != nil {
+		return "", false, err
+	}
+	if _, err := io.WriteString(conn, "get "+key+"\r\n"); err != nil {
+		s.pool.discard(conn)
+		return "", false, err
+	}
+
+	// the reply is an optional "VALUE <key> <flags> <bytes>" line and data block, followed by "END"
+	var value string
+	found := false
+	for {
+		line, err := conn.reader.ReadString('\n')
+		if err != nil {
+			s.pool.discard(conn)
+			return "", false, err
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		if line == "END" {
+			break
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] != "VALUE" {
+			s.pool.discard(conn)
+			return "", false, fmt.Errorf("unexpected memcached reply to get: %s", line)
+		}
+		n, err := strconv.Atoi(fields[3])
+		if err != nil {
+			s.pool.discard(conn)
+			return "", false, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(conn.reader, data); err != nil {
+			s.pool.discard(conn)
+			return "", false, err
+		}
+		value, found = string(data[:n]), true
+	}
+	s.pool.put(conn)
+	return value, found, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// memoryCheckInterval is the interval at which memory use is compared to the limit.
+const memoryCheckInterval = time.Second
+
+const (
+	// memoryShrinkRatio is the fraction of the memory limit above which the request timestamp cache is shrunk.
+	memoryShrinkRatio = 0.9
+	// memoryShedRatio is the fraction of the memory limit above which incoming audit events are dropped, until memory
+	// use falls below memoryShrinkRatio again.
+	memoryShedRatio = 0.95
+	// memoryShrinkFraction is the fraction of cached requests evicted each time the cache is shrunk.
+	memoryShrinkFraction = 0.25
+)
+
+// MemoryWatchdog keeps the exporter within a memory limit, so that it degrades gracefully instead of being killed for
+// running out of memory next to Vault. When built with Go 1.19 or later, the limit is set as the runtime's soft memory
+// limit, making the garbage collector work harder as it is approached. Should that not suffice, the watchdog evicts the
+// oldest requests from the timestamp cache, losing their latency, and finally sheds incoming audit events until memory
+// use has recovered.
+type MemoryWatchdog struct {
+	// shedding is 1 while incoming audit events are dropped, accessed atomically.
+	shedding int32
+
+	limit  int64
+	shrink func(fraction float64) int
+
+	gagueLimit     prometheus.Gauge
+	gagueUsed      prometheus.Gauge
+	gagueShedding  prometheus.Gauge
+	counterShrinks prometheus.Counter
+	counterEvicted prometheus.Counter
+}
+
+// NewMemoryWatchdog constructs a MemoryWatchdog for a limit in bytes, setting it as the runtime's memory limit when
+// built with Go 1.19 or later. shrink evicts a fraction of the cached requests, returning how many were evicted.
+func NewMemoryWatchdog(limit int64, shrink func(fraction float64) int) *MemoryWatchdog {
+	setMemoryLimit(limit)
+	w := &MemoryWatchdog{
+		limit:  limit,
+		shrink: shrink,
+		gagueLimit: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: PromNamespace,
+			Subsystem: "memory",
+			Name:      "limit_bytes",
+			Help:      "Memory limit set by -max-memory.",
+		}),
+		gagueUsed: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: PromNamespace,
+			Subsystem: "memory",
+			Name:      "used_bytes",
+			Help:      "Memory obtained from the OS and not released to it, as compared to -max-memory.",
+		}),
+		gagueShedding: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: PromNamespace,
+			Subsystem: "memory",
+			Name:      "shedding",
+			Help:      "Whether incoming audit events are dropped because memory use is close to -max-memory.",
+		}),
+		counterShrinks: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "memory",
+			Name:      "cache_shrinks_total",
+			Help:      "Number of times the request timestamp cache was shrunk because memory use was close to -max-memory.",
+		}),
+		counterEvicted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "memory",
+			Name:      "cache_evictions_total",
+			Help:      "Number of requests evicted from the timestamp cache because memory use was close to -max-memory.",
+		}),
+	}
+	w.gagueLimit.Set(float64(limit))
+	return w
+}
+
+func (w *MemoryWatchdog) collectors() []prometheus.Collector {
+	return []prometheus.Collector{w.gagueLimit, w.gagueUsed, w.gagueShedding, w.counterShrinks, w.counterEvicted}
+}
+
+// Shedding reports whether incoming audit events should be dropped.
+func (w *MemoryWatchdog) Shedding() bool {
+	return atomic.LoadInt32(&w.shedding) == 1
+}
+
+// used returns the memory obtained from the OS and not released to it, which is what the runtime's limit applies to.
+func (w *MemoryWatchdog) used() int64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return int64(stats.Sys - stats.HeapReleased)
+}
+
+// Run continuously compares memory use to the limit.
+func (w *MemoryWatchdog) Run() {
+	for {
+		time.Sleep(memoryCheckInterval)
+		used := w.used()
+		if used >= int64(memoryShrinkRatio*float64(w.limit)) {
+			evicted := w.shrink(memoryShrinkFraction)
+			w.counterShrinks.Inc()
+			w.counterEvicted.Add(float64(evicted))
+			// return the freed memory right away, so that the next check sees whether shrinking sufficed
+			debug.FreeOSMemory()
+			logWarn("memory use close to -max-memory, shrank request timestamp cache", "used", used, "limit", w.limit,
+				"evicted", evicted)
+			used = w.used()
+		}
+		w.gagueUsed.Set(float64(used))
+
+		switch {
+		case used >= int64(memoryShedRatio*float64(w.limit)) && !w.Shedding():
+			atomic.StoreInt32(&w.shedding, 1)
+			w.gagueShedding.Set(1)
+			logWarn("memory use close to -max-memory, dropping audit events", "used", used, "limit", w.limit)
+		case used < int64(memoryShrinkRatio*float64(w.limit)) && w.Shedding():
+			atomic.StoreInt32(&w.shedding, 0)
+			w.gagueShedding.Set(0)
+			logInfo("memory use recovered, no longer dropping audit events", "used", used, "limit", w.limit)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build go1.19
+// +build go1.19
+
+package main
+
+import "runtime/debug"
+
+// setMemoryLimit sets the runtime's soft memory limit, which makes the garbage collector work harder as it is
+// approached.
+func setMemoryLimit(limit int64) {
+	debug.SetMemoryLimit(limit)
+}
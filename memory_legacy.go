@@ -0,0 +1,10 @@
+//go:build !go1.19
+// +build !go1.19
+
+package main
+
+// setMemoryLimit does nothing, since the runtime only has a soft memory limit from Go 1.19 on. The watchdog still
+// shrinks the cache and sheds load near the limit.
+func setMemoryLimit(limit int64) {
+	logWarn("the memory limit is not passed to the Go runtime, which requires Go 1.19", "limit", limit)
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// memoryStore is a TimestampStore held in process memory. Entries are spread over shards by a hash of the request ID,
+// each with its own lock and eviction, so that concurrent events rarely contend. When the store is bounded, each shard
+// evicts its least recently stored requests to make room for a new one.
+type memoryStore struct {
+	shards  []*memoryShard
+	ttl     time.Duration
+	expired func()
+	// maxShardEntries and maxShardBytes bound the number of requests and their approximate size in memory per shard,
+	// with zero meaning unbounded.
+	maxShardEntries int
+	maxShardBytes   int64
+	duplicates      string
+
+	// operations, lockWait, evictions, and rejections are self-metrics, updated atomically. lockWait is in nanoseconds.
+	operations int64
+	lockWait   int64
+	evictions  int64
+	rejections int64
+}
+
+// memoryShard is one shard of a memoryStore. order lists the shard's requests from least to most recently stored, and
+// bytes is their approximate size in memory.
+type memoryShard struct {
+	mu    sync.Mutex
+	items map[string]*list.Element
+	order *list.List
+	bytes int64
+}
+
+const (
+	// cachedRequestOverhead approximates the memory used by a cached request besides its ID and times: the request
+	// itself, its list element, and its map entry.
+	cachedRequestOverhead = 160
+	// cachedTimeSize is the memory used by each time of a cached request.
+	cachedTimeSize = 24
+)
+
+// cachedRequest is a request ID awaiting its response. times holds more than one time only for duplicate request IDs
+// in DuplicateMultiset mode, oldest first.
+type cachedRequest struct {
+	id    string
+	times []time.Time
+	// expires is the Unix time in nanoseconds after which the request is evicted.
+	expires int64
+}
+
+// size approximates the memory used by a cached request.
+func (r *cachedRequest) size() int64 {
+	return cachedRequestOverhead + int64(len(r.id)) + int64(len(r.times))*cachedTimeSize
+}
+
+func newMemoryStore(shards, maxEntries int, maxBytes int64, duplicates string, ttl, cleanup time.Duration,
+	expired func()) *memoryStore {
+	if shards <= 0 {
+		shards = 1
+	}
+	s := &memoryStore{ttl: ttl, expired: expired, duplicates: duplicates}
+	if maxEntries > 0 {
+		s.maxShardEntries = (maxEntries + shards - 1) / shards
+	}
+	if maxBytes > 0 {
+		s.maxShardBytes = (maxBytes + int64(shards) - 1) / int64(shards)
+	}
+	for i := 0; i < shards; i++ {
+		s.shards = append(s.shards, &memoryShard{items: make(map[string]*list.Element), order: list.New()})
+	}
+	if cleanup > 0 {
+		go s.run(cleanup)
+	}
+	return s
+}
+
+// shard locks and returns the shard holding a request ID.
+func (s *memoryStore) shard(id string) *memoryShard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(id))
+	shard := s.shards[h.Sum32()%uint32(len(s.shards))]
+	s.lock(shard)
+	return shard
+}
+
+// lock locks a shard, accounting for the time spent waiting on the lock.
+func (s *memoryStore) lock(shard *memoryShard) {
+	start := time.Now()
+	shard.mu.Lock()
+	atomic.AddInt64(&s.lockWait, int64(time.Since(start)))
+	atomic.AddInt64(&s.operations, 1)
+}
+
+func (s *memoryStore) Set(id string, t time.Time, ttl time.Duration) (bool, error) {
+	if ttl == 0 {
+		ttl = s.ttl
+	}
+	expires := time.Now().Add(ttl).UnixNano()
+	evicted := 0
+	shard := s.shard(id)
+	element, duplicate := shard.items[id]
+	switch {
+	case duplicate && s.duplicates == DuplicateFirstWins:
+	case duplicate && s.duplicates == DuplicateMultiset:
+		request := element.Value.(*cachedRequest)
+		request.times = append(request.times, t)
+		request.expires = expires
+		shard.order.MoveToBack(element)
+		shard.bytes += cachedTimeSize
+		evicted = s.makeRoom(shard, 0, element)
+	case duplicate:
+		request := element.Value.(*cachedRequest)
+		request.times = []time.Time{t}
+		request.expires = expires
+		shard.order.MoveToBack(element)
+	default:
+		request := &cachedRequest{id: id, times: []time.Time{t}, expires: expires}
+
+		// a request that cannot fit even in an empty shard is not admitted, rather than emptying the shard for it
+		if s.maxShardBytes > 0 && request.size() > s.maxShardBytes {
+			shard.mu.Unlock()
+			atomic.AddInt64(&s.rejections, 1)
+			return false, nil
+		}
+		evicted = s.makeRoom(shard, request.size(), nil)
+		shard.items[id] = shard.order.PushBack(request)
+		shard.bytes += request.size()
+	}
+	shard.mu.Unlock()
+
+	atomic.AddInt64(&s.evictions, int64(evicted))
+	return duplicate, nil
+}
+
+// makeRoom evicts the least recently stored requests of a locked shard, other than keep, until a new request of size
+// bytes fits within the shard's bounds. It returns the number of evicted requests.
+func (s *memoryStore) makeRoom(shard *memoryShard, size int64, keep *list.Element) int {
+	evicted := 0
+	for {
+		full := s.maxShardBytes > 0 && shard.bytes+size > s.maxShardBytes
+		if size > 0 && s.maxShardEntries > 0 && len(shard.items) >= s.maxShardEntries {
+			full = true
+		}
+		oldest := shard.order.Front()
+		if !full || oldest == nil || oldest == keep {
+			return evicted
+		}
+		s.remove(shard, oldest)
+		evicted++
+	}
+}
+
+// remove deletes a request from a locked shard.
+func (s *memoryStore) remove(shard *memoryShard, element *list.Element) {
+	request := element.Value.(*cachedRequest)
+	delete(shard.items, request.id)
+	shard.order.Remove(element)
+	shard.bytes -= request.size()
+}
+
+func (s *memoryStore) Take(id string) (time.Time, bool, error) {
+	shard := s.shard(id)
+	element, found := shard.items[id]
+	if !found {
+		shard.mu.Unlock()
+		return time.Time{}, false, nil
+	}
+	request := element.Value.(*cachedRequest)
+	t, expires := request.times[0], request.expires
+	if len(request.times) > 1 {
+		request.times = request.times[1:]
+		shard.bytes -= cachedTimeSize
+	} else {
+		s.remove(shard, element)
+	}
+	shard.mu.Unlock()
+
+	if time.Now().UnixNano() > expires {
+		s.expired()
+		return time.Time{}, false, nil
+	}
+	return t, true, nil
+}
+
+func (s *memoryStore) Len() int {
+	n := 0
+	for _, shard := range s.shards {
+		s.lock(shard)
+		n += len(shard.items)
+		shard.mu.Unlock()
+	}
+	return n
+}
+
+// run continuously evicts expired requests, one shard at a time.
+func (s *memoryStore) run(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		for _, shard := range s.shards {
+			now := time.Now().UnixNano()
+			evicted := 0
+			s.lock(shard)
+			for _, element := range shard.items {
+				if request := element.Value.(*cachedRequest); now > request.expires {
+					s.remove(shard, element)
+					evicted += len(request.times)
+				}
+			}
+			shard.mu.Unlock()
+			for i := 0; i < evicted; i++ {
+				s.expired()
+			}
+		}
+	}
+}
+
+// shrink evicts the least recently stored fraction of each shard's requests, returning the number of evicted requests.
+func (s *memoryStore) shrink(fraction float64) int {
+	evicted := 0
+	for _, shard := range s.shards {
+		s.lock(shard)
+		for n := int(fraction * float64(len(shard.items))); n > 0; n-- {
+			s.remove(shard, shard.order.Front())
+			evicted++
+		}
+		shard.mu.Unlock()
+	}
+	return evicted
+}
+
+// Bytes returns the approximate memory used by the stored requests.
+func (s *memoryStore) Bytes() float64 {
+	n := int64(0)
+	for _, shard := range s.shards {
+		s.lock(shard)
+		n += shard.bytes
+		shard.mu.Unlock()
+	}
+	return float64(n)
+}
+
+// items returns a copy of the stored requests.
+func (s *memoryStore) items() []cachedRequest {
+	var items []cachedRequest
+	for _, shard := range s.shards {
+		s.lock(shard)
+		for element := shard.order.Front(); element != nil; element = element.Next() {
+			request := *element.Value.(*cachedRequest)
+			request.times = append([]time.Time(nil), request.times...)
+			items = append(items, request)
+		}
+		shard.mu.Unlock()
+	}
+	return items
+}
+
+// Operations returns the number of operations on the store's shards.
+func (s *memoryStore) Operations() float64 {
+	return float64(atomic.LoadInt64(&s.operations))
+}
+
+// Evictions returns the number of requests evicted to keep the store within its bound.
+func (s *memoryStore) Evictions() float64 {
+	return float64(atomic.LoadInt64(&s.evictions))
+}
+
+// Rejections returns the number of requests not admitted because they were too large for the store's bound.
+func (s *memoryStore) Rejections() float64 {
+	return float64(atomic.LoadInt64(&s.rejections))
+}
+
+// LockWait returns the total time in seconds spent waiting on the store's shard locks.
+func (s *memoryStore) LockWait() float64 {
+	return time.Duration(atomic.LoadInt64(&s.lockWait)).Seconds()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricShardFlushInterval is the interval at which workers merge their metric shards into the shared metrics.
+const metricShardFlushInterval = 500 * time.Millisecond
+
+// metricAdder is a counter or gauge that values are added to.
+type metricAdder interface {
+	Add(float64)
+}
+
+// metricShard aggregates the metric updates of one worker in high-throughput mode, so that workers don't contend on the
+// metric children shared by the events they process. The worker merges it into the shared metrics on a short ticker.
+// A nil metricShard records updates on the shared metrics right away.
+type metricShard struct {
+	adds         map[metricAdder]float64
+	observations map[prometheus.Observer][]float64
+}
+
+func newMetricShard() *metricShard {
+	return &metricShard{
+		adds:         make(map[metricAdder]float64),
+		observations: make(map[prometheus.Observer][]float64),
+	}
+}
+
+// add adds a value to a counter or gauge.
+func (s *metricShard) add(adder metricAdder, value float64) {
+	if s == nil {
+		adder.Add(value)
+		return
+	}
+	s.adds[adder] += value
+}
+
+// observe records an observation of a histogram.
+func (s *metricShard) observe(observer prometheus.Observer, value float64) {
+	if s == nil {
+		observer.Observe(value)
+		return
+	}
+	s.observations[observer] = append(s.observations[observer], value)
+}
+
+// flush merges the aggregated updates into the shared metrics. Observations are kept in slices that are reused while
+// their histogram keeps being observed, and forgotten otherwise, so that expired series are not retained.
+func (s *metricShard) flush() {
+	if s == nil {
+		return
+	}
+	for adder, value := range s.adds {
+		adder.Add(value)
+		delete(s.adds, adder)
+	}
+	for observer, values := range s.observations {
+		if len(values) == 0 {
+			delete(s.observations, observer)
+			continue
+		}
+		for _, value := range values {
+			observer.Observe(value)
+		}
+		s.observations[observer] = values[:0]
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// mfaMaxMethods bounds the number of MFA method IDs whose type is remembered.
+const mfaMaxMethods = 10000
+
+// MFAMonitor counts login MFA challenges and validations. A login requiring MFA responds with an MFA requirement instead
+// of a token, listing the IDs and types of the methods that satisfy it, and the client completes the login by passing
+// credentials for some of them to sys/mfa/validate. Validations only carry method IDs, so their types are those the
+// challenges listed for the same IDs.
+type MFAMonitor struct {
+	mu sync.Mutex
+	// methodTypes holds the type of each MFA method ID seen in a challenge.
+	methodTypes map[string]string
+
+	counterChallenges  *prometheus.CounterVec
+	counterValidations *prometheus.CounterVec
+}
+
+// NewMFAMonitor constructs an MFAMonitor.
+func NewMFAMonitor() *MFAMonitor {
+	return &MFAMonitor{
+		methodTypes: make(map[string]string),
+		counterChallenges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "security",
+			Name:      "mfa_challenges_total",
+			Help:      "Number of logins that required MFA. Partitioned by auth mount and MFA method type, counting a login once for each type it offers.",
+		},
+			[]string{"mount", "mfa_method"}),
+		counterValidations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "security",
+			Name:      "mfa_validations_total",
+			Help:      "Number of MFA validations of logins. Partitioned by MFA method type, where a challenge listed the method, and result (success or failure).",
+		},
+			[]string{"mfa_method", "result"}),
+	}
+}
+
+func (m *MFAMonitor) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.counterChallenges, m.counterValidations}
+}
+
+// Observe records an MFA challenge from a login response, or an MFA validation from its response.
+func (m *MFAMonitor) Observe(auditEvent *AuditEvent) {
+	entry := auditEvent.entry
+	if entry.Type != AuditEventTypeResponse || entry.Request == nil {
+		return
+	}
+	if entry.Request.Path == "sys/mfa/validate" {
+		m.validation(entry)
+		return
+	}
+	if entry.Error != "" || entry.Response == nil || entry.Response.Auth == nil ||
+		entry.Response.Auth.MFARequirement == nil {
+		return
+	}
+	mount, _, ok := parseLoginPath(entry.Request.Path)
+	if !ok {
+		return
+	}
+
+	types := make(map[string]bool)
+	m.mu.Lock()
+	for _, constraint := range entry.Response.Auth.MFARequirement.MFAConstraints {
+		for _, method := range constraint.Any {
+			types[method.Type] = true
+			if _, found := m.methodTypes[method.ID]; !found && method.ID != "" && len(m.methodTypes) < mfaMaxMethods {
+				m.methodTypes[method.ID] = method.Type
+			}
+		}
+	}
+	m.mu.Unlock()
+	for methodType := range types {
+		m.counterChallenges.WithLabelValues(mount, methodType).Inc()
+	}
+}
+
+// validation records an MFA validation once for each type of the methods it passed credentials for.
+func (m *MFAMonitor) validation(entry *AuditEntry) {
+	result := "success"
+	if entry.Error != "" {
+		result = "failure"
+	}
+	var ids []string
+	if entry.Request.Data != nil {
+		ids = entry.Request.Data.MFAMethodIDs
+	}
+	var types []string
+	m.mu.Lock()
+	for _, id := range ids {
+		types = append(types, m.methodTypes[id])
+	}
+	m.mu.Unlock()
+	if len(types) == 0 {
+		types = append(types, "")
+	}
+	sort.Strings(types)
+	for i, methodType := range types {
+		if i == 0 || methodType != types[i-1] {
+			m.counterValidations.WithLabelValues(methodType, result).Inc()
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// MountTable maps request paths to the secrets engine or auth method mounted at them, as read from the sys/mounts and
+// sys/auth endpoints of the Vault API.
+type MountTable struct {
+	client *VaultClient
+
+	mu     sync.RWMutex
+	mounts map[string]string
+}
+
+// NewMountTable constructs a MountTable. It is empty until refreshed.
+func NewMountTable(client *VaultClient) *MountTable {
+	return &MountTable{client: client, mounts: make(map[string]string)}
+}
+
+// mountsResponse is the response of the sys/mounts and sys/auth endpoints.
+type mountsResponse struct {
+	Data map[string]struct {
+		Type string `json:"type"`
+	} `json:"data"`
+}
+
+// Refresh reloads the mount table from Vault.
+func (t *MountTable) Refresh() error {
+	mounts := make(map[string]string)
+
+	var secrets mountsResponse
+	if err := t.client.Get("sys/mounts", &secrets); err != nil {
+		return err
+	}
+	for path, mount := range secrets.Data {
+		mounts[path] = mount.Type
+	}
+
+	var auths mountsResponse
+	if err := t.client.Get("sys/auth", &auths); err != nil {
+		return err
+	}
+	for path, mount := range auths.Data {
+		mounts["auth/"+path] = mount.Type
+	}
+
+	t.mu.Lock()
+	t.mounts = mounts
+	t.mu.Unlock()
+	return nil
+}
+
+// Run refreshes the mount table at the given interval.
+func (t *MountTable) Run(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := t.Refresh(); err != nil {
+			logError("error refreshing mount table", "error", err)
+		}
+	}
+}
+
+// Lookup returns the path and type of the longest mount that a request path falls under.
+func (t *MountTable) Lookup(path string) (mountPath, mountType string, found bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for candidate := path; candidate != ""; {
+		if typ, ok := t.mounts[candidate]; ok {
+			return candidate, typ, true
+		}
+		if typ, ok := t.mounts[candidate+"/"]; ok {
+			return candidate + "/", typ, true
+		}
+		i := strings.LastIndexByte(strings.TrimSuffix(candidate, "/"), '/')
+		if i < 0 {
+			break
+		}
+		candidate = candidate[:i+1]
+	}
+	return "", "", false
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	// defaultNewRelicURL is the Metric API endpoint of New Relic's US region, used if unset.
+	defaultNewRelicURL = "https://metric-api.newrelic.com/metric/v1"
+	// newRelicMaxMetrics is the largest number of metrics sent per request, which keeps compressed payloads well below
+	// the Metric API's limit of 1MB.
+	newRelicMaxMetrics = 2000
+)
+
+// newRelicSink sends dimensional metrics to the New Relic Metric API, authenticated with a license key or an insert
+// key. Metric families are sent the way New Relic's Prometheus integrations send them, so that their curated views
+// apply: counters as count metrics of their increments since the previous push, gauges as gauges, histograms as counts
+// of their cumulative buckets by an le attribute along with their count and sum, and summaries as gauges of their
+// quantiles along with counts of their count and sum. Labels and constant tags become attributes.
+type newRelicSink struct {
+	url      string
+	headers  map[string]string
+	client   *http.Client
+	common   map[string]string
+	counters *counterDeltas
+	// previous is the time of the previous push, which count metrics are the increments since.
+	previous time.Time
+}
+
+// newRelicMetric is a metric of a Metric API payload.
+type newRelicMetric struct {
+	Name       string            `json:"name"`
+	Type       string            `json:"type"`
+	Value      float64           `json:"value"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+func newNewRelicSink(cfg MetricSinkConfig) (*newRelicSink, error) {
+	url := cfg.URL
+	if url == "" {
+		url = defaultNewRelicURL
+	}
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("an http or https url is required")
+	}
+	if cfg.Token == "" {
+		return nil, fmt.Errorf("token is required")
+	}
+	s := &newRelicSink{
+		url:      url,
+		headers:  map[string]string{"Api-Key": cfg.Token},
+		client:   &http.Client{Timeout: sinkTimeout},
+		common:   cfg.Tags,
+		counters: newCounterDeltas(),
+		previous: time.Now(),
+	}
+	for name, value := range cfg.Headers {
+		s.headers[name] = value
+	}
+	return s, nil
+}
+
+func (s *newRelicSink) push(families []*dto.MetricFamily, now time.Time) error {
+	var metrics []newRelicMetric
+	add := func(name, typ string, labels []*dto.LabelPair, extra *dto.LabelPair, value float64) {
+		// JSON has no representation of NaN and infinities
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return
+		}
+		metric := newRelicMetric{Name: name, Type: typ, Value: value}
+		if len(labels) > 0 || extra != nil {
+			metric.Attributes = make(map[string]string, len(labels)+1)
+			for _, label := range labels {
+				if label.GetValue() != "" {
+					metric.Attributes[label.GetName()] = label.GetValue()
+				}
+			}
+			if extra != nil {
+				metric.Attributes[extra.GetName()] = extra.GetValue()
+			}
+		}
+		metrics = append(metrics, metric)
+	}
+	for _, family := range families {
+		name := family.GetName()
+		for _, m := range family.Metric {
+			key := seriesKey(name, m.Label)
+			switch metricType(family) {
+			case dto.MetricType_COUNTER:
+				add(name, "count", m.Label, nil, s.counters.delta(key, metricValue(m)))
+			case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+				add(name, "gauge", m.Label, nil, metricValue(m))
+			case dto.MetricType_HISTOGRAM:
+				histogram := m.GetHistogram()
+				for _, bucket := range histogram.Bucket {
+					if !math.IsInf(bucket.GetUpperBound(), 1) {
+						le := strconv.FormatFloat(bucket.GetUpperBound(), 'g', -1, 64)
+						add(name+"_bucket", "count", m.Label, labelPair("le", le),
+							s.counters.delta(key+"_bucket"+le, float64(bucket.GetCumulativeCount())))
+					}
+				}
+				add(name+"_bucket", "count", m.Label, labelPair("le", "+Inf"),
+					s.counters.delta(key+"_bucket+Inf", float64(histogram.GetSampleCount())))
+				add(name+"_count", "count", m.Label, nil, s.counters.delta(key+"_count", float64(histogram.GetSampleCount())))
+				add(name+"_sum", "count", m.Label, nil, s.counters.delta(key+"_sum", histogram.GetSampleSum()))
+			case dto.MetricType_SUMMARY:
+				summary := m.GetSummary()
+				for _, quantile := range summary.Quantile {
+					add(name, "gauge", m.Label, labelPair("quantile", strconv.FormatFloat(quantile.GetQuantile(), 'g', -1, 64)),
+						quantile.GetValue())
+				}
+				add(name+"_count", "count", m.Label, nil, s.counters.delta(key+"_count", float64(summary.GetSampleCount())))
+				add(name+"_sum", "count", m.Label, nil, s.counters.delta(key+"_sum", summary.GetSampleSum()))
+			}
+		}
+	}
+	s.counters.sweep()
+
+	type common struct {
+		Timestamp  int64             `json:"timestamp"`
+		Interval   int64             `json:"interval.ms"`
+		Attributes map[string]string `json:"attributes,omitempty"`
+	}
+	type payload struct {
+		Common  common           `json:"common"`
+		Metrics []newRelicMetric `json:"metrics"`
+	}
+	// count metrics cover the time since the previous push, which the other metrics ignore
+	shared := common{
+		Timestamp:  now.UnixNano() / int64(time.Millisecond),
+		Interval:   int64(now.Sub(s.previous) / time.Millisecond),
+		Attributes: s.common,
+	}
+	s.previous = now
+	for start := 0; start < len(metrics); start += newRelicMaxMetrics {
+		end := start + newRelicMaxMetrics
+		if end > len(metrics) {
+			end = len(metrics)
+		}
+		body, err := json.Marshal([]payload{{Common: shared, Metrics: metrics[start:end]}})
+		if err != nil {
+			return err
+		}
+		if err := postSink(s.client, s.url, "application/json", s.headers, body, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
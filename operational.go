@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Operational events recognized by an OperationalEventMonitor.
+const (
+	OperationalEventSeal         = "seal"
+	OperationalEventUnseal       = "unseal"
+	OperationalEventStepDown     = "step_down"
+	OperationalEventGenerateRoot = "generate_root"
+)
+
+// OperationalEventMonitor counts requests to Vault's operational endpoints, which seal and unseal it, make the active
+// node step down, and generate root tokens, and records when each last occurred. These are rare and significant, so
+// each is also logged. Requests are counted rather than responses, since sealing can keep the response from being
+// audited.
+type OperationalEventMonitor struct {
+	alerts *Alerter
+
+	counterEvents *prometheus.CounterVec
+	gagueLast     *prometheus.GaugeVec
+}
+
+// NewOperationalEventMonitor constructs an OperationalEventMonitor. Operational events are also findings for alerts.
+func NewOperationalEventMonitor(alerts *Alerter) *OperationalEventMonitor {
+	m := &OperationalEventMonitor{
+		alerts: alerts,
+		counterEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "security",
+			Name:      "operational_events_total",
+			Help:      "Number of requests to seal, unseal, step down, or generate a root token. Partitioned by event.",
+		},
+			[]string{"event"}),
+		gagueLast: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: PromNamespace,
+			Subsystem: "security",
+			Name:      "operational_event_last_timestamp_seconds",
+			Help:      "Unix time of the last request to seal, unseal, step down, or generate a root token. Partitioned by event.",
+		},
+			[]string{"event"}),
+	}
+	// start counters at zero, so that alerts on their increase fire for the first event
+	for _, event := range []string{OperationalEventSeal, OperationalEventUnseal, OperationalEventStepDown,
+		OperationalEventGenerateRoot} {
+		m.counterEvents.WithLabelValues(event)
+	}
+	return m
+}
+
+func (m *OperationalEventMonitor) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.counterEvents, m.gagueLast}
+}
+
+// operationalEvent returns the operational event a request path performs, or "" if none.
+func operationalEvent(path string) string {
+	switch {
+	case path == "sys/seal":
+		return OperationalEventSeal
+	case path == "sys/unseal":
+		return OperationalEventUnseal
+	case path == "sys/step-down":
+		return OperationalEventStepDown
+	case path == "sys/generate-root" || strings.HasPrefix(path, "sys/generate-root/"):
+		return OperationalEventGenerateRoot
+	}
+	return ""
+}
+
+// Observe records an operational event from its request.
+func (m *OperationalEventMonitor) Observe(auditEvent *AuditEvent) {
+	entry := auditEvent.entry
+	if entry.Type != AuditEventTypeRequest || entry.Request == nil {
+		return
+	}
+	event := operationalEvent(entry.Request.Path)
+	if event == "" {
+		return
+	}
+	m.counterEvents.WithLabelValues(event).Inc()
+	m.gagueLast.WithLabelValues(event).Set(float64(auditEvent.time.UnixNano()) / 1e9)
+	logWarn("vault operational event", "event", event, "operation", entry.Request.Operation, "path", entry.Request.Path,
+		"request_id", entry.Request.ID, "remote_address", entry.Request.RemoteAddr)
+	m.alerts.Fire(Finding{
+		Kind: FindingOperationalEvent,
+		Key:  event,
+		Summary: fmt.Sprintf("vault %s requested with %s %s%s", strings.Replace(event, "_", " ", -1),
+			entry.Request.Operation, entry.Request.Path, fromAddress(entry.Request.RemoteAddr)),
+		Time:    auditEvent.time,
+		Details: newRequestDetails(auditEvent),
+	})
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// otlpScope is the name of the instrumentation scope metrics are pushed as.
+const otlpScope = "github.com/pbar1/vault-audit-metrics"
+
+// otlpCumulative is the cumulative aggregation temporality of OTLP sums and histograms.
+const otlpCumulative = 2
+
+// otlpSink pushes metrics to an OpenTelemetry collector or backend with OTLP over HTTP, encoding them as protobuf,
+// which every OTLP/HTTP receiver accepts. Prometheus counters become monotonic cumulative sums, gauges and untyped
+// metrics become gauges, and histograms and summaries keep their type, all starting when the exporter started, so that
+// backends see the same series a Prometheus scrape would.
+type otlpSink struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+	// resource is the encoded resource the metrics belong to.
+	resource []byte
+	start    time.Time
+}
+
+func newOTLPSink(cfg MetricSinkConfig) (*otlpSink, error) {
+	if !strings.HasPrefix(cfg.URL, "http://") && !strings.HasPrefix(cfg.URL, "https://") {
+		return nil, fmt.Errorf("an http or https url is required")
+	}
+	attributes := map[string]string{"service.name": "vault-audit-metrics", "service.version": version}
+	for key, value := range cfg.ResourceAttributes {
+		attributes[key] = value
+	}
+	return &otlpSink{
+		url:      cfg.URL,
+		headers:  cfg.Headers,
+		client:   &http.Client{Timeout: sinkTimeout},
+		resource: otlpAttributes(nil, 1, attributes),
+		start:    time.Now(),
+	}, nil
+}
+
+func (s *otlpSink) push(families []*dto.MetricFamily, now time.Time) error {
+	var scope []byte
+	scope = protowire.AppendTag(scope, 1, protowire.BytesType)
+	scope = protowire.AppendString(scope, otlpScope)
+	scope = protowire.AppendTag(scope, 2, protowire.BytesType)
+	scope = protowire.AppendString(scope, version)
+
+	var scopeMetrics []byte
+	scopeMetrics = otlpAppendMessage(scopeMetrics, 1, scope)
+	for _, family := range families {
+		if metric := s.metric(family, now); metric != nil {
+			scopeMetrics = otlpAppendMessage(scopeMetrics, 2, metric)
+		}
+	}
+
+	var resourceMetrics []byte
+	resourceMetrics = otlpAppendMessage(resourceMetrics, 1, s.resource)
+	resourceMetrics = otlpAppendMessage(resourceMetrics, 2, scopeMetrics)
+	request := otlpAppendMessage(nil, 1, resourceMetrics)
+	return postSink(s.client, s.url, "application/x-protobuf", s.headers, request, true)
+}
+
+// metric encodes a metric family as an OTLP metric, or returns nil if it has no metrics.
+func (s *otlpSink) metric(family *dto.MetricFamily, now time.Time) []byte {
+	if len(family.Metric) == 0 {
+		return nil
+	}
+	start, end := uint64(s.start.UnixNano()), uint64(now.UnixNano())
+	var data []byte
+	var field protowire.Number
+	switch metricType(family) {
+	case dto.MetricType_COUNTER:
+		field = 7
+		for _, m := range family.Metric {
+			data = otlpAppendMessage(data, 1, otlpNumberPoint(m.Label, start, end, metricValue(m)))
+		}
+		data = protowire.AppendTag(data, 2, protowire.VarintType)
+		data = protowire.AppendVarint(data, otlpCumulative)
+		data = protowire.AppendTag(data, 3, protowire.VarintType)
+		data = protowire.AppendVarint(data, 1)
+	case dto.MetricType_GAUGE:
+		field = 5
+		for _, m := range family.Metric {
+			data = otlpAppendMessage(data, 1, otlpNumberPoint(m.Label, 0, end, metricValue(m)))
+		}
+	case dto.MetricType_UNTYPED:
+		field = 5
+		for _, m := range family.Metric {
+			data = otlpAppendMessage(data, 1, otlpNumberPoint(m.Label, 0, end, metricValue(m)))
+		}
+	case dto.MetricType_HISTOGRAM:
+		field = 9
+		for _, m := range family.Metric {
+			data = otlpAppendMessage(data, 1, otlpHistogramPoint(m.Label, start, end, m.GetHistogram()))
+		}
+		data = protowire.AppendTag(data, 2, protowire.VarintType)
+		data = protowire.AppendVarint(data, otlpCumulative)
+	case dto.MetricType_SUMMARY:
+		field = 11
+		for _, m := range family.Metric {
+			data = otlpAppendMessage(data, 1, otlpSummaryPoint(m.Label, start, end, m.GetSummary()))
+		}
+	default:
+		return nil
+	}
+
+	var metric []byte
+	metric = protowire.AppendTag(metric, 1, protowire.BytesType)
+	metric = protowire.AppendString(metric, family.GetName())
+	metric = protowire.AppendTag(metric, 2, protowire.BytesType)
+	metric = protowire.AppendString(metric, family.GetHelp())
+	if unit := otlpUnit(family.GetName()); unit != "" {
+		metric = protowire.AppendTag(metric, 3, protowire.BytesType)
+		metric = protowire.AppendString(metric, unit)
+	}
+	return otlpAppendMessage(metric, field, data)
+}
+
+// otlpUnit returns the UCUM unit of a metric by the Prometheus naming convention, or "" if it has none.
+func otlpUnit(name string) string {
+	name = strings.TrimSuffix(name, "_total")
+	switch {
+	case strings.HasSuffix(name, "_seconds"):
+		return "s"
+	case strings.HasSuffix(name, "_bytes"):
+		return "By"
+	}
+	return ""
+}
+
+// otlpNumberPoint encodes a data point of a sum or gauge. Gauges have no start time.
+func otlpNumberPoint(labels []*dto.LabelPair, start, end uint64, value float64) []byte {
+	var point []byte
+	if start != 0 {
+		point = otlpAppendFixed64(point, 2, start)
+	}
+	point = otlpAppendFixed64(point, 3, end)
+	point = otlpAppendFixed64(point, 4, math.Float64bits(value))
+	return otlpLabels(point, 7, labels)
+}
+
+// otlpHistogramPoint encodes a data point of a histogram. Prometheus buckets are cumulative and leave out the +Inf
+// bucket, while OTLP buckets count the observations between consecutive bounds, with a last bucket above them.
+func otlpHistogramPoint(labels []*dto.LabelPair, start, end uint64, histogram *dto.Histogram) []byte {
+	var point []byte
+	point = otlpAppendFixed64(point, 2, start)
+	point = otlpAppendFixed64(point, 3, end)
+	point = otlpAppendFixed64(point, 4, histogram.GetSampleCount())
+	point = otlpAppendFixed64(point, 5, math.Float64bits(histogram.GetSampleSum()))
+
+	var counts, bounds []byte
+	var previous uint64
+	for _, bucket := range histogram.Bucket {
+		if math.IsInf(bucket.GetUpperBound(), 1) {
+			continue
+		}
+		counts = protowire.AppendFixed64(counts, bucket.GetCumulativeCount()-previous)
+		bounds = protowire.AppendFixed64(bounds, math.Float64bits(bucket.GetUpperBound()))
+		previous = bucket.GetCumulativeCount()
+	}
+	counts = protowire.AppendFixed64(counts, histogram.GetSampleCount()-previous)
+	point = otlpAppendMessage(point, 6, counts)
+	if len(bounds) > 0 {
+		point = otlpAppendMessage(point, 7, bounds)
+	}
+	return otlpLabels(point, 9, labels)
+}
+
+// otlpSummaryPoint encodes a data point of a summary.
+func otlpSummaryPoint(labels []*dto.LabelPair, start, end uint64, summary *dto.Summary) []byte {
+	var point []byte
+	point = otlpAppendFixed64(point, 2, start)
+	point = otlpAppendFixed64(point, 3, end)
+	point = otlpAppendFixed64(point, 4, summary.GetSampleCount())
+	point = otlpAppendFixed64(point, 5, math.Float64bits(summary.GetSampleSum()))
+	for _, quantile := range summary.Quantile {
+		var value []byte
+		value = otlpAppendFixed64(value, 1, math.Float64bits(quantile.GetQuantile()))
+		value = otlpAppendFixed64(value, 2, math.Float64bits(quantile.GetValue()))
+		point = otlpAppendMessage(point, 6, value)
+	}
+	return otlpLabels(point, 7, labels)
+}
+
+// otlpLabels appends labels as attributes with the given field number. Empty labels are left out, since Prometheus
+// treats them as absent.
+func otlpLabels(b []byte, num protowire.Number, labels []*dto.LabelPair) []byte {
+	for _, label := range labels {
+		if label.GetValue() == "" {
+			continue
+		}
+		b = otlpAppendMessage(b, num, otlpKeyValue(label.GetName(), label.GetValue()))
+	}
+	return b
+}
+
+// otlpAttributes appends attributes with the given field number, ordered by key.
+func otlpAttributes(b []byte, num protowire.Number, attributes map[string]string) []byte {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		b = otlpAppendMessage(b, num, otlpKeyValue(key, attributes[key]))
+	}
+	return b
+}
+
+// otlpKeyValue encodes a key with a string value.
+func otlpKeyValue(key, value string) []byte {
+	var anyValue []byte
+	anyValue = protowire.AppendTag(anyValue, 1, protowire.BytesType)
+	anyValue = protowire.AppendString(anyValue, value)
+	var kv []byte
+	kv = protowire.AppendTag(kv, 1, protowire.BytesType)
+	kv = protowire.AppendString(kv, key)
+	return otlpAppendMessage(kv, 2, anyValue)
+}
+
+func otlpAppendMessage(b []byte, num protowire.Number, message []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, message)
+}
+
+func otlpAppendFixed64(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, v)
+}
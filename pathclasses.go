@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PathClass holds the metric settings for a class of request paths.
+type PathClass struct {
+	name         string
+	patterns     []*regexp.Regexp
+	countersOnly bool
+	dropLabels   []string
+	buckets      []float64
+
+	// histogram and series are set for classes with custom latency buckets.
+	histogram *prometheus.HistogramVec
+	series    *seriesTracker
+}
+
+// PathClassifier assigns request paths to path classes, so that cardinality can be spent where it matters.
+type PathClassifier struct {
+	classes []*PathClass
+}
+
+// NewPathClassifier compiles the path class configuration. In patterns, "*" matches any sequence of characters,
+// including "/".
+func NewPathClassifier(configs []PathClassConfig) (*PathClassifier, error) {
+	c := new(PathClassifier)
+	for _, cfg := range configs {
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("path class name is required")
+		}
+		class := &PathClass{
+			name:         cfg.Name,
+			countersOnly: cfg.CountersOnly,
+			dropLabels:   cfg.DropLabels,
+			buckets:      cfg.LatencyBuckets,
+		}
+		for _, pattern := range cfg.Paths {
+			re, err := compileGlob(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("path class %s: %v", cfg.Name, err)
+			}
+			class.patterns = append(class.patterns, re)
+		}
+		for i := 1; i < len(class.buckets); i++ {
+			if class.buckets[i] <= class.buckets[i-1] {
+				return nil, fmt.Errorf("path class %s: latency buckets must be in increasing order", cfg.Name)
+			}
+		}
+		c.classes = append(c.classes, class)
+	}
+	return c, nil
+}
+
+// Classify returns the first path class matching a path, or nil if none match.
+func (c *PathClassifier) Classify(path string) *PathClass {
+	for _, class := range c.classes {
+		if matchAny(class.patterns, path) {
+			return class
+		}
+	}
+	return nil
+}
+
+// HasCustomBuckets reports whether any path class has its own latency buckets.
+func (c *PathClassifier) HasCustomBuckets() bool {
+	for _, class := range c.classes {
+		if len(class.buckets) > 0 {
+			return true
+		}
+	}
+	return false
+}
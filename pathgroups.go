@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// PathGroup is a named group of path glob patterns.
+type PathGroup struct {
+	Name     string
+	Patterns []string
+}
+
+// PathGroups is an ordered list of path groups, decoded from a YAML mapping of group names to pattern lists.
+type PathGroups []PathGroup
+
+// UnmarshalYAML decodes path groups while preserving the order of the mapping, since the first matching group wins.
+func (g *PathGroups) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var items yaml.MapSlice
+	if err := unmarshal(&items); err != nil {
+		return err
+	}
+	for _, item := range items {
+		name, ok := item.Key.(string)
+		if !ok {
+			return fmt.Errorf("path group name must be a string: %v", item.Key)
+		}
+		values, ok := item.Value.([]interface{})
+		if !ok {
+			return fmt.Errorf("path group %s must be a list of patterns", name)
+		}
+		group := PathGroup{Name: name}
+		for _, value := range values {
+			pattern, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("path group %s: pattern must be a string: %v", name, value)
+			}
+			group.Patterns = append(group.Patterns, pattern)
+		}
+		*g = append(*g, group)
+	}
+	return nil
+}
+
+// PathGrouper assigns request paths to named path groups.
+type PathGrouper struct {
+	groups []compiledPathGroup
+}
+
+type compiledPathGroup struct {
+	name     string
+	patterns []*regexp.Regexp
+}
+
+// NewPathGrouper compiles path groups. In patterns, "*" matches any sequence of characters, including "/".
+func NewPathGrouper(groups PathGroups) (*PathGrouper, error) {
+	g := new(PathGrouper)
+	for _, group := range groups {
+		compiled := compiledPathGroup{name: group.Name}
+		for _, pattern := range group.Patterns {
+			re, err := compileGlob(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("path group %s: %v", group.Name, err)
+			}
+			compiled.patterns = append(compiled.patterns, re)
+		}
+		g.groups = append(g.groups, compiled)
+	}
+	return g, nil
+}
+
+// Group returns the name of the first path group matching a path, or an empty string if none match.
+func (g *PathGrouper) Group(path string) string {
+	for _, group := range g.groups {
+		if matchAny(group.patterns, path) {
+			return group.name
+		}
+	}
+	return ""
+}
+
+// compileGlob converts a glob pattern, in which "*" matches any sequence of characters, into an anchored regular
+// expression.
+func compileGlob(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("^" + strings.Replace(regexp.QuoteMeta(pattern), `\*`, ".*", -1) + "$")
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// kvV2Operations are the path segments following a KV v2 mount that address individual secrets.
+var kvV2Operations = map[string]bool{
+	"data":     true,
+	"metadata": true,
+	"delete":   true,
+	"undelete": true,
+	"destroy":  true,
+	"subkeys":  true,
+}
+
+// leasePathPrefixes are the endpoints whose remaining path is a lease ID (or lease ID prefix).
+var leasePathPrefixes = []string{
+	"sys/leases/lookup/",
+	"sys/leases/renew/",
+	"sys/leases/revoke/",
+	"sys/leases/revoke-force/",
+	"sys/leases/revoke-prefix/",
+	"sys/renew/",
+	"sys/revoke/",
+	"sys/revoke-force/",
+	"sys/revoke-prefix/",
+}
+
+var (
+	uuidRegexp  = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	hexRegexp   = regexp.MustCompile(`^[0-9a-fA-F]{32,}$`)
+	tokenRegexp = regexp.MustCompile(`^(hv[sbr]\.[A-Za-z0-9_-]{24,}|[sbr]\.[A-Za-z0-9]{24,})$`)
+)
+
+// PathNormalizer rewrites Vault request paths into stable label values, so that dynamic path segments don't create
+// unbounded numbers of series.
+type PathNormalizer struct {
+	kvV2Collapse    bool
+	kvV2Mounts      []string
+	collapseDynamic bool
+	rules           []pathRule
+	maxDepth        int
+}
+
+type pathRule struct {
+	match   *regexp.Regexp
+	replace string
+}
+
+// NewPathNormalizer constructs a PathNormalizer from the path settings of the configuration.
+func NewPathNormalizer(cfg *Config) (*PathNormalizer, error) {
+	n := &PathNormalizer{
+		kvV2Collapse:    cfg.KVv2.Collapse,
+		collapseDynamic: cfg.CollapseDynamicSegments,
+		maxDepth:        cfg.PathMaxDepth,
+	}
+	for _, mount := range cfg.KVv2.Mounts {
+		n.kvV2Mounts = append(n.kvV2Mounts, strings.TrimSuffix(mount, "/")+"/")
+	}
+	for i, rule := range cfg.PathRules {
+		match, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("path rule %d: invalid regex: %v", i, err)
+		}
+		n.rules = append(n.rules, pathRule{match: match, replace: rule.Replace})
+	}
+	return n, nil
+}
+
+// Normalize rewrites a request path. Built-in KV v2 and dynamic segment collapsing are applied first, followed by the path rules in order (each
+// to the output of the previous rule), after which the path is truncated to the maximum depth.
+func (n *PathNormalizer) Normalize(path string) string {
+	if n.kvV2Collapse {
+		if mount, op, key, ok := n.splitKVv2(path); ok && key != "" {
+			path = mount + op + "/*"
+		}
+	}
+	if n.collapseDynamic {
+		path = collapseDynamicSegments(path)
+	}
+	for _, rule := range n.rules {
+		path = rule.match.ReplaceAllString(path, rule.replace)
+	}
+	if n.maxDepth > 0 {
+		path = truncatePath(path, n.maxDepth)
+	}
+	return path
+}
+
+// KVv2Operation returns the KV v2 operation addressed by a path (such as "data" or "metadata"), or an empty string for
+// paths that are not KV v2 secret paths.
+func (n *PathNormalizer) KVv2Operation(path string) string {
+	_, op, _, _ := n.splitKVv2(path)
+	return op
+}
+
+// splitKVv2 splits a KV v2 secret path into its mount (with trailing slash), operation, and key. If KV v2 mounts are
+// configured only paths below them are considered, otherwise the first path segment is assumed to be the mount.
+func (n *PathNormalizer) splitKVv2(path string) (mount, op, key string, ok bool) {
+	if len(n.kvV2Mounts) > 0 {
+		for _, m := range n.kvV2Mounts {
+			if strings.HasPrefix(path, m) {
+				mount = m
+				break
+			}
+		}
+	} else if i := strings.IndexByte(path, '/'); i >= 0 {
+		mount = path[:i+1]
+	}
+	if mount == "" {
+		return "", "", "", false
+	}
+
+	rest := path[len(mount):]
+	i := strings.IndexByte(rest, '/')
+	if i < 0 {
+		return "", "", "", false
+	}
+	op, key = rest[:i], rest[i+1:]
+	if !kvV2Operations[op] {
+		return "", "", "", false
+	}
+	return mount, op, key, true
+}
+
+// collapseDynamicSegments replaces lease IDs with ":lease", UUIDs with ":uuid", and hex digests and Vault tokens with
+// ":id". Other segments are kept, since long names of mounts, roles, and secrets can't be told apart from random
+// identifiers reliably.
+func collapseDynamicSegments(path string) string {
+	for _, prefix := range leasePathPrefixes {
+		if strings.HasPrefix(path, prefix) && len(path) > len(prefix) {
+			return prefix + ":lease"
+		}
+	}
+
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		switch {
+		case uuidRegexp.MatchString(segment):
+			segments[i] = ":uuid"
+		case isOpaqueSegment(segment):
+			segments[i] = ":id"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// isOpaqueSegment reports whether a path segment has the shape of a generated identifier: a hex digest of at least 32
+// characters, such as an MD5 or SHA hash, or a Vault token with its type prefix.
+func isOpaqueSegment(segment string) bool {
+	return hexRegexp.MatchString(segment) || tokenRegexp.MatchString(segment)
+}
+
+// truncatePath keeps the first depth segments of a path, e.g. "secret/data/teams/foo/bar" truncated to a depth of 3 is
+// "secret/data/teams".
+func truncatePath(path string, depth int) string {
+	segments := 0
+	for i := 0; i < len(path); i++ {
+		if path[i] != '/' {
+			continue
+		}
+		segments++
+		if segments == depth {
+			return strings.TrimSuffix(path[:i], "/")
+		}
+	}
+	return path
+}
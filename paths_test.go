@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestCollapseDynamicSegments(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "sys/leases/renew/database/creds/app/6XyVRj4YbQYzUjLB5ZmNPiqB", want: "sys/leases/renew/:lease"},
+		{path: "identity/entity/id/8a3e5c1f-4b2d-4e6f-9a7b-1c2d3e4f5a6b", want: "identity/entity/id/:uuid"},
+		{path: "transit/keys/3f786850e387550fdab836ed7e6dc881de23001b", want: "transit/keys/:id"},
+		{path: "auth/token/lookup/s.kbgGr2vnJ7HwbJgFvUq0W8Yk", want: "auth/token/lookup/:id"},
+		{path: "auth/token/lookup/hvs.CAESIJ4QmZ8aTqBVnYpWh1_dKx3-jF7rL2oU", want: "auth/token/lookup/:id"},
+		{path: "sys/plugins/catalog/secret/e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", want: "sys/plugins/catalog/secret/:id"},
+
+		// long human-readable names
+		{path: "payments-service-v2-prod01/data/config", want: "payments-service-v2-prod01/data/config"},
+		{path: "auth/kubernetes-cluster-eu-west-1/login", want: "auth/kubernetes-cluster-eu-west-1/login"},
+		{path: "database/roles/app_backend_2023_readonly", want: "database/roles/app_backend_2023_readonly"},
+		{path: "secret/data/PaymentsServiceV2Prod01", want: "secret/data/PaymentsServiceV2Prod01"},
+		{path: "pki/issue/internal.services.eu-west-1.example.com", want: "pki/issue/internal.services.eu-west-1.example.com"},
+		{path: "aws/creds/deploy-role-123456789012", want: "aws/creds/deploy-role-123456789012"},
+		{path: "secret/data/customerdatabasebackup2023", want: "secret/data/customerdatabasebackup2023"},
+		{path: "secret/data/facade0123456789", want: "secret/data/facade0123456789"},
+		{path: "secret/data/DBPasswordRotation2023Q4", want: "secret/data/DBPasswordRotation2023Q4"},
+		{path: "secret/data/s.example-team-config-2023", want: "secret/data/s.example-team-config-2023"},
+	}
+	for _, test := range tests {
+		if got := collapseDynamicSegments(test.path); got != test.want {
+			t.Errorf("collapseDynamicSegments(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
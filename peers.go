@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// peerRetryInterval is how long an unreachable peer is bypassed before it is dialed again.
+const peerRetryInterval = 10 * time.Second
+
+// PeerCluster forwards each audit event to the exporter instance owning its request ID, so that a request and its
+// response always meet on the same instance regardless of which one received them. Events are owned by hashing their
+// request ID over the list of peers, which therefore must be identical, and in the same order, on every instance.
+type PeerCluster struct {
+	addr  string
+	self  int
+	peers []*peerForwarder
+	// secret, if set, must be sent by peers before any event they forward.
+	secret string
+	// maxFrameBytes bounds the frames received from peers.
+	maxFrameBytes int
+
+	counterForwarded     *prometheus.CounterVec
+	counterForwardErrors *prometheus.CounterVec
+	counterReceived      prometheus.Counter
+}
+
+// peerForwarder streams events to one peer over a long-lived connection. Events that cannot be delivered are handed
+// to fallback, which processes them locally.
+type peerForwarder struct {
+	addr      string
+	timeout   time.Duration
+	secret    string
+	queue     chan peerEvent
+	fallback  func(line []byte, received time.Time)
+	downUntil int64
+
+	forwarded prometheus.Counter
+	errors    prometheus.Counter
+}
+
+// peerEvent is a raw audit log line and the time it was received by the forwarding instance.
+type peerEvent struct {
+	line     []byte
+	received time.Time
+}
+
+// NewPeerCluster constructs a PeerCluster forwarding lines of up to maxLineBytes. Events that cannot be forwarded are
+// passed to fallback.
+func NewPeerCluster(cfg *PeerConfig, maxLineBytes int, fallback func(line []byte, received time.Time)) (*PeerCluster,
+	error) {
+	// frames prefix the lines they carry with their receipt time
+	c := &PeerCluster{addr: cfg.Addr, self: -1, secret: cfg.Secret, maxFrameBytes: maxLineBytes + 32}
+	c.counterForwarded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "peers",
+		Name:      "forwarded_total",
+		Help:      "Number of audit events forwarded to the peer owning their request ID. Partitioned by peer.",
+	},
+		[]string{"peer"})
+	c.counterForwardErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "peers",
+		Name:      "forward_errors_total",
+		Help:      "Number of audit events processed locally because they could not be forwarded to their peer. Partitioned by peer.",
+	},
+		[]string{"peer"})
+	c.counterReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "peers",
+		Name:      "received_total",
+		Help:      "Number of audit events received from peers.",
+	})
+
+	queueSize := cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = 10000
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	seen := make(map[string]bool)
+	for i, addr := range cfg.Peers {
+		if seen[addr] {
+			return nil, fmt.Errorf("duplicate peer: %s", addr)
+		}
+		seen[addr] = true
+		if addr == cfg.Addr {
+			c.self = i
+			c.peers = append(c.peers, nil)
+			continue
+		}
+		c.peers = append(c.peers, &peerForwarder{
+			addr:      addr,
+			timeout:   timeout,
+			secret:    cfg.Secret,
+			queue:     make(chan peerEvent, queueSize),
+			fallback:  fallback,
+			forwarded: c.counterForwarded.WithLabelValues(addr),
+			errors:    c.counterForwardErrors.WithLabelValues(addr),
+		})
+	}
+	if c.self < 0 {
+		return nil, fmt.Errorf("peer address %s is not in the list of peers", cfg.Addr)
+	}
+	return c, nil
+}
+
+// Forward queues an event for the peer owning its request ID. It returns false if the event is owned by this
+// instance, or if the owner is unreachable, in which case the caller processes the event itself.
+func (c *PeerCluster) Forward(id string, line []byte, received time.Time) bool {
+	peer := c.peers[fnv32a(id)%uint32(len(c.peers))]
+	if peer == nil {
+		return false
+	}
+	if atomic.LoadInt64(&peer.downUntil) > time.Now().UnixNano() {
+		peer.errors.Inc()
+		return false
+	}
+
+	// the scanner reuses its buffer, so the line must be copied before it is queued
+	event := peerEvent{line: append([]byte(nil), line...), received: received}
+	select {
+	case peer.queue <- event:
+		return true
+	default:
+		peer.errors.Inc()
+		return false
+	}
+}
+
+// Run connects to the peers and streams queued events to them.
+func (c *PeerCluster) Run() {
+	for _, peer := range c.peers {
+		if peer != nil {
+			go peer.run()
+		}
+	}
+}
+
+// Serve accepts events forwarded by peers, passing them to handle. Peers are not authenticated unless the cluster has
+// a secret, which is sent in plain text, so the listener must only be reachable by the other instances.
+func (c *PeerCluster) Serve(handle func(line []byte, received time.Time)) error {
+	listener, err := net.Listen("tcp", c.addr)
+	if err != nil {
+		return err
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			logError("error accepting peer connection", "error", err)
+			continue
+		}
+		go c.receive(conn, handle)
+	}
+}
+
+// receive reads events from a peer connection. The first line holds the cluster's secret, if any, and each line after
+// it holds the time the event was received in Unix nanoseconds,
+// followed by a space and the raw audit log line.
+func (c *PeerCluster) receive(conn net.Conn, handle func(line []byte, received time.Time)) {
+	defer func() {
+		if err := conn.Close(); err != nil {
+			logError("error closing peer connection", "peer", conn.RemoteAddr(), "error", err)
+		}
+	}()
+
+	reader := newLineReader(conn, c.maxFrameBytes)
+	defer reader.release()
+	if c.secret != "" {
+		frame, _, err := reader.Next()
+		if err != nil || frame == nil || subtle.ConstantTimeCompare(frame, []byte(c.secret)) != 1 {
+			logError("error authenticating peer, closing connection", "peer", conn.RemoteAddr())
+			return
+		}
+	}
+	for {
+		frame, size, err := reader.Next()
+		if err != nil {
+			if err != io.EOF {
+				logError("error reading from peer", "peer", conn.RemoteAddr(), "error", err)
+			}
+			return
+		}
+		if frame == nil {
+			logError("error reading from peer, skipping oversized frame", "peer", conn.RemoteAddr(), "bytes", size)
+			continue
+		}
+		i := bytes.IndexByte(frame, ' ')
+		if i < 0 {
+			logError("error parsing event from peer: missing receipt time", "peer", conn.RemoteAddr())
+			continue
+		}
+		nanos, err := strconv.ParseInt(string(frame[:i]), 10, 64)
+		if err != nil {
+			logError("error parsing event from peer", "peer", conn.RemoteAddr(), "error", err)
+			continue
+		}
+		c.counterReceived.Inc()
+		handle(frame[i+1:], time.Unix(0, nanos))
+	}
+}
+
+// run connects to the peer once there are events for it and writes them to the connection. While the peer is
+// unreachable, queued events are processed locally.
+func (f *peerForwarder) run() {
+	for event := range f.queue {
+		conn, err := net.DialTimeout("tcp", f.addr, f.timeout)
+		if err != nil {
+			logError("error connecting to peer, processing its events locally", "peer", f.addr, "retry_in",
+				peerRetryInterval, "error", err)
+			atomic.StoreInt64(&f.downUntil, time.Now().Add(peerRetryInterval).UnixNano())
+			f.failed(event)
+			f.drain()
+			continue
+		}
+		if err := f.stream(conn, event); err != nil {
+			logError("error forwarding to peer", "peer", f.addr, "error", err)
+		}
+		if err := conn.Close(); err != nil {
+			logError("error closing peer connection", "peer", f.addr, "error", err)
+		}
+	}
+}
+
+// stream writes event and the events queued after it to conn until a write fails. Writes are buffered and flushed
+// whenever the queue is empty or the buffer is full. Events only count as forwarded once flushed, and all events written
+// since the last flush are processed locally if the connection fails, as the peer may not have received them.
+func (f *peerForwarder) stream(conn net.Conn, event peerEvent) error {
+	writer := bufio.NewWriter(conn)
+	if f.secret != "" {
+		// the secret is sent with the first flush of events
+		if _, err := writer.WriteString(f.secret + "\n"); err != nil {
+			f.failed(event)
+			return err
+		}
+	}
+	var unflushed []peerEvent
+	fail := func(err error) error {
+		for _, event := range unflushed {
+			f.failed(event)
+		}
+		return err
+	}
+	flush := func() error {
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+		f.forwarded.Add(float64(len(unflushed)))
+		unflushed = unflushed[:0]
+		return nil
+	}
+
+	var frame []byte
+	for {
+		frame = strconv.AppendInt(frame[:0], event.received.UnixNano(), 10)
+		frame = append(frame, ' ')
+		frame = append(frame, event.line...)
+		frame = append(frame, '\n')
+		if err := conn.SetWriteDeadline(time.Now().Add(f.timeout)); err != nil {
+			unflushed = append(unflushed, event)
+			return fail(err)
+		}
+		// flush before the buffer overflows, so that the writer never sends frames of unflushed events on its own
+		if writer.Buffered() > 0 && writer.Available() < len(frame) {
+			if err := flush(); err != nil {
+				unflushed = append(unflushed, event)
+				return fail(err)
+			}
+		}
+		unflushed = append(unflushed, event)
+		if _, err := writer.Write(frame); err != nil {
+			return fail(err)
+		}
+		if len(f.queue) == 0 {
+			if err := flush(); err != nil {
+				return fail(err)
+			}
+		}
+		event = <-f.queue
+	}
+}
+
+// failed processes an event that could not be forwarded to the peer locally instead.
+func (f *peerForwarder) failed(event peerEvent) {
+	f.errors.Inc()
+	f.fallback(event.line, event.received)
+}
+
+// drain processes the events queued for an unreachable peer locally.
+func (f *peerForwarder) drain() {
+	for {
+		select {
+		case event := <-f.queue:
+			f.failed(event)
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sync/atomic"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// cacheTTLOverride is a compiled CacheTTLOverride.
+type cacheTTLOverride struct {
+	pattern *regexp.Regexp
+	ttl     time.Duration
+}
+
+// compileCacheTTLOverrides compiles the per-path request cache TTLs.
+func compileCacheTTLOverrides(configs []CacheTTLOverride) ([]cacheTTLOverride, error) {
+	var overrides []cacheTTLOverride
+	for _, cfg := range configs {
+		if cfg.TTL <= 0 {
+			return nil, fmt.Errorf("cache TTL for %s must be positive", cfg.Path)
+		}
+		re, err := compileGlob(cfg.Path)
+		if err != nil {
+			return nil, err
+		}
+		overrides = append(overrides, cacheTTLOverride{pattern: re, ttl: cfg.TTL})
+	}
+	return overrides, nil
+}
+
+// requestTTL returns how long a request with a path is cached awaiting its response. The first matching override
+// applies, falling back to the default cache TTL.
+func (p *AuditProcessor) requestTTL(path string) time.Duration {
+	for _, override := range p.cacheTTLOverrides {
+		if override.pattern.MatchString(path) {
+			return override.ttl
+		}
+	}
+	return 0
+}
+
+// States of a pendingResponse.
+const (
+	pendingWaiting int32 = iota
+	pendingMatching
+	pendingMatched
+	pendingEvicted
+)
+
+// pendingResponse is a response that arrived before its request, held until the request arrives or the entry expires.
+// Workers matching it and the cache's janitor evicting it race for its state, so that it is counted as either matched
+// or unmatched, never both.
+type pendingResponse struct {
+	event *AuditEvent
+	state int32
+}
+
+// newPendingResponses constructs the cache of responses awaiting their requests. Expired entries are reported as
+// unmatched, since their latency is lost, unless a worker is matching them, which then reports them if it fails.
+func newPendingResponses(ttl time.Duration, unmatched func(id string)) *cache.Cache {
+	cleanup := ttl / 2
+	if cleanup < time.Second {
+		cleanup = time.Second
+	}
+	pending := cache.New(ttl, cleanup)
+	pending.OnEvicted(func(id string, v interface{}) {
+		response := v.(*pendingResponse)
+		if atomic.CompareAndSwapInt32(&response.state, pendingWaiting, pendingEvicted) {
+			unmatched(id)
+			return
+		}
+		atomic.CompareAndSwapInt32(&response.state, pendingMatching, pendingEvicted)
+	})
+	return pending
+}
+
+// bufferResponse holds a response whose request has not been seen yet. It returns false if buffering is disabled, or
+// if a response with the same request ID is already buffered, which keeps its place so that every buffered response is
+// settled exactly once.
+func (p *AuditProcessor) bufferResponse(auditEvent *AuditEvent, shard *metricShard) bool {
+	if p.pending == nil {
+		return false
+	}
+	auditEvent.retained = true
+	if err := p.pending.Add(auditEvent.entry.Request.ID, &pendingResponse{event: auditEvent}, cache.DefaultExpiration); err != nil {
+		auditEvent.retained = false
+		p.counterDuplicateResponses.Inc()
+		return false
+	}
+	p.counterResponsesReordered.Inc()
+
+	// the request may have been stored after the response missed it, but before the response was buffered
+	p.matchPendingResponse(auditEvent.entry.Request.ID, shard)
+	return true
+}
+
+// matchPendingResponse records the latency of a buffered response once its request has been stored, and reports
+// whether it did. Both sides take the request timestamp from the store, so the latency is recorded exactly once.
+func (p *AuditProcessor) matchPendingResponse(id string, shard *metricShard) bool {
+	if p.pending == nil {
+		return false
+	}
+	v, found := p.pending.Get(id)
+	if !found {
+		return false
+	}
+	pending := v.(*pendingResponse)
+	if !atomic.CompareAndSwapInt32(&pending.state, pendingWaiting, pendingMatching) {
+		return false
+	}
+	requestTime, found, err := p.takeRequestTime(id, shard)
+	if err != nil || !found {
+		if err != nil {
+			logError("error loading request timestamp", "request_id", id, "error", err)
+		}
+		// the response waits for its request again, unless it was evicted meanwhile
+		if !atomic.CompareAndSwapInt32(&pending.state, pendingMatching, pendingWaiting) {
+			p.unmatchedResponse(id)
+		}
+		return false
+	}
+	atomic.StoreInt32(&pending.state, pendingMatched)
+	p.pending.Delete(id)
+	p.counterPendingMatched.Inc()
+	p.recordLatency(pending.event, requestTime, shard)
+	return true
+}
+
+// unmatchedResponse accounts for a response whose request was never seen.
+func (p *AuditProcessor) unmatchedResponse(id string) {
+	logWarn("prior request not found for response", "request_id", id)
+	p.counterUnmatchedResponses.Inc()
+}
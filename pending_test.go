@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestBufferResponseDuplicate checks that a response arriving while one with the same request ID is buffered doesn't
+// displace it, and is counted as unmatched instead.
+func TestBufferResponseDuplicate(t *testing.T) {
+	p := newTestAuditProcessor(t)
+	p.pending = newPendingResponses(time.Minute, p.unmatchedResponse)
+	defer func() { p.pending = nil }()
+
+	const id = "8a3e5c1f-4b2d-4e6f-9a7b-1c2d3e4f5a6b"
+	newResponse := func() *AuditEvent {
+		return &AuditEvent{
+			entry: &AuditEntry{Type: AuditEventTypeResponse, Request: &AuditRequest{ID: id, Path: "secret/data/app"}},
+			time:  time.Now(),
+		}
+	}
+	unmatched := counterValue(t, p.counterUnmatchedResponses)
+	duplicates := counterValue(t, p.counterDuplicateResponses)
+
+	first := newResponse()
+	p.observeLatency(first, nil)
+	if !first.retained {
+		t.Fatal("first response wasn't buffered")
+	}
+	second := newResponse()
+	p.observeLatency(second, nil)
+	if second.retained {
+		t.Error("second response was retained, so it would never be released")
+	}
+	v, found := p.pending.Get(id)
+	if !found || v.(*pendingResponse).event != first {
+		t.Error("second response displaced the first one")
+	}
+	if got := counterValue(t, p.counterDuplicateResponses) - duplicates; got != 1 {
+		t.Errorf("counted %v duplicate responses, want 1", got)
+	}
+	if got := counterValue(t, p.counterUnmatchedResponses) - unmatched; got != 1 {
+		t.Errorf("counted %v unmatched responses before the first one expired, want 1", got)
+	}
+
+	p.pending.Delete(id)
+	if got := counterValue(t, p.counterUnmatchedResponses) - unmatched; got != 2 {
+		t.Errorf("counted %v unmatched responses after the first one expired, want 2", got)
+	}
+}
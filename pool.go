@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+)
+
+// connPool is a bounded pool of connections to a remote timestamp store.
+type connPool struct {
+	name    string
+	addr    string
+	tls     bool
+	timeout time.Duration
+	// setup prepares new connections, for example by authenticating.
+	setup func(*poolConn) error
+	// slots bounds the number of open connections, and idle holds the ones not in use.
+	slots chan struct{}
+	idle  chan *poolConn
+}
+
+// poolConn is a pooled connection with a buffered reader for replies.
+type poolConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func newConnPool(name, addr string, useTLS bool, size int, timeout time.Duration, setup func(*poolConn) error) *connPool {
+	if size <= 0 {
+		size = 8
+	}
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	return &connPool{
+		name:    name,
+		addr:    addr,
+		tls:     useTLS,
+		timeout: timeout,
+		setup:   setup,
+		slots:   make(chan struct{}, size),
+		idle:    make(chan *poolConn, size),
+	}
+}
+
+// get takes a connection from the pool, dialing a new one if none are idle. It waits for a connection to be returned if
+// the pool is exhausted. The connection's deadline is set to the pool timeout.
+func (p *connPool) get() (*poolConn, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-time.After(p.timeout):
+		return nil, fmt.Errorf("timed out waiting for a %s connection", p.name)
+	}
+
+	var conn *poolConn
+	select {
+	case conn = <-p.idle:
+	default:
+		var err error
+		if conn, err = p.dial(); err != nil {
+			<-p.slots
+			return nil, err
+		}
+	}
+	if err := conn.SetDeadline(time.Now().Add(p.timeout)); err != nil {
+		p.discard(conn)
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (p *connPool) dial() (*poolConn, error) {
+	dialer := &net.Dialer{Timeout: p.timeout}
+	var conn net.Conn
+	var err error
+	if p.tls {
+		conn, err = tls.DialWithDialer(dialer, "tcp", p.addr, nil)
+	} else {
+		conn, err = dialer.Dial("tcp", p.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	pc := &poolConn{Conn: conn, reader: bufio.NewReader(conn)}
+	if p.setup != nil {
+		if err := pc.SetDeadline(time.Now().Add(p.timeout)); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		if err := p.setup(pc); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return pc, nil
+}
+
+// put returns a healthy connection to the pool.
+func (p *connPool) put(conn *poolConn) {
+	p.idle <- conn
+	<-p.slots
+}
+
+// discard closes a broken connection, freeing its slot in the pool.
+func (p *connPool) discard(conn *poolConn) {
+	_ = conn.Close()
+	<-p.slots
+}
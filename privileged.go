@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// privilegedEndpoints are the endpoints that Vault protects with the sudo capability, or that act on the cluster as a
+// whole. As in Vault's own path specifications, a trailing "*" matches any remainder of the path.
+var privilegedEndpoints = []string{
+	"auth/token/accessors*",
+	"auth/token/revoke-orphan*",
+	"sys/audit",
+	"sys/audit/*",
+	"sys/auth/*",
+	"sys/config/auditing/*",
+	"sys/config/cors",
+	"sys/config/ui/headers/*",
+	"sys/generate-root/*",
+	"sys/internal/inspect/*",
+	"sys/leases",
+	"sys/leases/lookup/*",
+	"sys/leases/revoke-force/*",
+	"sys/leases/revoke-prefix/*",
+	"sys/mfa/method/*",
+	"sys/plugins/catalog/*",
+	"sys/plugins/reload/backend",
+	"sys/pprof/*",
+	"sys/raw",
+	"sys/raw/*",
+	"sys/remount",
+	"sys/replication/dr/primary/secondary-token",
+	"sys/replication/dr/reindex",
+	"sys/replication/performance/primary/secondary-token",
+	"sys/replication/performance/reindex",
+	"sys/replication/primary/secondary-token",
+	"sys/replication/reindex",
+	"sys/revoke-force/*",
+	"sys/revoke-prefix/*",
+	"sys/rotate",
+	"sys/rotate/config",
+	"sys/seal",
+	"sys/step-down",
+	"sys/storage/raft/snapshot",
+	"sys/storage/raft/snapshot-auto/config/*",
+	"sys/storage/raft/snapshot-force",
+}
+
+// PrivilegedMonitor counts requests to sudo-protected and other privileged endpoints by endpoint and entity, answering
+// who is doing dangerous things out of the box.
+type PrivilegedMonitor struct {
+	counterRequests *prometheus.CounterVec
+}
+
+// NewPrivilegedMonitor constructs a PrivilegedMonitor.
+func NewPrivilegedMonitor() *PrivilegedMonitor {
+	return &PrivilegedMonitor{
+		counterRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "security",
+			Name:      "privileged_requests_total",
+			Help:      "Number of Vault requests to sudo-protected and other privileged endpoints, including denied ones. Partitioned by endpoint pattern and the entity ID of the token.",
+		},
+			[]string{"path", "entity"}),
+	}
+}
+
+func (m *PrivilegedMonitor) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.counterRequests}
+}
+
+// privilegedEndpoint returns the most specific privileged endpoint pattern matching a path, or "" if there is none.
+func privilegedEndpoint(path string) string {
+	var match string
+	for _, endpoint := range privilegedEndpoints {
+		if len(endpoint) <= len(match) {
+			continue
+		}
+		if prefix := strings.TrimSuffix(endpoint, "*"); prefix != endpoint {
+			if strings.HasPrefix(path, prefix) {
+				match = endpoint
+			}
+		} else if path == endpoint {
+			match = endpoint
+		}
+	}
+	return match
+}
+
+// Observe records a request to a privileged endpoint. Requests are counted rather than responses, so that denied
+// attempts are counted too.
+func (m *PrivilegedMonitor) Observe(auditEvent *AuditEvent) {
+	request := auditEvent.entry.Request
+	if auditEvent.entry.Type != AuditEventTypeRequest || request == nil {
+		return
+	}
+	endpoint := privilegedEndpoint(request.Path)
+	if endpoint == "" {
+		return
+	}
+	var entity string
+	if auth := auditEvent.entry.Auth; auth != nil {
+		entity = auth.EntityID
+	}
+	m.counterRequests.WithLabelValues(endpoint, entity).Inc()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// defaultPushgatewayJob is the job of the grouping key metrics are pushed under if unset.
+const defaultPushgatewayJob = "vault-audit-metrics"
+
+// pushgatewaySink pushes metrics to a Prometheus Pushgateway, for batch runs such as backfills of audit log files with
+// bench, which end before Prometheus could scrape them. Every push replaces the metrics of the group identified by the
+// job and grouping labels, so a run that is repeated, such as by cron, overwrites the results of its previous run.
+type pushgatewaySink struct {
+	// groupURL is the URL of the group metrics are pushed to.
+	groupURL string
+	headers  map[string]string
+	client   *http.Client
+}
+
+func newPushgatewaySink(cfg MetricSinkConfig) (*pushgatewaySink, error) {
+	base, err := url.Parse(strings.TrimSuffix(cfg.URL, "/"))
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") {
+		return nil, fmt.Errorf("an http or https url is required")
+	}
+	job := cfg.Job
+	if job == "" {
+		job = defaultPushgatewayJob
+	}
+	path := "/metrics/" + pushgatewayGroupingPath("job", job)
+	names := make([]string, 0, len(cfg.Grouping))
+	for name := range cfg.Grouping {
+		if name == "job" {
+			return nil, fmt.Errorf("the job is set with job, not grouping")
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path += "/" + pushgatewayGroupingPath(name, cfg.Grouping[name])
+	}
+	return &pushgatewaySink{
+		groupURL: base.String() + path,
+		headers:  cfg.Headers,
+		client:   &http.Client{Timeout: sinkTimeout},
+	}, nil
+}
+
+func (s *pushgatewaySink) push(families []*dto.MetricFamily, now time.Time) error {
+	var buf bytes.Buffer
+	for _, family := range families {
+		if _, err := expfmt.MetricFamilyToText(&buf, family); err != nil {
+			return err
+		}
+	}
+	// PUT replaces the whole group, so series that disappeared since the previous push are deleted
+	_, err := sendSink(s.client, http.MethodPut, s.groupURL, string(expfmt.FmtText), s.headers, buf.Bytes(), false)
+	return err
+}
+
+// pushgatewayGroupingPath returns the path segments of a label of a grouping key. Values that are empty or contain
+// slashes can't be path segments and are base64-encoded.
+func pushgatewayGroupingPath(name, value string) string {
+	if value == "" {
+		return url.PathEscape(name) + "@base64/="
+	}
+	if strings.Contains(value, "/") {
+		return url.PathEscape(name) + "@base64/" + base64.RawURLEncoding.EncodeToString([]byte(value))
+	}
+	return url.PathEscape(name) + "/" + url.PathEscape(value)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// parseErrorBucketInterval is the resolution of the parse error window.
+const parseErrorBucketInterval = 10 * time.Second
+
+// minParseErrorSample is the number of lines a window must hold before its parse error ratio is trusted, so that a
+// couple of bad lines during a quiet period don't fail readiness.
+const minParseErrorSample = 100
+
+// ParseErrorMonitor tracks the ratio of audit log lines that fail to parse over a rolling window. Above a threshold,
+// the exporter is reported as not ready, since a sustained failure usually means the audit log format changed and
+// metrics are silently flatlining.
+type ParseErrorMonitor struct {
+	threshold float64
+	window    time.Duration
+
+	mu      sync.Mutex
+	buckets []parseErrorBucket
+	// degraded is 1 while the parse error ratio exceeds the threshold, and ratio holds the ratio as float64 bits.
+	degraded int32
+	ratio    uint64
+
+	gagueRatio    prometheus.Gauge
+	gagueDegraded prometheus.Gauge
+}
+
+// parseErrorBucket holds the lines of one bucket interval, identified by the interval's index since the Unix epoch.
+type parseErrorBucket struct {
+	index         int64
+	lines, errors int
+}
+
+// NewParseErrorMonitor constructs a ParseErrorMonitor failing readiness when more than threshold of the lines within
+// window fail to parse.
+func NewParseErrorMonitor(threshold float64, window time.Duration) (*ParseErrorMonitor, error) {
+	if threshold <= 0 || threshold >= 1 {
+		return nil, fmt.Errorf("threshold must be between 0 and 1")
+	}
+	if window < parseErrorBucketInterval {
+		return nil, fmt.Errorf("window must be at least %s", parseErrorBucketInterval)
+	}
+	return &ParseErrorMonitor{
+		threshold: threshold,
+		window:    window,
+		buckets:   make([]parseErrorBucket, int(window/parseErrorBucketInterval)),
+		gagueRatio: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: PromNamespace,
+			Subsystem: "pipeline",
+			Name:      "parse_error_ratio",
+			Help:      "Ratio of audit log lines that failed to parse over -parse-error-window.",
+		}),
+		gagueDegraded: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: PromNamespace,
+			Subsystem: "pipeline",
+			Name:      "parse_errors_degraded",
+			Help:      "Whether the ratio of audit log lines that failed to parse exceeds -parse-error-threshold, failing readiness.",
+		}),
+	}, nil
+}
+
+// Record adds a line to the bucket of the current interval.
+func (m *ParseErrorMonitor) Record(failed bool) {
+	index := time.Now().UnixNano() / int64(parseErrorBucketInterval)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bucket := &m.buckets[index%int64(len(m.buckets))]
+	if bucket.index != index {
+		*bucket = parseErrorBucket{index: index}
+	}
+	bucket.lines++
+	if failed {
+		bucket.errors++
+	}
+}
+
+// Ready reports whether the parse error ratio is within the threshold, and otherwise why not.
+func (m *ParseErrorMonitor) Ready() (bool, string) {
+	if atomic.LoadInt32(&m.degraded) == 0 {
+		return true, ""
+	}
+	ratio := math.Float64frombits(atomic.LoadUint64(&m.ratio))
+	return false, fmt.Sprintf("%.1f%% of audit log lines failed to parse over %s", ratio*100, m.window)
+}
+
+// Run continuously updates the parse error ratio and readiness.
+func (m *ParseErrorMonitor) Run() {
+	for {
+		time.Sleep(parseErrorBucketInterval)
+		current := time.Now().UnixNano() / int64(parseErrorBucketInterval)
+		oldest := current - int64(len(m.buckets)) + 1
+		lines, errors := 0, 0
+		m.mu.Lock()
+		for _, bucket := range m.buckets {
+			if bucket.index >= oldest && bucket.index <= current {
+				lines += bucket.lines
+				errors += bucket.errors
+			}
+		}
+		m.mu.Unlock()
+
+		ratio := 0.0
+		if lines > 0 {
+			ratio = float64(errors) / float64(lines)
+		}
+		degraded := lines >= minParseErrorSample && ratio > m.threshold
+		atomic.StoreUint64(&m.ratio, math.Float64bits(ratio))
+		m.gagueRatio.Set(ratio)
+		if degraded {
+			if atomic.SwapInt32(&m.degraded, 1) == 0 {
+				logError("error parsing audit log lines, failing readiness", "ratio", ratio, "window", m.window)
+			}
+			m.gagueDegraded.Set(1)
+		} else {
+			if atomic.SwapInt32(&m.degraded, 0) == 1 {
+				logInfo("audit log lines are parsing again, passing readiness")
+			}
+			m.gagueDegraded.Set(0)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// RedisStore is a TimestampStore backed by Redis, which lets replicas behind a load balancer correlate requests and
+// responses received by one another. Entries expire through Redis key TTLs, so expired requests are not counted.
+type RedisStore struct {
+	client     *redisClient
+	prefix     string
+	duplicates string
+	ttl        time.Duration
+}
+
+// NewRedisStore constructs a RedisStore, verifying that Redis is reachable.
+func NewRedisStore(cfg *RedisConfig, duplicates string, ttl time.Duration) (*RedisStore, error) {
+	if cfg.Addr == "" {
+		return nil, errors.New("redis address is required")
+	}
+	s := &RedisStore{
+		client:     newRedisClient(cfg),
+		prefix:     cfg.KeyPrefix,
+		duplicates: duplicates,
+		ttl:        ttl,
+	}
+	if _, err := s.client.do([]string{"PING"}); err != nil {
+		return nil, fmt.Errorf("error connecting to redis: %v", err)
+	}
+	return s, nil
+}
+
+// Set stores a request. In DuplicateMultiset mode, requests are kept in a list per ID.
+func (s *RedisStore) Set(id string, t time.Time, ttl time.Duration) (bool, error) {
+	if ttl == 0 {
+		ttl = s.ttl
+	}
+	key, value, px := s.prefix+id, strconv.FormatInt(t.UnixNano(), 10), strconv.FormatInt(ttl.Milliseconds(), 10)
+
+	switch s.duplicates {
+	case DuplicateFirstWins:
+		replies, err := s.client.do([]string{"SET", key, value, "PX", px, "NX"})
+		if err != nil {
+			return false, err
+		}
+		return replies[0] == nil, nil
+	case DuplicateMultiset:
+		results, err := s.transaction([]string{"RPUSH", key, value}, []string{"PEXPIRE", key, px})
+		if err != nil {
+			return false, err
+		}
+		length, _ := results[0].(int64)
+		return length > 1, nil
+	default:
+		results, err := s.transaction([]string{"EXISTS", key}, []string{"SET", key, value, "PX", px})
+		if err != nil {
+			return false, err
+		}
+		exists, _ := results[0].(int64)
+		return exists > 0, nil
+	}
+}
+
+func (s *RedisStore) Take(id string) (time.Time, bool, error) {
+	key := s.prefix + id
+	var reply interface{}
+	if s.duplicates == DuplicateMultiset {
+		replies, err := s.client.do([]string{"LPOP", key})
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		reply = replies[0]
+	} else {
+		// GET and DEL run in a transaction rather than using GETDEL, which requires Redis 6.2. They must be atomic,
+		// so that a request stored between them is not deleted unseen and only one replica takes each request.
+		results, err := s.transaction([]string{"GET", key}, []string{"DEL", key})
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		reply = results[0]
+	}
+
+	value, ok := reply.(string)
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	nanos, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("error parsing stored timestamp '%s': %v", value, err)
+	}
+	return time.Unix(0, nanos), true, nil
+}
+
+// transaction runs commands atomically with MULTI and EXEC, returning their results.
+func (s *RedisStore) transaction(commands ...[]string) ([]interface{}, error) {
+	pipeline := append([][]string{{"MULTI"}}, commands...)
+	pipeline = append(pipeline, []string{"EXEC"})
+	replies, err := s.client.do(pipeline...)
+	if err != nil {
+		return nil, err
+	}
+	results, ok := replies[len(replies)-1].([]interface{})
+	if !ok || len(results) != len(commands) {
+		return nil, fmt.Errorf("unexpected redis transaction reply: %v", replies[len(replies)-1])
+	}
+	return results, nil
+}
+
+// redisClient is a minimal Redis client speaking RESP over a bounded pool of connections.
+type redisClient struct {
+	pool *connPool
+}
+
+func newRedisClient(cfg *RedisConfig) *redisClient {
+	setup := func(conn *poolConn) error {
+		var commands [][]string
+		if cfg.Password != "" {
+			commands = append(commands, []string{"AUTH", cfg.Password})
+		}
+		if cfg.DB != 0 {
+			commands = append(commands, []string{"SELECT", strconv.Itoa(cfg.DB)})
+		}
+		for _, args := range commands {
+			if _, err := conn.Write(appendRedisCommand(nil, args)); err != nil {
+				return err
+			}
+			if _, err := readRedisReply(conn.reader); err != nil {
+				return fmt.Errorf("error running %s: %v", args[0], err)
+			}
+		}
+		return nil
+	}
+	return &redisClient{pool: newConnPool("redis", cfg.Addr, cfg.TLS, cfg.PoolSize, cfg.Timeout, setup)}
+}
+
+// do sends commands in a single pipeline and returns their replies. Replies are strings, integers, nil, or slices of
+// replies; error replies are returned as errors.
+func (c *redisClient) do(commands ...[]string) ([]interface{}, error) {
+	conn, err := c.pool.get()
+	if err != nil {
+		return nil, err
+	}
+	var buf []byte
+	for _, args := range commands {
+		buf = appendRedisCommand(buf, args)
+	}
+	if _, err := conn.Write(buf); err != nil {
+		c.pool.discard(conn)
+		return nil, err
+	}
+	replies := make([]interface{}, len(commands))
+	var replyErr error
+	for i := range commands {
+		reply, err := readRedisReply(conn.reader)
+		if err != nil {
+			var redisErr redisError
+			if !errors.As(err, &redisErr) {
+				c.pool.discard(conn)
+				return nil, err
+			}
+			replyErr = err
+		}
+		replies[i] = reply
+	}
+	c.pool.put(conn)
+	return replies, replyErr
+}
+
+// redisError is an error reply from Redis.
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// appendRedisCommand encodes a command as a RESP array of bulk strings.
+func appendRedisCommand(buf []byte, args []string) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	return buf
+}
+
+// readRedisReply decodes a single RESP reply.
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed redis reply: %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRedisReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("unknown redis reply type: %q", kind)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Relabeling actions, following the semantics of Prometheus relabel_config.
+const (
+	RelabelActionReplace   = "replace"
+	RelabelActionKeep      = "keep"
+	RelabelActionDrop      = "drop"
+	RelabelActionLabelDrop = "labeldrop"
+)
+
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Relabeler applies an ordered list of relabeling rules to the label set of each audit event.
+type Relabeler struct {
+	rules []relabelRule
+}
+
+type relabelRule struct {
+	sourceLabels []string
+	separator    string
+	regex        *regexp.Regexp
+	targetLabel  string
+	replacement  string
+	action       string
+}
+
+// NewRelabeler compiles relabeling configuration into a Relabeler. Unset fields take the same defaults as in
+// Prometheus: a separator of ";", a regex of "(.*)", a replacement of "$1", and the replace action.
+func NewRelabeler(configs []RelabelConfig) (*Relabeler, error) {
+	r := new(Relabeler)
+	for i, cfg := range configs {
+		rule := relabelRule{
+			sourceLabels: cfg.SourceLabels,
+			separator:    ";",
+			targetLabel:  cfg.TargetLabel,
+			replacement:  "$1",
+			action:       strings.ToLower(cfg.Action),
+		}
+		if cfg.Separator != nil {
+			rule.separator = *cfg.Separator
+		}
+		if cfg.Replacement != nil {
+			rule.replacement = *cfg.Replacement
+		}
+		if rule.action == "" {
+			rule.action = RelabelActionReplace
+		}
+		expr := cfg.Regex
+		if expr == "" {
+			expr = "(.*)"
+		}
+		regex, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("relabel rule %d: invalid regex: %v", i, err)
+		}
+		rule.regex = regex
+
+		switch rule.action {
+		case RelabelActionReplace:
+			if !labelNameRegexp.MatchString(rule.targetLabel) {
+				return nil, fmt.Errorf("relabel rule %d: invalid target label: %q", i, rule.targetLabel)
+			}
+		case RelabelActionKeep, RelabelActionDrop:
+			if len(rule.sourceLabels) == 0 {
+				return nil, fmt.Errorf("relabel rule %d: %s requires source labels", i, rule.action)
+			}
+		case RelabelActionLabelDrop:
+		default:
+			return nil, fmt.Errorf("relabel rule %d: unknown action: %s", i, cfg.Action)
+		}
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+// TargetLabels returns the names of labels written by replace rules, so that they can be added to metric families.
+func (r *Relabeler) TargetLabels() []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, rule := range r.rules {
+		if rule.action == RelabelActionReplace && !seen[rule.targetLabel] {
+			seen[rule.targetLabel] = true
+			names = append(names, rule.targetLabel)
+		}
+	}
+	return names
+}
+
+// Apply runs the relabeling rules against a label set in place. It returns false if the event should be dropped.
+// Since the label names of each metric family are fixed, dropped labels and empty replacements are represented as
+// empty label values, which Prometheus treats the same as an absent label.
+func (r *Relabeler) Apply(labels prometheus.Labels) bool {
+	for _, rule := range r.rules {
+		values := make([]string, len(rule.sourceLabels))
+		for i, name := range rule.sourceLabels {
+			values[i] = labels[name]
+		}
+		value := strings.Join(values, rule.separator)
+
+		switch rule.action {
+		case RelabelActionReplace:
+			match := rule.regex.FindStringSubmatchIndex(value)
+			if match == nil {
+				continue
+			}
+			labels[rule.targetLabel] = string(rule.regex.ExpandString(nil, rule.replacement, value, match))
+		case RelabelActionKeep:
+			if !rule.regex.MatchString(value) {
+				return false
+			}
+		case RelabelActionDrop:
+			if rule.regex.MatchString(value) {
+				return false
+			}
+		case RelabelActionLabelDrop:
+			for name := range labels {
+				if rule.regex.MatchString(name) {
+					labels[name] = ""
+				}
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+)
+
+// AddressAggregator collapses client addresses into named networks or fixed-length prefixes, so that a remote address
+// label gives insight into client locality without creating a series per client IP.
+type AddressAggregator struct {
+	prefixV4 int
+	prefixV6 int
+	networks []namedNetwork
+}
+
+type namedNetwork struct {
+	name    string
+	network *net.IPNet
+}
+
+// NewAddressAggregator constructs an AddressAggregator. Addresses are masked to prefixV4 or prefixV6 bits unless they
+// fall into one of the given named networks, in which case the most specific network name is used.
+func NewAddressAggregator(prefixV4, prefixV6 int, networks map[string][]string) (*AddressAggregator, error) {
+	if prefixV4 < 0 || prefixV4 > 32 {
+		return nil, fmt.Errorf("invalid IPv4 prefix length: %d", prefixV4)
+	}
+	if prefixV6 < 0 || prefixV6 > 128 {
+		return nil, fmt.Errorf("invalid IPv6 prefix length: %d", prefixV6)
+	}
+
+	a := &AddressAggregator{prefixV4: prefixV4, prefixV6: prefixV6}
+	for name, cidrs := range networks {
+		for _, cidr := range cidrs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("network %s: %v", name, err)
+			}
+			a.networks = append(a.networks, namedNetwork{name: name, network: network})
+		}
+	}
+
+	// most specific networks are matched first, with ties broken by name for deterministic output
+	sort.Slice(a.networks, func(i, j int) bool {
+		iOnes, _ := a.networks[i].network.Mask.Size()
+		jOnes, _ := a.networks[j].network.Mask.Size()
+		if iOnes != jOnes {
+			return iOnes > jOnes
+		}
+		return a.networks[i].name < a.networks[j].name
+	})
+	return a, nil
+}
+
+// Aggregate maps a remote address to its named network or masked prefix. Unparseable addresses map to an empty string.
+func (a *AddressAggregator) Aggregate(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ""
+	}
+
+	for _, n := range a.networks {
+		if n.network.Contains(ip) {
+			return n.name
+		}
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(a.prefixV4, 32)), Mask: net.CIDRMask(a.prefixV4, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(a.prefixV6, 128)), Mask: net.CIDRMask(a.prefixV6, 128)}).String()
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// remoteWriteMaxSeries is the largest number of series written per request, as in Prometheus' default
+	// max_samples_per_send.
+	remoteWriteMaxSeries = 2000
+	// defaultRemoteWriteBuffer is the size of the requests buffered while the endpoint is unavailable if unset.
+	defaultRemoteWriteBuffer = 64 << 20
+)
+
+// remoteWriteMetadataTypes are the remote write metric types of the Prometheus metric types.
+var remoteWriteMetadataTypes = map[dto.MetricType]uint64{
+	dto.MetricType_COUNTER:   1,
+	dto.MetricType_GAUGE:     2,
+	dto.MetricType_HISTOGRAM: 3,
+	dto.MetricType_SUMMARY:   5,
+}
+
+// remoteWriteSeries is a sample of a series, with labels sorted by name.
+type remoteWriteSeries struct {
+	labels []*dto.LabelPair
+	value  float64
+}
+
+// remoteWriteSink writes metrics to an endpoint implementing the Prometheus remote write protocol, such as Mimir,
+// Thanos Receive, VictoriaMetrics, or Prometheus itself, for networks where the exporter can't be scraped. Histograms
+// and summaries are expanded into the series a scrape would produce, and external labels, by default a job label and
+// an instance label holding the host name, are added to every series. Requests that fail with a server error or
+// throttling are kept in memory, without a write-ahead log, and retried in order on later pushes, dropping the oldest
+// once they exceed the buffer size, while requests rejected as invalid are dropped.
+type remoteWriteSink struct {
+	url      string
+	headers  map[string]string
+	client   *http.Client
+	external []*dto.LabelPair
+
+	// pending holds the encoded requests that weren't written yet, oldest first.
+	pending      [][]byte
+	pendingBytes int
+	bufferBytes  int
+}
+
+func newRemoteWriteSink(cfg MetricSinkConfig) (*remoteWriteSink, error) {
+	if !strings.HasPrefix(cfg.URL, "http://") && !strings.HasPrefix(cfg.URL, "https://") {
+		return nil, fmt.Errorf("an http or https url is required")
+	}
+	if cfg.BufferBytes < 0 {
+		return nil, fmt.Errorf("buffer_bytes must not be negative")
+	}
+	s := &remoteWriteSink{
+		url: cfg.URL,
+		headers: map[string]string{
+			"Content-Encoding":                  "snappy",
+			"X-Prometheus-Remote-Write-Version": "0.1.0",
+		},
+		client:      &http.Client{Timeout: sinkTimeout},
+		bufferBytes: cfg.BufferBytes,
+	}
+	if s.bufferBytes == 0 {
+		s.bufferBytes = defaultRemoteWriteBuffer
+	}
+	for name, value := range cfg.Headers {
+		s.headers[name] = value
+	}
+
+	external := map[string]string{"job": "vault-audit-metrics"}
+	if hostname, err := os.Hostname(); err == nil {
+		external["instance"] = hostname
+	}
+	for name, value := range cfg.Tags {
+		external[name] = value
+	}
+	for name, value := range external {
+		if value != "" {
+			s.external = append(s.external, &dto.LabelPair{Name: stringPointer(name), Value: stringPointer(value)})
+		}
+	}
+	sortLabels(s.external)
+	return s, nil
+}
+
+func (s *remoteWriteSink) push(families []*dto.MetricFamily, now time.Time) error {
+	timestamp := now.UnixNano() / int64(time.Millisecond)
+	var series []remoteWriteSeries
+	var metadata []byte
+	add := func(name string, labels []*dto.LabelPair, extra *dto.LabelPair, value float64) {
+		all := make([]*dto.LabelPair, 0, len(labels)+len(s.external)+2)
+		all = append(all, &dto.LabelPair{Name: stringPointer("__name__"), Value: stringPointer(name)})
+		names := make(map[string]bool, len(labels)+1)
+		for _, label := range labels {
+			if label.GetValue() != "" {
+				all = append(all, label)
+				names[label.GetName()] = true
+			}
+		}
+		if extra != nil {
+			all = append(all, extra)
+			names[extra.GetName()] = true
+		}
+		// like Prometheus' external labels, these don't override the labels of a series
+		for _, label := range s.external {
+			if !names[label.GetName()] {
+				all = append(all, label)
+			}
+		}
+		sortLabels(all)
+		series = append(series, remoteWriteSeries{labels: all, value: value})
+	}
+	for _, family := range families {
+		name := family.GetName()
+		typ := metricType(family)
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.VarintType)
+		entry = protowire.AppendVarint(entry, remoteWriteMetadataTypes[typ])
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendString(entry, name)
+		entry = protowire.AppendTag(entry, 4, protowire.BytesType)
+		entry = protowire.AppendString(entry, family.GetHelp())
+		metadata = otlpAppendMessage(metadata, 3, entry)
+
+		for _, m := range family.Metric {
+			switch typ {
+			case dto.MetricType_COUNTER, dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+				add(name, m.Label, nil, metricValue(m))
+			case dto.MetricType_HISTOGRAM:
+				histogram := m.GetHistogram()
+				for _, bucket := range histogram.Bucket {
+					if !math.IsInf(bucket.GetUpperBound(), 1) {
+						add(name+"_bucket", m.Label, labelPair("le", formatLabelFloat(bucket.GetUpperBound())),
+							float64(bucket.GetCumulativeCount()))
+					}
+				}
+				add(name+"_bucket", m.Label, labelPair("le", "+Inf"), float64(histogram.GetSampleCount()))
+				add(name+"_sum", m.Label, nil, histogram.GetSampleSum())
+				add(name+"_count", m.Label, nil, float64(histogram.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				summary := m.GetSummary()
+				for _, quantile := range summary.Quantile {
+					add(name, m.Label, labelPair("quantile", formatLabelFloat(quantile.GetQuantile())), quantile.GetValue())
+				}
+				add(name+"_sum", m.Label, nil, summary.GetSampleSum())
+				add(name+"_count", m.Label, nil, float64(summary.GetSampleCount()))
+			}
+		}
+	}
+
+	for start := 0; start < len(series); start += remoteWriteMaxSeries {
+		end := start + remoteWriteMaxSeries
+		if end > len(series) {
+			end = len(series)
+		}
+		var request []byte
+		for _, sample := range series[start:end] {
+			request = otlpAppendMessage(request, 1, remoteWriteTimeSeries(sample, timestamp))
+		}
+		// metadata is sent along with the first request of every push
+		if start == 0 {
+			request = append(request, metadata...)
+		}
+		s.enqueue(snappyEncode(request))
+	}
+	return s.flush()
+}
+
+// enqueue buffers an encoded request, dropping the oldest ones beyond the buffer size.
+func (s *remoteWriteSink) enqueue(body []byte) {
+	s.pending = append(s.pending, body)
+	s.pendingBytes += len(body)
+	var dropped int
+	for s.pendingBytes > s.bufferBytes && len(s.pending) > 1 {
+		s.pendingBytes -= len(s.pending[0])
+		s.pending[0] = nil
+		s.pending = s.pending[1:]
+		dropped++
+	}
+	if dropped > 0 {
+		logWarn("dropped buffered remote write requests", "url", s.url, "requests", dropped)
+	}
+}
+
+// flush writes the buffered requests in order, stopping at the first that may succeed when retried, so that samples
+// arrive in order.
+func (s *remoteWriteSink) flush() error {
+	var firstErr error
+	for len(s.pending) > 0 {
+		err := postSink(s.client, s.url, "application/x-protobuf", s.headers, s.pending[0], false)
+		if err != nil && retryableSinkError(err) {
+			return err
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		s.pendingBytes -= len(s.pending[0])
+		s.pending[0] = nil
+		s.pending = s.pending[1:]
+	}
+	return firstErr
+}
+
+// remoteWriteTimeSeries encodes a sample as a remote write time series.
+func remoteWriteTimeSeries(sample remoteWriteSeries, timestamp int64) []byte {
+	var series []byte
+	for _, label := range sample.labels {
+		var pair []byte
+		pair = protowire.AppendTag(pair, 1, protowire.BytesType)
+		pair = protowire.AppendString(pair, label.GetName())
+		pair = protowire.AppendTag(pair, 2, protowire.BytesType)
+		pair = protowire.AppendString(pair, label.GetValue())
+		series = otlpAppendMessage(series, 1, pair)
+	}
+	var point []byte
+	point = otlpAppendFixed64(point, 1, math.Float64bits(sample.value))
+	point = protowire.AppendTag(point, 2, protowire.VarintType)
+	point = protowire.AppendVarint(point, uint64(timestamp))
+	return otlpAppendMessage(series, 2, point)
+}
+
+// formatLabelFloat formats the bound of a bucket or a quantile as Prometheus does in label values.
+func formatLabelFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func labelPair(name, value string) *dto.LabelPair {
+	return &dto.LabelPair{Name: stringPointer(name), Value: stringPointer(value)}
+}
+
+func sortLabels(labels []*dto.LabelPair) {
+	sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+}
+
+func stringPointer(s string) *string {
+	return &s
+}
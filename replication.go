@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// replicationActions are the actions on sys/replication endpoints that change replication, which bound the values of
+// the action label. Other actions are labeled "other".
+var replicationActions = map[string]bool{
+	"enable":                   true,
+	"disable":                  true,
+	"promote":                  true,
+	"demote":                   true,
+	"secondary-token":          true,
+	"revoke-secondary":         true,
+	"update-primary":           true,
+	"recover":                  true,
+	"reindex":                  true,
+	"paths-filter":             true,
+	"mount-filter":             true,
+	"generate-public-key":      true,
+	"generate-operation-token": true,
+	"operation-token":          true,
+}
+
+// ReplicationMonitor counts the operations that change performance and disaster recovery replication of Vault
+// Enterprise, such as enabling replication, generating secondary tokens, and promoting and demoting clusters, and
+// records when each last succeeded, since these operations precede most replication incidents. Successful ones are
+// also logged.
+type ReplicationMonitor struct {
+	alerts *Alerter
+
+	counterOperations *prometheus.CounterVec
+	gagueLast         *prometheus.GaugeVec
+}
+
+// NewReplicationMonitor constructs a ReplicationMonitor. Successful replication operations are also findings for
+// alerts.
+func NewReplicationMonitor(alerts *Alerter) *ReplicationMonitor {
+	m := &ReplicationMonitor{
+		alerts: alerts,
+		counterOperations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "replication",
+			Name:      "operations_total",
+			Help:      "Number of responses to requests changing replication. Partitioned by replication type (dr or performance), cluster role (primary, secondary, or empty), action (such as enable, promote, or demote), and result (success or failure).",
+		},
+			[]string{"type", "role", "action", "result"}),
+		gagueLast: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: PromNamespace,
+			Subsystem: "replication",
+			Name:      "last_operation_timestamp_seconds",
+			Help:      "Unix time of the last successful request changing replication. Partitioned by replication type, cluster role, and action.",
+		},
+			[]string{"type", "role", "action"}),
+	}
+	// start promotion and demotion counters at zero, so that alerts on their increase fire for the first one
+	for _, typ := range []string{"dr", "performance"} {
+		m.counterOperations.WithLabelValues(typ, "secondary", "promote", "success")
+		m.counterOperations.WithLabelValues(typ, "primary", "demote", "success")
+	}
+	return m
+}
+
+func (m *ReplicationMonitor) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.counterOperations, m.gagueLast}
+}
+
+// replicationOperation returns the replication type, cluster role, and action of a request path on sys/replication.
+// Paths without a type, such as "sys/replication/primary/enable", are the legacy form of performance replication. ok is
+// false for other paths, and for paths without an action, such as status endpoints.
+func replicationOperation(path string) (typ, role, action string, ok bool) {
+	if !strings.HasPrefix(path, "sys/replication/") {
+		return "", "", "", false
+	}
+	parts := strings.Split(path[len("sys/replication/"):], "/")
+	typ = "performance"
+	if parts[0] == "dr" || parts[0] == "performance" {
+		typ, parts = parts[0], parts[1:]
+	}
+	if len(parts) > 0 && (parts[0] == "primary" || parts[0] == "secondary") {
+		role, parts = parts[0], parts[1:]
+	}
+	if len(parts) == 0 || parts[0] == "" || parts[0] == "status" {
+		return "", "", "", false
+	}
+	action = parts[0]
+	if !replicationActions[action] {
+		action = "other"
+	}
+	return typ, role, action, true
+}
+
+// Observe records a replication operation from its response. Reads, such as of the status endpoints or of path
+// filters, are ignored.
+func (m *ReplicationMonitor) Observe(auditEvent *AuditEvent) {
+	entry := auditEvent.entry
+	if entry.Type != AuditEventTypeResponse || entry.Request == nil {
+		return
+	}
+	switch entry.Request.Operation {
+	case "create", "update", "delete":
+	default:
+		return
+	}
+	typ, role, action, ok := replicationOperation(entry.Request.Path)
+	if !ok {
+		return
+	}
+	if entry.Error != "" {
+		m.counterOperations.WithLabelValues(typ, role, action, "failure").Inc()
+		return
+	}
+	m.counterOperations.WithLabelValues(typ, role, action, "success").Inc()
+	m.gagueLast.WithLabelValues(typ, role, action).Set(float64(auditEvent.time.UnixNano()) / 1e9)
+	logWarn("vault replication changed", "type", typ, "role", role, "action", action, "path", entry.Request.Path,
+		"request_id", entry.Request.ID, "remote_address", entry.Request.RemoteAddr)
+	m.alerts.Fire(Finding{
+		Kind: FindingReplication,
+		Key:  strings.TrimSpace(typ + " " + role + " " + action),
+		Summary: fmt.Sprintf("%s replication changed with %s %s%s", typ, entry.Request.Operation, entry.Request.Path,
+			fromAddress(entry.Request.RemoteAddr)),
+		Time:    auditEvent.time,
+		Details: newRequestDetails(auditEvent),
+	})
+}
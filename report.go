@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// defaultReportTop is the number of paths and entities listed in a report if unset.
+	defaultReportTop = 10
+	// reportMaxKeys bounds the number of paths and entities counted for a report, with the rest counted as reportOther.
+	reportMaxKeys = 10000
+	// reportOther stands for the paths or entities beyond reportMaxKeys.
+	reportOther = "(other)"
+	// reportLatencySamples is the size of the uniform sample of latencies percentiles are computed from.
+	reportLatencySamples = 10000
+	// reportMaxConfigChanges bounds the number of configuration changes listed in a report.
+	reportMaxConfigChanges = 1000
+	// reportTimeout bounds each upload of a report.
+	reportTimeout = 10 * time.Second
+)
+
+// Formats of reports.
+const (
+	ReportFormatJSON = "json"
+	ReportFormatHTML = "html"
+)
+
+var reportNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// Reporter periodically summarizes the audit events since the previous report of each configured report: the busiest
+// paths and entities, error rates, latency percentiles, and configuration changes. Reports are written as JSON or HTML
+// to a directory, posted to a URL, or both.
+type Reporter struct {
+	paths   *PathNormalizer
+	reports []*report
+
+	counterGenerated *prometheus.CounterVec
+	counterErrors    *prometheus.CounterVec
+}
+
+// report is a configured report along with the statistics gathered since it was last generated.
+type report struct {
+	name      string
+	schedule  *cronSchedule
+	format    string
+	directory string
+	url       string
+	top       int
+	client    *http.Client
+
+	mu    sync.Mutex
+	stats *reportStats
+}
+
+// reportStats are the statistics of the events since a report's start.
+type reportStats struct {
+	start                time.Time
+	requests             int64
+	responses            int64
+	errors               int64
+	paths                map[string]*reportPathStats
+	entities             map[string]int64
+	latencies            []float64
+	latencyCount         int64
+	latencyMax           float64
+	configChanges        []ReportConfigChange
+	configChangesOmitted int
+}
+
+type reportPathStats struct {
+	requests, responses, errors int64
+}
+
+// Report is the summary of the audit events between Start and End.
+type Report struct {
+	Name      string    `json:"name"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Requests  int64     `json:"requests"`
+	Responses int64     `json:"responses"`
+	Errors    int64     `json:"errors"`
+	// ErrorRate is the ratio of responses that are errors.
+	ErrorRate   float64        `json:"error_rate"`
+	TopPaths    []ReportPath   `json:"top_paths"`
+	TopEntities []ReportEntity `json:"top_entities"`
+	Latency     ReportLatency  `json:"latency"`
+	// ConfigChanges are the successful configuration changes, of which ConfigChangesOmitted beyond the first
+	// reportMaxConfigChanges are left out.
+	ConfigChanges        []ReportConfigChange `json:"config_changes"`
+	ConfigChangesOmitted int                  `json:"config_changes_omitted,omitempty"`
+}
+
+// ReportPath is the number of requests and errors of a normalized path.
+type ReportPath struct {
+	Path      string  `json:"path"`
+	Requests  int64   `json:"requests"`
+	Errors    int64   `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+}
+
+// ReportEntity is the number of requests of an identity entity.
+type ReportEntity struct {
+	EntityID string `json:"entity_id"`
+	Requests int64  `json:"requests"`
+}
+
+// ReportLatency are the latency percentiles in seconds of the Samples responses whose latency was measured.
+type ReportLatency struct {
+	Samples int64   `json:"samples"`
+	P50     float64 `json:"p50"`
+	P90     float64 `json:"p90"`
+	P99     float64 `json:"p99"`
+	Max     float64 `json:"max"`
+}
+
+// ReportConfigChange is a successful change of Vault's configuration.
+type ReportConfigChange struct {
+	Time      time.Time `json:"time"`
+	Kind      string    `json:"kind"`
+	Operation string    `json:"operation"`
+	Path      string    `json:"path"`
+	EntityID  string    `json:"entity_id,omitempty"`
+}
+
+// NewReporter constructs a Reporter for the configured reports, normalizing their paths with paths.
+func NewReporter(configs []ReportConfig, paths *PathNormalizer) (*Reporter, error) {
+	r := &Reporter{paths: paths}
+	names := make(map[string]bool)
+	now := time.Now()
+	for _, cfg := range configs {
+		if !reportNameRegexp.MatchString(cfg.Name) {
+			return nil, fmt.Errorf("report name %q must consist of letters, digits, '_', '.', and '-'", cfg.Name)
+		}
+		if names[cfg.Name] {
+			return nil, fmt.Errorf("report %s is configured more than once", cfg.Name)
+		}
+		names[cfg.Name] = true
+		schedule, err := parseCron(cfg.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("report %s: %v", cfg.Name, err)
+		}
+		if schedule.next(now).IsZero() {
+			return nil, fmt.Errorf("report %s: schedule %q never matches", cfg.Name, cfg.Schedule)
+		}
+		rep := &report{
+			name:      cfg.Name,
+			schedule:  schedule,
+			format:    cfg.Format,
+			directory: cfg.Directory,
+			url:       cfg.URL,
+			top:       cfg.Top,
+			client:    &http.Client{Timeout: reportTimeout},
+			stats:     newReportStats(now),
+		}
+		switch rep.format {
+		case "":
+			rep.format = ReportFormatJSON
+		case ReportFormatJSON, ReportFormatHTML:
+		default:
+			return nil, fmt.Errorf("report %s: unknown format %q", cfg.Name, cfg.Format)
+		}
+		if rep.directory == "" && rep.url == "" {
+			return nil, fmt.Errorf("report %s: a directory or url is required", cfg.Name)
+		}
+		if rep.top == 0 {
+			rep.top = defaultReportTop
+		}
+		if rep.top < 0 {
+			return nil, fmt.Errorf("report %s: top must not be negative", cfg.Name)
+		}
+		r.reports = append(r.reports, rep)
+	}
+
+	r.counterGenerated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "reports",
+		Name:      "generated_total",
+		Help:      "Number of reports generated and delivered. Partitioned by report.",
+	},
+		[]string{"report"})
+	r.counterErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "reports",
+		Name:      "errors_total",
+		Help:      "Number of reports that could not be written or posted. Partitioned by report.",
+	},
+		[]string{"report"})
+	return r, nil
+}
+
+func (r *Reporter) collectors() []prometheus.Collector {
+	return []prometheus.Collector{r.counterGenerated, r.counterErrors}
+}
+
+func newReportStats(start time.Time) *reportStats {
+	return &reportStats{
+		start:    start,
+		paths:    make(map[string]*reportPathStats),
+		entities: make(map[string]int64),
+	}
+}
+
+// Observe adds an audit event to the statistics of every report.
+func (r *Reporter) Observe(auditEvent *AuditEvent) {
+	entry := auditEvent.entry
+	if entry.Request == nil {
+		return
+	}
+	path := r.paths.Normalize(entry.Request.Path)
+	var entity string
+	if entry.Auth != nil {
+		entity = entry.Auth.EntityID
+	}
+	var change *ReportConfigChange
+	if entry.Type == AuditEventTypeResponse && entry.Error == "" {
+		if kind := configChangeKind(entry.Request.Operation, entry.Request.Path); kind != "" {
+			change = &ReportConfigChange{
+				Time:      auditEvent.time,
+				Kind:      kind,
+				Operation: entry.Request.Operation,
+				Path:      entry.Request.Path,
+				EntityID:  entity,
+			}
+		}
+	}
+
+	for _, rep := range r.reports {
+		rep.mu.Lock()
+		s := rep.stats
+		switch entry.Type {
+		case AuditEventTypeRequest:
+			s.requests++
+			s.path(path).requests++
+			if entity != "" {
+				if _, found := s.entities[entity]; !found && len(s.entities) >= reportMaxKeys {
+					s.entities[reportOther]++
+				} else {
+					s.entities[entity]++
+				}
+			}
+		case AuditEventTypeResponse:
+			s.responses++
+			stats := s.path(path)
+			stats.responses++
+			if entry.Error != "" {
+				s.errors++
+				stats.errors++
+			}
+			if change != nil {
+				if len(s.configChanges) < reportMaxConfigChanges {
+					s.configChanges = append(s.configChanges, *change)
+				} else {
+					s.configChangesOmitted++
+				}
+			}
+		}
+		rep.mu.Unlock()
+	}
+}
+
+// path returns the statistics of a normalized path, which are those of reportOther once reportMaxKeys paths are
+// counted.
+func (s *reportStats) path(path string) *reportPathStats {
+	stats := s.paths[path]
+	if stats == nil {
+		if len(s.paths) >= reportMaxKeys {
+			path = reportOther
+			if stats = s.paths[path]; stats != nil {
+				return stats
+			}
+		}
+		stats = new(reportPathStats)
+		s.paths[path] = stats
+	}
+	return stats
+}
+
+// ObserveLatency adds the latency of a response to the statistics of every report, keeping a uniform sample of
+// latencies by reservoir sampling.
+func (r *Reporter) ObserveLatency(latency time.Duration) {
+	seconds := latency.Seconds()
+	for _, rep := range r.reports {
+		rep.mu.Lock()
+		s := rep.stats
+		s.latencyCount++
+		if seconds > s.latencyMax {
+			s.latencyMax = seconds
+		}
+		if len(s.latencies) < reportLatencySamples {
+			s.latencies = append(s.latencies, seconds)
+		} else if i := rand.Int63n(s.latencyCount); i < reportLatencySamples {
+			s.latencies[i] = seconds
+		}
+		rep.mu.Unlock()
+	}
+}
+
+// Run generates each report on its schedule in the background.
+func (r *Reporter) Run() {
+	for _, rep := range r.reports {
+		go r.run(rep)
+	}
+}
+
+func (r *Reporter) run(rep *report) {
+	for {
+		next := rep.schedule.next(time.Now())
+		if next.IsZero() {
+			logError("report schedule no longer matches", "report", rep.name)
+			return
+		}
+		time.Sleep(time.Until(next))
+		if err := r.generate(rep, next); err != nil {
+			logError("error generating report", "report", rep.name, "error", err)
+			r.counterErrors.WithLabelValues(rep.name).Inc()
+			continue
+		}
+		r.counterGenerated.WithLabelValues(rep.name).Inc()
+	}
+}
+
+// generate summarizes the statistics gathered since the previous report up to end, starting over, and delivers the
+// report.
+func (r *Reporter) generate(rep *report, end time.Time) error {
+	rep.mu.Lock()
+	stats := rep.stats
+	rep.stats = newReportStats(end)
+	rep.mu.Unlock()
+
+	body, err := stats.report(rep.name, end, rep.top).render(rep.format)
+	if err != nil {
+		return err
+	}
+	if rep.directory != "" {
+		name := fmt.Sprintf("%s-%s.%s", rep.name, end.UTC().Format("20060102T150405Z"), rep.format)
+		if err := ioutil.WriteFile(filepath.Join(rep.directory, name), body, 0o644); err != nil {
+			return err
+		}
+	}
+	if rep.url != "" {
+		contentType := "application/json"
+		if rep.format == ReportFormatHTML {
+			contentType = "text/html; charset=utf-8"
+		}
+		resp, err := rep.client.Post(rep.url, contentType, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("unexpected status: %s", resp.Status)
+		}
+	}
+	logInfo("report generated", "report", rep.name, "start", stats.start, "end", end)
+	return nil
+}
+
+// report summarizes the statistics into a Report listing the top paths and entities.
+func (s *reportStats) report(name string, end time.Time, top int) *Report {
+	report := &Report{
+		Name:                 name,
+		Start:                s.start,
+		End:                  end,
+		Requests:             s.requests,
+		Responses:            s.responses,
+		Errors:               s.errors,
+		ErrorRate:            reportRatio(s.errors, s.responses),
+		TopPaths:             []ReportPath{},
+		TopEntities:          []ReportEntity{},
+		ConfigChanges:        s.configChanges,
+		ConfigChangesOmitted: s.configChangesOmitted,
+	}
+	if report.ConfigChanges == nil {
+		report.ConfigChanges = []ReportConfigChange{}
+	}
+
+	for path, stats := range s.paths {
+		report.TopPaths = append(report.TopPaths, ReportPath{
+			Path:      path,
+			Requests:  stats.requests,
+			Errors:    stats.errors,
+			ErrorRate: reportRatio(stats.errors, stats.responses),
+		})
+	}
+	sort.Slice(report.TopPaths, func(i, j int) bool {
+		a, b := report.TopPaths[i], report.TopPaths[j]
+		return a.Requests > b.Requests || a.Requests == b.Requests && a.Path < b.Path
+	})
+	if len(report.TopPaths) > top {
+		report.TopPaths = report.TopPaths[:top]
+	}
+
+	for entity, requests := range s.entities {
+		report.TopEntities = append(report.TopEntities, ReportEntity{EntityID: entity, Requests: requests})
+	}
+	sort.Slice(report.TopEntities, func(i, j int) bool {
+		a, b := report.TopEntities[i], report.TopEntities[j]
+		return a.Requests > b.Requests || a.Requests == b.Requests && a.EntityID < b.EntityID
+	})
+	if len(report.TopEntities) > top {
+		report.TopEntities = report.TopEntities[:top]
+	}
+
+	report.Latency.Samples = s.latencyCount
+	report.Latency.Max = s.latencyMax
+	if len(s.latencies) > 0 {
+		sort.Float64s(s.latencies)
+		percentile := func(p float64) float64 {
+			return s.latencies[int(p*float64(len(s.latencies)-1)+0.5)]
+		}
+		report.Latency.P50 = percentile(0.5)
+		report.Latency.P90 = percentile(0.9)
+		report.Latency.P99 = percentile(0.99)
+	}
+	return report
+}
+
+// reportRatio returns n/d, or 0 if d is 0.
+func reportRatio(n, d int64) float64 {
+	if d == 0 {
+		return 0
+	}
+	return float64(n) / float64(d)
+}
+
+// render encodes a report in a format.
+func (report *Report) render(format string) ([]byte, error) {
+	if format == ReportFormatHTML {
+		var buf bytes.Buffer
+		if err := reportTemplate.Execute(&buf, report); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return json.MarshalIndent(report, "", "  ")
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"percent": func(f float64) string { return fmt.Sprintf("%.2f%%", f*100) },
+	"seconds": func(f float64) string { return fmt.Sprintf("%.3fs", f) },
+	"time":    func(t time.Time) string { return t.UTC().Format(time.RFC3339) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Vault audit report {{.Name}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+td.n { text-align: right; }
+</style>
+</head>
+<body>
+<h1>Vault audit report {{.Name}}</h1>
+<p>{{time .Start}} to {{time .End}}</p>
+<h2>Summary</h2>
+<table>
+<tr><th>Requests</th><td class="n">{{.Requests}}</td></tr>
+<tr><th>Responses</th><td class="n">{{.Responses}}</td></tr>
+<tr><th>Errors</th><td class="n">{{.Errors}}</td></tr>
+<tr><th>Error rate</th><td class="n">{{percent .ErrorRate}}</td></tr>
+</table>
+<h2>Latency</h2>
+<table>
+<tr><th>Samples</th><th>p50</th><th>p90</th><th>p99</th><th>Max</th></tr>
+<tr><td class="n">{{.Latency.Samples}}</td><td class="n">{{seconds .Latency.P50}}</td><td class="n">{{seconds .Latency.P90}}</td><td class="n">{{seconds .Latency.P99}}</td><td class="n">{{seconds .Latency.Max}}</td></tr>
+</table>
+<h2>Top paths</h2>
+<table>
+<tr><th>Path</th><th>Requests</th><th>Errors</th><th>Error rate</th></tr>
+{{range .TopPaths}}<tr><td>{{.Path}}</td><td class="n">{{.Requests}}</td><td class="n">{{.Errors}}</td><td class="n">{{percent .ErrorRate}}</td></tr>
+{{end}}</table>
+<h2>Top entities</h2>
+<table>
+<tr><th>Entity</th><th>Requests</th></tr>
+{{range .TopEntities}}<tr><td>{{.EntityID}}</td><td class="n">{{.Requests}}</td></tr>
+{{end}}</table>
+<h2>Configuration changes</h2>
+<table>
+<tr><th>Time</th><th>Kind</th><th>Operation</th><th>Path</th><th>Entity</th></tr>
+{{range .ConfigChanges}}<tr><td>{{time .Time}}</td><td>{{.Kind}}</td><td>{{.Operation}}</td><td>{{.Path}}</td><td>{{.EntityID}}</td></tr>
+{{end}}</table>
+{{if .ConfigChangesOmitted}}<p>{{.ConfigChangesOmitted}} more configuration changes omitted.</p>
+{{end}}</body>
+</html>
+`))
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RootTokenMonitor counts requests made with root tokens, which should be rare outside of break-glass procedures, and
+// optionally posts each of them to a webhook so that they can be paged on.
+type RootTokenMonitor struct {
+	paths   *PathNormalizer
+	webhook *Webhook
+	alerts  *Alerter
+
+	counterRequests      *prometheus.CounterVec
+	counterWebhookErrors prometheus.Counter
+}
+
+// rootTokenEvent is the body posted to the root token webhook.
+type rootTokenEvent struct {
+	RequestID     string    `json:"request_id"`
+	Operation     string    `json:"operation"`
+	Path          string    `json:"path"`
+	RemoteAddress string    `json:"remote_address,omitempty"`
+	Time          time.Time `json:"time"`
+}
+
+// NewRootTokenMonitor constructs a RootTokenMonitor labeling requests with paths normalized by paths. If webhook is not
+// empty, every root token request is posted to it. Root token requests are also findings for alerts.
+func NewRootTokenMonitor(paths *PathNormalizer, webhook string, alerts *Alerter) *RootTokenMonitor {
+	m := &RootTokenMonitor{
+		paths:  paths,
+		alerts: alerts,
+		counterRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "security",
+			Name:      "root_token_requests_total",
+			Help:      "Number of Vault requests made with a token carrying the root policy. Partitioned by path and operation.",
+		},
+			[]string{"path", "operation"}),
+		counterWebhookErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "security",
+			Name:      "root_token_webhook_errors_total",
+			Help:      "Number of failed calls of -root-token-webhook.",
+		}),
+	}
+	if webhook != "" {
+		m.webhook = NewWebhook("root-token-webhook", webhook, m.counterWebhookErrors.Inc)
+	}
+	return m
+}
+
+func (m *RootTokenMonitor) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.counterRequests, m.counterWebhookErrors}
+}
+
+// Observe records a request if it was made with a root token. The webhook receives the request's own path, rather than
+// the normalized path of the label.
+func (m *RootTokenMonitor) Observe(auditEvent *AuditEvent) {
+	request := auditEvent.entry.Request
+	if auditEvent.entry.Type != AuditEventTypeRequest || request == nil || auditEvent.TokenType() != "root" {
+		return
+	}
+	m.counterRequests.WithLabelValues(m.paths.Normalize(request.Path), request.Operation).Inc()
+	logWarn("root token used", "request_id", request.ID, "operation", request.Operation, "path", request.Path,
+		"remote_address", request.RemoteAddr)
+	event := rootTokenEvent{
+		RequestID:     request.ID,
+		Operation:     request.Operation,
+		Path:          request.Path,
+		RemoteAddress: request.RemoteAddr,
+		Time:          auditEvent.time,
+	}
+	m.webhook.Notify(event)
+	m.alerts.Fire(Finding{
+		Kind:    FindingRootToken,
+		Key:     request.RemoteAddr,
+		Summary: fmt.Sprintf("root token used to %s %s%s", request.Operation, request.Path, fromAddress(request.RemoteAddr)),
+		Time:    auditEvent.time,
+		Details: event,
+	})
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ruleAggregationLabels are the labels recording rules aggregate by, where the metric family has them.
+var ruleAggregationLabels = []string{"path_group", "route", "mount_path", "operation"}
+
+// sloBurnRateShortWindow is the ratio of the long to the short window of multi-window burn rate alerts.
+const sloBurnRateShortWindow = 12
+
+// ruleFile is a Prometheus rule file.
+type ruleFile struct {
+	Groups []ruleGroup `yaml:"groups"`
+}
+
+type ruleGroup struct {
+	Name  string `yaml:"name"`
+	Rules []rule `yaml:"rules"`
+}
+
+// rule is a recording rule, if Record is set, or an alerting rule.
+type rule struct {
+	Record      string            `yaml:"record,omitempty"`
+	Alert       string            `yaml:"alert,omitempty"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// rulesGenerate prints Prometheus recording and alerting rules for the metrics of the exporter configured by cfg, so
+// that rules follow the labels and features a site has configured. It returns the process exit code.
+func rulesGenerate(cfg *Config) int {
+	p, err := NewAuditProcessor(cfg)
+	if err != nil {
+		logError("error creating audit processor", "error", err)
+		return 1
+	}
+	out, err := yaml.Marshal(p.rules(cfg))
+	if err != nil {
+		logError("error encoding rules", "error", err)
+		return 1
+	}
+	if _, err := os.Stdout.Write(out); err != nil {
+		logError("error writing rules", "error", err)
+		return 1
+	}
+	return 0
+}
+
+// rules returns the recording and alerting rules for the metrics of the processor.
+func (p *AuditProcessor) rules(cfg *Config) *ruleFile {
+	return &ruleFile{Groups: []ruleGroup{
+		{Name: "vault-audit-metrics.rules", Rules: p.recordingRules()},
+		{Name: "vault-audit-metrics.alerts", Rules: p.alertingRules(cfg)},
+	}}
+}
+
+// metricName returns the full name of a metric.
+func metricName(subsystem, name string) string {
+	return PromNamespace + "_" + subsystem + "_" + name
+}
+
+// sumBy returns a sum aggregation of expr by labels.
+func sumBy(labels []string, expr string) string {
+	if len(labels) == 0 {
+		return fmt.Sprintf("sum(%s)", expr)
+	}
+	return fmt.Sprintf("sum by (%s) (%s)", strings.Join(labels, ", "), expr)
+}
+
+// aggregationLabels returns the labels of ruleAggregationLabels among those of a metric family.
+func aggregationLabels(familyLabels []string) []string {
+	var labels []string
+	for _, label := range ruleAggregationLabels {
+		if containsLabel(familyLabels, label) {
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+// errorSelector returns the label matcher selecting failed responses with the labels of a metric family, or "" if it
+// has none telling them apart.
+func errorSelector(familyLabels []string) string {
+	switch {
+	case containsLabel(familyLabels, "code_class"):
+		return fmt.Sprintf(`code_class!="%s"`, CodeClassSuccess)
+	case containsLabel(familyLabels, "error_class"):
+		return fmt.Sprintf(`error_class!="%s"`, ErrorClassNone)
+	case containsLabel(familyLabels, "error"):
+		return `error!=""`
+	}
+	return ""
+}
+
+// recordingRules returns rules recording request, response, and error rates, and latency percentiles, aggregated by
+// the configured labels.
+func (p *AuditProcessor) recordingRules() []rule {
+	requests := metricName("events", MetricFamilyRequests)
+	responses := metricName("events", MetricFamilyResponses)
+	latency := metricName("events", MetricFamilyLatency)
+	requestLabels := aggregationLabels(p.requestLabels)
+	responseLabels := aggregationLabels(p.responseLabels)
+	latencyLabels := aggregationLabels(p.latencyLabels)
+
+	rules := []rule{
+		{Record: "vaultaudit:requests:rate5m", Expr: sumBy(requestLabels, fmt.Sprintf("rate(%s[5m])", requests))},
+		{Record: "vaultaudit:responses:rate5m", Expr: sumBy(responseLabels, fmt.Sprintf("rate(%s[5m])", responses))},
+	}
+	if selector := errorSelector(p.responseLabels); selector != "" {
+		rules = append(rules, rule{
+			Record: "vaultaudit:response_errors:rate5m",
+			Expr:   sumBy(responseLabels, fmt.Sprintf("rate(%s{%s}[5m])", responses, selector)),
+		})
+	}
+	for _, quantile := range []struct {
+		name  string
+		value float64
+	}{{"p50", 0.5}, {"p90", 0.9}, {"p99", 0.99}} {
+		rules = append(rules, rule{
+			Record: fmt.Sprintf("vaultaudit:response_duration_seconds:%s_5m", quantile.name),
+			Expr: fmt.Sprintf("histogram_quantile(%g, %s)", quantile.value,
+				sumBy(append([]string{"le"}, latencyLabels...), fmt.Sprintf("rate(%s_bucket[5m])", latency))),
+		})
+	}
+	return rules
+}
+
+// alertingRules returns rules alerting on the health of the exporter, security findings, and SLO burn rates, for the
+// features that are configured.
+func (p *AuditProcessor) alertingRules(cfg *Config) []rule {
+	var rules []rule
+	add := func(name, severity, expr, duration, summary string) {
+		rules = append(rules, rule{
+			Alert:       name,
+			Expr:        expr,
+			For:         duration,
+			Labels:      map[string]string{"severity": severity},
+			Annotations: map[string]string{"summary": summary},
+		})
+	}
+
+	responses := metricName("events", MetricFamilyResponses)
+	if containsLabel(p.responseLabels, "code_class") {
+		labels := aggregationLabels(p.responseLabels)
+		add("VaultAuditHighServerErrorRatio", "warning",
+			fmt.Sprintf("%s\n/\n%s\n> 0.05",
+				sumBy(labels, fmt.Sprintf(`rate(%s{code_class="%s"}[5m])`, responses, CodeClassServerError)),
+				sumBy(labels, fmt.Sprintf("rate(%s[5m])", responses))),
+			"10m", "More than 5% of Vault responses are server errors.")
+	}
+	add("VaultAuditEventsDropped", "warning",
+		fmt.Sprintf(`sum by (reason) (rate(%s{reason=~"queue_full|memory"}[5m])) > 0`,
+			metricName("pipeline", "events_dropped_total")),
+		"5m", "The exporter is dropping audit events ({{ $labels.reason }}).")
+	if p.parseErrors != nil {
+		add("VaultAuditParseErrors", "warning", metricName("pipeline", "parse_errors_degraded")+" == 1", "5m",
+			"Too many audit log lines fail to parse.")
+	}
+	if p.sources != nil {
+		add("VaultAuditSourceDown", "critical", PromNamespace+"_audit_source_down == 1", "",
+			"Audit device {{ $labels.source }} stopped sending events, which can block Vault requests.")
+	}
+
+	add("VaultRootTokenUsed", "critical",
+		sumBy([]string{"path", "operation"}, fmt.Sprintf("increase(%s[5m])",
+			metricName("security", "root_token_requests_total")))+" > 0",
+		"", "A root token was used to {{ $labels.operation }} {{ $labels.path }}.")
+	operationalEvents := metricName("security", "operational_events_total")
+	add("VaultSealOrRootGeneration", "critical",
+		fmt.Sprintf(`sum by (event) (increase(%s{event=~"%s|%s"}[5m])) > 0`, operationalEvents,
+			OperationalEventSeal, OperationalEventGenerateRoot),
+		"", "Vault {{ $labels.event }} was requested.")
+	add("VaultOperationalEvent", "info",
+		fmt.Sprintf(`sum by (event) (increase(%s{event=~"%s|%s"}[5m])) > 0`, operationalEvents,
+			OperationalEventUnseal, OperationalEventStepDown),
+		"", "Vault {{ $labels.event }} was requested.")
+	add("VaultReplicationPromotedOrDemoted", "critical",
+		fmt.Sprintf(`sum by (type, action) (increase(%s{action=~"promote|demote",result="success"}[5m])) > 0`,
+			metricName("replication", "operations_total")),
+		"", "A {{ $labels.type }} replication cluster was {{ $labels.action }}d.")
+	add("VaultAuditDeviceChanged", "warning",
+		fmt.Sprintf(`sum by (operation) (increase(%s{kind="audit"}[5m])) > 0`,
+			metricName("security", "config_changes_total")),
+		"", "An audit device was changed ({{ $labels.operation }}).")
+	if p.logins.threshold > 0 {
+		add("VaultBruteForceLogin", "warning",
+			sumBy([]string{"mount"}, fmt.Sprintf("increase(%s[5m])",
+				metricName("security", "brute_force_detections_total")))+" > 0",
+			"", "Possible brute force login attempt against {{ $labels.mount }}.")
+	}
+	if len(cfg.Watchlist) > 0 {
+		add("VaultWatchlistAccess", "warning",
+			sumBy([]string{"watch", "operation", "entity"}, fmt.Sprintf("increase(%s[5m])",
+				metricName("security", "watchlist_access_total")))+" > 0",
+			"", "Watchlist {{ $labels.watch }} was accessed ({{ $labels.operation }}) by entity {{ $labels.entity }}.")
+	}
+	if p.credentials != nil {
+		add("VaultWatchedCredentialUsed", "critical",
+			sumBy([]string{"credential", "usage"}, fmt.Sprintf("increase(%s[5m])",
+				metricName("security", "credential_watchlist_hits_total")))+" > 0",
+			"", "Watched credential {{ $labels.credential }} appeared in the audit log ({{ $labels.usage }}).")
+	}
+	add("VaultWrappingTokensExpired", "warning",
+		fmt.Sprintf("increase(%s[15m]) > 0", metricName("wrapping", "tokens_expired_total")),
+		"", "Wrapping tokens expired without being unwrapped, a possible sign of interception.")
+	if p.schedules != nil {
+		add("VaultOutOfScheduleAccess", "warning",
+			sumBy([]string{"schedule"}, fmt.Sprintf("increase(%s[5m])",
+				metricName("security", "out_of_schedule_requests_total")))+" > 0",
+			"", "Requests outside the windows of access schedule {{ $labels.schedule }}.")
+	}
+	add("VaultKVSecretsDestroyed", "warning",
+		fmt.Sprintf(`sum by (mount) (increase(%s{operation=~"destroy|metadata_delete",result="success"}[5m])) > 0`,
+			metricName("kv", "lifecycle_operations_total")),
+		"", "KV v2 secret versions or metadata were permanently deleted from {{ $labels.mount }}.")
+	if p.anomalies != nil {
+		add("VaultAuditAnomaly", "warning",
+			fmt.Sprintf("abs(%s) >= %g", metricName("anomaly", "score"), p.anomalies.threshold),
+			"", "The {{ $labels.signal }} rate of {{ $labels.path_group }} deviates from its baseline.")
+	}
+	if p.slos != nil {
+		for _, s := range p.slos.slos {
+			rules = append(rules, sloBurnRateRules(s)...)
+		}
+	}
+	return rules
+}
+
+// burnRateThreshold returns the burn rate alerted on over a window, following the multi-window, multi-burn-rate alerts
+// of the Google SRE workbook: spending 2% of a 30 day budget within 1h, 5% within 6h, or 10% within 3d.
+func burnRateThreshold(window time.Duration) (threshold float64, severity string) {
+	switch {
+	case window <= time.Hour:
+		return 14.4, "critical"
+	case window <= 6*time.Hour:
+		return 6, "warning"
+	}
+	return 1, "warning"
+}
+
+// sloBurnRateRules returns the burn rate alerts of an SLO. Each window with a window a twelfth as long alerts when both
+// burn too fast, so that alerts fire quickly and resolve once the burn stops. Other windows of at least an hour alert
+// on their own.
+func sloBurnRateRules(s *slo) []rule {
+	windows := append([]time.Duration(nil), s.windows...)
+	sort.Slice(windows, func(i, j int) bool { return windows[i] < windows[j] })
+	configured := make(map[time.Duration]bool)
+	for _, window := range windows {
+		configured[window] = true
+	}
+	paired := make(map[time.Duration]bool)
+	for _, window := range windows {
+		if short := window / sloBurnRateShortWindow; window%sloBurnRateShortWindow == 0 && configured[short] {
+			paired[window], paired[short] = true, true
+		}
+	}
+
+	burnRate := metricName("slo", "burn_rate")
+	selector := func(window time.Duration) string {
+		return fmt.Sprintf(`%s{slo="%s",window="%s"}`, burnRate, s.name, formatWindow(window))
+	}
+	var rules []rule
+	for _, window := range windows {
+		short := window / sloBurnRateShortWindow
+		threshold, severity := burnRateThreshold(window)
+		var expr, duration string
+		switch {
+		case window%sloBurnRateShortWindow == 0 && configured[short]:
+			expr = fmt.Sprintf("%s > %g\nand ignoring (window)\n%s > %g", selector(window), threshold, selector(short),
+				threshold)
+		case !paired[window] && window >= time.Hour:
+			expr = fmt.Sprintf("%s > %g", selector(window), threshold)
+			duration = formatWindow(short)
+		default:
+			continue
+		}
+		rules = append(rules, rule{
+			Alert:  "VaultSLOBurnRate",
+			Expr:   expr,
+			For:    duration,
+			Labels: map[string]string{"severity": severity, "slo": s.name, "window": formatWindow(window)},
+			Annotations: map[string]string{"summary": fmt.Sprintf("SLO %s is burning its error budget %gx too fast over %s.",
+				s.name, threshold, formatWindow(window))},
+		})
+	}
+	return rules
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// s3Service is the service name requests to S3 are signed for.
+	s3Service = "s3"
+	// awsTimeFormat is the format of the timestamps of signed requests.
+	awsTimeFormat = "20060102T150405Z"
+	// defaultEC2MetadataEndpoint is the instance metadata service of EC2, which AWS_EC2_METADATA_SERVICE_ENDPOINT
+	// overrides.
+	defaultEC2MetadataEndpoint = "http://169.254.169.254"
+	// ecsCredentialsEndpoint is the credentials endpoint of ECS tasks, which AWS_CONTAINER_CREDENTIALS_RELATIVE_URI is
+	// relative to.
+	ecsCredentialsEndpoint = "http://169.254.170.2"
+)
+
+// s3Sink archives audit events to Amazon S3 or an S3-compatible object store, as gzip-compressed objects of their
+// audit log lines, one per line. Every batch becomes an object per hour of its events' timestamps, under keys
+// partitioned like "dt=2006-01-02/hour=15/", so that query engines such as Athena can prune partitions by time. Object
+// keys are derived from the object's contents, so that a batch sent again after a failure overwrites the objects it
+// wrote before rather than duplicating them. Requests are signed with AWS Signature Version 4, with the credentials of
+// the environment, the ECS task role, or the EC2 instance profile.
+type s3Sink struct {
+	// endpoint is the scheme and host of the bucket's URL, and bucketPath the path of the bucket, if any.
+	endpoint    string
+	host        string
+	bucketPath  string
+	region      string
+	prefix      string
+	hostname    string
+	headers     map[string]string
+	client      *http.Client
+	credentials *awsCredentialSource
+}
+
+func newS3Sink(cfg EventSinkConfig) (*s3Sink, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("bucket is required")
+	}
+	if len(cfg.Labels) > 0 {
+		return nil, fmt.Errorf("labels are not supported, since objects hold lines only")
+	}
+	s := &s3Sink{
+		region:      cfg.Region,
+		prefix:      cfg.Prefix,
+		headers:     make(map[string]string),
+		client:      &http.Client{Timeout: sinkTimeout},
+		credentials: &awsCredentialSource{client: &http.Client{Timeout: sinkTimeout}},
+	}
+	if s.region == "" {
+		s.region = os.Getenv("AWS_REGION")
+	}
+	if s.region == "" {
+		s.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if s.region == "" {
+		return nil, fmt.Errorf("region is required")
+	}
+	if cfg.URL == "" {
+		// virtual-hosted-style requests, which S3 requires for new buckets
+		s.host = cfg.Bucket + ".s3." + s.region + ".amazonaws.com"
+		s.endpoint = "https://" + s.host
+	} else {
+		// path-style requests, which S3-compatible stores such as MinIO support regardless of DNS
+		base, err := url.Parse(strings.TrimSuffix(cfg.URL, "/"))
+		if err != nil || (base.Scheme != "http" && base.Scheme != "https") {
+			return nil, fmt.Errorf("an http or https url is required")
+		}
+		s.host = base.Host
+		s.endpoint = base.Scheme + "://" + base.Host
+		s.bucketPath = base.Path + "/" + cfg.Bucket
+	}
+	if s.prefix != "" && !strings.HasSuffix(s.prefix, "/") {
+		s.prefix += "/"
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		s.hostname = hostname
+	}
+	if cfg.StorageClass != "" {
+		s.headers["x-amz-storage-class"] = cfg.StorageClass
+	}
+	if cfg.KMSKeyID != "" {
+		s.headers["x-amz-server-side-encryption"] = "aws:kms"
+		s.headers["x-amz-server-side-encryption-aws-kms-key-id"] = cfg.KMSKeyID
+	}
+	return s, nil
+}
+
+func (s *s3Sink) send(events []*forwardedEvent) error {
+	// events are partitioned by the hour of their timestamps rather than the time they are sent, so that late events
+	// are found where they belong
+	partitions := make(map[string][]*forwardedEvent)
+	var names []string
+	for _, event := range events {
+		name := event.time.UTC().Format("dt=2006-01-02/hour=15/")
+		if partitions[name] == nil {
+			names = append(names, name)
+		}
+		partitions[name] = append(partitions[name], event)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := s.putObject(name, partitions[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putObject writes the lines of events as an object in the partition with the key prefix partition.
+func (s *s3Sink) putObject(partition string, events []*forwardedEvent) error {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	for _, event := range events {
+		if _, err := gz.Write(bytes.TrimSpace(event.line)); err != nil {
+			return err
+		}
+		if _, err := gz.Write([]byte{'\n'}); err != nil {
+			return err
+		}
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	body := buf.Bytes()
+	digest := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(digest[:])
+	key := fmt.Sprintf("%s%s%s-%s-%s.json.gz", s.prefix, partition, s.hostname,
+		events[0].time.UTC().Format(awsTimeFormat), payloadHash[:16])
+	path := s.bucketPath + "/" + key
+
+	credentials, err := s.credentials.get()
+	if err != nil {
+		return fmt.Errorf("error obtaining credentials: %v", err)
+	}
+	// buckets with Object Lock require a checksum of the contents
+	checksum := md5.Sum(body)
+	headers := map[string]string{
+		"Content-MD5":          base64.StdEncoding.EncodeToString(checksum[:]),
+		"X-Amz-Content-Sha256": payloadHash,
+	}
+	for name, value := range s.headers {
+		headers[name] = value
+	}
+	s.sign(http.MethodPut, path, headers, payloadHash, credentials, time.Now())
+	_, err = sendSink(s.client, http.MethodPut, s.endpoint+awsURIEncode(path), "application/gzip", headers, body, false)
+	return err
+}
+
+// sign adds the headers of AWS Signature Version 4 to the headers of a request without a query string, signing all of
+// them along with the host.
+func (s *s3Sink) sign(method, path string, headers map[string]string, payloadHash string, credentials *awsCredentials,
+	now time.Time) {
+	timestamp := now.UTC().Format(awsTimeFormat)
+	headers["X-Amz-Date"] = timestamp
+	if credentials.Token != "" {
+		headers["X-Amz-Security-Token"] = credentials.Token
+	}
+	request, signedHeaders := s.canonicalRequest(method, path, headers, payloadHash)
+	scope := timestamp[:8] + "/" + s.region + "/" + s3Service + "/aws4_request"
+	key := []byte("AWS4" + credentials.SecretAccessKey)
+	for _, part := range []string{timestamp[:8], s.region, s3Service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hmacSHA256(key, awsStringToSign(timestamp, scope, request))
+	headers["Authorization"] = fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		credentials.AccessKeyID, scope, signedHeaders, hex.EncodeToString(signature))
+}
+
+// canonicalRequest returns the canonical request of AWS Signature Version 4 for a request without a query string, along
+// with the names of its signed headers, which are all of headers and the host.
+func (s *s3Sink) canonicalRequest(method, path string, headers map[string]string, payloadHash string) (string, string) {
+	canonical := map[string]string{"host": s.host}
+	for name, value := range headers {
+		canonical[strings.ToLower(name)] = strings.TrimSpace(value)
+	}
+	names := make([]string, 0, len(canonical))
+	for name := range canonical {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var request strings.Builder
+	request.WriteString(method + "\n" + awsURIEncode(path) + "\n\n")
+	for _, name := range names {
+		request.WriteString(name + ":" + canonical[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	request.WriteString("\n" + signedHeaders + "\n" + payloadHash)
+	return request.String(), signedHeaders
+}
+
+// awsStringToSign returns the string that AWS Signature Version 4 signs for a canonical request made at timestamp,
+// within the credential scope.
+func awsStringToSign(timestamp, scope, canonicalRequest string) string {
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	return "AWS4-HMAC-SHA256\n" + timestamp + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsURIEncode percent-encodes a path as AWS Signature Version 4 requires, leaving only unreserved characters and
+// slashes as they are.
+func awsURIEncode(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// awsCredentials are the credentials that requests to AWS are signed with, as the ECS and EC2 credentials endpoints
+// return them.
+type awsCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+// awsCredentialSource obtains AWS credentials from the environment variables AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY,
+// and AWS_SESSION_TOKEN, or else from the credentials endpoint of ECS tasks, which EKS Pod Identity provides too, or
+// else from the instance metadata service of EC2. Temporary credentials are cached until shortly before they expire.
+type awsCredentialSource struct {
+	client *http.Client
+	cached *awsCredentials
+}
+
+// get returns credentials, obtaining new ones if the cached ones expire within five minutes.
+func (s *awsCredentialSource) get() (*awsCredentials, error) {
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return &awsCredentials{AccessKeyID: id, SecretAccessKey: secret, Token: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	if s.cached != nil && time.Until(s.cached.Expiration) > 5*time.Minute {
+		return s.cached, nil
+	}
+	var body []byte
+	var err error
+	if endpoint := s.containerEndpoint(); endpoint != "" {
+		headers := make(map[string]string)
+		token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+		if path := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); path != "" {
+			var data []byte
+			if data, err = ioutil.ReadFile(path); err != nil {
+				return nil, err
+			}
+			token = strings.TrimSpace(string(data))
+		}
+		if token != "" {
+			headers["Authorization"] = token
+		}
+		body, err = s.do(http.MethodGet, endpoint, headers)
+	} else {
+		body, err = s.instanceCredentials()
+	}
+	if err != nil {
+		return nil, err
+	}
+	credentials := new(awsCredentials)
+	if err := json.Unmarshal(body, credentials); err != nil {
+		return nil, err
+	}
+	if credentials.AccessKeyID == "" || credentials.SecretAccessKey == "" {
+		return nil, fmt.Errorf("no credentials in response")
+	}
+	s.cached = credentials
+	return credentials, nil
+}
+
+// containerEndpoint returns the credentials endpoint of the ECS task or EKS pod, or an empty string outside of them.
+func (s *awsCredentialSource) containerEndpoint() string {
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		return ecsCredentialsEndpoint + uri
+	}
+	return os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+}
+
+// instanceCredentials returns the credentials of the instance profile's role from the instance metadata service of
+// EC2, with a session token of IMDSv2.
+func (s *awsCredentialSource) instanceCredentials() ([]byte, error) {
+	endpoint := os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT")
+	if endpoint == "" {
+		endpoint = defaultEC2MetadataEndpoint
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	token, err := s.do(http.MethodPut, endpoint+"/latest/api/token",
+		map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "21600"})
+	if err != nil {
+		return nil, err
+	}
+	headers := map[string]string{"X-aws-ec2-metadata-token": string(token)}
+	role, err := s.do(http.MethodGet, endpoint+"/latest/meta-data/iam/security-credentials/", headers)
+	if err != nil {
+		return nil, err
+	}
+	// the first line is the name of the role
+	name := strings.TrimSpace(strings.SplitN(string(role), "\n", 2)[0])
+	if name == "" {
+		return nil, fmt.Errorf("the instance has no instance profile")
+	}
+	return s.do(http.MethodGet, endpoint+"/latest/meta-data/iam/security-credentials/"+url.PathEscape(name), headers)
+}
+
+// do sends a request without a body and returns the body of a 2xx response.
+func (s *awsCredentialSource) do(method, url string, headers map[string]string) ([]byte, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &sinkStatusError{status: resp.StatusCode, body: string(bytes.TrimSpace(body))}
+	}
+	return body, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Sampler counts only a fraction of the events on extremely hot paths and scales their counters accordingly. Sampling
+// decisions are based on a hash of the request ID, so that a request and its response are always sampled together and
+// latency correlation keeps working.
+type Sampler struct {
+	rules []samplingRule
+}
+
+type samplingRule struct {
+	path  *regexp.Regexp
+	every uint32
+}
+
+// NewSampler constructs a Sampler from the sampling rules of the configuration.
+func NewSampler(configs []SamplingConfig) (*Sampler, error) {
+	s := new(Sampler)
+	for i, cfg := range configs {
+		path, err := regexp.Compile(cfg.Path)
+		if err != nil {
+			return nil, fmt.Errorf("sampling rule %d: invalid regex: %v", i, err)
+		}
+		if cfg.Every < 1 {
+			return nil, fmt.Errorf("sampling rule %d: every must be at least 1: %d", i, cfg.Every)
+		}
+		s.rules = append(s.rules, samplingRule{path: path, every: uint32(cfg.Every)})
+	}
+	return s, nil
+}
+
+// Sample decides whether an audit entry is counted, and the weight its counters are incremented by. The first rule
+// matching the request path applies; entries on paths without a rule are always counted with a weight of 1.
+func (s *Sampler) Sample(entry *AuditEntry) (keep bool, weight float64) {
+	for _, rule := range s.rules {
+		if !rule.path.MatchString(entry.Request.Path) {
+			continue
+		}
+		if fnv32a(entry.Request.ID)%rule.every != 0 {
+			return false, 0
+		}
+		return true, float64(rule.every)
+	}
+	return true, 1
+}
+
+// fnv32aOffset is the initial value of 32-bit FNV-1a hashes.
+const fnv32aOffset = 2166136261
+
+// fnv32a computes the 32-bit FNV-1a hash of a string without allocating.
+func fnv32a(s string) uint32 {
+	return fnv32aAppend(fnv32aOffset, s)
+}
+
+// fnv32aAppend continues a 32-bit FNV-1a hash over a string, as if it had been appended to the hashed input.
+func fnv32aAppend(hash uint32, s string) uint32 {
+	const prime32 = 16777619
+	for i := 0; i < len(s); i++ {
+		hash ^= uint32(s[i])
+		hash *= prime32
+	}
+	return hash
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// weekdays maps the abbreviated names of weekdays to their time.Weekday.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// accessSchedule is a compiled AccessScheduleConfig.
+type accessSchedule struct {
+	name       string
+	pathGroups map[string]bool
+	policies   map[string]bool
+	location   *time.Location
+	windows    []accessWindow
+}
+
+// accessWindow allows access on a set of weekdays between two times of day, in minutes since midnight.
+type accessWindow struct {
+	days       uint8
+	start, end int
+}
+
+// AccessScheduleMonitor counts requests to path groups, or made by tokens carrying policies, that are restricted to
+// windows of time, such as business hours, when they fall outside every window, since production secrets read at 3am
+// on a Sunday are worth a look.
+type AccessScheduleMonitor struct {
+	schedules []*accessSchedule
+	groups    *PathGrouper
+	alerts    *Alerter
+
+	counterOutside *prometheus.CounterVec
+}
+
+// NewAccessScheduleMonitor constructs an AccessScheduleMonitor for schedules, assigning request paths to path groups
+// with groups, which may be nil if no schedule restricts path groups. Requests outside the windows of a schedule are
+// also findings for alerts.
+func NewAccessScheduleMonitor(configs []AccessScheduleConfig, groups *PathGrouper, alerts *Alerter) (*AccessScheduleMonitor, error) {
+	m := &AccessScheduleMonitor{groups: groups, alerts: alerts}
+	for _, cfg := range configs {
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("access schedule name is required")
+		}
+		if len(cfg.PathGroups) == 0 && len(cfg.Policies) == 0 {
+			return nil, fmt.Errorf("access schedule %s: path groups or policies are required", cfg.Name)
+		}
+		if len(cfg.PathGroups) > 0 && groups == nil {
+			return nil, fmt.Errorf("access schedule %s: path_groups are required", cfg.Name)
+		}
+		if len(cfg.Windows) == 0 {
+			return nil, fmt.Errorf("access schedule %s: windows are required", cfg.Name)
+		}
+		s := &accessSchedule{
+			name:       cfg.Name,
+			pathGroups: make(map[string]bool),
+			policies:   make(map[string]bool),
+			location:   time.Local,
+		}
+		for _, group := range cfg.PathGroups {
+			s.pathGroups[group] = true
+		}
+		for _, policy := range cfg.Policies {
+			s.policies[policy] = true
+		}
+		if cfg.TimeZone != "" {
+			location, err := time.LoadLocation(cfg.TimeZone)
+			if err != nil {
+				return nil, fmt.Errorf("access schedule %s: %v", cfg.Name, err)
+			}
+			s.location = location
+		}
+		for _, windowConfig := range cfg.Windows {
+			window, err := parseAccessWindow(windowConfig)
+			if err != nil {
+				return nil, fmt.Errorf("access schedule %s: %v", cfg.Name, err)
+			}
+			s.windows = append(s.windows, window)
+		}
+		m.schedules = append(m.schedules, s)
+	}
+
+	m.counterOutside = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "security",
+		Name:      "out_of_schedule_requests_total",
+		Help:      "Number of Vault requests, including denied ones, that fell outside every window of an access schedule. Partitioned by schedule and operation.",
+	},
+		[]string{"schedule", "operation"})
+	return m, nil
+}
+
+func (m *AccessScheduleMonitor) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.counterOutside}
+}
+
+// parseAccessWindow parses the days and times of day of an access window.
+func parseAccessWindow(cfg AccessWindowConfig) (accessWindow, error) {
+	var window accessWindow
+	if len(cfg.Days) == 0 {
+		window.days = 1<<7 - 1
+	}
+	for _, days := range cfg.Days {
+		bounds := strings.SplitN(strings.ToLower(days), "-", 2)
+		first, ok := weekdays[bounds[0]]
+		last := first
+		if ok && len(bounds) == 2 {
+			last, ok = weekdays[bounds[1]]
+		}
+		if !ok {
+			return window, fmt.Errorf("invalid days %q", days)
+		}
+		// ranges may wrap around the end of the week, such as "sat-sun"
+		for day := first; ; day = (day + 1) % 7 {
+			window.days |= 1 << uint(day)
+			if day == last {
+				break
+			}
+		}
+	}
+
+	var err error
+	if window.start, err = parseTimeOfDay(cfg.Start); err != nil {
+		return window, err
+	}
+	if window.end, err = parseTimeOfDay(cfg.End); err != nil {
+		return window, err
+	}
+	if window.end <= window.start {
+		return window, fmt.Errorf("window end %s must be after its start %s", cfg.End, cfg.Start)
+	}
+	return window, nil
+}
+
+// parseTimeOfDay parses a time of day in the format "15:04", or "24:00" for the end of the day, into minutes since
+// midnight.
+func parseTimeOfDay(s string) (int, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	if hours < 0 || minutes < 0 || minutes > 59 || hours*60+minutes > 24*60 {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return hours*60 + minutes, nil
+}
+
+// allows returns whether a time falls within any window of the schedule.
+func (s *accessSchedule) allows(t time.Time) bool {
+	t = t.In(s.location)
+	minute := t.Hour()*60 + t.Minute()
+	for _, window := range s.windows {
+		if window.days&(1<<uint(t.Weekday())) != 0 && minute >= window.start && minute < window.end {
+			return true
+		}
+	}
+	return false
+}
+
+// applies returns whether the schedule restricts a request to a path group, or made by a token with policies.
+func (s *accessSchedule) applies(group string, policies []string) bool {
+	if group != "" && s.pathGroups[group] {
+		return true
+	}
+	for _, policy := range policies {
+		if s.policies[policy] {
+			return true
+		}
+	}
+	return false
+}
+
+// Observe records a request if it falls outside the windows of a schedule restricting it. Requests are counted rather
+// than responses, so that denied attempts are counted too.
+func (m *AccessScheduleMonitor) Observe(auditEvent *AuditEvent) {
+	request := auditEvent.entry.Request
+	if auditEvent.entry.Type != AuditEventTypeRequest || request == nil {
+		return
+	}
+	var group string
+	if m.groups != nil {
+		group = m.groups.Group(request.Path)
+	}
+	var policies []string
+	var entity string
+	if auth := auditEvent.entry.Auth; auth != nil {
+		policies = auth.Policies
+		entity = auth.EntityID
+	}
+	for _, s := range m.schedules {
+		if !s.applies(group, policies) || s.allows(auditEvent.time) {
+			continue
+		}
+		m.counterOutside.WithLabelValues(s.name, request.Operation).Inc()
+		m.alerts.Fire(Finding{
+			Kind: FindingOutOfSchedule,
+			Key:  s.name + " " + entity,
+			Summary: fmt.Sprintf("%s %s outside access schedule %s%s", request.Operation, request.Path, s.name,
+				fromAddress(request.RemoteAddr)),
+			Time:    auditEvent.time,
+			Details: newRequestDetails(auditEvent),
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// OverflowLabelValue is the value of every label of the series that new label combinations are folded into once a
+// metric family reaches its series limit.
+const OverflowLabelValue = "__other__"
+
+// seriesDeleter is implemented by metric vectors that series can be removed from.
+type seriesDeleter interface {
+	DeleteLabelValues(lvs ...string) bool
+}
+
+// seriesTracker keeps track of the label combinations recorded for a metric family, caching the metric vector's child
+// of each so that recording an event doesn't hash and validate its labels again. It folds new combinations into an
+// overflow series once the family's series limit is reached, and deletes series that have not been updated within the
+// series TTL from both the metric vector and the cache.
+type seriesTracker struct {
+	labelNames []string
+	maxSeries  int
+	ttl        time.Duration
+	vec        seriesDeleter
+	limited    prometheus.Counter
+	expired    prometheus.Counter
+
+	mu     sync.RWMutex
+	series map[string]*trackedSeries
+}
+
+type trackedSeries struct {
+	// lastSeen holds Unix nanoseconds, so that it can be updated while holding only a read lock.
+	lastSeen    int64
+	labelValues []string
+	child       interface{}
+}
+
+// newSeriesTracker constructs a seriesTracker for vec, which must be a *prometheus.GaugeVec, *prometheus.CounterVec, or
+// *prometheus.HistogramVec. A maxSeries or ttl of zero disables the series limit or expiration, respectively.
+func newSeriesTracker(labelNames []string, maxSeries int, ttl time.Duration, vec seriesDeleter, limited, expired prometheus.Counter) *seriesTracker {
+	return &seriesTracker{
+		labelNames: labelNames,
+		maxSeries:  maxSeries,
+		ttl:        ttl,
+		vec:        vec,
+		limited:    limited,
+		expired:    expired,
+		series:     make(map[string]*trackedSeries),
+	}
+}
+
+// gauge admits a label set and returns its child of a gauge vector.
+func (t *seriesTracker) gauge(labels prometheus.Labels) (prometheus.Gauge, error) {
+	child, err := t.admit(labels)
+	if err != nil {
+		return nil, err
+	}
+	return child.(prometheus.Gauge), nil
+}
+
+// observer admits a label set and returns its child of a histogram vector.
+func (t *seriesTracker) observer(labels prometheus.Labels) (prometheus.Observer, error) {
+	child, err := t.admit(labels)
+	if err != nil {
+		return nil, err
+	}
+	return child.(prometheus.Observer), nil
+}
+
+// admit registers a label set as a series of the metric family and returns its child of the metric vector. If the
+// label set is new and the family is at its limit, every label is rewritten in place to the overflow value, so that the
+// family never has more than one series beyond its limit.
+func (t *seriesTracker) admit(labels prometheus.Labels) (interface{}, error) {
+	var buf [256]byte
+	key := t.key(buf[:0], labels)
+	t.mu.RLock()
+	s, found := t.series[string(key)]
+	if found {
+		t.seen(s)
+		t.mu.RUnlock()
+		return s.child, nil
+	}
+	t.mu.RUnlock()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if s, found := t.series[string(key)]; found {
+		t.seen(s)
+		return s.child, nil
+	}
+	if t.maxSeries > 0 && len(t.series) >= t.maxSeries {
+		for _, name := range t.labelNames {
+			labels[name] = OverflowLabelValue
+		}
+		key = t.key(key[:0], labels)
+		t.limited.Inc()
+		if s, found := t.series[string(key)]; found {
+			t.seen(s)
+			return s.child, nil
+		}
+	}
+
+	s = &trackedSeries{labelValues: make([]string, len(t.labelNames)), lastSeen: time.Now().UnixNano()}
+	for i, name := range t.labelNames {
+		s.labelValues[i] = labels[name]
+	}
+	child, err := t.child(s.labelValues)
+	if err != nil {
+		return nil, err
+	}
+	s.child = child
+	t.series[string(key)] = s
+	return child, nil
+}
+
+// seen marks a series as updated, for expiration.
+func (t *seriesTracker) seen(s *trackedSeries) {
+	if t.ttl > 0 {
+		atomic.StoreInt64(&s.lastSeen, time.Now().UnixNano())
+	}
+}
+
+// child returns the metric vector's child for the label values.
+func (t *seriesTracker) child(labelValues []string) (interface{}, error) {
+	switch vec := t.vec.(type) {
+	case *prometheus.GaugeVec:
+		return vec.GetMetricWithLabelValues(labelValues...)
+	case *prometheus.CounterVec:
+		return vec.GetMetricWithLabelValues(labelValues...)
+	case *prometheus.HistogramVec:
+		return vec.GetMetricWithLabelValues(labelValues...)
+	default:
+		return nil, fmt.Errorf("unsupported metric vector: %T", vec)
+	}
+}
+
+// expire deletes series that have not been updated within the series TTL. Events recorded on a series while it is
+// being deleted are lost.
+func (t *seriesTracker) expire() {
+	if t.ttl <= 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cutoff := time.Now().Add(-t.ttl).UnixNano()
+	for key, s := range t.series {
+		if atomic.LoadInt64(&s.lastSeen) < cutoff {
+			t.vec.DeleteLabelValues(s.labelValues...)
+			delete(t.series, key)
+			t.expired.Inc()
+		}
+	}
+}
+
+// key appends a unique identifier of a label set to buf.
+func (t *seriesTracker) key(buf []byte, labels prometheus.Labels) []byte {
+	for _, name := range t.labelNames {
+		buf = append(buf, labels[name]...)
+		buf = append(buf, 0xff)
+	}
+	return buf
+}
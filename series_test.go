@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// TestSeriesTrackerLimit checks that label combinations beyond the series limit are folded into a single series, even
+// when they share their path.
+func TestSeriesTrackerLimit(t *testing.T) {
+	const maxSeries = 10
+	labelNames := []string{"path", "operation", "error"}
+	vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "requests"}, labelNames)
+	limited := prometheus.NewCounter(prometheus.CounterOpts{Name: "limited"})
+	expired := prometheus.NewCounter(prometheus.CounterOpts{Name: "expired"})
+	tracker := newSeriesTracker(labelNames, maxSeries, 0, vec, limited, expired)
+
+	const events = 100
+	for i := 0; i < events; i++ {
+		labels := prometheus.Labels{"path": "secret/data/app", "operation": "read", "error": fmt.Sprintf("error %d", i)}
+		gauge, err := tracker.gauge(labels)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gauge.Inc()
+		if i >= maxSeries {
+			for name, value := range labels {
+				if value != OverflowLabelValue {
+					t.Errorf("event %d beyond the limit recorded with %s=%q, want %q", i, name, value, OverflowLabelValue)
+				}
+			}
+		}
+	}
+
+	metrics := make(chan prometheus.Metric, 2*events)
+	vec.Collect(metrics)
+	close(metrics)
+	if got := len(metrics); got != maxSeries+1 {
+		t.Errorf("recorded %d series, want %d", got, maxSeries+1)
+	}
+	if got := counterValue(t, limited); got != events-maxSeries {
+		t.Errorf("counted %v limited events, want %d", got, events-maxSeries)
+	}
+	overflow, err := vec.GetMetricWithLabelValues(OverflowLabelValue, OverflowLabelValue, OverflowLabelValue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gaugeValue(t, overflow); got != events-maxSeries {
+		t.Errorf("recorded %v events on the overflow series, want %d", got, events-maxSeries)
+	}
+}
+
+// gaugeValue returns the current value of a gauge.
+func gaugeValue(t *testing.T, gauge prometheus.Gauge) float64 {
+	t.Helper()
+	var metric dto.Metric
+	if err := gauge.Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetGauge().GetValue()
+}
+
+// benchmarkSeriesEvent holds the label sets an audit event records its series with. Requests are counted, and
+// responses are counted and their latency observed.
+type benchmarkSeriesEvent struct {
+	request bool
+	counted prometheus.Labels
+	latency prometheus.Labels
+}
+
+// BenchmarkSeries compares recording the request, response, and latency series of the events of the test audit log
+// through series trackers, which cache the children of the metric vectors, with looking up each child with
+// GetMetricWith. Each operation records one event.
+func BenchmarkSeries(b *testing.B) {
+	p := newTestAuditProcessor(b)
+	log, err := ioutil.ReadFile("test/vault-audit.log")
+	if err != nil {
+		b.Fatal(err)
+	}
+	var events []benchmarkSeriesEvent
+	for _, line := range bytes.Split(bytes.TrimSpace(log), []byte{'\n'}) {
+		auditEvent := p.ingest(line, time.Now(), "benchmark", false)
+		if auditEvent == nil {
+			continue
+		}
+		switch auditEvent.entry.Type {
+		case "request":
+			events = append(events, benchmarkSeriesEvent{request: true, counted: auditEvent.PromLabels(p.requestLabels)})
+		case "response":
+			events = append(events, benchmarkSeriesEvent{counted: auditEvent.PromLabels(p.responseLabels),
+				latency: auditEvent.PromLabels(p.latencyLabels)})
+		}
+		auditEvent.release()
+	}
+	if len(events) == 0 {
+		b.Fatal("no events in test/vault-audit.log")
+	}
+
+	newVecs := func() (requests, responses *prometheus.GaugeVec, latency *prometheus.HistogramVec) {
+		requests = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "requests"}, p.requestLabels)
+		responses = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "responses"}, p.responseLabels)
+		latency = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "latency"}, p.latencyLabels)
+		return requests, responses, latency
+	}
+	benchmark := func(b *testing.B, record func(event *benchmarkSeriesEvent) error) {
+		// create the series of all events up front, so that only recording on existing series is measured
+		for i := range events {
+			if err := record(&events[i]); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := record(&events[i%len(events)]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.Run("tracker", func(b *testing.B) {
+		requests, responses, latency := newVecs()
+		counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "counter"})
+		requestSeries := newSeriesTracker(p.requestLabels, 0, 0, requests, counter, counter)
+		responseSeries := newSeriesTracker(p.responseLabels, 0, 0, responses, counter, counter)
+		latencySeries := newSeriesTracker(p.latencyLabels, 0, 0, latency, counter, counter)
+		benchmark(b, func(event *benchmarkSeriesEvent) error {
+			if event.request {
+				gauge, err := requestSeries.gauge(event.counted)
+				if err != nil {
+					return err
+				}
+				gauge.Inc()
+				return nil
+			}
+			gauge, err := responseSeries.gauge(event.counted)
+			if err != nil {
+				return err
+			}
+			gauge.Inc()
+			observer, err := latencySeries.observer(event.latency)
+			if err != nil {
+				return err
+			}
+			observer.Observe(0.001)
+			return nil
+		})
+	})
+	b.Run("GetMetricWith", func(b *testing.B) {
+		requests, responses, latency := newVecs()
+		benchmark(b, func(event *benchmarkSeriesEvent) error {
+			if event.request {
+				gauge, err := requests.GetMetricWith(event.counted)
+				if err != nil {
+					return err
+				}
+				gauge.Inc()
+				return nil
+			}
+			gauge, err := responses.GetMetricWith(event.counted)
+			if err != nil {
+				return err
+			}
+			gauge.Inc()
+			observer, err := latency.GetMetricWith(event.latency)
+			if err != nil {
+				return err
+			}
+			observer.Observe(0.001)
+			return nil
+		})
+	})
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	// defaultSinkInterval is the interval at which metrics are pushed to a sink if unset.
+	defaultSinkInterval = 30 * time.Second
+	// sinkTimeout bounds each push to a sink.
+	sinkTimeout = 10 * time.Second
+	// udpPacketSize is the largest datagram sent over UDP, which fits a typical MTU without fragmentation.
+	udpPacketSize = 1432
+	// unixgramPacketSize is the largest datagram sent over a Unix domain socket.
+	unixgramPacketSize = 8192
+	// streamWriteSize is the largest write to a stream socket.
+	streamWriteSize = 64 * 1024
+)
+
+// Types of metric sinks.
+const (
+	MetricSinkOTLP            = "otlp"
+	MetricSinkStatsD          = "statsd"
+	MetricSinkInfluxDB        = "influxdb"
+	MetricSinkGraphite        = "graphite"
+	MetricSinkCloudWatch      = "cloudwatch"
+	MetricSinkRemoteWrite     = "remote_write"
+	MetricSinkPushgateway     = "pushgateway"
+	MetricSinkNewRelic        = "newrelic"
+	MetricSinkCloudMonitoring = "cloudmonitoring"
+)
+
+// metricSink pushes the metric families gathered at a point in time to a backend.
+type metricSink interface {
+	push(families []*dto.MetricFamily, now time.Time) error
+}
+
+// MetricSinks periodically push the exporter's metrics to backends that don't scrape Prometheus exposition, such as
+// OpenTelemetry collectors. Only the exporter's own metric families are pushed, not those of the Go runtime and the
+// process.
+type MetricSinks struct {
+	gatherer prometheus.Gatherer
+	sinks    []*configuredSink
+
+	counterPushes *prometheus.CounterVec
+	counterErrors *prometheus.CounterVec
+}
+
+// configuredSink is a metric sink along with its name and push interval. mu serializes its pushes, so that a push on
+// shutdown doesn't overlap with a periodic one.
+type configuredSink struct {
+	name     string
+	interval time.Duration
+	sink     metricSink
+
+	mu sync.Mutex
+}
+
+// NewMetricSinks constructs MetricSinks for the configured sinks, pushing the metrics gathered by gatherer.
+func NewMetricSinks(configs []MetricSinkConfig, gatherer prometheus.Gatherer) (*MetricSinks, error) {
+	s := &MetricSinks{gatherer: gatherer}
+	names := make(map[string]bool)
+	for _, cfg := range configs {
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("metric sink name is required")
+		}
+		if names[cfg.Name] {
+			return nil, fmt.Errorf("metric sink %s is configured more than once", cfg.Name)
+		}
+		names[cfg.Name] = true
+		if cfg.Interval < 0 {
+			return nil, fmt.Errorf("metric sink %s: interval must not be negative", cfg.Name)
+		}
+		if cfg.Interval == 0 {
+			cfg.Interval = defaultSinkInterval
+		}
+		var sink metricSink
+		var err error
+		switch cfg.Type {
+		case MetricSinkOTLP:
+			sink, err = newOTLPSink(cfg)
+		case MetricSinkStatsD:
+			sink, err = newStatsDSink(cfg)
+		case MetricSinkInfluxDB:
+			sink, err = newInfluxSink(cfg)
+		case MetricSinkGraphite:
+			sink, err = newGraphiteSink(cfg)
+		case MetricSinkCloudWatch:
+			sink, err = newCloudWatchSink(cfg)
+		case MetricSinkRemoteWrite:
+			sink, err = newRemoteWriteSink(cfg)
+		case MetricSinkPushgateway:
+			sink, err = newPushgatewaySink(cfg)
+		case MetricSinkNewRelic:
+			sink, err = newNewRelicSink(cfg)
+		case MetricSinkCloudMonitoring:
+			sink, err = newCloudMonitoringSink(cfg)
+		default:
+			err = fmt.Errorf("unknown type %q", cfg.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("metric sink %s: %v", cfg.Name, err)
+		}
+		s.sinks = append(s.sinks, &configuredSink{name: cfg.Name, interval: cfg.Interval, sink: sink})
+	}
+
+	s.counterPushes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "sinks",
+		Name:      "pushes_total",
+		Help:      "Number of times metrics were pushed to a metric sink. Partitioned by sink.",
+	},
+		[]string{"sink"})
+	s.counterErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "sinks",
+		Name:      "push_errors_total",
+		Help:      "Number of times metrics could not be pushed to a metric sink. Partitioned by sink.",
+	},
+		[]string{"sink"})
+	return s, nil
+}
+
+func (s *MetricSinks) collectors() []prometheus.Collector {
+	return []prometheus.Collector{s.counterPushes, s.counterErrors}
+}
+
+// Run pushes metrics to every sink on its interval in the background.
+func (s *MetricSinks) Run() {
+	for _, sink := range s.sinks {
+		go s.run(sink)
+	}
+}
+
+func (s *MetricSinks) run(sink *configuredSink) {
+	ticker := time.NewTicker(sink.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		_ = s.push(sink)
+	}
+}
+
+// Flush pushes metrics to every sink right away, so that the updates since the last push aren't lost on shutdown or
+// at the end of a batch run. It returns the first error, after every sink was pushed to.
+func (s *MetricSinks) Flush() error {
+	var firstErr error
+	for _, sink := range s.sinks {
+		if err := s.push(sink); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("metric sink %s: %v", sink.name, err)
+		}
+	}
+	return firstErr
+}
+
+func (s *MetricSinks) push(sink *configuredSink) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	families, err := s.gather()
+	if err == nil {
+		err = sink.sink.push(families, time.Now())
+	}
+	if err != nil {
+		logError("error pushing metrics", "sink", sink.name, "error", err)
+		s.counterErrors.WithLabelValues(sink.name).Inc()
+		return err
+	}
+	s.counterPushes.WithLabelValues(sink.name).Inc()
+	return nil
+}
+
+// gather returns the exporter's own metric families.
+func (s *MetricSinks) gather() ([]*dto.MetricFamily, error) {
+	families, err := s.gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+	own := families[:0]
+	for _, family := range families {
+		if strings.HasPrefix(family.GetName(), PromNamespace+"_") {
+			own = append(own, family)
+		}
+	}
+	return own, nil
+}
+
+// seriesKey identifies a series by its metric name and labels.
+func seriesKey(name string, labels []*dto.LabelPair) string {
+	var b strings.Builder
+	b.WriteString(name)
+	for _, label := range labels {
+		b.WriteByte(0xff)
+		b.WriteString(label.GetName())
+		b.WriteByte('=')
+		b.WriteString(label.GetValue())
+	}
+	return b.String()
+}
+
+// counterDeltas turns the cumulative values of counters into the increments since the previous push, for backends that
+// aggregate increments themselves. Series that disappear between pushes are forgotten.
+type counterDeltas struct {
+	previous map[string]float64
+	seen     map[string]bool
+}
+
+func newCounterDeltas() *counterDeltas {
+	return &counterDeltas{previous: make(map[string]float64), seen: make(map[string]bool)}
+}
+
+// delta returns the increment of the counter of a series since the previous push. A counter that went down was reset,
+// such as by deleting its series, and counts from zero again.
+func (d *counterDeltas) delta(key string, value float64) float64 {
+	d.seen[key] = true
+	delta := value - d.previous[key]
+	if delta < 0 {
+		delta = value
+	}
+	d.previous[key] = value
+	return delta
+}
+
+// sweep forgets the series that weren't seen since the previous sweep, which is called after every push.
+func (d *counterDeltas) sweep() {
+	for key := range d.previous {
+		if !d.seen[key] {
+			delete(d.previous, key)
+		}
+	}
+	d.seen = make(map[string]bool, len(d.previous))
+}
+
+// lineConn writes lines of text to a socket, dialing it on the first write and again after an error. Lines are batched
+// into as few writes as fit them, where each datagram of a datagram socket holds whole lines.
+type lineConn struct {
+	network  string
+	address  string
+	maxWrite int
+	conn     net.Conn
+}
+
+// newLineConn constructs a lineConn to address over network, which defaults to defaultNetwork.
+func newLineConn(network, address, defaultNetwork string) (*lineConn, error) {
+	if network == "" {
+		network = defaultNetwork
+	}
+	c := &lineConn{network: network, address: address}
+	switch network {
+	case "udp", "udp4", "udp6":
+		c.maxWrite = udpPacketSize
+	case "unixgram":
+		c.maxWrite = unixgramPacketSize
+	case "tcp", "tcp4", "tcp6", "unix":
+		c.maxWrite = streamWriteSize
+	default:
+		return nil, fmt.Errorf("unknown network %q", network)
+	}
+	if address == "" {
+		return nil, fmt.Errorf("address is required")
+	}
+	return c, nil
+}
+
+// write writes lines, each terminated by a newline.
+func (c *lineConn) write(lines []string) error {
+	if c.conn == nil {
+		conn, err := net.DialTimeout(c.network, c.address, sinkTimeout)
+		if err != nil {
+			return err
+		}
+		c.conn = conn
+	}
+	var buf bytes.Buffer
+	flush := func() error {
+		if buf.Len() == 0 {
+			return nil
+		}
+		if err := c.conn.SetWriteDeadline(time.Now().Add(sinkTimeout)); err != nil {
+			return err
+		}
+		_, err := c.conn.Write(buf.Bytes())
+		buf.Reset()
+		return err
+	}
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+len(line)+1 > c.maxWrite {
+			if err := flush(); err != nil {
+				c.close()
+				return err
+			}
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	if err := flush(); err != nil {
+		c.close()
+		return err
+	}
+	return nil
+}
+
+func (c *lineConn) close() {
+	if err := c.conn.Close(); err != nil {
+		logDebug("error closing sink connection", "address", c.address, "error", err)
+	}
+	c.conn = nil
+}
+
+// metricType returns the type a metric family is pushed as. Gauges named like counters, with a "_total" suffix, such as
+// the request and response counts, only ever increase and are pushed as counters.
+func metricType(family *dto.MetricFamily) dto.MetricType {
+	if family.GetType() == dto.MetricType_GAUGE && strings.HasSuffix(family.GetName(), "_total") {
+		return dto.MetricType_COUNTER
+	}
+	return family.GetType()
+}
+
+// metricValue returns the value of a counter, gauge, or untyped metric.
+func metricValue(m *dto.Metric) float64 {
+	switch {
+	case m.Counter != nil:
+		return m.Counter.GetValue()
+	case m.Gauge != nil:
+		return m.Gauge.GetValue()
+	}
+	return m.GetUntyped().GetValue()
+}
+
+// postSink posts a body to a sink's HTTP endpoint with headers, gzip-compressing it if compress is set, and fails with a
+// *sinkStatusError for responses other than 2xx.
+func postSink(client *http.Client, url, contentType string, headers map[string]string, body []byte, compress bool) error {
+	_, err := sendSink(client, http.MethodPost, url, contentType, headers, body, compress)
+	return err
+}
+
+// sendSink is postSink with any method, returning the body of the response.
+func sendSink(client *http.Client, method, url, contentType string, headers map[string]string, body []byte,
+	compress bool) ([]byte, error) {
+	if compress {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(body); err != nil {
+			return nil, err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+		body = buf.Bytes()
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, &sinkStatusError{status: resp.StatusCode, body: strings.TrimSpace(string(message))}
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// sinkStatusError is a response of a sink's HTTP endpoint other than 2xx.
+type sinkStatusError struct {
+	status int
+	body   string
+}
+
+func (e *sinkStatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d: %s", e.status, e.body)
+}
+
+// retryable returns whether the request may succeed if retried, which is the case for server errors and throttling
+// but not for other client errors, such as malformed or rejected payloads.
+func (e *sinkStatusError) retryable() bool {
+	return e.status >= 500 || e.status == http.StatusTooManyRequests
+}
+
+// retryableSinkError returns whether a request to a sink that failed with err may succeed if retried, which is the case
+// for network errors and retryable statuses.
+func retryableSinkError(err error) bool {
+	var status *sinkStatusError
+	return !errors.As(err, &status) || status.retryable()
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sloBucketInterval is the resolution of the SLO burn rate windows.
+const sloBucketInterval = 10 * time.Second
+
+// defaultSLOWindows are the burn rate windows used when an SLO doesn't configure its own, matching common multi-window
+// burn rate alerts.
+var defaultSLOWindows = []time.Duration{5 * time.Minute, 30 * time.Minute, time.Hour, 6 * time.Hour}
+
+// SLOTracker evaluates responses against latency and error objectives per path group, exposing good and bad event
+// counters and multi-window burn rates.
+type SLOTracker struct {
+	slos []*slo
+
+	counterEvents *prometheus.CounterVec
+	gagueBurnRate *prometheus.GaugeVec
+}
+
+// slo is a compiled SLOConfig with a ring of per-interval event counts covering its longest window.
+type slo struct {
+	name       string
+	pathGroup  string
+	operations map[string]bool
+	objective  float64
+	latency    time.Duration
+	errors     bool
+	windows    []time.Duration
+
+	mu      sync.Mutex
+	buckets []sloBucket
+}
+
+// sloBucket holds the events of one bucket interval, identified by the interval's index since the Unix epoch.
+type sloBucket struct {
+	index     int64
+	good, bad float64
+}
+
+// NewSLOTracker compiles the SLO configuration.
+func NewSLOTracker(configs []SLOConfig) (*SLOTracker, error) {
+	t := new(SLOTracker)
+	for _, cfg := range configs {
+		if cfg.Name == "" || cfg.PathGroup == "" {
+			return nil, fmt.Errorf("slo name and path group are required")
+		}
+		if cfg.Objective <= 0 || cfg.Objective >= 1 {
+			return nil, fmt.Errorf("slo %s: objective must be between 0 and 1", cfg.Name)
+		}
+		if cfg.Latency <= 0 && !cfg.Errors {
+			return nil, fmt.Errorf("slo %s: a latency threshold or errors is required", cfg.Name)
+		}
+		s := &slo{
+			name:       cfg.Name,
+			pathGroup:  cfg.PathGroup,
+			operations: operationSet(cfg.Operations),
+			objective:  cfg.Objective,
+			latency:    cfg.Latency,
+			errors:     cfg.Errors,
+			windows:    cfg.Windows,
+		}
+		if len(s.windows) == 0 {
+			s.windows = defaultSLOWindows
+		}
+		longest := time.Duration(0)
+		for _, window := range s.windows {
+			if window < sloBucketInterval {
+				return nil, fmt.Errorf("slo %s: windows must be at least %s", cfg.Name, sloBucketInterval)
+			}
+			if window > longest {
+				longest = window
+			}
+		}
+		s.buckets = make([]sloBucket, longest/sloBucketInterval)
+		t.slos = append(t.slos, s)
+	}
+
+	t.counterEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: PromNamespace,
+		Subsystem: "slo",
+		Name:      "events_total",
+		Help:      "Number of responses evaluated against an SLO. Partitioned by SLO and result (good or bad).",
+	},
+		[]string{"slo", "result"})
+	t.gagueBurnRate = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: PromNamespace,
+		Subsystem: "slo",
+		Name:      "burn_rate",
+		Help:      "Rate at which an SLO's error budget is spent over a window, where 1 spends it exactly over the SLO period. Partitioned by SLO and window.",
+	},
+		[]string{"slo", "window"})
+	return t, nil
+}
+
+// Observe evaluates a response with a known latency against the SLOs of its path group.
+func (t *SLOTracker) Observe(auditEvent *AuditEvent, latency time.Duration) {
+	for _, s := range t.slos {
+		if s.pathGroup != auditEvent.pathGroup {
+			continue
+		}
+		if len(s.operations) > 0 && !s.operations[auditEvent.entry.Request.Operation] {
+			continue
+		}
+		bad := (s.latency > 0 && latency > s.latency) || (s.errors && auditEvent.entry.Error != "")
+		result := "good"
+		if bad {
+			result = "bad"
+		}
+		t.counterEvents.WithLabelValues(s.name, result).Add(auditEvent.Weight())
+		s.record(time.Now(), bad, auditEvent.Weight())
+	}
+}
+
+// record adds an event to the bucket of the current interval.
+func (s *slo) record(now time.Time, bad bool, weight float64) {
+	index := now.UnixNano() / int64(sloBucketInterval)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bucket := &s.buckets[index%int64(len(s.buckets))]
+	if bucket.index != index {
+		*bucket = sloBucket{index: index}
+	}
+	if bad {
+		bucket.bad += weight
+	} else {
+		bucket.good += weight
+	}
+}
+
+// burnRate returns the ratio of bad events over a window, divided by the error budget of the objective.
+func (s *slo) burnRate(now time.Time, window time.Duration) float64 {
+	current := now.UnixNano() / int64(sloBucketInterval)
+	oldest := current - int64(window/sloBucketInterval) + 1
+	var good, bad float64
+	s.mu.Lock()
+	for _, bucket := range s.buckets {
+		if bucket.index >= oldest && bucket.index <= current {
+			good += bucket.good
+			bad += bucket.bad
+		}
+	}
+	s.mu.Unlock()
+	if good+bad == 0 {
+		return 0
+	}
+	return bad / (good + bad) / (1 - s.objective)
+}
+
+// Run continuously updates the burn rate gauges.
+func (t *SLOTracker) Run() {
+	for {
+		now := time.Now()
+		for _, s := range t.slos {
+			for _, window := range s.windows {
+				t.gagueBurnRate.WithLabelValues(s.name, formatWindow(window)).Set(s.burnRate(now, window))
+			}
+		}
+		time.Sleep(sloBucketInterval)
+	}
+}
+
+// formatWindow formats a window in the style of Prometheus durations, such as "5m" or "6h".
+func formatWindow(window time.Duration) string {
+	switch {
+	case window%time.Hour == 0:
+		return fmt.Sprintf("%dh", window/time.Hour)
+	case window%time.Minute == 0:
+		return fmt.Sprintf("%dm", window/time.Minute)
+	default:
+		return fmt.Sprintf("%ds", window/time.Second)
+	}
+}
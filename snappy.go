@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/binary"
+)
+
+const (
+	// snappyBlockSize is the size of the blocks that snappy compresses independently, within which copies refer back.
+	snappyBlockSize = 1 << 16
+	// snappyTableBits is the number of bits of the hash table of positions that matches are looked up in.
+	snappyTableBits = 14
+	// snappyMinBlockSize is the size below which a block is emitted as a literal, too short to be worth matching.
+	snappyMinBlockSize = 17
+)
+
+// snappyEncode compresses src in the snappy block format, as used by Prometheus remote write. It finds matches greedily
+// with a hash table of 4-byte sequences, which compresses repetitive payloads such as series labels nearly as well as
+// the reference implementation.
+func snappyEncode(src []byte) []byte {
+	dst := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(src)+len(src)/6+32)
+	dst = dst[:binary.PutUvarint(dst, uint64(len(src)))]
+	for len(src) > 0 {
+		block := src
+		if len(block) > snappyBlockSize {
+			block = block[:snappyBlockSize]
+		}
+		src = src[len(block):]
+		dst = snappyEncodeBlock(dst, block)
+	}
+	return dst
+}
+
+func snappyEncodeBlock(dst, src []byte) []byte {
+	if len(src) < snappyMinBlockSize {
+		return snappyEmitLiteral(dst, src)
+	}
+	var table [1 << snappyTableBits]int32
+	hash := func(u uint32) uint32 { return (u * 0x1e35a7bd) >> (32 - snappyTableBits) }
+
+	var emitted int
+	for s := 1; s+4 <= len(src); {
+		current := binary.LittleEndian.Uint32(src[s:])
+		h := hash(current)
+		candidate := int(table[h])
+		table[h] = int32(s)
+		if candidate >= s || binary.LittleEndian.Uint32(src[candidate:]) != current {
+			s++
+			continue
+		}
+		dst = snappyEmitLiteral(dst, src[emitted:s])
+		start := s
+		s += 4
+		for c := candidate + 4; s < len(src) && src[s] == src[c]; c++ {
+			s++
+		}
+		dst = snappyEmitCopy(dst, start-candidate, s-start)
+		emitted = s
+	}
+	return snappyEmitLiteral(dst, src[emitted:])
+}
+
+// snappyEmitLiteral appends a literal element holding lit.
+func snappyEmitLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	n := uint32(len(lit) - 1)
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n<<2))
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+// snappyEmitCopy appends copy elements repeating length bytes from offset bytes back, where offset is within a block
+// and length is at least 4.
+func snappyEmitCopy(dst []byte, offset, length int) []byte {
+	// copies with 2-byte offsets hold at most 64 bytes, and splitting must leave at least 4 for the last copy
+	for length >= 68 {
+		dst = append(dst, 63<<2|2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	if length > 64 {
+		dst = append(dst, 59<<2|2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+	if length >= 12 || offset >= 2048 {
+		return append(dst, byte(length-1)<<2|2, byte(offset), byte(offset>>8))
+	}
+	return append(dst, byte(offset>>8)<<5|byte(length-4)<<2|1, byte(offset))
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestSnappyEncode(t *testing.T) {
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rand.New(rand.NewSource(int64(n))).Read(b)
+		return b
+	}
+	// repeat repeats pattern up to n bytes
+	repeat := func(pattern []byte, n int) []byte {
+		return bytes.Repeat(pattern, n/len(pattern)+1)[:n]
+	}
+	// labels resembles a remote write request, whose series share most of their labels
+	var labels []byte
+	for i := 0; len(labels) < 200000; i++ {
+		labels = append(labels, fmt.Sprintf(`__name__ vaultaudit_requests_total operation read path secret/data/app%d/*`+
+			` error  code_class 2xx token_type service %d`, i%37, i)...)
+	}
+
+	tests := []struct {
+		name string
+		src  []byte
+		// maxRatio bounds the size of the encoding relative to src, for inputs that must compress.
+		maxRatio float64
+	}{
+		{name: "empty", src: []byte{}},
+		{name: "one byte", src: []byte("x")},
+		{name: "shorter than the minimum block", src: []byte("abcdabcdabcdabcd")},
+		{name: "minimum block", src: []byte("abcdabcdabcdabcdx"), maxRatio: 1},
+		{name: "random 100 bytes", src: random(100)},
+		{name: "random 60 bytes", src: random(60)},
+		{name: "random 61 bytes", src: random(61)},
+		{name: "random 256 bytes", src: random(256)},
+		{name: "random 257 bytes", src: random(257)},
+		{name: "random 64 KiB", src: random(snappyBlockSize)},
+		{name: "random 64 KiB and 1 byte", src: random(snappyBlockSize + 1)},
+		{name: "random 1 MiB", src: random(1 << 20)},
+		{name: "zeros 64 KiB", src: make([]byte, snappyBlockSize), maxRatio: 0.05},
+		{name: "zeros 1 MiB", src: make([]byte, 1<<20), maxRatio: 0.05},
+		{name: "short pattern over 64 KiB", src: repeat([]byte("abc"), 3*snappyBlockSize+5), maxRatio: 0.05},
+		{name: "pattern of 67 bytes", src: repeat(random(67), 100000), maxRatio: 0.1},
+		{name: "pattern of 3000 bytes", src: repeat(random(3000), 200000), maxRatio: 0.15},
+		{name: "pattern of 40 KiB over 64 KiB", src: repeat(random(40000), 300000), maxRatio: 0.8},
+		{name: "labels", src: labels, maxRatio: 0.3},
+		// both random halves of 5000 bytes are the same
+		{name: "random with repeats", src: append(append(random(5000), random(5000)...), random(70000)...), maxRatio: 0.95},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded := snappyEncode(test.src)
+			decoded, err := snappyDecode(encoded)
+			if err != nil {
+				t.Fatalf("decoding %d bytes encoded from %d bytes: %v", len(encoded), len(test.src), err)
+			}
+			if !bytes.Equal(decoded, test.src) {
+				t.Fatalf("decoded %d bytes that differ from the %d bytes encoded", len(decoded), len(test.src))
+			}
+			if test.maxRatio > 0 && float64(len(encoded)) > test.maxRatio*float64(len(test.src)) {
+				t.Errorf("encoded %d bytes into %d bytes, want at most %.0f%% of them", len(test.src), len(encoded),
+					100*test.maxRatio)
+			}
+		})
+	}
+}
+
+// snappyDecode decodes the snappy block format. It follows the format's description rather than snappyEncode, so that
+// the encoder is checked against the format instead of against itself.
+func snappyDecode(src []byte) ([]byte, error) {
+	length, n := binary.Uvarint(src)
+	if n <= 0 {
+		return nil, errors.New("invalid decoded length")
+	}
+	src = src[n:]
+	dst := make([]byte, 0, length)
+	for len(src) > 0 {
+		tag := src[0]
+		var offset, size int
+		switch tag & 3 {
+		case 0:
+			// literal, whose length minus one is held by the tag or, from 60 on, by the next 1 to 4 bytes
+			size = int(tag>>2) + 1
+			src = src[1:]
+			if extra := int(tag>>2) - 59; extra > 0 {
+				if len(src) < extra {
+					return nil, errors.New("truncated literal length")
+				}
+				size = 0
+				for i := extra - 1; i >= 0; i-- {
+					size = size<<8 | int(src[i])
+				}
+				size++
+				src = src[extra:]
+			}
+			if len(src) < size {
+				return nil, errors.New("truncated literal")
+			}
+			dst = append(dst, src[:size]...)
+			src = src[size:]
+			continue
+		case 1:
+			// copy of 4 to 11 bytes with an 11-bit offset
+			if len(src) < 2 {
+				return nil, errors.New("truncated copy")
+			}
+			size = int(tag>>2&7) + 4
+			offset = int(tag>>5)<<8 | int(src[1])
+			src = src[2:]
+		case 2:
+			// copy of 1 to 64 bytes with a 16-bit offset
+			if len(src) < 3 {
+				return nil, errors.New("truncated copy")
+			}
+			size = int(tag>>2) + 1
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case 3:
+			// copy of 1 to 64 bytes with a 32-bit offset
+			if len(src) < 5 {
+				return nil, errors.New("truncated copy")
+			}
+			size = int(tag>>2) + 1
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+		if offset == 0 || offset > len(dst) {
+			return nil, fmt.Errorf("copy offset %d out of range of %d decoded bytes", offset, len(dst))
+		}
+		// copies may overlap the bytes they produce, so they are made a byte at a time
+		for i := 0; i < size; i++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if uint64(len(dst)) != length {
+		return nil, fmt.Errorf("decoded %d bytes, want %d", len(dst), length)
+	}
+	return dst, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cacheSnapshot is the on-disk form of the request timestamps held in memory, persisted across restarts so that
+// requests in flight during a deploy still have their latency recorded.
+type cacheSnapshot struct {
+	SavedAt  time.Time         `json:"saved_at"`
+	Requests []snapshotRequest `json:"requests"`
+}
+
+// snapshotRequest is a request ID awaiting its response in a cacheSnapshot.
+type snapshotRequest struct {
+	ID      string      `json:"id"`
+	Times   []time.Time `json:"times"`
+	Expires time.Time   `json:"expires"`
+}
+
+// localStore returns the in-memory part of a timestamp store.
+func localStore(store TimestampStore) *memoryStore {
+	switch s := store.(type) {
+	case *memoryStore:
+		return s
+	case *fallbackStore:
+		return s.local
+	}
+	return nil
+}
+
+// saveSnapshot writes the requests held in memory to a file, replacing it atomically.
+func (s *memoryStore) saveSnapshot(path string) error {
+	snapshot := cacheSnapshot{SavedAt: time.Now()}
+	for _, request := range s.items() {
+		snapshot.Requests = append(snapshot.Requests, snapshotRequest{
+			ID:      request.id,
+			Times:   request.times,
+			Expires: time.Unix(0, request.expires),
+		})
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadSnapshot restores the requests from a snapshot file that is no older than maxAge, keeping their original
+// expiration. A missing snapshot file is not an error. The file is removed once loaded, so it is never restored twice.
+func (s *memoryStore) loadSnapshot(path string, maxAge time.Duration) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := os.Remove(path); err != nil {
+			logError("error removing cache snapshot", "path", path, "error", err)
+		}
+	}()
+
+	var snapshot cacheSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return 0, fmt.Errorf("error parsing cache snapshot: %v", err)
+	}
+	if age := time.Since(snapshot.SavedAt); age > maxAge {
+		logWarn("ignoring stale cache snapshot", "path", path, "age", age.Round(time.Second))
+		return 0, nil
+	}
+	restored := 0
+	now := time.Now()
+	for _, request := range snapshot.Requests {
+		if ttl := request.Expires.Sub(now); ttl > 0 {
+			for _, t := range request.Times {
+				if _, err := s.Set(request.ID, t, ttl); err != nil {
+					return restored, err
+				}
+				restored++
+			}
+		}
+	}
+	return restored, nil
+}
+
+// Shutdown sends the queued audit events to event sinks, pushes the latest metrics to metric sinks, and persists the
+// request timestamps held in memory, if a snapshot file is configured.
+func (p *AuditProcessor) Shutdown() {
+	if p.eventSinks != nil {
+		p.eventSinks.Flush()
+	}
+	if p.metricSinks != nil {
+		// errors are logged, and there's nothing left to do about them on shutdown
+		_ = p.metricSinks.Flush()
+	}
+	if p.snapshotPath == "" {
+		return
+	}
+	store := localStore(p.timestamps)
+	if err := store.saveSnapshot(p.snapshotPath); err != nil {
+		logError("error saving cache snapshot", "path", p.snapshotPath, "error", err)
+		return
+	}
+	logInfo("saved request timestamps", "path", p.snapshotPath, "count", store.Len())
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sourceCheckInterval is the interval at which sources are checked for having gone down or recovered.
+const sourceCheckInterval = 5 * time.Second
+
+// Source states, reported by the source webhook.
+const (
+	SourceDown = "down"
+	SourceUp   = "up"
+)
+
+// SourceMonitor detects audit devices that stop sending events, whether their connections were closed or have gone
+// silent. A blocked socket audit device can block Vault requests entirely, so a source going down is logged, exposed
+// as a metric, and optionally posted to a webhook.
+type SourceMonitor struct {
+	downAfter time.Duration
+	webhook   *Webhook
+	alerts    *Alerter
+
+	mu      sync.Mutex
+	sources map[string]*sourceState
+
+	gagueDown            *prometheus.GaugeVec
+	counterWebhookErrors prometheus.Counter
+}
+
+// sourceState tracks the connections and events of one source. lastEvent holds the Unix nanoseconds of the last line
+// received, or 0 if none was received yet.
+type sourceState struct {
+	lastEvent   int64
+	connections int
+	down        bool
+	downSince   time.Time
+}
+
+// sourceEvent is the body posted to the source webhook.
+type sourceEvent struct {
+	Source    string    `json:"source"`
+	Status    string    `json:"status"`
+	Reason    string    `json:"reason,omitempty"`
+	LastEvent time.Time `json:"last_event"`
+	Time      time.Time `json:"time"`
+}
+
+// NewSourceMonitor constructs a SourceMonitor considering a source down once no line was received from it for
+// downAfter. If webhook is not empty, changes of state are posted to it. Sources going down are also findings for
+// alerts, resolved when they recover.
+func NewSourceMonitor(downAfter time.Duration, webhook string, alerts *Alerter) *SourceMonitor {
+	m := &SourceMonitor{
+		downAfter: downAfter,
+		alerts:    alerts,
+		sources:   make(map[string]*sourceState),
+		gagueDown: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: PromNamespace,
+			Name:      "audit_source_down",
+			Help:      "Whether an audit device that sent events has stopped doing so for -source-down-after. Partitioned by source address.",
+		},
+			[]string{"source"}),
+		counterWebhookErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Name:      "audit_source_webhook_errors_total",
+			Help:      "Number of failed calls of -source-down-webhook.",
+		}),
+	}
+	if webhook != "" {
+		m.webhook = NewWebhook("source-down-webhook", webhook, m.counterWebhookErrors.Inc)
+	}
+	return m
+}
+
+// open records a connection accepted from source, returning its state.
+func (m *SourceMonitor) open(source string) *sourceState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state, ok := m.sources[source]
+	if !ok {
+		state = new(sourceState)
+		m.sources[source] = state
+	}
+	state.connections++
+	return state
+}
+
+// close records a connection from source being closed.
+func (m *SourceMonitor) close(state *sourceState) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state.connections--
+}
+
+// received records a line received from a source at a time.
+func (s *sourceState) received(t time.Time) {
+	atomic.StoreInt64(&s.lastEvent, t.UnixNano())
+}
+
+// Run continuously checks for sources going down or recovering.
+func (m *SourceMonitor) Run() {
+	for {
+		time.Sleep(sourceCheckInterval)
+		now := time.Now()
+		m.mu.Lock()
+		for source, state := range m.sources {
+			nanos := atomic.LoadInt64(&state.lastEvent)
+			if nanos == 0 {
+				continue
+			}
+			lastEvent := time.Unix(0, nanos)
+			switch {
+			case !state.down && now.Sub(lastEvent) >= m.downAfter:
+				reason := "silent"
+				if state.connections == 0 {
+					reason = "closed"
+				}
+				state.down, state.downSince = true, now
+				logWarn("audit source down", "source", source, "reason", reason, "last_event", lastEvent)
+				m.gagueDown.WithLabelValues(source).Set(1)
+				m.notify(sourceEvent{Source: source, Status: SourceDown, Reason: reason, LastEvent: lastEvent, Time: now})
+			case state.down && lastEvent.After(state.downSince):
+				state.down = false
+				logInfo("audit source recovered", "source", source, "down_for", now.Sub(state.downSince).Round(time.Second))
+				m.gagueDown.WithLabelValues(source).Set(0)
+				m.notify(sourceEvent{Source: source, Status: SourceUp, LastEvent: lastEvent, Time: now})
+			case !state.down:
+				m.gagueDown.WithLabelValues(source).Set(0)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+// notify posts event to the webhook, if one is configured, and raises or resolves alerts without blocking.
+func (m *SourceMonitor) notify(event sourceEvent) {
+	m.webhook.Notify(event)
+	summary := fmt.Sprintf("audit source %s recovered", event.Source)
+	if event.Status == SourceDown {
+		summary = fmt.Sprintf("audit source %s down: %s", event.Source, event.Reason)
+	}
+	m.alerts.Fire(Finding{
+		Kind:     FindingSourceDown,
+		Key:      event.Source,
+		Summary:  summary,
+		Resolved: event.Status == SourceUp,
+		Time:     event.Time,
+		Details:  event,
+	})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultSplunkSourcetype is the sourcetype of events if unset, which is the one the Splunk Add-on for HashiCorp Vault
+	// extracts the fields of audit log lines for.
+	defaultSplunkSourcetype = "hashicorp_vault_audit_log"
+	// defaultSplunkSource is the source of events if unset.
+	defaultSplunkSource = "vault-audit-metrics"
+	// splunkAckPollInterval is the time between queries for the acknowledgement of a batch.
+	splunkAckPollInterval = time.Second
+	// splunkAckTimeout is the longest time to wait for the acknowledgement of a batch before sending it again.
+	splunkAckTimeout = time.Minute
+)
+
+// splunkSink sends audit events to the Splunk HTTP Event Collector, authenticated with a HEC token. Each event is a HEC
+// event of its audit log line as a JSON object, with the event's labels selected for the sink, along with the constant
+// tags, as indexed fields. With acknowledgement, a batch only counts as sent once Splunk acknowledges that it was
+// indexed, and is sent again if that doesn't happen within splunkAckTimeout, so that events may be duplicated but
+// aren't lost when an indexer fails.
+type splunkSink struct {
+	eventURL string
+	ackURL   string
+	headers  map[string]string
+	client   *http.Client
+	// acknowledge is whether to wait for batches to be acknowledged, and warned whether Splunk didn't acknowledge one
+	// since the token doesn't have acknowledgement enabled.
+	acknowledge bool
+	warned      bool
+
+	host       string
+	source     string
+	sourcetype string
+	index      string
+	tags       map[string]string
+}
+
+func newSplunkSink(cfg EventSinkConfig) (*splunkSink, error) {
+	base, err := url.Parse(strings.TrimSuffix(cfg.URL, "/"))
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") {
+		return nil, fmt.Errorf("an http or https url is required")
+	}
+	if cfg.Token == "" {
+		return nil, fmt.Errorf("token is required")
+	}
+	s := &splunkSink{
+		headers:     map[string]string{"Authorization": "Splunk " + cfg.Token},
+		client:      &http.Client{Timeout: sinkTimeout},
+		acknowledge: cfg.Acknowledge,
+		source:      cfg.Source,
+		sourcetype:  cfg.Sourcetype,
+		index:       cfg.Index,
+		tags:        cfg.Tags,
+	}
+	// the URL may be the base URL of the collector or its event endpoint
+	if !strings.HasSuffix(base.Path, "/services/collector/event") {
+		base.Path += "/services/collector/event"
+	}
+	s.eventURL = base.String()
+	base.Path = strings.TrimSuffix(base.Path, "/event") + "/ack"
+	if s.acknowledge {
+		// acknowledgement requires a channel, a GUID identifying the client
+		channel := randomUUID(rand.New(rand.NewSource(time.Now().UnixNano())))
+		s.headers["X-Splunk-Request-Channel"] = channel
+		base.RawQuery = url.Values{"channel": {channel}}.Encode()
+	}
+	s.ackURL = base.String()
+	if s.source == "" {
+		s.source = defaultSplunkSource
+	}
+	if s.sourcetype == "" {
+		s.sourcetype = defaultSplunkSourcetype
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		s.host = hostname
+	}
+	for name, value := range cfg.Headers {
+		s.headers[name] = value
+	}
+	return s, nil
+}
+
+func (s *splunkSink) send(events []*forwardedEvent) error {
+	type hecEvent struct {
+		Time       json.Number       `json:"time"`
+		Host       string            `json:"host,omitempty"`
+		Source     string            `json:"source"`
+		Sourcetype string            `json:"sourcetype"`
+		Index      string            `json:"index,omitempty"`
+		Event      json.RawMessage   `json:"event"`
+		Fields     map[string]string `json:"fields,omitempty"`
+	}
+	// a batch is a sequence of events rather than a JSON array
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, event := range events {
+		hec := hecEvent{
+			Time:       json.Number(strconv.FormatFloat(float64(event.time.UnixNano()/int64(time.Microsecond))/1e6, 'f', -1, 64)),
+			Host:       s.host,
+			Source:     s.source,
+			Sourcetype: s.sourcetype,
+			Index:      s.index,
+			Event:      event.line,
+		}
+		if len(s.tags) > 0 || len(event.labels) > 0 {
+			hec.Fields = make(map[string]string, len(s.tags)+len(event.labels))
+			for name, value := range s.tags {
+				hec.Fields[name] = value
+			}
+			for name, value := range event.labels {
+				hec.Fields[name] = value
+			}
+		}
+		if err := encoder.Encode(hec); err != nil {
+			return err
+		}
+	}
+	body, err := sendSink(s.client, http.MethodPost, s.eventURL, "application/json", s.headers, buf.Bytes(), true)
+	if err != nil || !s.acknowledge {
+		return err
+	}
+
+	var response struct {
+		AckID *int64 `json:"ackId"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return fmt.Errorf("error decoding response: %v", err)
+	}
+	if response.AckID == nil {
+		if !s.warned {
+			logWarn("splunk did not acknowledge audit events, check that indexer acknowledgement is enabled for the token",
+				"url", s.eventURL)
+			s.warned = true
+		}
+		return nil
+	}
+	return s.waitAck(*response.AckID)
+}
+
+// waitAck polls the acknowledgement of a batch until Splunk acknowledges that it was indexed, or fails once
+// splunkAckTimeout passed.
+func (s *splunkSink) waitAck(id int64) error {
+	query, err := json.Marshal(map[string][]int64{"acks": {id}})
+	if err != nil {
+		return err
+	}
+	key := strconv.FormatInt(id, 10)
+	for deadline := time.Now().Add(splunkAckTimeout); time.Now().Before(deadline); {
+		time.Sleep(splunkAckPollInterval)
+		body, err := sendSink(s.client, http.MethodPost, s.ackURL, "application/json", s.headers, query, false)
+		if err != nil {
+			if !retryableSinkError(err) {
+				return err
+			}
+			logDebug("error querying acknowledgement", "ack", id, "error", err)
+			continue
+		}
+		var response struct {
+			Acks map[string]bool `json:"acks"`
+		}
+		if err := json.Unmarshal(body, &response); err != nil {
+			return fmt.Errorf("error decoding acknowledgement: %v", err)
+		}
+		if response.Acks[key] {
+			return nil
+		}
+	}
+	return fmt.Errorf("batch %d was not acknowledged within %s", id, splunkAckTimeout)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Flavors of StatsD.
+const (
+	StatsDFlavorStatsD    = "statsd"
+	StatsDFlavorDogStatsD = "dogstatsd"
+)
+
+// statsdReplacer replaces the characters that delimit the parts of a StatsD line.
+var statsdReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", "\n", "_", " ", "_")
+
+// statsdSink emits metrics to a StatsD server or the Datadog agent's DogStatsD over UDP or a Unix domain socket. StatsD
+// aggregates what it receives between flushes itself, so counters are emitted as the increments since the previous
+// push and histograms as timings of the observations since the previous push, each at its bucket's upper bound with a
+// sample rate standing for the number of observations in the bucket. Gauges are emitted as they are. With DogStatsD,
+// labels become tags, while with plain StatsD, which has no tags, label values are appended to the metric name.
+type statsdSink struct {
+	conn   *lineConn
+	flavor string
+	prefix string
+	tags   []string
+
+	counters *counterDeltas
+	// buckets holds the bucket counts of histograms at the previous push by series.
+	buckets map[string][]uint64
+}
+
+func newStatsDSink(cfg MetricSinkConfig) (*statsdSink, error) {
+	s := &statsdSink{
+		flavor:   cfg.Flavor,
+		prefix:   cfg.Prefix,
+		counters: newCounterDeltas(),
+		buckets:  make(map[string][]uint64),
+	}
+	switch cfg.Network {
+	case "", "udp", "udp4", "udp6", "unixgram":
+	default:
+		return nil, fmt.Errorf("unknown network %q", cfg.Network)
+	}
+	conn, err := newLineConn(cfg.Network, cfg.Address, "udp")
+	if err != nil {
+		return nil, err
+	}
+	s.conn = conn
+	switch s.flavor {
+	case "":
+		s.flavor = StatsDFlavorDogStatsD
+	case StatsDFlavorStatsD, StatsDFlavorDogStatsD:
+	default:
+		return nil, fmt.Errorf("unknown flavor %q", cfg.Flavor)
+	}
+	if len(cfg.Tags) > 0 && s.flavor != StatsDFlavorDogStatsD {
+		return nil, fmt.Errorf("tags require the dogstatsd flavor")
+	}
+	for name, value := range cfg.Tags {
+		s.tags = append(s.tags, statsdReplacer.Replace(name)+":"+statsdReplacer.Replace(value))
+	}
+	sort.Strings(s.tags)
+	return s, nil
+}
+
+func (s *statsdSink) push(families []*dto.MetricFamily, _ time.Time) error {
+	var lines []string
+	seen := make(map[string]bool)
+	for _, family := range families {
+		name := family.GetName()
+		for _, m := range family.Metric {
+			key := seriesKey(name, m.Label)
+			switch metricType(family) {
+			case dto.MetricType_COUNTER:
+				if delta := s.counters.delta(key, metricValue(m)); delta > 0 {
+					lines = append(lines, s.line(name, m.Label, strconv.FormatFloat(delta, 'g', -1, 64), "c", 1))
+				}
+			case dto.MetricType_GAUGE:
+				lines = append(lines, s.line(name, m.Label, strconv.FormatFloat(metricValue(m), 'g', -1, 64), "g", 1))
+			case dto.MetricType_UNTYPED:
+				lines = append(lines, s.line(name, m.Label, strconv.FormatFloat(metricValue(m), 'g', -1, 64), "g", 1))
+			case dto.MetricType_HISTOGRAM:
+				seen[key] = true
+				lines = s.appendHistogram(lines, name, m, key)
+			}
+		}
+	}
+	s.counters.sweep()
+	for key := range s.buckets {
+		if !seen[key] {
+			delete(s.buckets, key)
+		}
+	}
+	return s.conn.write(lines)
+}
+
+// appendHistogram appends the timings of the observations of a histogram since the previous push. Histograms of
+// seconds are emitted as timings in milliseconds, as StatsD expects, and others as DogStatsD histograms.
+func (s *statsdSink) appendHistogram(lines []string, name string, m *dto.Metric, key string) []string {
+	histogram := m.GetHistogram()
+	var bounds []float64
+	var buckets []uint64
+	var cumulative uint64
+	for _, bucket := range histogram.Bucket {
+		if math.IsInf(bucket.GetUpperBound(), 1) {
+			continue
+		}
+		bounds = append(bounds, bucket.GetUpperBound())
+		buckets = append(buckets, bucket.GetCumulativeCount()-cumulative)
+		cumulative = bucket.GetCumulativeCount()
+	}
+	// observations above the largest bound are emitted at the largest bound, as nothing more is known about them
+	buckets = append(buckets, histogram.GetSampleCount()-cumulative)
+	previous := s.buckets[key]
+	s.buckets[key] = buckets
+	if len(bounds) == 0 {
+		return lines
+	}
+
+	reset := len(previous) != len(buckets)
+	for i, count := range buckets {
+		if !reset && count < previous[i] {
+			reset = true
+		}
+	}
+	kind, scale := "h", 1.0
+	if strings.HasSuffix(name, "_seconds") {
+		kind, scale = "ms", 1000
+	} else if s.flavor == StatsDFlavorStatsD {
+		kind = "ms"
+	}
+	for i, count := range buckets {
+		if !reset {
+			count -= previous[i]
+		}
+		if count == 0 {
+			continue
+		}
+		bound := bounds[len(bounds)-1]
+		if i < len(bounds) {
+			bound = bounds[i]
+		}
+		lines = append(lines, s.line(name, m.Label, strconv.FormatFloat(bound*scale, 'g', -1, 64), kind, count))
+	}
+	return lines
+}
+
+// line formats a StatsD line for a value of a series, standing for count samples.
+func (s *statsdSink) line(name string, labels []*dto.LabelPair, value, kind string, count uint64) string {
+	var b strings.Builder
+	b.WriteString(s.prefix)
+	b.WriteString(name)
+	if s.flavor == StatsDFlavorStatsD {
+		for _, label := range labels {
+			if label.GetValue() != "" {
+				b.WriteByte('.')
+				b.WriteString(strings.ReplaceAll(statsdReplacer.Replace(label.GetValue()), ".", "_"))
+			}
+		}
+	}
+	b.WriteByte(':')
+	b.WriteString(value)
+	b.WriteByte('|')
+	b.WriteString(kind)
+	if count > 1 {
+		b.WriteString("|@")
+		b.WriteString(strconv.FormatFloat(1/float64(count), 'g', -1, 64))
+	}
+	if s.flavor == StatsDFlavorDogStatsD {
+		separator := "|#"
+		for _, label := range labels {
+			if label.GetValue() != "" {
+				b.WriteString(separator)
+				b.WriteString(statsdReplacer.Replace(label.GetName()))
+				b.WriteByte(':')
+				b.WriteString(statsdReplacer.Replace(label.GetValue()))
+				separator = ","
+			}
+		}
+		for _, tag := range s.tags {
+			b.WriteString(separator)
+			b.WriteString(tag)
+			separator = ","
+		}
+	}
+	return b.String()
+}
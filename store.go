@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// TimestampStoreMemory keeps request timestamps in process memory.
+	TimestampStoreMemory = "memory"
+	// TimestampStoreRedis keeps request timestamps in Redis, so that correlation works across replicas.
+	TimestampStoreRedis = "redis"
+	// TimestampStoreMemcached keeps request timestamps in memcached, so that correlation works across replicas.
+	TimestampStoreMemcached = "memcached"
+)
+
+const (
+	// DuplicateLastWins replaces the time of a request when its ID is stored again.
+	DuplicateLastWins = "last-wins"
+	// DuplicateFirstWins keeps the time of the first request stored with an ID.
+	DuplicateFirstWins = "first-wins"
+	// DuplicateMultiset keeps the times of all requests stored with an ID, matching responses to them in order.
+	DuplicateMultiset = "multiset"
+)
+
+// TimestampStore holds the timestamps of requests awaiting their responses.
+type TimestampStore interface {
+	// Set stores the time of a request for ttl, or for the store's default TTL if ttl is zero, reporting whether a
+	// request with the same ID was already stored. Duplicates are handled according to the store's duplicate mode.
+	Set(id string, t time.Time, ttl time.Duration) (bool, error)
+	// Take removes and returns the time of a request, reporting whether it was found.
+	Take(id string) (time.Time, bool, error)
+}
+
+// sizedStore is implemented by timestamp stores that can cheaply report their number of entries.
+type sizedStore interface {
+	Len() int
+}
+
+// NewTimestampStore constructs the timestamp store selected by the configuration. expired is called for every request
+// evicted before its response arrived, where the store is able to tell, and errors for every failed remote operation.
+// Remote stores fall back to local-only correlation while they are failing.
+func NewTimestampStore(cfg *Config, expired, errors func()) (TimestampStore, error) {
+	switch cfg.DuplicateRequestIDs {
+	case DuplicateLastWins, DuplicateFirstWins, DuplicateMultiset:
+	default:
+		return nil, fmt.Errorf("unknown duplicate request ID mode: %s", cfg.DuplicateRequestIDs)
+	}
+	local := newMemoryStore(cfg.CacheShards, cfg.CacheMaxEntries, cfg.CacheMaxBytes, cfg.DuplicateRequestIDs, cfg.CacheTTL, cfg.CacheCleanup,
+		expired)
+	var remote TimestampStore
+	var err error
+	switch cfg.TimestampStore {
+	case TimestampStoreMemory, "":
+		return local, nil
+	case TimestampStoreRedis:
+		remote, err = NewRedisStore(&cfg.Redis, cfg.DuplicateRequestIDs, cfg.CacheTTL)
+	case TimestampStoreMemcached:
+		remote, err = NewMemcachedStore(&cfg.Memcached, cfg.DuplicateRequestIDs, cfg.CacheTTL)
+	default:
+		return nil, fmt.Errorf("unknown timestamp store: %s", cfg.TimestampStore)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &fallbackStore{remote: remote, local: local, errors: errors}, nil
+}
+
+// remoteStoreRetryInterval is how long a failing remote timestamp store is bypassed before it is tried again.
+const remoteStoreRetryInterval = 10 * time.Second
+
+// fallbackStore degrades a remote timestamp store to local-only correlation while the remote store is failing.
+// Requests stored locally can still be matched by responses received by the same replica.
+type fallbackStore struct {
+	remote TimestampStore
+	local  *memoryStore
+	errors func()
+	// downUntil is the Unix time in nanoseconds until which the remote store is bypassed.
+	downUntil int64
+}
+
+// available reports whether the remote store should be used.
+func (s *fallbackStore) available() bool {
+	return time.Now().UnixNano() >= atomic.LoadInt64(&s.downUntil)
+}
+
+// fail records a failed remote operation, bypassing the remote store for a while.
+func (s *fallbackStore) fail(err error) {
+	if time.Now().UnixNano() >= atomic.LoadInt64(&s.downUntil) {
+		logError("error using remote timestamp store, correlating locally", "retry_in", remoteStoreRetryInterval,
+			"error", err)
+	}
+	atomic.StoreInt64(&s.downUntil, time.Now().Add(remoteStoreRetryInterval).UnixNano())
+	s.errors()
+}
+
+func (s *fallbackStore) Set(id string, t time.Time, ttl time.Duration) (bool, error) {
+	if s.available() {
+		duplicate, err := s.remote.Set(id, t, ttl)
+		if err == nil {
+			return duplicate, nil
+		}
+		s.fail(err)
+	}
+	return s.local.Set(id, t, ttl)
+}
+
+func (s *fallbackStore) Take(id string) (time.Time, bool, error) {
+	if t, found, _ := s.local.Take(id); found {
+		return t, true, nil
+	}
+	if !s.available() {
+		return time.Time{}, false, nil
+	}
+	t, found, err := s.remote.Take(id)
+	if err != nil {
+		s.fail(err)
+		return time.Time{}, false, nil
+	}
+	return t, found, nil
+}
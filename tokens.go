@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ttlBuckets are the buckets of the histograms of issued token TTLs and lease durations in seconds, from a minute to
+// Vault's default maximum TTL of 32 days and beyond.
+var ttlBuckets = []float64{
+	time.Minute.Seconds(),
+	(5 * time.Minute).Seconds(),
+	(15 * time.Minute).Seconds(),
+	time.Hour.Seconds(),
+	(4 * time.Hour).Seconds(),
+	(8 * time.Hour).Seconds(),
+	(24 * time.Hour).Seconds(),
+	(72 * time.Hour).Seconds(),
+	(7 * 24 * time.Hour).Seconds(),
+	(32 * 24 * time.Hour).Seconds(),
+	(365 * 24 * time.Hour).Seconds(),
+}
+
+// TokenIssuanceMonitor counts the tokens issued by logins and token creation, and observes their TTLs, to find
+// long-lived tokens that violate policy.
+type TokenIssuanceMonitor struct {
+	counterIssued *prometheus.CounterVec
+	histogramTTL  *prometheus.HistogramVec
+}
+
+// NewTokenIssuanceMonitor constructs a TokenIssuanceMonitor.
+func NewTokenIssuanceMonitor() *TokenIssuanceMonitor {
+	return &TokenIssuanceMonitor{
+		counterIssued: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "tokens",
+			Name:      "issued_total",
+			Help:      "Number of tokens issued by logins and token creation. Partitioned by auth method and token type.",
+		},
+			[]string{"method", "token_type"}),
+		histogramTTL: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: PromNamespace,
+			Subsystem: "tokens",
+			Name:      "issued_ttl_seconds",
+			Help:      "TTL of tokens issued by logins and token creation, for tokens whose audit entry carries one. Partitioned by auth method and token type.",
+			Buckets:   ttlBuckets,
+		},
+			[]string{"method", "token_type"}),
+	}
+}
+
+func (m *TokenIssuanceMonitor) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.counterIssued, m.histogramTTL}
+}
+
+// tokenIssuingMethod returns the auth method of a request path issuing tokens, or "" if it issues none. Logins are
+// attributed to the type of their mount, if known, and to the mount path otherwise.
+func tokenIssuingMethod(path, mountType string) string {
+	if strings.HasPrefix(path, "auth/token/create") {
+		return "token"
+	}
+	mount, _, ok := parseLoginPath(path)
+	if !ok {
+		return ""
+	}
+	if mountType != "" {
+		return mountType
+	}
+	return mount
+}
+
+// Observe records a token issued by a response, unless it failed. Logins requiring MFA are issued their token by the MFA
+// validation rather than the login response.
+func (m *TokenIssuanceMonitor) Observe(auditEvent *AuditEvent) {
+	entry := auditEvent.entry
+	if entry.Type != AuditEventTypeResponse || entry.Request == nil || entry.Error != "" || entry.Response == nil ||
+		entry.Response.Auth == nil || entry.Response.Auth.MFARequirement != nil {
+		return
+	}
+	method := tokenIssuingMethod(entry.Request.Path, entry.Request.MountType)
+	if method == "" {
+		return
+	}
+	auth := entry.Response.Auth
+	m.counterIssued.WithLabelValues(method, auth.TokenType).Inc()
+	if auth.TokenTTL > 0 {
+		m.histogramTTL.WithLabelValues(method, auth.TokenType).Observe(float64(auth.TokenTTL))
+	}
+}
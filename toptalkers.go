@@ -0,0 +1,254 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// topTalkerBuckets is the number of intervals the top talker window is divided into, so that it slides by a fifth.
+	topTalkerBuckets = 5
+	// topTalkerCapacityFactor is the number of clients tracked per interval for each top talker reported, which bounds
+	// the error of the space-saving algorithm.
+	topTalkerCapacityFactor = 10
+	// topTalkerMinCapacity is the minimum number of clients tracked per interval.
+	topTalkerMinCapacity = 100
+	// topTalkerUpdateInterval is the interval at which the top talker gauges are updated.
+	topTalkerUpdateInterval = 15 * time.Second
+	// MaxTopTalkers bounds the number of top talkers, and so the values of the rank label.
+	MaxTopTalkers = 100
+)
+
+// TopTalker is a client among those making the most requests within the top talker window.
+type TopTalker struct {
+	Rank        int    `json:"rank"`
+	EntityID    string `json:"entity_id,omitempty"`
+	EntityName  string `json:"entity_name,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+	// Requests is the estimated number of requests, which overestimates the actual number by at most Error.
+	Requests float64 `json:"requests"`
+	Error    float64 `json:"error"`
+}
+
+// TopTalkers tracks the clients making the most requests within a sliding window, turning "who is hammering Vault" into
+// a dashboard panel. A client is an identity entity, or the display name of tokens without an entity, such as root
+// tokens. Counting the requests of every client would take memory for every one of them, so the space-saving algorithm
+// tracks a bounded number of clients per interval of the window instead, whose counts are merged over the window.
+type TopTalkers struct {
+	k        int
+	window   time.Duration
+	interval time.Duration
+
+	mu      sync.Mutex
+	buckets [topTalkerBuckets]topTalkerBucket
+
+	gagueRequests *prometheus.GaugeVec
+}
+
+// topTalkerBucket is the space-saving summary of the requests of one interval, identified by the interval's index since
+// the Unix epoch.
+type topTalkerBucket struct {
+	index   int64
+	summary *spaceSaving
+}
+
+// NewTopTalkers constructs TopTalkers reporting the k clients making the most requests within window.
+func NewTopTalkers(k int, window time.Duration) *TopTalkers {
+	return &TopTalkers{
+		k:        k,
+		window:   window,
+		interval: window / topTalkerBuckets,
+		gagueRequests: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: PromNamespace,
+			Subsystem: "top_talkers",
+			Name:      "requests",
+			Help:      "Estimated number of requests of the clients making the most requests within -top-talkers-window. Partitioned by rank, entity ID, and token display name.",
+		},
+			[]string{"rank", "entity", "display_name"}),
+	}
+}
+
+func (t *TopTalkers) collectors() []prometheus.Collector {
+	return []prometheus.Collector{t.gagueRequests}
+}
+
+// Observe counts a request towards its client. Requests without a token, such as logins, are ignored.
+func (t *TopTalkers) Observe(auditEvent *AuditEvent) {
+	entry := auditEvent.entry
+	if entry.Type != AuditEventTypeRequest || entry.Request == nil || entry.Auth == nil {
+		return
+	}
+	entity, displayName := entry.Auth.EntityID, entry.Auth.DisplayName
+	key := entity
+	if key == "" {
+		if displayName == "" {
+			return
+		}
+		// display names never collide with entity IDs, which are UUIDs
+		key = "display_name:" + displayName
+	}
+
+	now := time.Now()
+	index := now.UnixNano() / int64(t.interval)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	bucket := &t.buckets[index%topTalkerBuckets]
+	if bucket.index != index || bucket.summary == nil {
+		capacity := t.k * topTalkerCapacityFactor
+		if capacity < topTalkerMinCapacity {
+			capacity = topTalkerMinCapacity
+		}
+		bucket.index = index
+		bucket.summary = newSpaceSaving(capacity)
+	}
+	counter := bucket.summary.add(key, 1)
+	counter.entity = entity
+	counter.displayName = displayName
+	counter.entityName = auditEvent.identity.entityName()
+}
+
+// Top returns the clients making the most requests within the window, by rank.
+func (t *TopTalkers) Top(now time.Time) []TopTalker {
+	current := now.UnixNano() / int64(t.interval)
+	merged := make(map[string]*TopTalker)
+	t.mu.Lock()
+	for _, bucket := range t.buckets {
+		if bucket.summary == nil || bucket.index <= current-topTalkerBuckets || bucket.index > current {
+			continue
+		}
+		for key, counter := range bucket.summary.counters {
+			talker := merged[key]
+			if talker == nil {
+				talker = &TopTalker{EntityID: counter.entity}
+				merged[key] = talker
+			}
+			// the latest interval's names win
+			if bucket.index == current || talker.DisplayName == "" {
+				talker.DisplayName = counter.displayName
+				talker.EntityName = counter.entityName
+			}
+			talker.Requests += counter.count
+			talker.Error += counter.err
+		}
+	}
+	t.mu.Unlock()
+
+	talkers := make([]TopTalker, 0, len(merged))
+	for _, talker := range merged {
+		talkers = append(talkers, *talker)
+	}
+	sort.Slice(talkers, func(i, j int) bool {
+		a, b := talkers[i], talkers[j]
+		if a.Requests != b.Requests {
+			return a.Requests > b.Requests
+		}
+		return a.EntityID+a.DisplayName < b.EntityID+b.DisplayName
+	})
+	if len(talkers) > t.k {
+		talkers = talkers[:t.k]
+	}
+	for i := range talkers {
+		talkers[i].Rank = i + 1
+	}
+	return talkers
+}
+
+// Run continuously updates the top talker gauges. The gauges are reset on every update, so that clients dropping out
+// of the top don't linger.
+func (t *TopTalkers) Run() {
+	for {
+		time.Sleep(topTalkerUpdateInterval)
+		top := t.Top(time.Now())
+		t.gagueRequests.Reset()
+		for _, talker := range top {
+			t.gagueRequests.WithLabelValues(strconv.Itoa(talker.Rank), talker.EntityID, talker.DisplayName).Set(talker.Requests)
+		}
+	}
+}
+
+// ServeHTTP responds with the current top talkers as JSON.
+func (t *TopTalkers) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	body := struct {
+		Window  string      `json:"window"`
+		Talkers []TopTalker `json:"talkers"`
+	}{t.window.String(), t.Top(time.Now())}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logError("error writing top talkers response", "error", err)
+	}
+}
+
+// spaceSaving is a summary of the most frequent keys of a stream with the space-saving algorithm. It tracks up to
+// capacity keys, and a key arriving while it is full replaces the key with the lowest count, inheriting that count as
+// its error. The counts of frequent keys are thus overestimated by at most their error.
+type spaceSaving struct {
+	capacity int
+	counters map[string]*spaceSavingCounter
+	// heap orders the counters by count, lowest first.
+	heap spaceSavingHeap
+}
+
+type spaceSavingCounter struct {
+	key        string
+	count, err float64
+	index      int
+
+	entity, displayName, entityName string
+}
+
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{capacity: capacity, counters: make(map[string]*spaceSavingCounter, capacity)}
+}
+
+// add adds weight to the count of a key, returning its counter.
+func (s *spaceSaving) add(key string, weight float64) *spaceSavingCounter {
+	if counter, found := s.counters[key]; found {
+		counter.count += weight
+		heap.Fix(&s.heap, counter.index)
+		return counter
+	}
+	if len(s.heap) < s.capacity {
+		counter := &spaceSavingCounter{key: key, count: weight}
+		s.counters[key] = counter
+		heap.Push(&s.heap, counter)
+		return counter
+	}
+	counter := s.heap[0]
+	delete(s.counters, counter.key)
+	*counter = spaceSavingCounter{key: key, count: counter.count + weight, err: counter.count, index: 0}
+	s.counters[key] = counter
+	heap.Fix(&s.heap, 0)
+	return counter
+}
+
+// spaceSavingHeap is a min-heap of counters by count, implementing heap.Interface.
+type spaceSavingHeap []*spaceSavingCounter
+
+func (h spaceSavingHeap) Len() int           { return len(h) }
+func (h spaceSavingHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+
+func (h spaceSavingHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *spaceSavingHeap) Push(x interface{}) {
+	counter := x.(*spaceSavingCounter)
+	counter.index = len(*h)
+	*h = append(*h, counter)
+}
+
+func (h *spaceSavingHeap) Pop() interface{} {
+	old := *h
+	counter := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return counter
+}
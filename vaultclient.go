@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// VaultClient is a minimal client for the Vault HTTP API, used to enrich audit events with information that isn't part
+// of the audit log itself.
+type VaultClient struct {
+	addr      string
+	token     string
+	tokenFile string
+	namespace string
+	client    *http.Client
+}
+
+// NewVaultClient constructs a VaultClient. If tokenFile is set (for example the sink file of a Vault Agent auto-auth
+// configuration) the token is re-read from it on every request, otherwise the static token is used.
+func NewVaultClient(cfg *VaultConfig) (*VaultClient, error) {
+	if cfg.Addr == "" {
+		return nil, fmt.Errorf("vault address is required")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.CACert != "" {
+		pem, err := ioutil.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA certificate: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CACert)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &VaultClient{
+		addr:      strings.TrimSuffix(cfg.Addr, "/"),
+		token:     cfg.Token,
+		tokenFile: cfg.TokenFile,
+		namespace: cfg.Namespace,
+		client:    &http.Client{Transport: transport, Timeout: 30 * time.Second},
+	}, nil
+}
+
+// Get reads a Vault API path (such as "sys/mounts") and decodes the JSON response into out.
+func (c *VaultClient) Get(path string, out interface{}) error {
+	token, err := c.currentToken()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, c.addr+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if c.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.namespace)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return &vaultStatusError{path: path, status: resp.StatusCode, body: strings.TrimSpace(string(body))}
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// vaultStatusError is returned for Vault API responses with an unexpected status.
+type vaultStatusError struct {
+	path   string
+	status int
+	body   string
+}
+
+func (e *vaultStatusError) Error() string {
+	return fmt.Sprintf("GET %s: unexpected status %d: %s", e.path, e.status, e.body)
+}
+
+// currentToken returns the token to authenticate with.
+func (c *VaultClient) currentToken() (string, error) {
+	if c.tokenFile == "" {
+		return c.token, nil
+	}
+	data, err := ioutil.ReadFile(c.tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("error reading token file: %v", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
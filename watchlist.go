@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// WatchlistMonitor counts every access of sensitive paths, such as production payment secrets or transit key
+// configuration, by the entity that made it, and optionally posts each access to a webhook. Watches are named groups of
+// path patterns, matched like path groups, with the first matching watch counting the access.
+type WatchlistMonitor struct {
+	watches *PathGrouper
+	webhook *Webhook
+	alerts  *Alerter
+
+	counterAccesses      *prometheus.CounterVec
+	counterWebhookErrors prometheus.Counter
+}
+
+// watchlistEvent is the body posted to the watchlist webhook.
+type watchlistEvent struct {
+	Watch         string    `json:"watch"`
+	RequestID     string    `json:"request_id"`
+	Operation     string    `json:"operation"`
+	Path          string    `json:"path"`
+	EntityID      string    `json:"entity_id,omitempty"`
+	EntityName    string    `json:"entity_name,omitempty"`
+	EntityGroups  []string  `json:"entity_groups,omitempty"`
+	RemoteAddress string    `json:"remote_address,omitempty"`
+	Time          time.Time `json:"time"`
+}
+
+// NewWatchlistMonitor constructs a WatchlistMonitor for watches. If webhook is not empty, every access of a watched path
+// is posted to it. Accesses are also findings for alerts.
+func NewWatchlistMonitor(watches PathGroups, webhook string, alerts *Alerter) (*WatchlistMonitor, error) {
+	grouper, err := NewPathGrouper(watches)
+	if err != nil {
+		return nil, err
+	}
+	m := &WatchlistMonitor{
+		watches: grouper,
+		alerts:  alerts,
+		counterAccesses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "security",
+			Name:      "watchlist_access_total",
+			Help:      "Number of requests to paths on the watchlist. Partitioned by watch, operation, and the entity ID of the token.",
+		},
+			[]string{"watch", "operation", "entity"}),
+		counterWebhookErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "security",
+			Name:      "watchlist_webhook_errors_total",
+			Help:      "Number of failed calls of -watchlist-webhook.",
+		}),
+	}
+	if webhook != "" {
+		m.webhook = NewWebhook("watchlist-webhook", webhook, m.counterWebhookErrors.Inc)
+	}
+	return m, nil
+}
+
+func (m *WatchlistMonitor) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.counterAccesses, m.counterWebhookErrors}
+}
+
+// Observe records a request if its path is on the watchlist. Requests are counted rather than responses, so that denied
+// attempts are counted too.
+func (m *WatchlistMonitor) Observe(auditEvent *AuditEvent) {
+	request := auditEvent.entry.Request
+	if auditEvent.entry.Type != AuditEventTypeRequest || request == nil {
+		return
+	}
+	watch := m.watches.Group(request.Path)
+	if watch == "" {
+		return
+	}
+	var entity string
+	if auth := auditEvent.entry.Auth; auth != nil {
+		entity = auth.EntityID
+	}
+	m.counterAccesses.WithLabelValues(watch, request.Operation, entity).Inc()
+	event := watchlistEvent{
+		Watch:         watch,
+		RequestID:     request.ID,
+		Operation:     request.Operation,
+		Path:          request.Path,
+		EntityID:      entity,
+		EntityName:    auditEvent.identity.entityName(),
+		EntityGroups:  auditEvent.identity.entityGroups(),
+		RemoteAddress: request.RemoteAddr,
+		Time:          auditEvent.time,
+	}
+	m.webhook.Notify(event)
+	m.alerts.Fire(Finding{
+		Kind:    FindingWatchlist,
+		Key:     watch + " " + entity,
+		Summary: fmt.Sprintf("watchlist %s accessed with %s %s by entity %q", watch, request.Operation, request.Path, entity),
+		Time:    auditEvent.time,
+		Details: event,
+	})
+}
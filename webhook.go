@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// webhookTimeout bounds each call of a webhook.
+const webhookTimeout = 10 * time.Second
+
+// webhookQueueSize is the number of notifications that may be pending for a webhook before new ones are dropped.
+const webhookQueueSize = 100
+
+// Webhook posts notifications as JSON to a URL in the background, one at a time, so that a slow or failing receiver
+// holds up neither the caller nor, through a growing number of pending calls, the exporter.
+type Webhook struct {
+	name   string
+	url    string
+	client *http.Client
+	queue  chan interface{}
+	failed func()
+}
+
+// NewWebhook constructs a Webhook posting to url, named after the flag configuring it in logs. failed is called for
+// every notification that could not be delivered, including those dropped because too many were pending.
+func NewWebhook(name, url string, failed func()) *Webhook {
+	w := &Webhook{
+		name:   name,
+		url:    url,
+		client: &http.Client{Timeout: webhookTimeout},
+		queue:  make(chan interface{}, webhookQueueSize),
+		failed: failed,
+	}
+	go w.run()
+	return w
+}
+
+// Notify queues a notification without blocking. A nil Webhook ignores notifications.
+func (w *Webhook) Notify(event interface{}) {
+	if w == nil {
+		return
+	}
+	select {
+	case w.queue <- event:
+	default:
+		logError("error calling webhook", "webhook", w.name, "error", "too many pending notifications")
+		w.failed()
+	}
+}
+
+func (w *Webhook) run() {
+	for event := range w.queue {
+		if err := w.post(event); err != nil {
+			logError("error calling webhook", "webhook", w.name, "error", err)
+			w.failed()
+		}
+	}
+}
+
+func (w *Webhook) post(event interface{}) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// wrappingCheckInterval is the interval at which wrapping tokens are checked for expiry.
+	wrappingCheckInterval = 10 * time.Second
+	// wrappingMaxPending bounds the number of wrapping tokens awaiting unwrapping that are tracked.
+	wrappingMaxPending = 100000
+)
+
+// WrappingMonitor tracks response wrapping: the wrapping tokens created for responses requested with a wrap TTL or by
+// sys/wrapping/wrap, their TTLs, and the operations on sys/wrapping/*. A wrapping token is meant to be unwrapped exactly
+// once by its intended recipient, so one that expires without being unwrapped, or an unwrap that fails, can mean that
+// the token was intercepted. Wrapping tokens are matched by their HMAC, which the audit device records both in the
+// wrapped response and in the request unwrapping it.
+type WrappingMonitor struct {
+	mu sync.Mutex
+	// pending holds the expiry of each wrapping token awaiting unwrapping, by the HMAC of the token.
+	pending map[string]time.Time
+
+	counterCreated    prometheus.Counter
+	histogramTTL      prometheus.Histogram
+	counterOperations *prometheus.CounterVec
+	counterExpired    prometheus.Counter
+	gaguePending      prometheus.Gauge
+}
+
+// NewWrappingMonitor constructs a WrappingMonitor.
+func NewWrappingMonitor() *WrappingMonitor {
+	return &WrappingMonitor{
+		pending: make(map[string]time.Time),
+		counterCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "wrapping",
+			Name:      "tokens_created_total",
+			Help:      "Number of wrapping tokens created for wrapped responses.",
+		}),
+		histogramTTL: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: PromNamespace,
+			Subsystem: "wrapping",
+			Name:      "ttl_seconds",
+			Help:      "TTL of wrapping tokens created for wrapped responses.",
+			Buckets:   ttlBuckets,
+		}),
+		counterOperations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "wrapping",
+			Name:      "operations_total",
+			Help:      "Number of responses to sys/wrapping requests. Partitioned by operation (wrap, unwrap, rewrap, or lookup) and result (success or failure).",
+		},
+			[]string{"operation", "result"}),
+		counterExpired: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: PromNamespace,
+			Subsystem: "wrapping",
+			Name:      "tokens_expired_total",
+			Help:      "Number of wrapping tokens that expired without being unwrapped or rewrapped, a possible sign of interception.",
+		}),
+		gaguePending: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: PromNamespace,
+			Subsystem: "wrapping",
+			Name:      "tokens_pending",
+			Help:      "Number of wrapping tokens awaiting unwrapping.",
+		}),
+	}
+}
+
+func (m *WrappingMonitor) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.counterCreated, m.histogramTTL, m.counterOperations, m.counterExpired, m.gaguePending}
+}
+
+// wrappingOperation returns the operation of a request path on sys/wrapping, or "" if it is none.
+func wrappingOperation(path string) string {
+	if !strings.HasPrefix(path, "sys/wrapping/") {
+		return ""
+	}
+	switch operation := path[len("sys/wrapping/"):]; operation {
+	case "wrap", "unwrap", "rewrap", "lookup":
+		return operation
+	}
+	return ""
+}
+
+// Observe records a wrapping operation and the wrapping token created by a response.
+func (m *WrappingMonitor) Observe(auditEvent *AuditEvent) {
+	entry := auditEvent.entry
+	if entry.Type != AuditEventTypeResponse || entry.Request == nil {
+		return
+	}
+	if operation := wrappingOperation(entry.Request.Path); operation != "" {
+		result := "success"
+		if entry.Error != "" {
+			result = "failure"
+		}
+		m.counterOperations.WithLabelValues(operation, result).Inc()
+		// the wrapping token is passed either as the request's token or in the body
+		if entry.Error == "" && (operation == "unwrap" || operation == "rewrap") {
+			m.consume(entry.Request.ClientToken)
+			if entry.Request.Data != nil {
+				m.consume(entry.Request.Data.Token)
+			}
+		}
+	}
+
+	if entry.Error != "" || entry.Response == nil || entry.Response.WrapInfo == nil {
+		return
+	}
+	wrapInfo := entry.Response.WrapInfo
+	// the TTL requested with the wrap TTL header applies where the wrapping token's own isn't recorded
+	ttl := wrapInfo.TTL
+	if ttl <= 0 {
+		ttl = entry.Request.WrapTTL
+	}
+	m.counterCreated.Inc()
+	if ttl <= 0 {
+		return
+	}
+	m.histogramTTL.Observe(float64(ttl))
+	if wrapInfo.Token == "" {
+		return
+	}
+	m.mu.Lock()
+	if len(m.pending) < wrappingMaxPending {
+		m.pending[wrapInfo.Token] = auditEvent.time.Add(time.Duration(ttl) * time.Second)
+	}
+	m.gaguePending.Set(float64(len(m.pending)))
+	m.mu.Unlock()
+}
+
+// consume stops tracking a wrapping token that was unwrapped or rewrapped.
+func (m *WrappingMonitor) consume(token string) {
+	if token == "" {
+		return
+	}
+	m.mu.Lock()
+	delete(m.pending, token)
+	m.gaguePending.Set(float64(len(m.pending)))
+	m.mu.Unlock()
+}
+
+// Run continuously counts wrapping tokens that expired without being unwrapped.
+func (m *WrappingMonitor) Run() {
+	for {
+		time.Sleep(wrappingCheckInterval)
+		now := time.Now()
+		var expired int
+		m.mu.Lock()
+		for token, expiry := range m.pending {
+			if expiry.Before(now) {
+				delete(m.pending, token)
+				expired++
+			}
+		}
+		m.gaguePending.Set(float64(len(m.pending)))
+		m.mu.Unlock()
+		if expired > 0 {
+			m.counterExpired.Add(float64(expired))
+			logWarn("wrapping tokens expired without being unwrapped", "count", expired)
+		}
+	}
+}